@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Permission is what a role may do with the records of a collection
+type Permission uint8
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermDelete
+
+	PermAll = PermRead | PermWrite | PermDelete
+)
+
+// AnyCollection in a Role grants permissions on the collections it doesn't list
+const AnyCollection = "*"
+
+func (p Permission) String() string {
+	var names []string
+	for _, perm := range []struct {
+		p    Permission
+		name string
+	}{{PermRead, "read"}, {PermWrite, "write"}, {PermDelete, "delete"}} {
+		if p&perm.p != 0 {
+			names = append(names, perm.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "+")
+}
+
+// Role grants permissions by collection
+type Role map[string]Permission
+
+func (r Role) permission(collection string) Permission {
+	if p, ok := r[collection]; ok {
+		return p
+	}
+	return r[AnyCollection]
+}
+
+// AccessControl restricts what the callers of the Driver's HTTP handlers may do by
+// the roles they have, see Options.AccessControl. Operations on a collection need
+// the permission on it; operations on the whole database, such as replicating it
+// or syncing with it, need it through AnyCollection. HealthHandler and
+// MetricsHandler touch no records and aren't restricted. RaftHandler isn't either:
+// its requests come from the other nodes, which authenticate with
+// ClusterOptions.Secret, and the writes they replicate were checked by the leader.
+type AccessControl struct {
+	Roles map[string]Role
+
+	// the roles of the caller of a request, typically Authenticator.RolesOf. A caller
+	// without roles may do nothing.
+	RolesOf func(r *http.Request) []string
+}
+
+// allowed reports whether the caller of r may do p to collection, or to every
+// collection if it's empty
+func (d *Driver) allowed(r *http.Request, collection string, p Permission) bool {
+	ac := d.access
+	if ac == nil {
+		return true
+	}
+	if ac.RolesOf == nil {
+		return false
+	}
+	var granted Permission
+	for _, name := range ac.RolesOf(r) {
+		role, ok := ac.Roles[name]
+		if !ok {
+			continue
+		}
+		if collection == "" {
+			granted |= role[AnyCollection]
+		} else {
+			granted |= role.permission(d.partitionParent(collection))
+		}
+	}
+	return granted&p == p
+}
+
+// authorize is allowed as an error for the handlers to return
+func (d *Driver) authorize(r *http.Request, collection string, p Permission) error {
+	if d.allowed(r, collection, p) {
+		return nil
+	}
+	if collection == "" {
+		return fmt.Errorf("%w: %v on every collection", ErrForbidden, p)
+	}
+	return fmt.Errorf("%w: %v on %v", ErrForbidden, p, collection)
+}
+
+// authorizer hands the checks for the caller of r to code that doesn't see it
+func (d *Driver) authorizer(r *http.Request) func(collection string, p Permission) error {
+	if d.access == nil {
+		return nil
+	}
+	return func(collection string, p Permission) error {
+		return d.authorize(r, collection, p)
+	}
+}
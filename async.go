@@ -0,0 +1,33 @@
+package main
+
+import "context"
+
+// WriteAsync writes a record like Write, but returns as soon as it's in place, to be
+// read and found, rather than once it's durable, for request paths that can't wait
+// for Options.GroupCommit. The channel gets the error of the write, or of syncing
+// it, or nil once it's durable, and is then closed. Writes to a resource are
+// applied in the order of the calls.
+//
+// Without GroupCommit a Durable write is synced before WriteAsync returns, and
+// without Durable it's never synced; either way the channel is ready right away.
+func (d *Driver) WriteAsync(collection, resource string, v interface{}) <-chan error {
+	durable := make(chan error, 1)
+	batch, err := d.timed("write", collection, resource, func() (interface{}, error) {
+		if err := d.put(context.Background(), collection, resource, v); err != nil {
+			return nil, err
+		}
+		return d.queuedCommit(d.foldCollection(collection)), nil
+	})
+
+	b, _ := batch.(*commitBatch)
+	if err != nil || b == nil {
+		durable <- err
+		close(durable)
+		return durable
+	}
+	go func() {
+		durable <- b.wait()
+		close(durable)
+	}()
+	return durable
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// attachments of users/john live in users/john.attachments/, one file each, which
+// ReadAll and friends skip like any other directory
+const attachmentSuffix = ".attachments"
+
+func (d *Driver) attachmentDir(collection, resource string) string {
+	return filepath.Join(d.recordDir(collection, resource), d.keyFile(resource)+attachmentSuffix)
+}
+
+func checkAttachmentName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid attachment name %q", name)
+	}
+	return nil
+}
+
+// PutAttachment stores the binary content of r under name next to a record, e.g. an
+// avatar or a PDF, replacing any attachment of that name. The record has to exist.
+func (d *Driver) PutAttachment(collection, resource, name string, r io.Reader) error {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return err
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if collection == "" {
+		return fmt.Errorf("%w - no place to save attachment!", ErrEmptyCollection)
+	}
+	if resource == "" {
+		return fmt.Errorf("%w - unable to save attachment!", ErrEmptyResource)
+	}
+	if err := checkAttachmentName(name); err != nil {
+		return err
+	}
+
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !d.exists(collection, resource) {
+		return fmt.Errorf("unable to attach %v: %w", name, notExist(d.recordPath(collection, resource)))
+	}
+
+	dir := d.attachmentDir(collection, resource)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, name)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// GetAttachment opens an attachment for reading, the caller has to Close it
+func (d *Driver) GetAttachment(collection, resource, name string) (io.ReadCloser, error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return nil, err
+	}
+	if collection == "" || resource == "" {
+		return nil, missingName(collection, "unable to read attachment!")
+	}
+	if err := checkAttachmentName(name); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(d.attachmentDir(collection, resource), name))
+}
+
+// ListAttachments returns the names of the attachments of a record
+func (d *Driver) ListAttachments(collection, resource string) ([]string, error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(d.attachmentDir(collection, resource))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) != ".tmp" {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DeleteAttachment removes one attachment of a record
+func (d *Driver) DeleteAttachment(collection, resource, name string) error {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return err
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if err := checkAttachmentName(name); err != nil {
+		return err
+	}
+
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dir := d.attachmentDir(collection, resource)
+	if err := os.Remove(filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	os.Remove(dir) // only goes if that was the last one
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// where reads of Options.AuditReads collections are logged without an AuditLog
+const auditDir = "_audit"
+
+// AuditEntry is a line of the read audit log
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Who        string    `json:"who,omitempty"` // given with AuditAs, empty for the application itself
+	Operation  string    `json:"op"`
+	Collection string    `json:"collection"`
+	Resources  []string  `json:"resources"`
+}
+
+// AuditAs names the caller a ReadAll or Find is made for in the read audit log
+func AuditAs(who string) QueryOption {
+	return func(q *query) {
+		q.who = who
+	}
+}
+
+type auditLog struct {
+	mu          sync.Mutex // keeps entries whole
+	w           io.Writer  // nil to append to the file in the database directory
+	collections map[string]bool
+}
+
+func newAuditLog(collections []string, w io.Writer) *auditLog {
+	if len(collections) == 0 {
+		return nil
+	}
+	a := &auditLog{w: w, collections: map[string]bool{}}
+	for _, collection := range collections {
+		a.collections[collection] = true
+	}
+	return a
+}
+
+func (d *Driver) audited(collection string) bool {
+	return d.audit != nil && (d.audit.collections[d.partitionParent(collection)] || d.audit.collections[AnyCollection])
+}
+
+// auditRead logs that who read resources of collection, if it's audited. Reads fail
+// when they can't be logged.
+func (d *Driver) auditRead(who string, op int, collection string, resources []string) error {
+	if !d.audited(collection) || len(resources) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(AuditEntry{
+		Time: time.Now(), Who: who, Operation: opNames[op], Collection: collection, Resources: resources,
+	})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	d.audit.mu.Lock()
+	defer d.audit.mu.Unlock()
+	if d.audit.w != nil {
+		_, err = d.audit.w.Write(b)
+		return err
+	}
+	path := filepath.Join(d.dir, auditDir, "reads.log")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func recordNames(records []*record) []string {
+	names := make([]string, len(records))
+	for i, r := range records {
+		names[i] = r.name
+	}
+	return names
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // for RS384 and up
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long fetched JWKS keys are used before fetching them again, and how often at
+// most a token signed with an unknown key makes them be fetched early
+const (
+	jwksRefresh    = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+// how long fetching the JWKS may take
+const jwksTimeout = 10 * time.Second
+
+type AuthOptions struct {
+	// static API keys and the roles they grant, sent as X-API-Key or as a bearer token
+	APIKeys map[string][]string
+
+	// JWT bearer tokens are accepted when JWKSURL or HMACSecret is set. They're
+	// checked against the keys published at JWKSURL (RS256/384/512, ES256/384/512) or
+	// HMACSecret (HS256), and against Issuer and Audience unless those are empty.
+	JWKSURL    string
+	HMACSecret []byte
+	Issuer     string
+	Audience   string
+
+	// the claim holding the roles of a token's subject, a list or a space separated
+	// string. "roles" if empty.
+	RolesClaim string
+
+	// clock skew allowed checking exp and nbf
+	Leeway time.Duration
+
+	// fetches JWKSURL, a client giving up after 10s if nil. A fetch takes no more
+	// than that with any client.
+	Client *http.Client
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Subject string // of a token, key:<fingerprint> for API keys
+	Roles   []string
+	Claims  map[string]interface{} // of a token
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns the caller Authenticator let through
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Authenticator lets requests with a valid API key or JWT through to the Driver's
+// handlers, so they can be exposed beyond localhost:
+//
+//	auth, err := NewAuthenticator(&AuthOptions{APIKeys: keys})
+//	http.Handle("/graphql", auth.Handler(db.GraphQLHandler()))
+//
+// Its RolesOf goes into AccessControl.RolesOf.
+type Authenticator struct {
+	opts AuthOptions
+	keys map[[sha256.Size]byte][]string // by hash, so looking them up takes no time that depends on them
+
+	mu         sync.Mutex // guards the JWKS
+	jwks       map[string]crypto.PublicKey
+	fetched    time.Time
+	fetchedOK  time.Time
+	fetchErr   error         // of the last fetch
+	refreshing chan struct{} // closed once the fetch in flight is done, nil without one
+}
+
+func NewAuthenticator(opts *AuthOptions) (*Authenticator, error) {
+	a := &Authenticator{keys: map[[sha256.Size]byte][]string{}}
+	if opts != nil {
+		a.opts = *opts
+	}
+	if a.opts.RolesClaim == "" {
+		a.opts.RolesClaim = "roles"
+	}
+	if a.opts.Client == nil {
+		a.opts.Client = &http.Client{Timeout: jwksTimeout}
+	}
+	for key, roles := range a.opts.APIKeys {
+		if key == "" {
+			return nil, fmt.Errorf("empty API key")
+		}
+		a.keys[sha256.Sum256([]byte(key))] = roles
+	}
+	if len(a.keys) == 0 && a.opts.JWKSURL == "" && len(a.opts.HMACSecret) == 0 {
+		return nil, fmt.Errorf("no API keys, JWKS URL or HMAC secret to authenticate with")
+	}
+	return a, nil
+}
+
+// Handler answers 401 to requests without valid credentials and passes the others
+// on to h, with their Principal in the context
+func (a *Authenticator) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="golang-database"`)
+			writeError(w, CodeUnauthenticated, "%v", err)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// RolesOf returns the roles of the caller of a request that went through Handler
+func (a *Authenticator) RolesOf(r *http.Request) []string {
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		return p.Roles
+	}
+	return nil
+}
+
+// Authenticate works out the caller of a request from its X-API-Key or bearer token
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	credential := r.Header.Get("X-API-Key")
+	if credential == "" {
+		auth := r.Header.Get("Authorization")
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			credential = strings.TrimSpace(auth[7:])
+		}
+	}
+	if credential == "" {
+		return nil, fmt.Errorf("no credentials")
+	}
+
+	sum := sha256.Sum256([]byte(credential))
+	if roles, ok := a.keys[sum]; ok {
+		return &Principal{Subject: "key:" + hex.EncodeToString(sum[:4]), Roles: roles}, nil
+	}
+	if strings.Count(credential, ".") == 2 && (a.opts.JWKSURL != "" || len(a.opts.HMACSecret) > 0) {
+		return a.verifyJWT(credential)
+	}
+	return nil, fmt.Errorf("invalid credentials")
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *Authenticator) verifyJWT(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %v", err)
+	}
+	if err := a.verifySignature(header, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("token without exp")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(a.opts.Leeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.opts.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	if a.opts.Issuer != "" && claims["iss"] != a.opts.Issuer {
+		return nil, fmt.Errorf("token of another issuer")
+	}
+	if a.opts.Audience != "" && !claimHas(claims["aud"], a.opts.Audience) {
+		return nil, fmt.Errorf("token for another audience")
+	}
+
+	p := &Principal{Claims: claims}
+	p.Subject, _ = claims["sub"].(string)
+	switch roles := claims[a.opts.RolesClaim].(type) {
+	case string:
+		p.Roles = strings.Fields(roles)
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				p.Roles = append(p.Roles, s)
+			}
+		}
+	}
+	return p, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// claimHas reports whether a claim that may be a string or a list holds s
+func claimHas(claim interface{}, s string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == s
+	case []interface{}:
+		for _, v := range c {
+			if v == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Authenticator) verifySignature(header jwtHeader, signed, sig []byte) error {
+	hash, ok := map[string]crypto.Hash{
+		"HS256": crypto.SHA256,
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}[header.Alg]
+	if !ok {
+		return fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	if header.Alg == "HS256" {
+		if len(a.opts.HMACSecret) == 0 {
+			return fmt.Errorf("unsupported token algorithm %q", header.Alg)
+		}
+		mac := hmac.New(sha256.New, a.opts.HMACSecret)
+		mac.Write(signed)
+		if subtle.ConstantTimeCompare(mac.Sum(nil), sig) != 1 {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+	if a.opts.JWKSURL == "" {
+		return fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	key, err := a.jwk(header.Kid)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(header.Alg, "RS") {
+			return fmt.Errorf("token algorithm %q doesn't fit key %v", header.Alg, header.Kid)
+		}
+		if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(header.Alg, "ES") || len(sig) != 2*size {
+			return fmt.Errorf("token algorithm %q doesn't fit key %v", header.Alg, header.Kid)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key %v", header.Kid)
+	}
+	return nil
+}
+
+// jwk returns the key of a kid. Keys known are used right away, stale ones too while
+// the JWKS is fetched again in the background; an unknown kid waits for a fetch,
+// shared by every request waiting for one.
+func (a *Authenticator) jwk(kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	if key, ok := a.jwks[kid]; ok {
+		if time.Since(a.fetchedOK) > jwksRefresh {
+			a.refreshLocked()
+		}
+		a.mu.Unlock()
+		return key, nil
+	}
+	done := a.refreshLocked()
+	a.mu.Unlock()
+	if done == nil {
+		return nil, fmt.Errorf("unknown token key %q", kid)
+	}
+
+	<-done
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key, ok := a.jwks[kid]; ok {
+		return key, nil
+	}
+	if a.fetchErr != nil {
+		return nil, a.fetchErr
+	}
+	return nil, fmt.Errorf("unknown token key %q", kid)
+}
+
+// refreshLocked fetches the JWKS in the background, unless a fetch is in flight or
+// the last one was less than jwksMinRefresh ago, and returns a channel closed once
+// the fetch in flight is done, nil without one. a.mu has to be held.
+func (a *Authenticator) refreshLocked() chan struct{} {
+	if a.refreshing != nil {
+		return a.refreshing
+	}
+	if time.Since(a.fetched) < jwksMinRefresh {
+		return nil
+	}
+	done := make(chan struct{})
+	a.refreshing, a.fetched = done, time.Now()
+	go func() {
+		keys, err := a.fetchJWKS()
+		a.mu.Lock()
+		if err == nil {
+			a.jwks, a.fetchedOK = keys, time.Now()
+		}
+		a.fetchErr, a.refreshing = err, nil
+		a.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (a *Authenticator) fetchJWKS() (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.opts.JWKSURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %v", err)
+	}
+	res, err := a.opts.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: %v", res.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue // keys of kinds we don't know don't spoil the others
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key %v", k.Kid)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := num(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid key %v", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := num(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid key %v", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v", k.Kty)
+}
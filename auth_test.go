@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signES256 makes a token of claims signed by key under kid
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	part := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := part(jwtHeader{Alg: "ES256", Kid: kid}) + "." + part(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWKSServedWhileRefreshHangs(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "EC", "crv": "P-256", "kid": "k1",
+		"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys are served once, every fetch after that hangs until the test is over
+	var fetches int32
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			select {
+			case <-hang:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	a, err := NewAuthenticator(&AuthOptions{JWKSURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signES256(t, key, "k1", map[string]interface{}{"sub": "ann", "exp": time.Now().Add(time.Hour).Unix()})
+	authenticate := func() {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if p, err := a.Authenticate(req); err != nil || p.Subject != "ann" {
+			t.Fatalf("authenticated %+v: %v, want ann", p, err)
+		}
+	}
+	authenticate()
+
+	// the keys went stale, the refresh hangs and the keys known are used meanwhile
+	a.mu.Lock()
+	a.fetched = a.fetched.Add(-2 * jwksRefresh)
+	a.fetchedOK = a.fetched
+	a.mu.Unlock()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		authenticate()
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("authenticating took %v, waiting for the JWKS refresh", took)
+	}
+	eventually(t, time.Second, func() error {
+		if n := atomic.LoadInt32(&fetches); n != 2 {
+			return fmt.Errorf("fetched the JWKS %d times, want 2", n)
+		}
+		return nil
+	})
+}
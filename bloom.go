@@ -0,0 +1,157 @@
+package main
+
+import (
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// bloom is a bloom filter over the resource names of one collection. It can say a
+// resource is definitely missing, never that it exists. Deleted names stay in it
+// until it is rebuilt, which only makes it answer "maybe" more often.
+type bloom struct {
+	mu    sync.RWMutex
+	bits  []uint64
+	k     uint32
+	n     int // names added
+	limit int // names it was sized for, past that it gets rebuilt bigger
+}
+
+// about 10 bits and 7 hashes per name keeps false positives near 1%
+func newBloom(capacity int) *bloom {
+	if capacity < 1024 {
+		capacity = 1024
+	}
+	return &bloom{
+		bits:  make([]uint64, (capacity*10+63)/64),
+		k:     7,
+		limit: capacity,
+	}
+}
+
+// hashes derives k bit positions from two halves of a 64 bit FNV hash
+func (b *bloom) hashes(name string, fn func(bit uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+
+	m := uint64(len(b.bits) * 64)
+	for i := uint32(0); i < b.k; i++ {
+		fn(uint64(h1+i*h2) % m)
+	}
+}
+
+func (b *bloom) add(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hashes(name, func(bit uint64) { b.bits[bit/64] |= 1 << (bit % 64) })
+	b.n++
+}
+
+func (b *bloom) mayContain(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	found := true
+	b.hashes(name, func(bit uint64) {
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// collectionBloom returns the filter of a collection, building it from a directory
+// listing the first time (and again once it's outgrown its size)
+func (d *Driver) collectionBloom(collection string) (*bloom, error) {
+	d.bmu.Lock()
+	defer d.bmu.Unlock()
+
+	b := d.blooms[collection]
+	if b != nil {
+		b.mu.RLock()
+		full := b.n > b.limit
+		b.mu.RUnlock()
+		if !full {
+			return b, nil
+		}
+	}
+
+	names, err := d.listRecords(collection)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	b = newBloom(len(names) * 2)
+	for _, name := range names {
+		b.add(name)
+	}
+	d.blooms[collection] = b
+	return b, nil
+}
+
+// mayExist is false only when a resource is known not to exist. Without
+// Options.BloomFilter or Options.KeyDirectory it is always true.
+func (d *Driver) mayExist(collection, resource string) bool {
+	if exists, known := d.knownKey(collection, resource); known {
+		return exists
+	}
+	if !d.bloomFilter {
+		return true
+	}
+	b, err := d.collectionBloom(collection)
+	if err != nil {
+		return true // can't tell, let the caller look on disk
+	}
+	return b.mayContain(resource)
+}
+
+// bloomAdd records a written resource in the filter of its collection
+func (d *Driver) bloomAdd(collection, resource string) {
+	if !d.bloomFilter {
+		return
+	}
+	d.bmu.Lock()
+	b := d.blooms[collection]
+	d.bmu.Unlock()
+
+	// not built yet, the listing will pick the new record up
+	if b != nil {
+		b.add(resource)
+	}
+}
+
+// Exists reports whether a record is there. With Options.BloomFilter most misses are
+// answered from memory without touching the disk, with Options.KeyDirectory all of
+// them and the hits too.
+func (d *Driver) Exists(collection, resource string) bool {
+	found, _ := d.timed("exists", collection, resource, func() (interface{}, error) {
+		return d.exists(collection, resource), nil
+	})
+	return found == true
+}
+
+func (d *Driver) exists(collection, resource string) bool {
+	collection, resource = d.fold(collection, resource)
+	if d.checkNames(collection, resource) != nil {
+		return false
+	}
+	if collection == "" || resource == "" {
+		return false
+	}
+	collection, err := d.partitionFor(collection, resource)
+	if err != nil || !d.mayExist(collection, resource) {
+		return false
+	}
+	if _, known := d.knownKey(collection, resource); known || d.isDirty(collection, resource) {
+		return true
+	}
+	fi, err := d.statRecord(collection, resource)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// notExist is the error Read gives for a missing record, os.IsNotExist reports true for it
+func notExist(path string) error {
+	return &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
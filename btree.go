@@ -0,0 +1,963 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A B-tree index file is a copy-on-write B+tree in pages of btreePageSize. A change
+// never overwrites a page in use: the nodes on the path to it are written anew at the
+// end of the file, then the older of the two meta pages at the start is overwritten
+// to point at the new root. A crash before the meta page is written leaves the tree
+// it pointed at before, and a torn meta page fails its checksum so the other one is
+// used. Pages of replaced nodes aren't reused, once they outnumber the live ones the
+// tree is rewritten to a fresh file.
+const (
+	btreeSuffix   = ".btree"
+	btreeMagic    = "GDBT"
+	btreePageSize = 4096
+	btreeMeta0    = 0 // meta pages, the tree starts on page 2
+	btreeMeta1    = 1
+
+	btreeCacheNodes = 1024 // decoded nodes a tree keeps, most recently used first
+
+	// ids of the nodes a transaction changed are handed out from here up until the
+	// commit writes them to pages
+	btreeDirty = 1 << 63
+)
+
+// btreeMeta is what a meta page holds: the latest transaction wins
+type btreeMeta struct {
+	txid   uint64
+	root   uint64 // 0 for an empty tree
+	next   uint64 // pages in the file, dead ones included
+	live   uint64 // pages of the nodes of the tree
+	header []byte // the indexHeader, as JSON
+}
+
+func (m btreeMeta) encode() ([]byte, error) {
+	page := make([]byte, btreePageSize)
+	if 40+len(m.header) > btreePageSize-4 {
+		return nil, fmt.Errorf("B-tree header of %d bytes doesn't fit a page", len(m.header))
+	}
+	copy(page, btreeMagic)
+	binary.LittleEndian.PutUint64(page[4:], m.txid)
+	binary.LittleEndian.PutUint64(page[12:], m.root)
+	binary.LittleEndian.PutUint64(page[20:], m.next)
+	binary.LittleEndian.PutUint64(page[28:], m.live)
+	binary.LittleEndian.PutUint32(page[36:], uint32(len(m.header)))
+	copy(page[40:], m.header)
+	binary.LittleEndian.PutUint32(page[btreePageSize-4:], crc32.ChecksumIEEE(page[:btreePageSize-4]))
+	return page, nil
+}
+
+func decodeBTreeMeta(page []byte) (btreeMeta, bool) {
+	if len(page) != btreePageSize || string(page[:4]) != btreeMagic ||
+		crc32.ChecksumIEEE(page[:btreePageSize-4]) != binary.LittleEndian.Uint32(page[btreePageSize-4:]) {
+		return btreeMeta{}, false
+	}
+	m := btreeMeta{
+		txid: binary.LittleEndian.Uint64(page[4:]),
+		root: binary.LittleEndian.Uint64(page[12:]),
+		next: binary.LittleEndian.Uint64(page[20:]),
+		live: binary.LittleEndian.Uint64(page[28:]),
+	}
+	n := int(binary.LittleEndian.Uint32(page[36:]))
+	if 40+n > btreePageSize-4 {
+		return btreeMeta{}, false
+	}
+	m.header = append([]byte(nil), page[40:40+n]...)
+	return m, true
+}
+
+// bnode is a node of a B-tree. Nodes read from the file are shared through the cache
+// and never changed, a transaction changes copies of them.
+type bnode struct {
+	id   uint64
+	span uint64 // pages the node takes in the file
+	leaf bool
+	keys [][]byte // sorted; keys[i] of a branch is the first key below kids[i], keys[0] is ignored
+	vals [][]byte // leaf only
+	kids []uint64 // branch only
+}
+
+// a node is a header (crc32 of the rest, length of the body, leaf flag, count) and a
+// body of entries: uvarint key length, key, then uvarint value length and value for a
+// leaf or the page of the child for a branch. Nodes bigger than a page span several.
+const bnodeHeader = 13
+
+func (n *bnode) size() int {
+	size := bnodeHeader
+	for i, k := range n.keys {
+		size += binary.MaxVarintLen32 + len(k)
+		if n.leaf {
+			size += binary.MaxVarintLen32 + len(n.vals[i])
+		} else {
+			size += 8
+		}
+	}
+	return size
+}
+
+func (n *bnode) encode() []byte {
+	b := make([]byte, bnodeHeader, n.size())
+	for i, k := range n.keys {
+		b = appendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		if n.leaf {
+			b = appendUvarint(b, uint64(len(n.vals[i])))
+			b = append(b, n.vals[i]...)
+		} else {
+			var kid [8]byte
+			binary.LittleEndian.PutUint64(kid[:], n.kids[i])
+			b = append(b, kid[:]...)
+		}
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-bnodeHeader))
+	if n.leaf {
+		b[8] = 1
+	}
+	binary.LittleEndian.PutUint32(b[9:], uint32(len(n.keys)))
+	binary.LittleEndian.PutUint32(b[0:], crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func decodeBNode(b []byte) (*bnode, bool) {
+	if len(b) < bnodeHeader || crc32.ChecksumIEEE(b[4:]) != binary.LittleEndian.Uint32(b) {
+		return nil, false
+	}
+	n := &bnode{leaf: b[8] == 1}
+	count := int(binary.LittleEndian.Uint32(b[9:]))
+	body := b[bnodeHeader:]
+	next := func() ([]byte, bool) {
+		l, k := binary.Uvarint(body)
+		if k <= 0 || uint64(len(body)-k) < l {
+			return nil, false
+		}
+		v := body[k : k+int(l)]
+		body = body[k+int(l):]
+		return v, true
+	}
+	for i := 0; i < count; i++ {
+		k, ok := next()
+		if !ok {
+			return nil, false
+		}
+		n.keys = append(n.keys, k)
+		if n.leaf {
+			v, ok := next()
+			if !ok {
+				return nil, false
+			}
+			n.vals = append(n.vals, v)
+			continue
+		}
+		if len(body) < 8 {
+			return nil, false
+		}
+		n.kids = append(n.kids, binary.LittleEndian.Uint64(body))
+		body = body[8:]
+	}
+	return n, len(n.keys) > 0
+}
+
+// search is the position of key in a leaf, or where it would go
+func (n *bnode) search(key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) >= 0 })
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+// child is the position of the child of a branch key belongs below
+func (n *bnode) child(key []byte) int {
+	i := sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) > 0 }) - 1
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+func (n *bnode) clone() *bnode {
+	c := &bnode{leaf: n.leaf, keys: append([][]byte(nil), n.keys...)}
+	if n.leaf {
+		c.vals = append([][]byte(nil), n.vals...)
+	} else {
+		c.kids = append([]uint64(nil), n.kids...)
+	}
+	return c
+}
+
+// btree is an open B-tree file
+type btree struct {
+	mu   sync.Mutex // one transaction at a time, guards the fields below
+	path string
+	f    *os.File
+	meta btreeMeta
+	sync bool // fsync pages before the meta page pointing at them, for Options.Durable
+
+	cache *list.List // of *bnode, front is the most recently used
+	nodes map[uint64]*list.Element
+}
+
+// createBTree makes an empty tree at path, replacing whatever was there
+func createBTree(path string, header []byte, sync bool) (*btree, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := newBTree(path, f, sync)
+	t.meta = btreeMeta{next: 2, header: header}
+	for _, txid := range []uint64{0, 1} {
+		t.meta.txid = txid
+		if err := t.writeMeta(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// openBTree opens the tree at path with the latest meta page that's intact
+func openBTree(path string, sync bool) (*btree, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var metas []btreeMeta
+	for _, id := range []uint64{btreeMeta0, btreeMeta1} {
+		page := make([]byte, btreePageSize)
+		if _, err := f.ReadAt(page, int64(id)*btreePageSize); err != nil {
+			continue
+		}
+		if m, ok := decodeBTreeMeta(page); ok {
+			metas = append(metas, m)
+		}
+	}
+	if len(metas) == 0 {
+		f.Close()
+		return nil, fmt.Errorf("%w: B-tree file %v has no valid meta page", ErrCorrupted, path)
+	}
+	t := newBTree(path, f, sync)
+	t.meta = metas[0]
+	if len(metas) > 1 && metas[1].txid > metas[0].txid {
+		t.meta = metas[1]
+	}
+	return t, nil
+}
+
+func newBTree(path string, f *os.File, sync bool) *btree {
+	return &btree{path: path, f: f, sync: sync, cache: list.New(), nodes: map[uint64]*list.Element{}}
+}
+
+func (t *btree) writeMeta() error {
+	page, err := t.meta.encode()
+	if err != nil {
+		return err
+	}
+	if _, err := t.f.WriteAt(page, int64(t.meta.txid%2)*btreePageSize); err != nil {
+		return err
+	}
+	if t.sync {
+		return t.f.Sync()
+	}
+	return nil
+}
+
+// node reads the node at page id, from the cache if it's there
+func (t *btree) node(id uint64) (*bnode, error) {
+	if el, ok := t.nodes[id]; ok {
+		t.cache.MoveToFront(el)
+		return el.Value.(*bnode), nil
+	}
+	if id < 2 || id >= t.meta.next {
+		return nil, fmt.Errorf("%w: B-tree page %d of %v is out of the file", ErrCorrupted, id, t.path)
+	}
+
+	page := make([]byte, btreePageSize)
+	if _, err := t.f.ReadAt(page, int64(id)*btreePageSize); err != nil {
+		return nil, err
+	}
+	length := int(binary.LittleEndian.Uint32(page[4:])) + bnodeHeader
+	if uint64(length) > (t.meta.next-id)*btreePageSize {
+		return nil, fmt.Errorf("%w: B-tree page %d of %v", ErrCorrupted, id, t.path)
+	}
+	b := page
+	if length > btreePageSize {
+		b = make([]byte, length)
+		if _, err := t.f.ReadAt(b, int64(id)*btreePageSize); err != nil {
+			return nil, err
+		}
+	}
+	n, ok := decodeBNode(b[:length])
+	if !ok {
+		return nil, fmt.Errorf("%w: B-tree page %d of %v", ErrCorrupted, id, t.path)
+	}
+	n.id, n.span = id, pagesFor(length)
+	t.cached(n)
+	return n, nil
+}
+
+func (t *btree) cached(n *bnode) {
+	t.nodes[n.id] = t.cache.PushFront(n)
+	for t.cache.Len() > btreeCacheNodes {
+		el := t.cache.Back()
+		t.cache.Remove(el)
+		delete(t.nodes, el.Value.(*bnode).id)
+	}
+}
+
+func pagesFor(size int) uint64 {
+	return uint64((size + btreePageSize - 1) / btreePageSize)
+}
+
+// update runs fn in a transaction and commits what it changed, nothing if it fails
+func (t *btree) update(fn func(tx *btreeTx) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return os.ErrClosed
+	}
+	tx := t.begin()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return t.commit(tx)
+}
+
+// view runs fn in a transaction that's thrown away
+func (t *btree) view(fn func(tx *btreeTx) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return os.ErrClosed
+	}
+	return fn(t.begin())
+}
+
+// change and read make a tree an indexFile
+func (t *btree) change(fn func(tx kvTx) error) error {
+	return t.update(func(tx *btreeTx) error { return fn(tx) })
+}
+
+func (t *btree) read(fn func(tx kvTx) error) error {
+	return t.view(func(tx *btreeTx) error { return fn(tx) })
+}
+
+func (t *btree) begin() *btreeTx {
+	return &btreeTx{t: t, root: t.meta.root, dirty: map[uint64]*bnode{}, pseudo: btreeDirty}
+}
+
+// commit writes the nodes tx changed after the end of the file, then the meta page
+// pointing at its root
+func (t *btree) commit(tx *btreeTx) error {
+	if tx.root == t.meta.root && len(tx.dirty) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	next := t.meta.next
+	var written []*bnode
+	root := tx.write(tx.root, &buf, &next, &written)
+	if buf.Len() > 0 {
+		if _, err := t.f.WriteAt(buf.Bytes(), int64(t.meta.next)*btreePageSize); err != nil {
+			return err
+		}
+		if t.sync {
+			if err := t.f.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+
+	prev := t.meta
+	t.meta.txid++
+	t.meta.root = root
+	t.meta.next = next
+	t.meta.live = prev.live + (next - prev.next)
+	if tx.freed < t.meta.live {
+		t.meta.live -= tx.freed
+	} else {
+		t.meta.live = 0
+	}
+	if err := t.writeMeta(); err != nil {
+		t.meta = prev
+		return err
+	}
+	for _, n := range written {
+		t.cached(n)
+	}
+	return nil
+}
+
+// waste is the pages of replaced nodes in the file, and those of the tree
+func (t *btree) waste() (dead, live int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return int(t.meta.next - 2 - t.meta.live), int(t.meta.live)
+}
+
+// rewrite copies the tree to a fresh file, without its dead pages, and replaces the
+// file with it. With empty the fresh tree has nothing in it.
+func (t *btree) rewrite(empty bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return os.ErrClosed
+	}
+
+	tmp := t.path + ".tmp"
+	fresh, err := createBTree(tmp, t.meta.header, t.sync)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		tx := fresh.begin()
+		n := 0
+		err = t.begin().walk(nil, nil, func(key, val []byte) error {
+			if err := tx.put(key, val); err != nil {
+				return err
+			}
+			if n++; n%fileBatch == 0 {
+				if err := fresh.commit(tx); err != nil {
+					return err
+				}
+				tx = fresh.begin()
+			}
+			return nil
+		})
+		if err == nil {
+			err = fresh.commit(tx)
+		}
+	}
+	if cerr := fresh.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	t.f.Close()
+	t.f = nil
+	if err := os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+	if t.f, err = os.OpenFile(t.path, os.O_RDWR, 0644); err != nil {
+		return err
+	}
+	t.meta = fresh.meta
+	t.cache.Init()
+	t.nodes = map[uint64]*list.Element{}
+	return nil
+}
+
+func (t *btree) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return nil
+	}
+	err := t.f.Close()
+	t.f = nil
+	return err
+}
+
+// btreeTx is a transaction on a tree. Nodes it changes are copies kept in dirty under
+// ids from btreeDirty up, until commit writes them.
+type btreeTx struct {
+	t      *btree
+	root   uint64
+	dirty  map[uint64]*bnode
+	pseudo uint64 // the next id of a dirty node
+	freed  uint64 // pages of the nodes replaced
+}
+
+func (tx *btreeTx) node(id uint64) (*bnode, error) {
+	if id >= btreeDirty {
+		return tx.dirty[id], nil
+	}
+	return tx.t.node(id)
+}
+
+// add makes n a dirty node of the transaction
+func (tx *btreeTx) add(n *bnode) uint64 {
+	n.id = tx.pseudo
+	tx.pseudo++
+	tx.dirty[n.id] = n
+	return n.id
+}
+
+// writable is the node at id, copied into the transaction unless it's dirty already
+func (tx *btreeTx) writable(id uint64) (*bnode, error) {
+	if id >= btreeDirty {
+		return tx.dirty[id], nil
+	}
+	n, err := tx.t.node(id)
+	if err != nil {
+		return nil, err
+	}
+	tx.freed += n.span
+	c := n.clone()
+	tx.add(c)
+	return c, nil
+}
+
+// drop forgets the node at id, which is gone from the tree
+func (tx *btreeTx) drop(id uint64) error {
+	if id >= btreeDirty {
+		delete(tx.dirty, id)
+		return nil
+	}
+	n, err := tx.t.node(id)
+	if err != nil {
+		return err
+	}
+	tx.freed += n.span
+	return nil
+}
+
+func (tx *btreeTx) get(key []byte) ([]byte, bool, error) {
+	id := tx.root
+	for id != 0 {
+		n, err := tx.node(id)
+		if err != nil {
+			return nil, false, err
+		}
+		if !n.leaf {
+			id = n.kids[n.child(key)]
+			continue
+		}
+		if i, ok := n.search(key); ok {
+			return n.vals[i], true, nil
+		}
+		break
+	}
+	return nil, false, nil
+}
+
+func (tx *btreeTx) put(key, val []byte) error {
+	if tx.root == 0 {
+		tx.root = tx.add(&bnode{leaf: true, keys: [][]byte{key}, vals: [][]byte{val}})
+		return nil
+	}
+	id, sep, right, err := tx.insert(tx.root, key, val)
+	if err != nil {
+		return err
+	}
+	if right != 0 {
+		id = tx.add(&bnode{keys: [][]byte{nil, sep}, kids: []uint64{id, right}})
+	}
+	tx.root = id
+	return nil
+}
+
+// insert puts key into the subtree at id and returns the id of its copy, and the first
+// key and id of the node split off it if it grew past a page
+func (tx *btreeTx) insert(id uint64, key, val []byte) (uint64, []byte, uint64, error) {
+	n, err := tx.writable(id)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if n.leaf {
+		i, found := n.search(key)
+		if found {
+			n.vals[i] = val
+		} else {
+			n.keys = insertBytes(n.keys, i, key)
+			n.vals = insertBytes(n.vals, i, val)
+		}
+	} else {
+		i := n.child(key)
+		kid, sep, right, err := tx.insert(n.kids[i], key, val)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		n.kids[i] = kid
+		if right != 0 {
+			n.keys = insertBytes(n.keys, i+1, sep)
+			n.kids = append(n.kids, 0)
+			copy(n.kids[i+2:], n.kids[i+1:])
+			n.kids[i+1] = right
+		}
+	}
+
+	if len(n.keys) < 2 || n.size() <= btreePageSize {
+		return n.id, nil, 0, nil
+	}
+	// split where the left half reaches half a page
+	m, size := 1, bnodeHeader
+	for ; m < len(n.keys)-1; m++ {
+		if size += len(n.keys[m-1]); n.leaf {
+			size += len(n.vals[m-1])
+		}
+		if size >= btreePageSize/2 {
+			break
+		}
+	}
+	right := &bnode{leaf: n.leaf, keys: append([][]byte(nil), n.keys[m:]...)}
+	n.keys = n.keys[:m:m]
+	if n.leaf {
+		right.vals = append([][]byte(nil), n.vals[m:]...)
+		n.vals = n.vals[:m:m]
+	} else {
+		right.kids = append([]uint64(nil), n.kids[m:]...)
+		n.kids = n.kids[:m:m]
+	}
+	return n.id, right.keys[0], tx.add(right), nil
+}
+
+func insertBytes(s [][]byte, i int, b []byte) [][]byte {
+	s = append(s, nil)
+	copy(s[i+1:], s[i:])
+	s[i] = b
+	return s
+}
+
+// delete removes key, if it's there. Nodes aren't merged as they shrink, only dropped
+// once empty; rewrite packs them again.
+func (tx *btreeTx) delete(key []byte) error {
+	if _, ok, err := tx.get(key); err != nil || !ok {
+		return err
+	}
+	id, err := tx.remove(tx.root, key)
+	if err != nil {
+		return err
+	}
+	// a branch with a single child isn't worth a level
+	for id != 0 {
+		n, err := tx.node(id)
+		if err != nil {
+			return err
+		}
+		if n.leaf || len(n.kids) > 1 {
+			break
+		}
+		if err := tx.drop(id); err != nil {
+			return err
+		}
+		id = n.kids[0]
+	}
+	tx.root = id
+	return nil
+}
+
+// remove takes key out of the subtree at id and returns the id of its copy, 0 if
+// nothing is left of it
+func (tx *btreeTx) remove(id uint64, key []byte) (uint64, error) {
+	n, err := tx.writable(id)
+	if err != nil {
+		return 0, err
+	}
+	if n.leaf {
+		if i, ok := n.search(key); ok {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			n.vals = append(n.vals[:i], n.vals[i+1:]...)
+		}
+	} else {
+		i := n.child(key)
+		kid, err := tx.remove(n.kids[i], key)
+		if err != nil {
+			return 0, err
+		}
+		if kid == 0 {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			n.kids = append(n.kids[:i], n.kids[i+1:]...)
+		} else {
+			n.kids[i] = kid
+		}
+	}
+	if len(n.keys) == 0 {
+		delete(tx.dirty, n.id)
+		return 0, nil
+	}
+	return n.id, nil
+}
+
+// walk calls fn with the entries from key from (the first if nil) up to, but not
+// including, key to (the last if nil), in order
+func (tx *btreeTx) walk(from, to []byte, fn func(key, val []byte) error) error {
+	if tx.root == 0 {
+		return nil
+	}
+	_, err := tx.walkNode(tx.root, from, to, fn)
+	return err
+}
+
+func (tx *btreeTx) walkNode(id uint64, from, to []byte, fn func(key, val []byte) error) (bool, error) {
+	n, err := tx.node(id)
+	if err != nil {
+		return false, err
+	}
+	if n.leaf {
+		i, _ := n.search(from)
+		for ; i < len(n.keys); i++ {
+			if to != nil && bytes.Compare(n.keys[i], to) >= 0 {
+				return false, nil
+			}
+			if err := fn(n.keys[i], n.vals[i]); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	first := n.child(from)
+	for i := first; i < len(n.kids); i++ {
+		if i > first && to != nil && bytes.Compare(n.keys[i], to) >= 0 {
+			return false, nil
+		}
+		more, err := tx.walkNode(n.kids[i], from, to, fn)
+		if err != nil || !more {
+			return more, err
+		}
+	}
+	return true, nil
+}
+
+// walkBack is walk backwards, from the last entry before key to down to key from
+func (tx *btreeTx) walkBack(from, to []byte, fn func(key, val []byte) error) error {
+	if tx.root == 0 {
+		return nil
+	}
+	_, err := tx.walkNodeBack(tx.root, from, to, fn)
+	return err
+}
+
+func (tx *btreeTx) walkNodeBack(id uint64, from, to []byte, fn func(key, val []byte) error) (bool, error) {
+	n, err := tx.node(id)
+	if err != nil {
+		return false, err
+	}
+	if n.leaf {
+		i := len(n.keys)
+		if to != nil {
+			i, _ = n.search(to)
+		}
+		for i--; i >= 0; i-- {
+			if bytes.Compare(n.keys[i], from) < 0 {
+				return false, nil
+			}
+			if err := fn(n.keys[i], n.vals[i]); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	last := len(n.kids) - 1
+	if to != nil {
+		last = n.child(to)
+	}
+	for i := last; i >= 0; i-- {
+		// the keys of a child are below the first of the next
+		if i < last && bytes.Compare(n.keys[i+1], from) <= 0 {
+			return false, nil
+		}
+		more, err := tx.walkNodeBack(n.kids[i], from, to, fn)
+		if err != nil || !more {
+			return more, err
+		}
+	}
+	return true, nil
+}
+
+// scan calls fn with the entries whose key starts with prefix, in order
+func (tx *btreeTx) scan(prefix []byte, fn func(key, val []byte) error) error {
+	return tx.walk(prefix, prefixEnd(prefix), fn)
+}
+
+// write puts the dirty nodes of the subtree at id into buf as pages from *next on,
+// children first, and returns the page of its root
+func (tx *btreeTx) write(id uint64, buf *bytes.Buffer, next *uint64, written *[]*bnode) uint64 {
+	if id < btreeDirty {
+		return id
+	}
+	n := tx.dirty[id]
+	for i, kid := range n.kids {
+		n.kids[i] = tx.write(kid, buf, next, written)
+	}
+	b := n.encode()
+	n.id, n.span = *next, pagesFor(len(b))
+	*next += n.span
+	buf.Write(b)
+	buf.Write(make([]byte, int(n.span)*btreePageSize-len(b)))
+	*written = append(*written, n)
+	return n.id
+}
+
+// tags of the kinds of values in keys, in the order they sort in. Values only compare
+// with values of their kind, a range never goes past the tag of its bounds.
+const (
+	tagMissing byte = iota + 1
+	tagNull
+	tagBool
+	tagNumber
+	tagString
+	tagJSON
+)
+
+// appendIndexValue appends an encoding of v that sorts like compareValues does and
+// that no other encoding is a prefix of
+func appendIndexValue(b []byte, v interface{}, present bool) []byte {
+	if !present {
+		return append(b, tagMissing)
+	}
+	if f, ok := toFloat(v); ok {
+		if f == 0 {
+			f = 0 // -0 too
+		}
+		bits := math.Float64bits(f)
+		if bits>>63 == 1 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], bits)
+		return append(append(b, tagNumber), n[:]...)
+	}
+	switch x := v.(type) {
+	case string:
+		return appendEscaped(append(b, tagString), []byte(x))
+	case bool:
+		if x {
+			return append(b, tagBool, 1)
+		}
+		return append(b, tagBool, 0)
+	case nil:
+		return append(b, tagNull)
+	}
+	j, _ := json.Marshal(v)
+	return appendEscaped(append(b, tagJSON), j)
+}
+
+// appendEscaped appends s with 0 escaped as 0 0xff and ended by 0 1, so it sorts
+// bytewise and ends where it ends
+func appendEscaped(b, s []byte) []byte {
+	for _, c := range s {
+		if c == 0 {
+			b = append(b, 0, 0xff)
+			continue
+		}
+		b = append(b, c)
+	}
+	return append(b, 0, 1)
+}
+
+// indexValueTag is the tag v is encoded with
+func indexValueTag(v interface{}) byte {
+	return appendIndexValue(nil, v, true)[0]
+}
+
+// treeNames lists the resources with an entry from key from up to key to
+func (ix *index) treeNames(from, to []byte) ([]string, error) {
+	var names []string
+	err := ix.tree().view(func(tx *btreeTx) error {
+		return tx.walk(from, to, func(_, val []byte) error {
+			names = append(names, string(val))
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// errWalked ends a walk that found what it was after
+var errWalked = errors.New("walk done")
+
+// treeOrder lists the first n resources in the order of the values of the index,
+// backwards with Desc, and those tying with the last of them
+func (ix *index) treeOrder(dir Direction, n int) ([]string, error) {
+	var names []string
+	var last []byte // the values of the nth
+	take := func(key, val []byte) error {
+		values := key[:len(key)-len(val)-1] // the name follows a 0
+		if len(names) >= n && !bytes.Equal(values, last) {
+			return errWalked
+		}
+		if len(names) == n-1 {
+			last = append([]byte(nil), values...)
+		}
+		names = append(names, string(val))
+		return nil
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	err := ix.tree().view(func(tx *btreeTx) error {
+		from, to := []byte{fileEntry}, []byte{fileEntry + 1}
+		if dir == Desc {
+			return tx.walkBack(from, to, take)
+		}
+		return tx.walk(from, to, take)
+	})
+	if err == errWalked {
+		err = nil
+	}
+	return names, err
+}
+
+// rangeLookup returns the resources whose first field satisfies every comparison,
+// which all have to be on it. ok is false if they compare with different kinds of
+// values, which no value satisfies, or with values that don't compare.
+func (ix *index) rangeLookup(cmps []cmpFilter) (names []string, ok bool, err error) {
+	if len(cmps) == 0 {
+		return nil, false, nil
+	}
+	tag := indexValueTag(cmps[0].value)
+	if tag != tagNumber && tag != tagString && tag != tagBool {
+		return nil, false, nil
+	}
+	from, to := []byte{fileEntry, tag}, []byte{fileEntry, tag + 1}
+	for _, c := range cmps {
+		if indexValueTag(c.value) != tag {
+			return nil, false, nil
+		}
+		bound := appendIndexValue([]byte{fileEntry}, c.value, true)
+		past := append(bound[:len(bound):len(bound)], 0xff) // past every key with the value
+		switch c.op {
+		case ">":
+			from = maxBytes(from, past)
+		case ">=":
+			from = maxBytes(from, bound)
+		case "<":
+			to = minBytes(to, bound)
+		case "<=":
+			to = minBytes(to, past)
+		default:
+			return nil, false, nil
+		}
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if bytes.Compare(from, to) >= 0 {
+		return nil, true, nil
+	}
+	names, err = ix.treeNames(from, to)
+	return names, err == nil, err
+}
+
+func maxBytes(a, b []byte) []byte {
+	if bytes.Compare(a, b) >= 0 {
+		return a
+	}
+	return b
+}
+
+func minBytes(a, b []byte) []byte {
+	if bytes.Compare(a, b) <= 0 {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func putBTree(t *testing.T, tree *btree, keys ...string) {
+	t.Helper()
+	err := tree.update(func(tx *btreeTx) error {
+		for _, key := range keys {
+			if err := tx.put([]byte(key), []byte("value of "+key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("putting %v: %v", keys, err)
+	}
+}
+
+func requireBTree(t *testing.T, tree *btree, key string, want bool) {
+	t.Helper()
+	err := tree.view(func(tx *btreeTx) error {
+		val, ok, err := tx.get([]byte(key))
+		if err != nil {
+			return err
+		}
+		if ok != want || ok && string(val) != "value of "+key {
+			return fmt.Errorf("%v is %q (found %v), want found %v", key, val, ok, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tearPage overwrites the middle of a page like a write cut short by a crash
+func tearPage(t *testing.T, path string, page int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	garbage := bytes.Repeat([]byte{0xff}, 64)
+	if _, err := f.WriteAt(garbage, page*btreePageSize+btreePageSize/2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBTreeRecoversFromTornMetaPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ix"+btreeSuffix)
+	tree, err := createBTree(path, []byte(`{}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putBTree(t, tree, "a", "b") // txid 2, meta page 0
+	putBTree(t, tree, "c")      // txid 3, meta page 1
+	if err := tree.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the meta page of the latest commit is torn, the one before it is used
+	tearPage(t, path, btreeMeta1)
+	if tree, err = openBTree(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if tree.meta.txid != 2 {
+		t.Fatalf("opened at transaction %d, want 2", tree.meta.txid)
+	}
+	requireBTree(t, tree, "a", true)
+	requireBTree(t, tree, "b", true)
+	requireBTree(t, tree, "c", false)
+
+	// the next commit goes over the torn page and wins on the next open
+	putBTree(t, tree, "d")
+	if err := tree.close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = openBTree(path, false); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.close()
+	if tree.meta.txid != 3 {
+		t.Fatalf("opened at transaction %d, want 3", tree.meta.txid)
+	}
+	requireBTree(t, tree, "a", true)
+	requireBTree(t, tree, "c", false)
+	requireBTree(t, tree, "d", true)
+}
+
+func TestBTreeWithoutMetaPageIsCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ix"+btreeSuffix)
+	tree, err := createBTree(path, []byte(`{}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putBTree(t, tree, "a")
+	if err := tree.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tearPage(t, path, btreeMeta0)
+	tearPage(t, path, btreeMeta1)
+	if tree, err = openBTree(path, false); !errors.Is(err, ErrCorrupted) {
+		if err == nil {
+			tree.close()
+		}
+		t.Fatalf("opening a tree with both meta pages torn: %v, want %v", err, ErrCorrupted)
+	}
+}
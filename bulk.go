@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// DeleteWhere removes every record of a collection matching filter (nil removes them all)
+// and returns how many were removed. The collection stays locked for the whole run.
+func (d *Driver) DeleteWhere(collection string, filter Filter) (int, error) {
+	n, err := d.timed("delete_where", collection, "", func() (interface{}, error) {
+		return d.deleteWhere(collection, filter)
+	})
+	removed, _ := n.(int)
+	return removed, err
+}
+
+func (d *Driver) deleteWhere(collection string, filter Filter) (int, error) {
+	deadline := d.deadline()
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return 0, err
+	}
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+	if collection == "" {
+		return 0, fmt.Errorf("%w - unable to delete", ErrEmptyCollection)
+	}
+	if _, ok := d.partitions[collection]; ok {
+		return d.deletePartitioned(collection, filter)
+	}
+
+	mutex := d.lockFor(collection)
+	if _, err := mutex.lockBy(deadline); err != nil {
+		return 0, err
+	}
+	defer mutex.Unlock()
+
+	records, release, err := d.readRecords(collection, filter != nil)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	removed := 0
+	for _, r := range records {
+		if filter != nil {
+			doc, err := r.decode()
+			if err != nil {
+				return removed, err
+			}
+			if !filter.Match(doc) {
+				continue
+			}
+		}
+
+		ok, err := d.removeRecord(collection, r.name)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// UpdateWhere applies a JSON merge patch (RFC 7386) to every record matching filter and
+// returns how many were updated. patch may be raw JSON ([]byte, string, json.RawMessage)
+// or any value that marshals to a JSON object. Each record is rewritten atomically.
+func (d *Driver) UpdateWhere(collection string, filter Filter, patch interface{}) (int, error) {
+	n, err := d.timed("update_where", collection, "", func() (interface{}, error) {
+		return d.updateWhere(collection, filter, patch)
+	})
+	updated, _ := n.(int)
+	return updated, err
+}
+
+func (d *Driver) updateWhere(collection string, filter Filter, patch interface{}) (updated int, err error) {
+	deadline := d.deadline()
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return 0, err
+	}
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+	if collection == "" {
+		return 0, fmt.Errorf("%w - unable to update", ErrEmptyCollection)
+	}
+
+	p, err := decodePatch(patch)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err == nil {
+			err = d.awaitCommit(collection)
+		}
+	}()
+	if _, ok := d.partitions[collection]; ok {
+		return d.updatePartitioned(collection, filter, p)
+	}
+
+	mutex := d.lockFor(collection)
+	if _, err := mutex.lockBy(deadline); err != nil {
+		return 0, err
+	}
+	defer mutex.Unlock()
+
+	records, release, err := d.readRecords(collection, true)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	for _, r := range records {
+		doc, err := r.decode()
+		if err != nil {
+			return updated, err
+		}
+		if filter != nil && !filter.Match(doc) {
+			continue
+		}
+
+		// the decoded doc may be shared with the read cache, patch a fresh copy
+		doc, err = (&record{name: r.name, raw: r.raw}).decode()
+		if err != nil {
+			return updated, err
+		}
+		b, err := json.MarshalIndent(mergePatch(doc, p), "", "\t")
+		if err != nil {
+			return updated, err
+		}
+		b = append(b, byte('\n'))
+		if b, err = d.hashRecord(b, d.hashPaths(collection, nil)); err != nil {
+			return updated, err
+		}
+
+		if err := d.checkSchema(collection, r.name, b); err != nil {
+			return updated, err
+		}
+		if err := d.checkUnique(collection, r.name, b); err != nil {
+			return updated, err
+		}
+		if err := d.storeRecord(collection, r.name, b); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+func decodePatch(patch interface{}) (map[string]interface{}, error) {
+	var raw []byte
+	switch p := patch.(type) {
+	case []byte:
+		raw = p
+	case json.RawMessage:
+		raw = p
+	case string:
+		raw = []byte(p)
+	default:
+		b, err := json.Marshal(patch)
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	}
+
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil || m == nil {
+		return nil, fmt.Errorf("invalid patch - it has to be a JSON object")
+	}
+	return m, nil
+}
+
+// mergePatch applies patch to doc: null removes a member, objects merge recursively
+// and everything else replaces what was there
+func mergePatch(doc, patch map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	for k, v := range patch {
+		switch pv := v.(type) {
+		case nil:
+			delete(doc, k)
+		case map[string]interface{}:
+			dv, _ := doc[k].(map[string]interface{})
+			doc[k] = mergePatch(dv, pv)
+		default:
+			doc[k] = v
+		}
+	}
+	return doc
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheMode decides what Write does with the read cache
+type CacheMode int
+
+const (
+	// WriteInvalidate drops the cached copy, the next Read goes to disk (the default)
+	WriteInvalidate CacheMode = iota
+
+	// WriteThrough writes to disk and caches the new copy, so reading back what was
+	// just written never touches the disk
+	WriteThrough
+
+	// WriteBack only caches the new copy. Changed records are written to disk every
+	// Options.FlushInterval, on Flush and on Close. Much faster for bursts of writes
+	// to the same records, but whatever wasn't flushed is lost if the process dies.
+	WriteBack
+)
+
+// lru keeps the most recently used records in memory, up to size records. It holds
+// the loaded *record, so the raw bytes and (once something decoded it) the decoded
+// document are shared by every reader that hits.
+type lru struct {
+	// bumped by every invalidation of a key in the stripe, see generation. First with
+	// the counters, for 64 bit atomic access on 32 bit platforms.
+	gens         [64]uint64
+	hits, misses uint64
+
+	mu    sync.Mutex
+	size  int
+	ll    *list.List               // front is the most recently used
+	items map[string]*list.Element // key -> element holding a *cacheItem
+
+	// WriteBack records not on disk yet. They don't count against size and are never
+	// evicted, a flush moves them over to the LRU list.
+	dirty map[string]*dirtyItem
+}
+
+type cacheItem struct {
+	key string
+	rec *record
+}
+
+type dirtyItem struct {
+	collection string
+	rec        *record
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, ll: list.New(), items: map[string]*list.Element{}, dirty: map[string]*dirtyItem{}}
+}
+
+// the parts are kept apart by a byte no name has, "users/john/orders" + "42" and
+// "users" + "john/orders/42" are different records
+func cacheKey(collection, resource string) string {
+	return collection + "\x00" + resource
+}
+
+func stripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % 64)
+}
+
+func (c *lru) get(key string) (*record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, ok := c.dirty[key]; ok {
+		atomic.AddUint64(&c.hits, 1)
+		return item.rec, true
+	}
+
+	el, ok := c.items[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheItem).rec, true
+}
+
+// generation is read before loading a record from disk and handed to add. If the
+// key was invalidated in between (a Write raced the read) the add is dropped, so an
+// old copy never lands in the cache after the new one was written.
+func (c *lru) generation(key string) uint64 {
+	return atomic.LoadUint64(&c.gens[stripe(key)])
+}
+
+func (c *lru) add(key string, rec *record, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if atomic.LoadUint64(&c.gens[stripe(key)]) != gen {
+		return
+	}
+	c.insert(key, rec)
+}
+
+// put caches a record that was just written, replacing whatever a reader may be
+// about to add
+func (c *lru) put(key string, rec *record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	atomic.AddUint64(&c.gens[stripe(key)], 1)
+	c.insert(key, rec)
+}
+
+func (c *lru) insert(key string, rec *record) {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*cacheItem).rec = rec
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&cacheItem{key: key, rec: rec})
+
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheItem).key)
+	}
+}
+
+func (c *lru) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	atomic.AddUint64(&c.gens[stripe(key)], 1)
+	delete(c.dirty, key)
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func (c *lru) putDirty(collection, key string, rec *record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	atomic.AddUint64(&c.gens[stripe(key)], 1)
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+	c.dirty[key] = &dirtyItem{collection: collection, rec: rec}
+}
+
+func (c *lru) isDirty(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.dirty[key]
+	return ok
+}
+
+// peekDirty returns an unflushed record without counting a hit
+func (c *lru) peekDirty(key string) (*record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.dirty[key]
+	if !ok {
+		return nil, false
+	}
+	return item.rec, true
+}
+
+func (c *lru) dirtyLen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.dirty)
+}
+
+// dirtyKeys lists the unflushed records, sorted so flushes go collection by collection
+func (c *lru) dirtyKeys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.dirty))
+	for key := range c.dirty {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dirtyNames lists the unflushed resources of a collection
+func (c *lru) dirtyNames(collection string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var names []string
+	for _, item := range c.dirty {
+		if item.collection == collection {
+			names = append(names, item.rec.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dirtyCollections lists the collections with unflushed records
+func (d *Driver) dirtyCollections() []string {
+	if d.cache == nil {
+		return nil
+	}
+
+	d.cache.mu.Lock()
+	defer d.cache.mu.Unlock()
+
+	seen := map[string]bool{}
+	var collections []string
+	for _, item := range d.cache.dirty {
+		if !seen[item.collection] {
+			seen[item.collection] = true
+			collections = append(collections, item.collection)
+		}
+	}
+	sort.Strings(collections)
+	return collections
+}
+
+// markClean moves a flushed record from the dirty set to the LRU list
+func (c *lru) markClean(key string, rec *record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, ok := c.dirty[key]; ok && item.rec == rec {
+		delete(c.dirty, key)
+		c.insert(key, rec)
+	}
+}
+
+// removeCollection drops every cached record of a collection
+func (c *lru) removeCollection(collection string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prefix := cacheKey(collection, "")
+	for key, item := range c.dirty {
+		if item.collection == collection {
+			atomic.AddUint64(&c.gens[stripe(key)], 1)
+			delete(c.dirty, key)
+		}
+	}
+	for key, el := range c.items {
+		if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+			atomic.AddUint64(&c.gens[stripe(key)], 1)
+			c.ll.Remove(el)
+			delete(c.items, key)
+		}
+	}
+}
+
+// uncache drops a record from the read cache after it was changed or deleted
+func (d *Driver) uncache(collection, resource string) {
+	if d.cache != nil {
+		d.cache.remove(cacheKey(collection, resource))
+	}
+}
+
+// CacheStats returns the hits and misses of the read cache so far
+func (d *Driver) CacheStats() (hits, misses uint64) {
+	if d.cache == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&d.cache.hits), atomic.LoadUint64(&d.cache.misses)
+}
+
+// isDirty tells if a record only exists in the WriteBack cache so far
+func (d *Driver) isDirty(collection, resource string) bool {
+	return d.cache != nil && d.cache.isDirty(cacheKey(collection, resource))
+}
+
+// Flush writes the records changed in WriteBack mode to disk. It does nothing in
+// the other modes.
+func (d *Driver) Flush() error {
+	if d.cache == nil || d.cacheMode != WriteBack {
+		return nil
+	}
+
+	// sorted by key, so a collection's records are next to each other
+	keys := d.cache.dirtyKeys()
+	for len(keys) > 0 {
+		collection := keys[0][:strings.IndexByte(keys[0], 0)]
+		n := 1
+		for n < len(keys) && n < flushBatchSize && strings.HasPrefix(keys[n], cacheKey(collection, "")) {
+			n++
+		}
+		if err := d.flushBatch(collection, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// how many records of a collection Flush writes under one lock of it, so the writes
+// to it meanwhile aren't held up for long
+const flushBatchSize = 256
+
+// flushBatch writes records of collection, in the order of their keys, and waits for
+// their group commit with Options.Durable
+func (d *Driver) flushBatch(collection string, keys []string) error {
+	if err := d.flushLocked(collection, keys); err != nil {
+		return err
+	}
+	return d.awaitCommit(collection)
+}
+
+func (d *Driver) flushLocked(collection string, keys []string) error {
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, key := range keys {
+		// look now that the collection is locked, a Write or Delete may have won
+		d.cache.mu.Lock()
+		item, ok := d.cache.dirty[key]
+		d.cache.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		dir := d.recordDir(collection, item.rec.name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := d.writeRecordFile(collection, item.rec.name, item.rec.raw); err != nil {
+			return err
+		}
+		d.cache.markClean(key, item.rec)
+
+		// the index entry was made with no mtime, give it the real one
+		if err := d.reindex(collection, item.rec.name, item.rec.raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bufferWrite tells the flusher to flush now once Options.WriteBuffer records are
+// waiting for it
+func (d *Driver) bufferWrite() {
+	if d.writeBuffer <= 0 || d.cache.dirtyLen() < d.writeBuffer {
+		return
+	}
+	select {
+	case d.flushNow <- struct{}{}:
+	default: // it's told already
+	}
+}
+
+func (d *Driver) startFlusher(interval time.Duration) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+			case <-d.flushNow:
+			}
+			start := time.Now()
+			err := d.Flush()
+			if err != nil {
+				d.logf(LevelError, "Write back flush failed", "operation", "flush", "duration", time.Since(start), "error", err)
+			}
+			d.background.set("write back flush", err)
+		}
+	}()
+}
+
+func checkCacheOptions(opts Options) error {
+	if opts.WriteBuffer > 0 && opts.CacheMode != WriteInvalidate && opts.CacheMode != WriteBack {
+		return fmt.Errorf("a WriteBuffer is cache mode WriteBack, not %d", opts.CacheMode)
+	}
+	if opts.CacheMode != WriteInvalidate && opts.CacheSize <= 0 && opts.WriteBuffer <= 0 {
+		return fmt.Errorf("cache mode %d needs a CacheSize", opts.CacheMode)
+	}
+	return nil
+}
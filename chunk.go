@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// a record over Options.ChunkSize is split into users/john.chunks/<gen>/000000, 000001,
+// ... and users/john.json only holds a manifest pointing at them. The manifest starts
+// with chunkMagic, which no JSON document does, so it can't be mistaken for a record.
+const (
+	chunkMagic  = "#chunks "
+	chunkSuffix = ".chunks"
+)
+
+type chunkManifest struct {
+	Gen   string `json:"gen"`
+	Count int    `json:"count"`
+	Size  int64  `json:"size"`
+	Sum   string `json:"sum,omitempty"` // SHA-256 of the record, hex, none before it was added
+}
+
+// errChecksum is what reading chunks that don't add up to the Sum of their
+// manifest fails with, an ErrCorrupted corrupted passes on as it is
+var errChecksum = fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+
+func (d *Driver) chunkDir(collection, resource string) string {
+	return filepath.Join(d.recordDir(collection, resource), d.keyFile(resource)+chunkSuffix)
+}
+
+func isChunked(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(chunkMagic))
+}
+
+func parseManifest(b []byte) (chunkManifest, error) {
+	var m chunkManifest
+	if err := json.Unmarshal(b[len(chunkMagic):], &m); err != nil {
+		return m, fmt.Errorf("invalid chunk manifest: %v", err)
+	}
+	return m, nil
+}
+
+// writeRecordFile puts an encoded record on disk, in chunks when it's too big for
+// one file. The collection has to be locked.
+func (d *Driver) writeRecordFile(collection, resource string, b []byte) error {
+	if d.lsm != nil {
+		if err := d.lsm.put(cacheKey(collection, resource), b); err != nil {
+			return err
+		}
+		return d.syncWritten(collection, d.lsm.walPath())
+	}
+	if d.chunkSize > 0 && int64(len(b)) > d.chunkSize {
+		return d.writeChunks(collection, resource, bytes.NewReader(b), int64(len(b)))
+	}
+
+	path := d.recordPath(collection, resource)
+	write := writeAtomic
+	if d.durable {
+		write = writeSynced
+	}
+	if err := d.withRetry(func() error { return write(path, b) }); err != nil {
+		return err
+	}
+	if err := d.syncWritten(collection, path); err != nil {
+		return err
+	}
+	return d.dropOldChunks(collection, resource, "")
+}
+
+// writeChunks writes size bytes of r as a new generation of chunks and only then
+// swaps the manifest in, so readers see either the old or the new record
+func (d *Driver) writeChunks(collection, resource string, r io.Reader, size int64) error {
+	m := chunkManifest{Gen: strconv.FormatInt(time.Now().UnixNano(), 36), Size: size}
+	dir := filepath.Join(d.chunkDir(collection, resource), m.Gen)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	sum := sha256.New()
+	r = io.TeeReader(r, sum)
+	written := []string{dir} // its own entry is in the chunk directory
+	for left := size; left > 0; left -= d.chunkSize {
+		n := d.chunkSize
+		if left < n {
+			n = left
+		}
+		chunk := filepath.Join(dir, fmt.Sprintf("%06d", m.Count))
+		if err := writeChunk(chunk, r, n); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		written = append(written, chunk)
+		m.Count++
+	}
+	m.Sum = hex.EncodeToString(sum.Sum(nil))
+
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	manifest = append([]byte(chunkMagic), append(manifest, '\n')...)
+	path := d.recordPath(collection, resource)
+	write := writeAtomic
+	if d.durable {
+		// the manifest mustn't be in place, after a crash, without its chunks
+		if err := syncFiles(written); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		write = writeSynced
+	}
+	if err := write(path, manifest); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := d.syncWritten(collection, path); err != nil {
+		return err
+	}
+	return d.dropOldChunks(collection, resource, m.Gen)
+}
+
+func writeChunk(path string, r io.Reader, n int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, r, n)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// dropOldChunks drops the generations of chunks of a record but keep, all of them if
+// keep is empty, once what replaced them is durable: until the write is synced a
+// crash may bring back the manifest pointing at them. The collection has to be
+// locked.
+func (d *Driver) dropOldChunks(collection, resource, keep string) error {
+	dir := d.chunkDir(collection, resource)
+	gens, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// those there now, newer ones may be written before they're dropped
+	var old []string
+	for _, gen := range gens {
+		if gen.Name() != keep {
+			old = append(old, filepath.Join(dir, gen.Name()))
+		}
+	}
+	return d.afterCommit(collection, func() error {
+		for _, gen := range old {
+			if err := os.RemoveAll(gen); err != nil {
+				return err
+			}
+		}
+		if keep == "" {
+			os.Remove(dir) // unless the record was split up again meanwhile
+		}
+		return nil
+	})
+}
+
+// readRecordInto reads a record file into buf, putting the chunks of a chunked record
+// back together
+func (d *Driver) readRecordInto(buf *bytes.Buffer, collection, resource string) error {
+	if d.lsm != nil {
+		return d.lsmRecordInto(buf, collection, resource)
+	}
+	path := d.recordPath(collection, resource)
+
+	for attempt := 0; ; attempt++ {
+		err := d.withRetry(func() error {
+			buf.Reset() // whatever a failed read left
+			return readFileInto(buf, path)
+		})
+		if err != nil {
+			return err
+		}
+		if !isChunked(buf.Bytes()) {
+			return nil
+		}
+
+		err = d.readChunks(buf, collection, resource)
+		// reads don't lock the collection, a Write may have replaced the chunks since
+		// the manifest was read, so read it again
+		if os.IsNotExist(err) && attempt < 3 {
+			buf.Reset()
+			continue
+		}
+		if err != nil {
+			d.corrupt(collection, resource, path, err)
+			return &RecordError{Op: "read", Collection: collection, Resource: resource, Err: corrupted(err)}
+		}
+		return nil
+	}
+}
+
+// readChunks replaces the manifest in buf with the chunks it points at
+func (d *Driver) readChunks(buf *bytes.Buffer, collection, resource string) error {
+	m, err := parseManifest(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(d.chunkDir(collection, resource), m.Gen)
+	buf.Reset()
+	buf.Grow(int(m.Size))
+	for i := 0; i < m.Count; i++ {
+		if err := readChunkInto(buf, filepath.Join(dir, fmt.Sprintf("%06d", i))); err != nil {
+			return err
+		}
+	}
+	if int64(buf.Len()) != m.Size {
+		return fmt.Errorf("chunks of %v/%v hold %d bytes, the manifest says %d", collection, resource, buf.Len(), m.Size)
+	}
+	if m.Sum != "" {
+		if sum := sha256.Sum256(buf.Bytes()); hex.EncodeToString(sum[:]) != m.Sum {
+			return fmt.Errorf("chunks of %v/%v: %w", collection, resource, errChecksum)
+		}
+	}
+	return nil
+}
+
+func readChunkInto(buf *bytes.Buffer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = buf.ReadFrom(f)
+	return err
+}
+
+// openChunks opens every chunk of a record up front, so a Write replacing them can't
+// pull them away from under the stream
+func (d *Driver) openChunks(collection, resource string, manifest []byte) (io.ReadCloser, error) {
+	m, err := parseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(d.chunkDir(collection, resource), m.Gen)
+	c := &chunkReader{files: make([]*os.File, 0, m.Count)}
+	for i := 0; i < m.Count; i++ {
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%06d", i)))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.files = append(c.files, f)
+	}
+	return c, nil
+}
+
+// chunkReader reads the chunk files one after the other
+type chunkReader struct {
+	files []*os.File
+	next  int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for c.next < len(c.files) {
+		n, err := c.files[c.next].Read(p)
+		if err == io.EOF {
+			c.next++
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+	return 0, io.EOF
+}
+
+func (c *chunkReader) Close() error {
+	var err error
+	for _, f := range c.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// where the vector clocks of records live with Options.VectorClocks, one file per
+// record. Deleted records keep theirs.
+const clockDir = "_clock"
+
+// VectorClock counts the writes of a record per node that made them, by nodeID.
+// Of two versions of a record, the one whose clock descends the other's was written
+// knowing about it; when neither does, they were written concurrently.
+type VectorClock map[string]uint64
+
+// Descends reports whether c has seen every write o has
+func (c VectorClock) Descends(o VectorClock) bool {
+	for node, n := range o {
+		if c[node] < n {
+			return false
+		}
+	}
+	return true
+}
+
+// Concurrent reports whether c and o were written without knowing about each other
+func (c VectorClock) Concurrent(o VectorClock) bool {
+	return !c.Descends(o) && !o.Descends(c)
+}
+
+// mergeClocks returns the clock that has seen the writes of both, nil if neither
+// has any
+func mergeClocks(a, b VectorClock) VectorClock {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	m := VectorClock{}
+	for node, n := range a {
+		m[node] = n
+	}
+	for node, n := range b {
+		if n > m[node] {
+			m[node] = n
+		}
+	}
+	return m
+}
+
+// causal picks the version of two that was written knowing about the other, if
+// their clocks tell
+func causal(our, their syncSide) (syncSide, bool) {
+	if len(our.clock) == 0 || len(their.clock) == 0 || our.clock.Concurrent(their.clock) {
+		return syncSide{}, false
+	}
+	if our.clock.Descends(their.clock) {
+		return our, true
+	}
+	return their, true
+}
+
+// settledClock works out the clock of the version a sync settled on: one that has
+// seen both sides, plus a write of the Driver's own if the version is a merge
+func (d *Driver) settledClock(our, their, winner syncSide) (VectorClock, error) {
+	if !d.vclocks {
+		return nil, nil
+	}
+	c := mergeClocks(our.clock, their.clock)
+	if winner.hash == our.hash || winner.hash == their.hash {
+		return c, nil
+	}
+	node, err := d.nodeID()
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		c = VectorClock{}
+	}
+	c[node]++
+	return c, nil
+}
+
+// Clock returns the vector clock of a record, deleted or not, nil for a record
+// written before Options.VectorClocks was set or without it
+func (d *Driver) Clock(collection, resource string) (VectorClock, error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return nil, err
+	}
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	return d.readClock(collection, resource)
+}
+
+func (d *Driver) clockPath(collection, resource string) string {
+	return filepath.Join(d.dir, clockDir, collection, d.recordFile(resource))
+}
+
+func (d *Driver) readClock(collection, resource string) (VectorClock, error) {
+	b, err := ioutil.ReadFile(d.clockPath(collection, resource))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c VectorClock
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid vector clock of %v/%v: %v", collection, resource, err)
+	}
+	return c, nil
+}
+
+func (d *Driver) writeClock(collection, resource string, c VectorClock) error {
+	path := d.clockPath(collection, resource)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, b)
+}
+
+// tickClock counts a write or delete of the Driver's own. The collection has to be
+// locked.
+func (d *Driver) tickClock(collection, resource string) error {
+	node, err := d.nodeID()
+	if err != nil {
+		return err
+	}
+	c, err := d.readClock(collection, resource)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		c = VectorClock{}
+	}
+	c[node]++
+	return d.writeClock(collection, resource, c)
+}
+
+// takeClock puts the clock of a version applied from elsewhere over the tick
+// storeRecord or removeRecord made. The collection has to be locked.
+func (d *Driver) takeClock(collection, resource string, c VectorClock) error {
+	if !d.vclocks || c == nil {
+		return nil
+	}
+	return d.writeClock(collection, resource, c)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commitBatch is the record files written to a collection within one group commit
+// window, synced together
+type commitBatch struct {
+	files map[string]bool
+	after []func() error // run once synced, see afterCommit
+	done  chan struct{}  // closed once synced
+	err   error
+}
+
+// commitGroup gathers the writes to a collection for Options.GroupCommit
+type commitGroup struct {
+	syncing sync.Mutex // one batch at a time, in order
+
+	mu       sync.Mutex // guards the fields below
+	open     *commitBatch
+	inflight *commitBatch // being synced
+}
+
+// syncWritten makes record files just put in place durable with Options.Durable:
+// right away, or in the group commit of their collection for the writer to wait for
+// with awaitCommit once it unlocked the collection.
+func (d *Driver) syncWritten(collection string, paths ...string) error {
+	if !d.durable {
+		return nil
+	}
+	if d.groupCommit <= 0 {
+		return syncFiles(paths)
+	}
+
+	g := d.commitGroupOf(collection)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.open == nil {
+		g.open = &commitBatch{files: make(map[string]bool), done: make(chan struct{})}
+		time.AfterFunc(d.groupCommit, func() { d.commit(g) })
+	}
+	for _, p := range paths {
+		g.open.files[p] = true
+	}
+	return nil
+}
+
+// afterCommit runs fn, with collection locked, once the writes to it so far are
+// durable: right away unless they wait for a group commit, after it otherwise. It's
+// for cleaning up what the records replaced, which a crash before the sync could
+// bring back. The collection has to be locked.
+func (d *Driver) afterCommit(collection string, fn func() error) error {
+	if !d.durable || d.groupCommit <= 0 {
+		return fn()
+	}
+
+	g := d.commitGroupOf(collection)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.open == nil {
+		return fn() // nothing waiting, what's written is synced
+	}
+	g.open.after = append(g.open.after, func() error {
+		mutex := d.lockFor(collection)
+		mutex.Lock()
+		defer mutex.Unlock()
+		return fn()
+	})
+	return nil
+}
+
+// awaitCommit waits for the group commit of the writes to collection so far, for
+// the writers that queued theirs with syncWritten
+func (d *Driver) awaitCommit(collection string) error {
+	return d.queuedCommit(collection).wait()
+}
+
+// queuedCommit is the batch syncing the writes to collection so far, nil if
+// they're synced already
+func (d *Driver) queuedCommit(collection string) *commitBatch {
+	if !d.durable || d.groupCommit <= 0 {
+		return nil
+	}
+	g := d.commitGroupOf(collection)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// the open batch has every write queued since the one being synced was taken
+	if g.open != nil {
+		return g.open
+	}
+	return g.inflight
+}
+
+// wait waits for the batch to be synced, nothing for a nil batch
+func (b *commitBatch) wait() error {
+	if b == nil {
+		return nil
+	}
+	<-b.done
+	return b.err
+}
+
+// commitGroupOf is the group of collection, shared by the partitions of a
+// partitioned one, which its writes lock as a whole
+func (d *Driver) commitGroupOf(collection string) *commitGroup {
+	if i := strings.LastIndex(collection, "/"); i > 0 {
+		if _, ok := d.partitions[collection[:i]]; ok {
+			collection = collection[:i]
+		}
+	}
+
+	d.commitMu.Lock()
+	defer d.commitMu.Unlock()
+	g, ok := d.commits[collection]
+	if !ok {
+		g = &commitGroup{}
+		d.commits[collection] = g
+	}
+	return g
+}
+
+// commit syncs the open batch of g
+func (d *Driver) commit(g *commitGroup) {
+	g.syncing.Lock()
+	defer g.syncing.Unlock()
+
+	g.mu.Lock()
+	b := g.open
+	g.open, g.inflight = nil, b
+	g.mu.Unlock()
+	if b == nil {
+		return
+	}
+
+	paths := make([]string, 0, len(b.files))
+	for p := range b.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	start := time.Now()
+	b.err = syncFiles(paths)
+	if b.err != nil {
+		d.logf(LevelError, "Group commit failed", "operation", "commit", "files", len(paths), "error", b.err)
+	} else {
+		d.logf(LevelTrace, "Group commit", "operation", "commit", "files", len(paths), "duration", time.Since(start))
+	}
+
+	g.mu.Lock()
+	g.inflight = nil
+	g.mu.Unlock()
+	close(b.done)
+
+	// after the writers were let go, which may wait for it holding collection locks
+	if b.err != nil {
+		return // left behind rather than lost with what replaced it
+	}
+	for _, fn := range b.after {
+		if err := fn(); err != nil {
+			d.logf(LevelError, "Cleanup after group commit failed", "operation", "commit", "error", err)
+		}
+	}
+}
+
+// commitAll syncs the open batches of every collection now, for Shutdown
+func (d *Driver) commitAll() error {
+	d.commitMu.Lock()
+	groups := make([]*commitGroup, 0, len(d.commits))
+	for _, g := range d.commits {
+		groups = append(groups, g)
+	}
+	d.commitMu.Unlock()
+
+	var firstErr error
+	for _, g := range groups {
+		g.mu.Lock()
+		b := g.open
+		g.mu.Unlock()
+		if b == nil {
+			continue
+		}
+		d.commit(g)
+		if b.err != nil && firstErr == nil {
+			firstErr = b.err
+		}
+	}
+	return firstErr
+}
+
+// syncFiles fsyncs files, or directories, and then once each the directories they
+// were renamed or made in. Paths removed meanwhile are skipped.
+func syncFiles(paths []string) error {
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		if err := syncPath(p); err != nil {
+			return err
+		}
+		dirs[filepath.Dir(p)] = true
+	}
+	for dir := range dirs {
+		if err := syncPath(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncPath(path string) error {
+	flag := os.O_RDONLY
+	if runtime.GOOS == "windows" {
+		// directories can't be opened there, renames are durable once they return,
+		// and files have to be opened for writing to be flushed
+		if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+			return nil
+		}
+		flag = os.O_WRONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// CompactionPolicy moves the compaction of index logs, the files every change of an
+// index is appended to until they're rewritten as a snapshot, off the writes that
+// would trigger it to a background worker. Without one, see Options.Compaction, the
+// write appending past the threshold compacts the log itself while holding the
+// index lock.
+type CompactionPolicy struct {
+	// a log is compacted once more than SizeRatio times as many changes were
+	// appended to it as its index has records, and more than MinEntries. 1 and
+	// 1000 if zero, the threshold of writes without a policy.
+	SizeRatio  float64
+	MinEntries int
+
+	// how often the worker looks for logs over the ratio, 10 seconds if zero
+	Interval time.Duration
+
+	// local time of day, e.g. "03:00", to compact every log with changes appended
+	// whatever their ratio, for databases with quiet hours. None if empty.
+	DailyAt string
+
+	// how long the worker waits after compacting a log before the next one, so the
+	// writes held up by one compaction (it locks the index for as long as it
+	// rewrites the file) get through before another. 100ms if zero.
+	Pause time.Duration
+}
+
+// compactor is a CompactionPolicy with the defaults filled in
+type compactor struct {
+	CompactionPolicy
+	daily time.Duration // of DailyAt after midnight, < 0 for none
+}
+
+func newCompactor(p CompactionPolicy) (*compactor, error) {
+	if p.SizeRatio <= 0 {
+		p.SizeRatio = 1
+	}
+	if p.MinEntries <= 0 {
+		p.MinEntries = 1000
+	}
+	if p.Interval <= 0 {
+		p.Interval = 10 * time.Second
+	}
+	if p.Pause <= 0 {
+		p.Pause = 100 * time.Millisecond
+	}
+	c := &compactor{CompactionPolicy: p, daily: -1}
+	if p.DailyAt != "" {
+		t, err := time.Parse("15:04", p.DailyAt)
+		if err != nil {
+			return nil, fmt.Errorf("compaction DailyAt %q isn't a time of day like 03:00", p.DailyAt)
+		}
+		c.daily = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return c, nil
+}
+
+// threshold is how many changes a log of an index with that many records takes
+// before it's compacted
+func (c *compactor) threshold(entries int) int {
+	if c == nil {
+		c = &compactor{CompactionPolicy: CompactionPolicy{SizeRatio: 1, MinEntries: 1000}}
+	}
+	if limit := int(c.SizeRatio * float64(entries)); limit > c.MinEntries {
+		return limit
+	}
+	return c.MinEntries
+}
+
+// nextDaily is the first DailyAt after now
+func (c *compactor) nextDaily(now time.Time) time.Time {
+	y, m, day := now.Date()
+	next := time.Date(y, m, day, 0, 0, 0, 0, now.Location()).Add(c.daily)
+	if !next.After(now) {
+		next = time.Date(y, m, day+1, 0, 0, 0, 0, now.Location()).Add(c.daily)
+	}
+	return next
+}
+
+// startCompactor runs the worker of Options.Compaction
+func (d *Driver) startCompactor() {
+	c := d.compactor
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+		var daily <-chan time.Time
+		if c.daily >= 0 {
+			daily = time.After(time.Until(c.nextDaily(time.Now())))
+		}
+		for {
+			all := false
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+			case <-daily:
+				all = true
+				daily = time.After(time.Until(c.nextDaily(time.Now())))
+			}
+			start := time.Now()
+			n, err := d.compactIndexes(all, c.Pause)
+			if err != nil {
+				d.logf(LevelError, "Index compaction failed", "operation", "compact", "duration", time.Since(start), "error", err)
+			} else if n > 0 {
+				d.logf(LevelDebug, "Compacted indexes", "operation", "compact", "indexes", n, "duration", time.Since(start))
+			}
+			d.background.set("index compaction", err)
+		}
+	}()
+}
+
+// Compact rewrites the log of every index with changes appended since its last
+// snapshot right away, whatever Options.Compaction says, e.g. before a backup or
+// after a bulk load.
+func (d *Driver) Compact() error {
+	_, err := d.compactIndexes(true, 0)
+	return err
+}
+
+// compactIndexes compacts the logs over the threshold, or all with changes, pausing
+// between them. It returns how many it compacted.
+func (d *Driver) compactIndexes(all bool, pause time.Duration) (int, error) {
+	d.imu.RLock()
+	var indexes []*index
+	for _, byField := range d.indexes {
+		for _, ix := range byField {
+			indexes = append(indexes, ix)
+		}
+	}
+	d.imu.RUnlock()
+
+	compacted := 0
+	for _, ix := range indexes {
+		ix.mu.RLock()
+		pending, entries := ix.pending, len(ix.entries)
+		if ix.file != nil {
+			// dead pages against the live ones for a B-tree or hash index
+			pending, entries = ix.file.waste()
+		}
+		ix.mu.RUnlock()
+		if pending == 0 || !all && pending <= d.compactor.threshold(entries) {
+			continue
+		}
+
+		if compacted > 0 && pause > 0 {
+			select {
+			case <-d.done:
+				return compacted, nil
+			case <-time.After(pause):
+			}
+		}
+		if err := ix.compact(); err != nil {
+			return compacted, fmt.Errorf("compacting index %v(%v): %w", ix.collection, indexName(ix.fields), err)
+		}
+		compacted++
+	}
+	return compacted, nil
+}
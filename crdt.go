@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// where the field timestamps of CRDT collections live, one file per record
+const crdtDir = "_crdt"
+
+// where a Driver without Options.NodeID keeps the ID it made up for itself
+const nodeIDFile = "_node"
+
+// crdtStamp orders writes across nodes: by time, then by node for writes in the
+// same nanosecond
+type crdtStamp struct {
+	TS   int64  `json:"ts"`
+	Node string `json:"node"`
+}
+
+func (s crdtStamp) after(o crdtStamp) bool {
+	return s.TS > o.TS || s.TS == o.TS && s.Node > o.Node
+}
+
+// crdtField is the last write of a top level field
+type crdtField struct {
+	crdtStamp
+	Removed bool `json:"removed,omitempty"`
+}
+
+// crdtMeta is the state of a record of a CRDT collection: a last-writer-wins
+// register per field, plus the last delete of the whole record. Fields written
+// before that delete are gone.
+type crdtMeta struct {
+	Fields  map[string]crdtField `json:"fields"`
+	Deleted *crdtStamp           `json:"deleted,omitempty"`
+}
+
+// nodeID names this Driver in CRDT stamps and vector clocks: Options.NodeID, or a
+// random ID made up once and kept in the database directory
+func (d *Driver) nodeID() (string, error) {
+	d.nodeOnce.Do(func() {
+		if d.node != "" {
+			return
+		}
+		path := filepath.Join(d.dir, nodeIDFile)
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			d.node = strings.TrimSpace(string(b))
+			return
+		}
+		if !os.IsNotExist(err) {
+			d.nodeErr = err
+			return
+		}
+		id := make([]byte, 8)
+		rand.Read(id)
+		d.node = hex.EncodeToString(id)
+		d.nodeErr = writeAtomic(path, []byte(d.node+"\n"))
+	})
+	return d.node, d.nodeErr
+}
+
+func (d *Driver) isCRDT(collection string) bool {
+	return d.crdtCollections[collection]
+}
+
+// crdtNow returns a stamp later than every stamp this Driver has made or merged,
+// even if the wall clock goes back
+func (d *Driver) crdtNow() (crdtStamp, error) {
+	node, err := d.nodeID()
+	if err != nil {
+		return crdtStamp{}, err
+	}
+	d.crdtMu.Lock()
+	defer d.crdtMu.Unlock()
+	ts := time.Now().UnixNano()
+	if ts <= d.crdtClock {
+		ts = d.crdtClock + 1
+	}
+	d.crdtClock = ts
+	return crdtStamp{TS: ts, Node: node}, nil
+}
+
+// crdtWitness moves the clock past a merged stamp, so later local writes win over it
+func (d *Driver) crdtWitness(s crdtStamp) {
+	d.crdtMu.Lock()
+	defer d.crdtMu.Unlock()
+	if s.TS > d.crdtClock {
+		d.crdtClock = s.TS
+	}
+}
+
+func (d *Driver) crdtPath(collection, resource string) string {
+	return filepath.Join(d.dir, crdtDir, collection, d.recordFile(resource))
+}
+
+func (d *Driver) readCRDTMeta(collection, resource string) (*crdtMeta, error) {
+	m := &crdtMeta{Fields: map[string]crdtField{}}
+	b, err := ioutil.ReadFile(d.crdtPath(collection, resource))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid CRDT state of %v/%v: %v", collection, resource, err)
+	}
+	if m.Fields == nil {
+		m.Fields = map[string]crdtField{}
+	}
+	return m, nil
+}
+
+func (d *Driver) writeCRDTMeta(collection, resource string, m *crdtMeta) error {
+	path := d.crdtPath(collection, resource)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, b)
+}
+
+// crdtFields splits a record of a CRDT collection into its top level fields
+func crdtFields(collection, resource string, b []byte) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("records of CRDT collection %v must be JSON objects, %v isn't", collection, resource)
+	}
+	return fields, nil
+}
+
+// stampWrite works out the state of a record about to be written: the fields that
+// changed or went away since the stored version get a new stamp. The collection has
+// to be locked.
+func (d *Driver) stampWrite(collection, resource string, b []byte) (*crdtMeta, error) {
+	fields, err := crdtFields(collection, resource, b)
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.readCRDTMeta(collection, resource)
+	if err != nil {
+		return nil, err
+	}
+	now, err := d.crdtNow()
+	if err != nil {
+		return nil, err
+	}
+
+	old := map[string]json.RawMessage{}
+	if r, err := d.loadRecord(collection, resource); err == nil {
+		old, _ = crdtFields(collection, resource, r.raw)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for name, v := range fields {
+		prev, ok := old[name]
+		if _, stamped := m.Fields[name]; !ok || !stamped || !jsonEqual(prev, v) {
+			m.Fields[name] = crdtField{crdtStamp: now}
+		}
+	}
+	for name := range old {
+		if _, ok := fields[name]; !ok {
+			m.Fields[name] = crdtField{crdtStamp: now, Removed: true}
+		}
+	}
+	return m, nil
+}
+
+// stampDelete records the delete of a record. The collection has to be locked.
+func (d *Driver) stampDelete(collection, resource string) error {
+	m, err := d.readCRDTMeta(collection, resource)
+	if err != nil {
+		return err
+	}
+	now, err := d.crdtNow()
+	if err != nil {
+		return err
+	}
+	m.Deleted = &now
+	return d.writeCRDTMeta(collection, resource, m)
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// MergeCRDT merges the CRDT collections of other into the Driver: per field the
+// later write wins, and a delete removes the fields written before it. Merging is
+// deterministic, so after a.MergeCRDT(b) and b.MergeCRDT(a) both hold the same
+// records however they were written while apart. It returns how many records
+// changed.
+func (d *Driver) MergeCRDT(other *Driver) (int, error) {
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+
+	var collections []string
+	for collection := range d.crdtCollections {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	changed := 0
+	for _, collection := range collections {
+		n, err := d.mergeCRDTCollection(other, collection)
+		changed += n
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+func (d *Driver) mergeCRDTCollection(other *Driver, collection string) (int, error) {
+	names, err := other.crdtResources(collection)
+	if err != nil {
+		return 0, err
+	}
+	records, err := other.listRecords(collection)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		seen[name] = true
+	}
+	for _, name := range records {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	changed := 0
+	for _, name := range names {
+		ok, err := d.mergeCRDTRecord(other, collection, name)
+		if err != nil {
+			return changed, err
+		}
+		if ok {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// crdtResources lists the records of a CRDT collection that have a state, deleted
+// ones included
+func (d *Driver) crdtResources(collection string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(d.dir, crdtDir, collection))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if name, ok := d.recordName(file.Name()); ok && !file.IsDir() {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// crdtRecord reads the fields and state of a record, fields of a deleted one are empty
+func (d *Driver) crdtRecord(collection, resource string) (map[string]json.RawMessage, *crdtMeta, error) {
+	m, err := d.readCRDTMeta(collection, resource)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	r, err := d.loadRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return fields, m, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if fields, err = crdtFields(collection, resource, r.raw); err != nil {
+		return nil, nil, err
+	}
+	for name := range fields {
+		if _, ok := m.Fields[name]; !ok {
+			// written before the collection was a CRDT one, any stamped write wins
+			m.Fields[name] = crdtField{}
+		}
+	}
+	return fields, m, nil
+}
+
+// mergeCRDTRecord merges one record of other in. The collection has to be locked.
+func (d *Driver) mergeCRDTRecord(other *Driver, collection, resource string) (bool, error) {
+	theirFields, theirs, err := other.crdtRecord(collection, resource)
+	if err != nil {
+		return false, err
+	}
+	ourFields, ours, err := d.crdtRecord(collection, resource)
+	if err != nil {
+		return false, err
+	}
+
+	merged := &crdtMeta{Fields: map[string]crdtField{}, Deleted: ours.Deleted}
+	if theirs.Deleted != nil && (merged.Deleted == nil || theirs.Deleted.after(*merged.Deleted)) {
+		merged.Deleted = theirs.Deleted
+	}
+	fields := map[string]json.RawMessage{}
+	for name, f := range ours.Fields {
+		merged.Fields[name] = f
+		if v, ok := ourFields[name]; ok {
+			fields[name] = v
+		}
+	}
+	for name, f := range theirs.Fields {
+		if mine, ok := merged.Fields[name]; ok && !f.after(mine.crdtStamp) {
+			continue
+		}
+		merged.Fields[name] = f
+		delete(fields, name)
+		if v, ok := theirFields[name]; ok {
+			fields[name] = v
+		}
+	}
+
+	// what's left: fields that weren't removed and were written after the last delete
+	alive := map[string]json.RawMessage{}
+	for name, f := range merged.Fields {
+		d.crdtWitness(f.crdtStamp)
+		if f.Removed || merged.Deleted != nil && !f.after(*merged.Deleted) {
+			continue
+		}
+		if v, ok := fields[name]; ok {
+			alive[name] = v
+		}
+	}
+	if merged.Deleted != nil {
+		d.crdtWitness(*merged.Deleted)
+	}
+
+	same := len(alive) == len(ourFields)
+	for name, v := range alive {
+		if !same || !jsonEqual(ourFields[name], v) {
+			same = false
+			break
+		}
+	}
+	if same {
+		// the records agree, though the stamps may still be news
+		return false, d.writeCRDTMeta(collection, resource, merged)
+	}
+
+	if len(alive) == 0 {
+		if _, err := d.removeRecord(collection, resource); err != nil {
+			return false, err
+		}
+	} else {
+		if err := os.MkdirAll(d.recordDir(collection, resource), 0755); err != nil {
+			return false, err
+		}
+		b, err := json.MarshalIndent(alive, "", "\t")
+		if err != nil {
+			return false, err
+		}
+		if err := d.storeRecord(collection, resource, append(b, '\n')); err != nil {
+			return false, err
+		}
+	}
+	// over the stamps storeRecord and removeRecord made
+	return true, d.writeCRDTMeta(collection, resource, merged)
+}
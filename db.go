@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DB is the read and write methods of Driver, for code that should take a Driver, a
+// Router or, in unit tests, a MemDB
+type DB interface {
+	Write(collection, resource string, v interface{}) error
+	WriteStream(collection, resource string, rd io.Reader) error
+	Delete(collection, resource string) error
+	DeleteIf(collection, resource, expectedVersion string) error
+	DeleteWhere(collection string, filter Filter) (int, error)
+	UpdateWhere(collection string, filter Filter, patch interface{}) (int, error)
+
+	Read(collection, resource string, v interface{}, opts ...QueryOption) error
+	ReadVersion(collection, resource string, v interface{}, opts ...QueryOption) (string, error)
+	ReadPath(collection, resource, path string, v interface{}, opts ...QueryOption) error
+	ReadStream(collection, resource string, opts ...QueryOption) (io.ReadCloser, error)
+	ReadInto(collection, resource string, buf []byte, opts ...QueryOption) ([]byte, error)
+	ReadMany(collection string, keys []string, dest interface{}, opts ...QueryOption) ([]string, error)
+	ReadAll(collection string, opts ...QueryOption) ([]string, error)
+	ReadAllRaw(collection string, opts ...QueryOption) ([]json.RawMessage, error)
+	ReadRange(collection, startKey, endKey string, opts ...QueryOption) ([]string, error)
+	List(collection, prefix string, opts ...QueryOption) ([]string, error)
+	Glob(collection, pattern string, opts ...QueryOption) ([]string, error)
+	Exists(collection, resource string) bool
+	Find(collection string, filter Filter, opts ...QueryOption) ([]string, error)
+	FindRaw(collection string, filter Filter, opts ...QueryOption) ([]json.RawMessage, error)
+	FindOne(collection string, filter Filter, v interface{}, opts ...QueryOption) error
+	Query(sql string) ([]string, error)
+
+	WriteContext(ctx context.Context, collection, resource string, v interface{}) error
+	DeleteContext(ctx context.Context, collection, resource string) error
+	ReadContext(ctx context.Context, collection, resource string, v interface{}, opts ...QueryOption) error
+	ReadAllContext(ctx context.Context, collection string, opts ...QueryOption) ([]string, error)
+	FindContext(ctx context.Context, collection string, filter Filter, opts ...QueryOption) ([]string, error)
+}
+
+var (
+	_ DB = (*Driver)(nil)
+	_ DB = (*Router)(nil)
+	_ DB = (*MemDB)(nil)
+)
+
+// MemDB is a DB kept in memory, a fake for unit tests of code taking a DB. Records,
+// filters, OrderBy, Select, merge patches and SQL queries behave as with a Driver,
+// and missing records and collections give the same errors. Indexes, schemas,
+// redaction and the other Options don't apply.
+type MemDB struct {
+	// called before every operation when set, the method name as op, and returned
+	// instead when not nil, to test how code copes with failures
+	Err func(op, collection, resource string) error
+
+	mu          sync.RWMutex
+	collections map[string]map[string][]byte
+}
+
+// NewMemDB returns an empty MemDB
+func NewMemDB() *MemDB {
+	return &MemDB{collections: map[string]map[string][]byte{}}
+}
+
+func (m *MemDB) fail(op, collection, resource string) error {
+	if m.Err == nil {
+		return nil
+	}
+	return m.Err(op, collection, resource)
+}
+
+func (m *MemDB) Write(collection, resource string, v interface{}) error {
+	if err := m.fail("Write", collection, resource); err != nil {
+		return err
+	}
+	if collection == "" {
+		return fmt.Errorf("%w - no place to save record!", ErrEmptyCollection)
+	}
+	if resource == "" {
+		return fmt.Errorf("%w - unable to save record (no name)!", ErrEmptyResource)
+	}
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	m.store(collection, resource, append(b, byte('\n')))
+	return nil
+}
+
+func (m *MemDB) WriteStream(collection, resource string, rd io.Reader) error {
+	if err := m.fail("WriteStream", collection, resource); err != nil {
+		return err
+	}
+	if collection == "" || resource == "" {
+		return missingName(collection, "unable to save record")
+	}
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(b) {
+		return fmt.Errorf("record %v/%v isn't valid JSON", collection, resource)
+	}
+	m.store(collection, resource, b)
+	return nil
+}
+
+func (m *MemDB) store(collection, resource string, b []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.collections[collection] == nil {
+		m.collections[collection] = map[string][]byte{}
+	}
+	m.collections[collection][resource] = b
+}
+
+// Delete removes a record, or a collection with its subcollections for an empty
+// resource
+func (m *MemDB) Delete(collection, resource string) error {
+	if err := m.fail("Delete", collection, resource); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := strings.TrimSuffix(collection+"/"+resource, "/")
+	if resource != "" {
+		if _, ok := m.collections[collection][resource]; !ok {
+			return notFound("delete", collection, resource, notExist(path))
+		}
+		delete(m.collections[collection], resource)
+		return nil
+	}
+	if _, ok := m.collections[collection]; !ok {
+		return notFound("delete", collection, resource, notExist(path))
+	}
+	for c := range m.collections {
+		if c == collection || strings.HasPrefix(c, collection+"/") {
+			delete(m.collections, c)
+		}
+	}
+	return nil
+}
+
+func (m *MemDB) DeleteIf(collection, resource, expectedVersion string) error {
+	if err := m.fail("DeleteIf", collection, resource); err != nil {
+		return err
+	}
+	if collection == "" {
+		return fmt.Errorf("%w - unable to delete!", ErrEmptyCollection)
+	}
+	if resource == "" {
+		return fmt.Errorf("%w - unable to delete record!", ErrEmptyResource)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.collections[collection][resource]
+	if !ok {
+		return notFound("delete", collection, resource, notExist(collection+"/"+resource))
+	}
+	if current := recordVersion(b); current != expectedVersion {
+		return &RecordError{Op: "delete", Collection: collection, Resource: resource,
+			Err: fmt.Errorf("%w: at %v, not %v", ErrVersionMismatch, current, expectedVersion)}
+	}
+	delete(m.collections[collection], resource)
+	return nil
+}
+
+func (m *MemDB) DeleteWhere(collection string, filter Filter) (int, error) {
+	if err := m.fail("DeleteWhere", collection, ""); err != nil {
+		return 0, err
+	}
+	records, err := m.records(collection, filter)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range records {
+		delete(m.collections[collection], r.name)
+	}
+	return len(records), nil
+}
+
+func (m *MemDB) UpdateWhere(collection string, filter Filter, patch interface{}) (int, error) {
+	if err := m.fail("UpdateWhere", collection, ""); err != nil {
+		return 0, err
+	}
+	p, err := decodePatch(patch)
+	if err != nil {
+		return 0, err
+	}
+	records, err := m.records(collection, filter)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range records {
+		b, err := json.MarshalIndent(mergePatch(r.doc, p), "", "\t")
+		if err != nil {
+			return 0, err
+		}
+		m.store(collection, r.name, append(b, byte('\n')))
+	}
+	return len(records), nil
+}
+
+func (m *MemDB) Read(collection, resource string, v interface{}, opts ...QueryOption) error {
+	b, err := m.raw("Read", collection, resource)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &v)
+}
+
+func (m *MemDB) ReadVersion(collection, resource string, v interface{}, opts ...QueryOption) (string, error) {
+	b, err := m.raw("ReadVersion", collection, resource)
+	if err != nil {
+		return "", err
+	}
+	if v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			return "", err
+		}
+	}
+	return recordVersion(b), nil
+}
+
+func (m *MemDB) ReadPath(collection, resource, path string, v interface{}, opts ...QueryOption) error {
+	b, err := m.raw("ReadPath", collection, resource)
+	if err != nil {
+		return err
+	}
+	compiled, err := compilePath(path)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+
+	var selected interface{}
+	switch nodes := compiled.eval(doc); {
+	case len(nodes) == 0:
+		return fmt.Errorf("%v matched nothing in %v/%v", path, collection, resource)
+	case len(nodes) == 1 && !compiled.multi():
+		selected = nodes[0]
+	default:
+		selected = nodes
+	}
+	b, err = json.Marshal(selected)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (m *MemDB) ReadStream(collection, resource string, opts ...QueryOption) (io.ReadCloser, error) {
+	b, err := m.raw("ReadStream", collection, resource)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *MemDB) ReadInto(collection, resource string, buf []byte, opts ...QueryOption) ([]byte, error) {
+	b, err := m.raw("ReadInto", collection, resource)
+	if err != nil {
+		return buf[:0], err
+	}
+	return append(buf[:0], b...), nil
+}
+
+func (m *MemDB) ReadMany(collection string, keys []string, dest interface{}, opts ...QueryOption) ([]string, error) {
+	if err := m.fail("ReadMany", collection, ""); err != nil {
+		return nil, err
+	}
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to read!", ErrEmptyCollection)
+	}
+	found := map[string][]byte{}
+	var missing []string
+	m.mu.RLock()
+	for _, key := range keys {
+		if key == "" {
+			m.mu.RUnlock()
+			return nil, fmt.Errorf("%w - unable to read record!", ErrEmptyResource)
+		}
+		if b, ok := m.collections[collection][key]; ok {
+			found[key] = b
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	m.mu.RUnlock()
+	return missing, decodeMany(dest, keys, found)
+}
+
+// raw returns a stored record, or the error a Driver gives for a missing one
+func (m *MemDB) raw(op, collection, resource string) ([]byte, error) {
+	if err := m.fail(op, collection, resource); err != nil {
+		return nil, err
+	}
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to read!", ErrEmptyCollection)
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("%w - unable to read record!", ErrEmptyResource)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	b, ok := m.collections[collection][resource]
+	if !ok {
+		return nil, notFound("read", collection, resource, notExist(collection+"/"+resource+".json"))
+	}
+	return b, nil
+}
+
+func (m *MemDB) ReadAll(collection string, opts ...QueryOption) ([]string, error) {
+	return m.Find(collection, nil, opts...)
+}
+
+func (m *MemDB) ReadAllRaw(collection string, opts ...QueryOption) ([]json.RawMessage, error) {
+	return m.FindRaw(collection, nil, opts...)
+}
+
+func (m *MemDB) ReadRange(collection, startKey, endKey string, opts ...QueryOption) ([]string, error) {
+	return m.Find(collection, nil, append(opts, keyRange(startKey, endKey))...)
+}
+
+func (m *MemDB) List(collection, prefix string, opts ...QueryOption) ([]string, error) {
+	if err := m.fail("List", collection, ""); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records, ok := m.collections[collection]
+	if !ok {
+		return nil, notExist(collection)
+	}
+	var names []string
+	for name := range records {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	q := newQuery(opts)
+	names = q.page(names, true)
+	from, to := q.window(len(names))
+	return names[from:to], nil
+}
+
+func (m *MemDB) Glob(collection, pattern string, opts ...QueryOption) ([]string, error) {
+	if err := checkGlob(pattern); err != nil {
+		return nil, err
+	}
+	names, err := m.List(collection, globPrefix(pattern))
+	if err != nil {
+		return nil, err
+	}
+	q := newQuery(opts)
+	names = q.page(matchGlob(names, pattern), true)
+	from, to := q.window(len(names))
+	return names[from:to], nil
+}
+
+func (m *MemDB) Exists(collection, resource string) bool {
+	_, err := m.raw("Exists", collection, resource)
+	return err == nil
+}
+
+func (m *MemDB) Find(collection string, filter Filter, opts ...QueryOption) ([]string, error) {
+	found, err := m.find("Find", collection, filter, opts)
+	out := make([]string, len(found))
+	for i, b := range found {
+		out[i] = string(b)
+	}
+	return out, err
+}
+
+func (m *MemDB) FindRaw(collection string, filter Filter, opts ...QueryOption) ([]json.RawMessage, error) {
+	found, err := m.find("FindRaw", collection, filter, opts)
+	out := make([]json.RawMessage, len(found))
+	for i, b := range found {
+		out[i] = b
+	}
+	return out, err
+}
+
+func (m *MemDB) FindOne(collection string, filter Filter, v interface{}, opts ...QueryOption) error {
+	found, err := m.find("FindOne", collection, filter, append(opts, Limit(1)))
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return ErrNotFound
+	}
+	return json.Unmarshal(found[0], v)
+}
+
+func (m *MemDB) Query(sql string) ([]string, error) {
+	stmt, err := parseSelect(sql)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.none {
+		return nil, nil
+	}
+	return m.Find(stmt.collection, stmt.filter, stmt.opts...)
+}
+
+// find is Find returning the results as bytes
+func (m *MemDB) find(op, collection string, filter Filter, opts []QueryOption) ([][]byte, error) {
+	if err := m.fail(op, collection, ""); err != nil {
+		return nil, err
+	}
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to find", ErrEmptyCollection)
+	}
+	records, err := m.records(collection, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	q := newQuery(opts)
+	if q.picksKeys() {
+		past := records[:0]
+		for _, r := range records {
+			if q.wants(r.name) {
+				past = append(past, r)
+			}
+		}
+		records = past
+	}
+	if len(q.orderBy) > 0 {
+		if err := sortRecords(records, q.orderBy, nil); err != nil { // no mtimes in memory
+			return nil, err
+		}
+	}
+	from, to := q.window(len(records))
+	records = records[from:to]
+	out := make([][]byte, 0, len(records))
+	for _, r := range records {
+		if len(q.fields) == 0 {
+			out = append(out, r.raw)
+			continue
+		}
+		b, err := project(r.raw, q.fields)
+		if err != nil {
+			return nil, fmt.Errorf("unable to select fields of record %v: %v", r.name, err)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// records returns the decoded records of a collection matching filter, in name order
+func (m *MemDB) records(collection string, filter Filter) ([]*record, error) {
+	m.mu.RLock()
+	stored, ok := m.collections[collection]
+	records := make([]*record, 0, len(stored))
+	for name, b := range stored {
+		records = append(records, &record{name: name, raw: append([]byte(nil), b...)})
+	}
+	m.mu.RUnlock()
+	if !ok {
+		return nil, notExist(collection)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].name < records[j].name })
+
+	matched := records[:0]
+	for _, r := range records {
+		doc, err := r.decode()
+		if err != nil {
+			return nil, err
+		}
+		if filter == nil || filter.Match(doc) {
+			matched = append(matched, r)
+		}
+	}
+	return matched, nil
+}
+
+// the Context methods are the plain ones, there's no tracing to do
+
+func (m *MemDB) WriteContext(ctx context.Context, collection, resource string, v interface{}) error {
+	return m.Write(collection, resource, v)
+}
+
+func (m *MemDB) DeleteContext(ctx context.Context, collection, resource string) error {
+	return m.Delete(collection, resource)
+}
+
+func (m *MemDB) ReadContext(ctx context.Context, collection, resource string, v interface{}, opts ...QueryOption) error {
+	return m.Read(collection, resource, v, opts...)
+}
+
+func (m *MemDB) ReadAllContext(ctx context.Context, collection string, opts ...QueryOption) ([]string, error) {
+	return m.ReadAll(collection, opts...)
+}
+
+func (m *MemDB) FindContext(ctx context.Context, collection string, filter Filter, opts ...QueryOption) ([]string, error) {
+	return m.Find(collection, filter, opts...)
+}
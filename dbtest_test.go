@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// The helpers live in a _test file so that testing stays out of the binary. They
+// were asked for as a dbtest package with dbtest.New(t), but a package main can't
+// be imported, by a dbtest package or anyone else, so they are for the tests of
+// this package: NewTestDriver is dbtest.New, NewTestMemDB its in-memory variant.
+
+// NewTestDriver opens a database in a temporary directory for a test, closed and
+// removed when the test ends. The Driver logs through t.Logf unless options set a
+// Logger, so its output shows with the failures it goes with.
+//
+//	func TestOrders(t *testing.T) {
+//		db := NewTestDriver(t, nil)
+//		...
+//		RequireRecord(t, db, "orders", "1", map[string]interface{}{"total": 3})
+//	}
+func NewTestDriver(t testing.TB, options *Options) *Driver {
+	t.Helper()
+	opts := Options{}
+	if options != nil {
+		opts = *options
+	}
+	if opts.Logger == nil {
+		opts.Logger = testLogger{t}
+	}
+
+	d, err := New(filepath.Join(t.TempDir(), "db"), &opts)
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	// before TempDir removes the directory, cleanups run last registered first
+	t.Cleanup(func() {
+		if err := d.Close(); err != nil {
+			t.Errorf("closing test database: %v", err)
+		}
+	})
+	return d
+}
+
+// NewTestMemDB is NewTestDriver keeping the records in memory, for tests that need
+// none of the Options; there's nothing on disk to remove when the test ends.
+func NewTestMemDB(t testing.TB) *MemDB {
+	return NewMemDB()
+}
+
+// RequireRecord fails the test unless the record is stored and equals want as JSON,
+// so a struct, a map or a json.RawMessage can be compared with what was written
+func RequireRecord(t testing.TB, d DB, collection, resource string, want interface{}) {
+	t.Helper()
+	var got json.RawMessage
+	if err := d.Read(collection, resource, &got); err != nil {
+		t.Fatalf("reading %v/%v: %v", collection, resource, err)
+	}
+	gotJSON, err := canonicalJSON(got)
+	if err != nil {
+		t.Fatalf("%v/%v: %v", collection, resource, err)
+	}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("%v/%v: can't compare with %#v: %v", collection, resource, want, err)
+	}
+	wantJSON, err := canonicalJSON(b)
+	if err != nil {
+		t.Fatalf("%v/%v: %v", collection, resource, err)
+	}
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Fatalf("%v/%v is\n\t%s\nwant\n\t%s", collection, resource, gotJSON, wantJSON)
+	}
+}
+
+// RequireNoRecord fails the test if the record is stored
+func RequireNoRecord(t testing.TB, d DB, collection, resource string) {
+	t.Helper()
+	var got json.RawMessage
+	err := d.Read(collection, resource, &got)
+	if err == nil {
+		t.Fatalf("%v/%v is stored, want none:\n\t%s", collection, resource, got)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("reading %v/%v: %v", collection, resource, err)
+	}
+}
+
+func TestRequireRecordOnDriverAndMemDB(t *testing.T) {
+	for name, db := range map[string]DB{"driver": NewTestDriver(t, nil), "memdb": NewTestMemDB(t)} {
+		if err := db.Write("users", "1", User{Name: "ann", Age: "30"}); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		RequireRecord(t, db, "users", "1", User{Name: "ann", Age: "30"})
+		RequireNoRecord(t, db, "users", "2")
+	}
+}
+
+// canonicalJSON re-encodes b with sorted keys and no spacing, numbers left as written
+func canonicalJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return json.Marshal(v)
+}
+
+// testLogger is the Logger of NewTestDriver, its Fatal only logs
+type testLogger struct {
+	t testing.TB
+}
+
+func (l testLogger) Fatal(format string, v ...interface{})   { l.logf("FATAL", format, v...) }
+func (l testLogger) Error(format string, v ...interface{})   { l.logf("ERROR", format, v...) }
+func (l testLogger) Warning(format string, v ...interface{}) { l.logf("WARN", format, v...) }
+func (l testLogger) Info(format string, v ...interface{})    { l.logf("INFO", format, v...) }
+func (l testLogger) Debug(format string, v ...interface{})   {}
+func (l testLogger) Trace(format string, v ...interface{})   {}
+
+func (l testLogger) logf(level, format string, v ...interface{}) {
+	l.t.Logf("%v %v", level, bytes.TrimRight([]byte(fmt.Sprintf(format, v...)), "\n"))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Engine is how a database stores its records, see Options.Engine
+type Engine int
+
+const (
+	// FileEngine keeps every record in a JSON file of its own, in a directory per
+	// collection (the default), so records can be read, backed up and fixed with
+	// any tool
+	FileEngine Engine = iota
+
+	// LSMEngine keeps records in a log-structured merge tree in _lsm: writes are
+	// appended to a log and kept in a memtable, which is written out as a sorted
+	// segment file once full, and segments are merged down into levels in the
+	// background, with a bloom filter each for lookups. It's for workloads writing
+	// millions of small records, where a file per record takes the filesystem down.
+	// Collection directories are still made, for attachments. See LSMOptions.
+	LSMEngine
+)
+
+func (e Engine) String() string {
+	if e == LSMEngine {
+		return "lsm"
+	}
+	return "files"
+}
+
+// checkEngineOptions refuses the options that take records to be files
+func checkEngineOptions(opts Options) error {
+	if opts.Engine != LSMEngine {
+		return nil
+	}
+	switch {
+	case opts.ChunkSize > 0:
+		return fmt.Errorf("LSMEngine keeps records whole, it can't have a ChunkSize")
+	case opts.MMap:
+		return fmt.Errorf("LSMEngine records aren't files to memory map")
+	case len(opts.Shards) > 0:
+		return fmt.Errorf("LSMEngine collections aren't directories to shard")
+	}
+	return nil
+}
+
+// openEngine opens the LSMEngine tree of the database, nothing for FileEngine
+func (d *Driver) openEngine(opts Options) error {
+	if d.engine != LSMEngine {
+		return nil
+	}
+	var lo LSMOptions
+	if opts.LSM != nil {
+		lo = *opts.LSM
+	}
+	t, err := openLSM(filepath.Join(d.dir, lsmDir), lo)
+	if err != nil {
+		return err
+	}
+	d.lsm = t
+	d.startLSMCompactor()
+	return nil
+}
+
+// startLSMCompactor runs the merges of the LSMEngine tree after its flushes
+func (d *Driver) startLSMCompactor() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			select {
+			case <-d.done:
+				return
+			case <-d.lsm.kick:
+			}
+			start := time.Now()
+			merges := 0
+			var err error
+			for {
+				var merged bool
+				if merged, err = d.lsm.compact(); err != nil || !merged {
+					break
+				}
+				merges++
+			}
+			if err != nil {
+				d.logf(LevelError, "LSM compaction failed", "operation", "compact", "duration", time.Since(start), "error", err)
+			} else if merges > 0 {
+				d.logf(LevelDebug, "Compacted LSM segments", "operation", "compact", "merges", merges, "duration", time.Since(start))
+			}
+			d.background.set("lsm compaction", err)
+		}
+	}()
+}
+
+// the functions below are the file operations on records for both engines
+
+// lsmFileInfo is what statRecord and recordFiles make of LSMEngine records
+type lsmFileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+}
+
+func (fi lsmFileInfo) Name() string       { return fi.name }
+func (fi lsmFileInfo) Size() int64        { return fi.size }
+func (fi lsmFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi lsmFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi lsmFileInfo) IsDir() bool        { return false }
+func (fi lsmFileInfo) Sys() interface{}   { return nil }
+
+// statRecord is os.Stat of a record file
+func (d *Driver) statRecord(collection, resource string) (os.FileInfo, error) {
+	if d.lsm == nil {
+		return os.Stat(d.recordPath(collection, resource))
+	}
+	e, ok, err := d.lsm.get(cacheKey(collection, resource))
+	if err != nil {
+		return nil, err
+	}
+	if !ok || e.value == nil {
+		return nil, notExist(d.recordPath(collection, resource))
+	}
+	return lsmFileInfo{name: d.recordFile(resource), size: int64(len(e.value)), mtime: time.Unix(0, e.mtime)}, nil
+}
+
+// lsmRecordInto is readRecordInto for LSMEngine
+func (d *Driver) lsmRecordInto(buf *bytes.Buffer, collection, resource string) error {
+	e, ok, err := d.lsm.get(cacheKey(collection, resource))
+	if err != nil {
+		path := d.recordPath(collection, resource)
+		d.corrupt(collection, resource, path, err)
+		return &RecordError{Op: "read", Collection: collection, Resource: resource, Err: corrupted(err)}
+	}
+	if !ok || e.value == nil {
+		return notExist(d.recordPath(collection, resource))
+	}
+	buf.Write(e.value)
+	return nil
+}
+
+// removeRecordFile is os.Remove of a record file
+func (d *Driver) removeRecordFile(collection, resource string) error {
+	if d.lsm == nil {
+		return os.Remove(d.recordPath(collection, resource))
+	}
+	if _, err := d.statRecord(collection, resource); err != nil {
+		return err
+	}
+	return d.lsm.put(cacheKey(collection, resource), nil)
+}
+
+// lsmRecordFiles is recordFiles for LSMEngine
+func (d *Driver) lsmRecordFiles(collection string) ([]os.FileInfo, error) {
+	prefix := cacheKey(collection, "")
+	stats, err := d.lsm.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, len(stats))
+	for i, st := range stats {
+		files[i] = lsmFileInfo{name: d.recordFile(strings.TrimPrefix(st.key, prefix)), size: st.size, mtime: time.Unix(0, st.mtime)}
+	}
+	return files, nil
+}
+
+// dropLSMCollection deletes the records of a collection from the LSMEngine tree
+func (d *Driver) dropLSMCollection(collection string) error {
+	stats, err := d.lsm.list(cacheKey(collection, ""))
+	if err != nil {
+		return err
+	}
+	for _, st := range stats {
+		if err := d.lsm.put(st.key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
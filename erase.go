@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type EraseMode int
+
+const (
+	// the record goes, with everything the database keeps of it
+	EraseDelete EraseMode = iota
+	// the personal fields of the record are nulled, the rest stays
+	EraseAnonymize
+)
+
+func (m EraseMode) String() string {
+	if m == EraseAnonymize {
+		return "anonymize"
+	}
+	return "delete"
+}
+
+type ErasePolicy struct {
+	Mode EraseMode
+
+	// dotted paths of the fields EraseAnonymize nulls, Options.PIIFields of the
+	// collection if empty
+	Fields []string
+}
+
+// ErasureReport tells what Erase did, to keep as evidence of the erasure
+type ErasureReport struct {
+	Collection string
+	Resource   string
+	Mode       EraseMode
+	Time       time.Time
+
+	Erased   []string // what was removed or rewritten
+	Fields   []string // the fields anonymized, of those the record had
+	Retained []string // what still refers to the record, and why
+}
+
+// Erase carries out a request to erase a person's data, such as under the GDPR.
+// EraseDelete deletes the record with its attachments and chunks, drops it from the
+// indexes and the cache and scrubs it from the replication log. EraseAnonymize nulls
+// the policy's fields in place and scrubs the earlier versions from the log.
+// Followers, cluster members and sync peers apply the erasure like any change.
+func (d *Driver) Erase(collection, resource string, policy ErasePolicy) (*ErasureReport, error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return nil, err
+	}
+	if collection == "" || resource == "" {
+		return nil, missingName(collection, "unable to erase")
+	}
+	if err := d.checkResourceName(resource); err != nil {
+		return nil, err
+	}
+	parent := collection
+	collection, err := d.partitionFor(collection, resource)
+	if err != nil {
+		return nil, err
+	}
+	report := &ErasureReport{Collection: collection, Resource: resource, Mode: policy.Mode, Time: time.Now()}
+
+	fields := policy.Fields
+	if len(fields) == 0 {
+		fields = d.piiFields[parent]
+	}
+	if policy.Mode == EraseAnonymize && len(fields) == 0 {
+		return nil, fmt.Errorf("no fields to anonymize in %v, set ErasePolicy.Fields or Options.PIIFields", collection)
+	}
+
+	r := d.cluster()
+	if r == nil {
+		if err := d.writable(); err != nil {
+			return nil, err
+		}
+	}
+
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	locked := true
+	unlock := func() {
+		if locked {
+			mutex.Unlock()
+			locked = false
+		}
+	}
+	defer unlock()
+
+	current, err := d.loadRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %v/%v", ErrNotFound, collection, resource)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// before the erasure goes in, which followers get as it is
+	if n := d.repl.scrub(collection, resource); n > 0 {
+		report.Erased = append(report.Erased, fmt.Sprintf("%d earlier versions in the replication log", n))
+	}
+
+	switch policy.Mode {
+	case EraseDelete:
+		if _, err := os.Stat(d.attachmentDir(collection, resource)); err == nil {
+			report.Erased = append(report.Erased, "attachments")
+		}
+		if r != nil {
+			unlock() // the leader applies it, here too if this is the leader
+			err = r.remove(collection, resource)
+		} else {
+			_, err = d.removeRecord(collection, resource)
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Erased = append(report.Erased, "record")
+		if d.isCRDT(collection) || d.vclocks {
+			report.Retained = append(report.Retained, "CRDT and vector clock tombstones, without values, so merges and syncs delete it too")
+		}
+
+	case EraseAnonymize:
+		// a fresh copy, the decoded doc may be shared with the read cache
+		doc, err := (&record{name: resource, raw: current.raw}).decode()
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			if anonymize(doc, field) {
+				report.Fields = append(report.Fields, field)
+			}
+		}
+		if len(report.Fields) == 0 {
+			return report, nil
+		}
+		if r != nil {
+			unlock()
+			err = r.write(collection, resource, doc)
+		} else {
+			var b []byte
+			if b, err = json.MarshalIndent(doc, "", "\t"); err == nil {
+				err = d.storeRecord(collection, resource, append(b, '\n'))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Erased = append(report.Erased, "fields of the record")
+	}
+
+	if r != nil {
+		report.Retained = append(report.Retained, "earlier versions in the cluster's Raft log")
+	}
+	if d.audited(collection) {
+		report.Retained = append(report.Retained, "read audit log entries naming the resource, kept as the record of access")
+	}
+	d.logf(LevelInfo, "Erased record", "operation", "erase", "collection", collection,
+		"resource", resource, "mode", policy.Mode.String(), "fields", strings.Join(report.Fields, ","))
+	return report, nil
+}
+
+// anonymize nulls the field at a dotted path, reporting whether the record had it
+func anonymize(doc map[string]interface{}, field string) bool {
+	parent, key, ok := fieldParent(doc, field)
+	if ok {
+		parent[key] = nil
+	}
+	return ok
+}
+
+// scrub drops the contents of a record from the changes kept for followers, which
+// then read the record as it is now. It returns how many changes held some.
+func (l *replLog) scrub(collection, resource string) int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for i := range l.entries {
+		c := &l.entries[i]
+		if c.Collection == collection && c.Resource == resource && c.Record != nil {
+			c.Record = nil
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrorCode is the stable name of a kind of error in the responses of the handlers,
+// for clients to tell errors apart without going by their messages
+type ErrorCode string
+
+const (
+	CodeNotFound           ErrorCode = "not_found"
+	CodeDuplicateKey       ErrorCode = "duplicate_key"
+	CodeConflict           ErrorCode = "conflict"
+	CodeStaleMessage       ErrorCode = "stale_message"
+	CodeIncompatibleSchema ErrorCode = "incompatible_schema"
+	CodeSchemaViolation    ErrorCode = "schema_violation"
+	CodeInvalidName        ErrorCode = "invalid_name"
+	CodeRecordTooLarge     ErrorCode = "record_too_large"
+	CodeQuotaExceeded      ErrorCode = "quota_exceeded"
+	CodeBadRequest         ErrorCode = "bad_request"
+	CodeMethodNotAllowed   ErrorCode = "method_not_allowed"
+	CodeUnauthenticated    ErrorCode = "unauthenticated"
+	CodeForbidden          ErrorCode = "forbidden"
+	CodeReadOnly           ErrorCode = "read_only"
+	CodeNotLeader          ErrorCode = "not_leader"
+	CodeRateLimited        ErrorCode = "rate_limited"
+	CodeUnavailable        ErrorCode = "unavailable"
+	CodeTimeout            ErrorCode = "timeout"
+	CodeNotImplemented     ErrorCode = "not_implemented"
+	CodeCorrupted          ErrorCode = "corrupted"
+	CodeInternal           ErrorCode = "internal"
+)
+
+// the HTTP status and gRPC status code (google.golang.org/grpc/codes) of each code
+var errorCodes = map[ErrorCode]struct {
+	status int
+	grpc   uint32
+}{
+	CodeNotFound:           {http.StatusNotFound, 5},              // NotFound
+	CodeDuplicateKey:       {http.StatusConflict, 6},              // AlreadyExists
+	CodeConflict:           {http.StatusConflict, 10},             // Aborted
+	CodeStaleMessage:       {http.StatusConflict, 9},              // FailedPrecondition
+	CodeIncompatibleSchema: {http.StatusConflict, 9},              // FailedPrecondition
+	CodeSchemaViolation:    {http.StatusUnprocessableEntity, 3},   // InvalidArgument
+	CodeInvalidName:        {http.StatusUnprocessableEntity, 3},   // InvalidArgument
+	CodeRecordTooLarge:     {http.StatusRequestEntityTooLarge, 3}, // InvalidArgument
+	CodeQuotaExceeded:      {http.StatusInsufficientStorage, 8},   // ResourceExhausted
+	CodeBadRequest:         {http.StatusBadRequest, 3},            // InvalidArgument
+	CodeMethodNotAllowed:   {http.StatusMethodNotAllowed, 12},     // Unimplemented
+	CodeUnauthenticated:    {http.StatusUnauthorized, 16},         // Unauthenticated
+	CodeForbidden:          {http.StatusForbidden, 7},             // PermissionDenied
+	CodeReadOnly:           {http.StatusServiceUnavailable, 9},    // FailedPrecondition
+	CodeNotLeader:          {http.StatusServiceUnavailable, 14},   // Unavailable
+	CodeRateLimited:        {http.StatusTooManyRequests, 8},       // ResourceExhausted
+	CodeUnavailable:        {http.StatusServiceUnavailable, 14},   // Unavailable
+	CodeTimeout:            {http.StatusGatewayTimeout, 4},        // DeadlineExceeded
+	CodeNotImplemented:     {http.StatusNotImplemented, 12},       // Unimplemented
+	CodeCorrupted:          {http.StatusInternalServerError, 15},  // DataLoss
+	CodeInternal:           {http.StatusInternalServerError, 13},  // Internal
+}
+
+// the code of each sentinel error, the first one an error is wins
+var errorSentinels = []struct {
+	err  error
+	code ErrorCode
+}{
+	{ErrNotFound, CodeNotFound},
+	{os.ErrNotExist, CodeNotFound},
+	{ErrDuplicateKey, CodeDuplicateKey},
+	{ErrConflict, CodeConflict},
+	{ErrStaleMessage, CodeStaleMessage},
+	{ErrIncompatibleSchema, CodeIncompatibleSchema},
+	{ErrSchemaViolation, CodeSchemaViolation},
+	{ErrInvalidName, CodeInvalidName},
+	{ErrEmptyCollection, CodeInvalidName},
+	{ErrEmptyResource, CodeInvalidName},
+	{ErrRecordTooLarge, CodeRecordTooLarge},
+	{ErrQuotaExceeded, CodeQuotaExceeded},
+	{ErrForbidden, CodeForbidden},
+	{ErrReadOnly, CodeReadOnly},
+	{ErrNotLeader, CodeNotLeader},
+	{ErrTimeout, CodeTimeout},
+	{ErrClosed, CodeUnavailable},
+	{ErrCorrupted, CodeCorrupted},
+}
+
+// HTTPStatus is the status responses with the code are sent with
+func (c ErrorCode) HTTPStatus() int {
+	if info, ok := errorCodes[c]; ok {
+		return info.status
+	}
+	return http.StatusInternalServerError
+}
+
+// GRPCCode is the gRPC status code for the code, to answer with from a gRPC server
+// in front of the Driver: status.Error(codes.Code(CodeOf(err).GRPCCode()), ...)
+func (c ErrorCode) GRPCCode() uint32 {
+	if info, ok := errorCodes[c]; ok {
+		return info.grpc
+	}
+	return 13 // Internal
+}
+
+// APIError is an error as the handlers answer it, in a JSON envelope:
+//
+//	{"error": {"code": "not_found", "message": "read users/alice: ...", "collection": "users", "resource": "alice"}}
+//
+// The errors of the clients of those handlers (SyncRemote, Follow) are APIErrors
+// too, and errors.Is matches them to the sentinel of their code.
+type APIError struct {
+	Code       ErrorCode `json:"code"`
+	Message    string    `json:"message"`
+	Collection string    `json:"collection,omitempty"`
+	Resource   string    `json:"resource,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func (e *APIError) Is(target error) bool {
+	for _, s := range errorSentinels {
+		if s.err == target {
+			return s.code == e.Code
+		}
+	}
+	return false
+}
+
+// CodeOf returns the code of an error, CodeInternal for errors of no known kind
+func CodeOf(err error) ErrorCode {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return ae.Code
+	}
+	for _, s := range errorSentinels {
+		if errors.Is(err, s.err) {
+			return s.code
+		}
+	}
+	return CodeInternal
+}
+
+// ErrorFor returns the APIError of err, with the collection and resource of its
+// RecordError if it has one
+func ErrorFor(err error) *APIError {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return ae
+	}
+	e := &APIError{Code: CodeOf(err), Message: err.Error()}
+	var re *RecordError
+	if errors.As(err, &re) {
+		e.Collection, e.Resource = re.Collection, re.Resource
+		if e.Code == CodeNotFound {
+			// not the path of the file, which is no business of clients
+			e.Message = (&RecordError{Op: re.Op, Collection: re.Collection, Resource: re.Resource, Err: ErrNotFound}).Error()
+		}
+	}
+	return e
+}
+
+// WriteError answers a request with the APIError of err, with the status of its code
+func WriteError(w http.ResponseWriter, err error) {
+	writeAPIError(w, ErrorFor(err))
+}
+
+// writeError answers a request with an error the handler found itself
+func writeError(w http.ResponseWriter, code ErrorCode, format string, v ...interface{}) {
+	writeAPIError(w, &APIError{Code: code, Message: fmt.Sprintf(format, v...)})
+}
+
+func writeAPIError(w http.ResponseWriter, e *APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Code.HTTPStatus())
+	json.NewEncoder(w).Encode(map[string]*APIError{"error": e})
+}
+
+// readError turns the response of a handler that failed into its APIError, or one
+// made up from the status for answers of something else
+func readError(res *http.Response) error {
+	b, _ := ioutil.ReadAll(res.Body)
+	var envelope struct {
+		Error *APIError `json:"error"`
+	}
+	if json.Unmarshal(b, &envelope) == nil && envelope.Error != nil && envelope.Error.Code != "" {
+		return envelope.Error
+	}
+
+	code := CodeInternal
+	switch res.StatusCode {
+	case http.StatusBadRequest:
+		code = CodeBadRequest
+	case http.StatusUnauthorized:
+		code = CodeUnauthenticated
+	case http.StatusForbidden:
+		code = CodeForbidden
+	case http.StatusNotFound:
+		code = CodeNotFound
+	case http.StatusMethodNotAllowed:
+		code = CodeMethodNotAllowed
+	case http.StatusTooManyRequests:
+		code = CodeRateLimited
+	case http.StatusServiceUnavailable:
+		code = CodeUnavailable
+	case http.StatusGatewayTimeout:
+		code = CodeTimeout
+	}
+	msg := res.Status
+	if text := strings.TrimSpace(string(b)); text != "" {
+		msg += ": " + text
+	}
+	return &APIError{Code: code, Message: msg}
+}
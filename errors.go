@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrNotFound is returned when a lookup matches no record, and is what the
+	// RecordError of a record that isn't stored is
+	ErrNotFound = errors.New("record not found")
+
+	// ErrEmptyCollection is returned when the collection name is empty
+	ErrEmptyCollection = errors.New("Missing collection")
+
+	// ErrEmptyResource is returned when the resource name is empty
+	ErrEmptyResource = errors.New("Missing resource")
+
+	// ErrConflict is returned when versions of a record changed on both sides of a
+	// sync can't be merged
+	ErrConflict = errors.New("conflict")
+
+	// ErrVersionMismatch is returned by DeleteIf when the record changed since its
+	// version was read
+	ErrVersionMismatch = errors.New("version mismatch")
+
+	// ErrCorrupted is returned for records whose file can't be decoded, or whose
+	// chunks are missing
+	ErrCorrupted = errors.New("corrupted record")
+
+	// ErrDuplicateKey is returned when a write would break a unique index
+	ErrDuplicateKey = errors.New("duplicate key")
+
+	// ErrRecordTooLarge is returned when a record is over Options.MaxRecordSize
+	ErrRecordTooLarge = errors.New("record too large")
+
+	// ErrQuotaExceeded is returned when a write would take a collection or the
+	// database over its quota
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrWatcherLagging is what Watcher.Err returns when the Watcher was stopped for
+	// not keeping up with the changes
+	ErrWatcherLagging = errors.New("watcher fell behind")
+
+	// ErrReadOnly is returned by writes to a Driver following a leader
+	ErrReadOnly = errors.New("database is read only")
+
+	// ErrNotLeader is returned by Write and Delete on a node of a cluster that isn't
+	// its leader
+	ErrNotLeader = errors.New("not the cluster leader")
+
+	// ErrForbidden is returned when the roles of a caller of an HTTP handler don't
+	// allow the operation, see AccessControl
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrInvalidName is returned for collection and resource names that can't be
+	// stored, or that break Options.Naming
+	ErrInvalidName = errors.New("invalid name")
+
+	// ErrQueueEmpty is returned by Dequeue when no message is ready
+	ErrQueueEmpty = errors.New("queue empty")
+
+	// ErrStaleMessage is returned by Ack and Nack of a message that was redelivered,
+	// or acknowledged, since it was dequeued
+	ErrStaleMessage = errors.New("stale message")
+
+	// ErrIncompatibleSchema is returned by RegisterSchema for a schema that breaks the
+	// compatibility declared for its collection
+	ErrIncompatibleSchema = errors.New("incompatible schema")
+
+	// ErrSchemaViolation is returned by writes of records that don't match the latest
+	// schema of their collection
+	ErrSchemaViolation = errors.New("schema violation")
+
+	// ErrTimeout is what the TimeoutError of an operation that ran past
+	// Options.OperationTimeout is
+	ErrTimeout = errors.New("operation timed out")
+
+	// ErrClosed is returned by operations of a Driver after Shutdown or Close
+	ErrClosed = errors.New("database is closed")
+
+	// ErrFormat is returned by New for databases stored in a way the Driver, or its
+	// options, can't read
+	ErrFormat = errors.New("unsupported database format")
+)
+
+// RecordError is an error of an operation on a record, or on a collection when
+// Resource is empty. errors.As finds it in the errors of the Driver and errors.Is sees
+// through it, to ErrCorrupted say. A record that isn't stored is both ErrNotFound and
+// os.ErrNotExist.
+type RecordError struct {
+	Op         string // "read", "delete", "sync", ...
+	Collection string
+	Resource   string
+	Err        error
+}
+
+func (e *RecordError) Error() string {
+	name := e.Collection
+	if e.Resource != "" {
+		if name != "" {
+			name += "/"
+		}
+		name += e.Resource
+	}
+	return fmt.Sprintf("%v %v: %v", e.Op, name, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes a record missing from the filesystem ErrNotFound
+func (e *RecordError) Is(target error) bool {
+	return target == ErrNotFound && e.Resource != "" && errors.Is(e.Err, os.ErrNotExist)
+}
+
+// notFound turns the error of the filesystem for a record or collection that isn't
+// stored into a RecordError, other errors are left as they are
+func notFound(op, collection, resource string, err error) error {
+	var re *RecordError
+	if err == nil || !errors.Is(err, os.ErrNotExist) || errors.As(err, &re) {
+		return err
+	}
+	return &RecordError{Op: op, Collection: collection, Resource: resource, Err: err}
+}
+
+// corrupted marks err, why a record can't be read, as ErrCorrupted
+func corrupted(err error) error {
+	if errors.Is(err, ErrCorrupted) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrCorrupted, err)
+}
+
+// conflictError is ErrConflict for why the versions of a record couldn't be merged,
+// which it unwraps to
+type conflictError struct {
+	err error
+}
+
+func (e conflictError) Error() string        { return "conflict: " + e.err.Error() }
+func (e conflictError) Unwrap() error        { return e.err }
+func (e conflictError) Is(target error) bool { return target == ErrConflict }
+
+// missingName is the error for an empty collection, or else resource, name
+func missingName(collection, doing string) error {
+	if collection == "" {
+		return fmt.Errorf("%w - %v", ErrEmptyCollection, doing)
+	}
+	return fmt.Errorf("%w - %v", ErrEmptyResource, doing)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+)
+
+type EventType int
+
+const (
+	// an operation took longer than Options.SlowOperation
+	EventSlowOperation EventType = iota + 1
+	// a writer waited longer than Options.LockWaitThreshold for a collection lock
+	EventLockContention
+	// a file of the database couldn't be read back, Err says why
+	EventCorruption
+	// an index log was rewritten into a compact snapshot
+	EventCompaction
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSlowOperation:
+		return "slow operation"
+	case EventLockContention:
+		return "lock contention"
+	case EventCorruption:
+		return "corruption"
+	case EventCompaction:
+		return "compaction"
+	}
+	return "unknown"
+}
+
+// Event is what Options.OnEvent gets. Fields that don't apply are left empty, e.g.
+// Resource for a compaction.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	Operation  string // write, read, read_all, find, delete, ...
+	Collection string
+	Resource   string
+	Path       string        // of the file an EventCorruption is about
+	Duration   time.Duration // of the operation, lock wait or compaction
+	Ops        int           // log entries folded by an EventCompaction
+	Err        error
+}
+
+func (d *Driver) emitEvent(e Event) {
+	if d.onEvent == nil {
+		return
+	}
+	e.Time = time.Now()
+	d.onEvent(e)
+}
+
+// corrupt reports a file that couldn't be read back
+func (d *Driver) corrupt(collection, resource, path string, err error) {
+	d.emitEvent(Event{Type: EventCorruption, Collection: collection, Resource: resource, Path: path, Err: err})
+}
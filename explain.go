@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScanType says how a query finds its candidate records
+type ScanType string
+
+const (
+	FullScan  ScanType = "full scan"
+	IndexScan ScanType = "index scan"
+)
+
+// Plan describes how Find will run a query, see Explain
+type Plan struct {
+	Collection     string
+	Filter         string   // the filter as Find sees it
+	Scan           ScanType // FullScan or IndexScan
+	Index          string   // the index used by an IndexScan
+	Records        int      // records currently in the collection
+	EstimatedReads int      // record files Find expects to open
+	SortInMemory   bool     // results are sorted after reading by decoding them
+	Sorted         bool     // results are sorted with the values kept in an index
+
+	candidates []string // what an IndexScan will read
+}
+
+func (p *Plan) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "collection: %v\n", p.Collection)
+	fmt.Fprintf(&sb, "filter:     %v\n", p.Filter)
+	if p.Scan == IndexScan {
+		fmt.Fprintf(&sb, "scan:       %v on %v\n", p.Scan, p.Index)
+	} else {
+		fmt.Fprintf(&sb, "scan:       %v\n", p.Scan)
+	}
+	fmt.Fprintf(&sb, "reads:      ~%d of %d records\n", p.EstimatedReads, p.Records)
+	if p.SortInMemory {
+		fmt.Fprintf(&sb, "sort:       in memory\n")
+	} else if p.Sorted {
+		fmt.Fprintf(&sb, "sort:       from index\n")
+	}
+	return sb.String()
+}
+
+// Explain reports how Find would run a query without running it, so a slow
+// query can be told apart from a missing index
+func (d *Driver) Explain(collection string, filter Filter, opts ...QueryOption) (*Plan, error) {
+	collection = d.foldCollection(collection)
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to explain", ErrEmptyCollection)
+	}
+	if err := d.checkNames(collection, ""); err != nil {
+		return nil, err
+	}
+	return d.plan(collection, filter, newQuery(opts))
+}
+
+func (d *Driver) plan(collection string, filter Filter, q *query) (*Plan, error) {
+	n, err := d.countRecords(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plan{
+		Collection:     collection,
+		Filter:         describe(filter),
+		Scan:           FullScan,
+		Records:        n,
+		EstimatedReads: n,
+	}
+	if len(q.orderBy) == 1 && q.orderBy[0].by == byField && d.sortIndex(collection, q.orderBy[0].field) != nil {
+		p.Sorted = true
+	} else {
+		p.SortInMemory = len(q.orderBy) > 0
+	}
+
+	if names, used, ok := d.indexCandidates(collection, filter); ok {
+		p.Scan = IndexScan
+		p.Index = used
+		p.EstimatedReads = len(names)
+		p.candidates = names
+	}
+	return p, nil
+}
+
+// countRecords counts the record files of a collection without opening them
+func (d *Driver) countRecords(collection string) (int, error) {
+	names, err := d.listRecords(collection)
+	return len(names), err
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// Filter decides if a decoded record belongs in a result set
+type Filter interface {
+	Match(record map[string]interface{}) bool
+}
+
+// FilterFunc lets an ordinary function be used as a Filter
+type FilterFunc func(record map[string]interface{}) bool
+
+func (f FilterFunc) Match(record map[string]interface{}) bool {
+	return f(record)
+}
+
+func (f FilterFunc) String() string {
+	return "<func>"
+}
+
+// describe renders a filter for Explain
+func describe(f Filter) string {
+	if f == nil {
+		return "<all>"
+	}
+	if s, ok := f.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("<%T>", f)
+}
+
+// formatValue prints strings quoted and everything else (numbers, bools, null) as is
+func formatValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", x)
+	case nil:
+		return "null"
+	}
+	return fmt.Sprint(v)
+}
+
+type eqFilter struct {
+	field string
+	value interface{}
+}
+
+// Eq matches records whose field equals value
+func Eq(field string, value interface{}) Filter {
+	return eqFilter{field: field, value: value}
+}
+
+func (f eqFilter) Match(record map[string]interface{}) bool {
+	v, ok := lookup(record, f.field)
+	if !ok {
+		return false
+	}
+	c, ok := compareValues(v, f.value)
+	if !ok {
+		// objects and arrays are only ever equal as a whole
+		return reflect.DeepEqual(v, f.value)
+	}
+	return c == 0
+}
+
+func (f eqFilter) String() string {
+	return fmt.Sprintf("%v = %v", f.field, formatValue(f.value))
+}
+
+// Ne matches records whose field is missing or differs from value
+func Ne(field string, value interface{}) Filter {
+	return Not(Eq(field, value))
+}
+
+type cmpFilter struct {
+	field string
+	op    string
+	value interface{}
+	want  func(c int) bool
+}
+
+func (f cmpFilter) Match(record map[string]interface{}) bool {
+	v, ok := lookup(record, f.field)
+	if !ok {
+		return false
+	}
+	c, ok := compareValues(v, f.value)
+	return ok && f.want(c)
+}
+
+func (f cmpFilter) String() string {
+	return fmt.Sprintf("%v %v %v", f.field, f.op, formatValue(f.value))
+}
+
+// Gt matches records whose field is greater than value
+func Gt(field string, value interface{}) Filter {
+	return cmpFilter{field, ">", value, func(c int) bool { return c > 0 }}
+}
+
+// Gte matches records whose field is greater than or equal to value
+func Gte(field string, value interface{}) Filter {
+	return cmpFilter{field, ">=", value, func(c int) bool { return c >= 0 }}
+}
+
+// Lt matches records whose field is less than value
+func Lt(field string, value interface{}) Filter {
+	return cmpFilter{field, "<", value, func(c int) bool { return c < 0 }}
+}
+
+// Lte matches records whose field is less than or equal to value
+func Lte(field string, value interface{}) Filter {
+	return cmpFilter{field, "<=", value, func(c int) bool { return c <= 0 }}
+}
+
+// In matches records whose field equals any of values
+func In(field string, values ...interface{}) Filter {
+	filters := make([]Filter, 0, len(values))
+	for _, v := range values {
+		filters = append(filters, Eq(field, v))
+	}
+	return Or(filters...)
+}
+
+type existsFilter struct {
+	field  string
+	exists bool
+}
+
+// Exists matches records that have (or, with false, don't have) the field
+func Exists(field string, exists bool) Filter {
+	return existsFilter{field, exists}
+}
+
+func (f existsFilter) Match(record map[string]interface{}) bool {
+	_, ok := lookup(record, f.field)
+	return ok == f.exists
+}
+
+func (f existsFilter) String() string {
+	if f.exists {
+		return f.field + " exists"
+	}
+	return f.field + " missing"
+}
+
+// regular expressions longer than this, or compiling to more instructions, are turned
+// down by MatchesRegex and KeyMatchesRegex, so an ad-hoc search can't make every record a long match
+const (
+	maxRegexLen   = 1024
+	maxRegexInsts = 10000
+)
+
+type regexFilter struct {
+	field string
+	re    *regexp.Regexp
+}
+
+// MatchesRegex matches records whose field is a string matching pattern, a regular
+// expression as regexp takes it, anywhere in the string unless anchored with ^ and $.
+// Matching takes time linear in the string whatever the pattern, as regexp never
+// backtracks, and patterns too big to match quickly are an error.
+func MatchesRegex(field, pattern string) (Filter, error) {
+	re, err := compileRegex(field, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return regexFilter{field, re}, nil
+}
+
+// compileRegex compiles pattern for what it's matched on, unless it's over
+// maxRegexLen or maxRegexInsts
+func compileRegex(on, pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > maxRegexLen {
+		return nil, fmt.Errorf("regular expression on %v is longer than %d bytes", on, maxRegexLen)
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression on %v: %w", on, err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression on %v: %w", on, err)
+	}
+	if len(prog.Inst) > maxRegexInsts {
+		return nil, fmt.Errorf("regular expression on %v is too complex", on)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression on %v: %w", on, err)
+	}
+	return re, nil
+}
+
+func (f regexFilter) Match(record map[string]interface{}) bool {
+	v, ok := lookup(record, f.field)
+	if !ok {
+		return false
+	}
+	s, ok := v.(string)
+	return ok && f.re.MatchString(s)
+}
+
+func (f regexFilter) String() string {
+	return fmt.Sprintf("%v ~ /%v/", f.field, f.re)
+}
+
+type andFilter []Filter
+
+// And matches records matching all of filters
+func And(filters ...Filter) Filter {
+	return andFilter(filters)
+}
+
+func (f andFilter) Match(record map[string]interface{}) bool {
+	for _, filter := range f {
+		if !filter.Match(record) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f andFilter) String() string {
+	return joinFilters(f, " AND ")
+}
+
+type orFilter []Filter
+
+// Or matches records matching at least one of filters
+func Or(filters ...Filter) Filter {
+	return orFilter(filters)
+}
+
+func (f orFilter) Match(record map[string]interface{}) bool {
+	for _, filter := range f {
+		if filter.Match(record) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f orFilter) String() string {
+	return joinFilters(f, " OR ")
+}
+
+func joinFilters(filters []Filter, sep string) string {
+	parts := make([]string, 0, len(filters))
+	for _, f := range filters {
+		parts = append(parts, describe(f))
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+type notFilter struct {
+	filter Filter
+}
+
+// Not matches records that filter doesn't match
+func Not(filter Filter) Filter {
+	return notFilter{filter}
+}
+
+func (f notFilter) Match(record map[string]interface{}) bool {
+	return !f.filter.Match(record)
+}
+
+func (f notFilter) String() string {
+	return "NOT " + describe(f.filter)
+}
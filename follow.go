@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// where a follower keeps the position it has applied the leader's changes up to,
+// so it catches up from there after a restart
+const followPositionFile = "_replication.json"
+
+type FollowOptions struct {
+	// how long to wait before reconnecting after the stream broke, doubling on every
+	// failed attempt up to a minute. A second if zero.
+	RetryInterval time.Duration
+
+	// Health reports a problem when the follower has been disconnected or behind the
+	// leader for longer than MaxLag. No check if zero.
+	MaxLag time.Duration
+
+	// http.DefaultClient if nil. Its Timeout has to be zero, the stream doesn't end.
+	Client *http.Client
+}
+
+// ReplicationStatus tells how far a follower is behind its leader, see
+// Driver.ReplicationStatus
+type ReplicationStatus struct {
+	Leader    string
+	Connected bool
+	Epoch     string // of the leader
+	Seq       uint64 // of the last change applied
+	LeaderSeq uint64 // of the last change the leader is known to have
+
+	// how old the last applied change was when it was applied, zero once the
+	// follower is known to be caught up
+	Lag         time.Duration
+	LastContact time.Time
+	Err         error // that broke the stream last
+}
+
+type follower struct {
+	leader string
+	opts   FollowOptions
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the follower stopped
+
+	mu     sync.Mutex // guards status
+	status ReplicationStatus
+	behind time.Time // when the follower fell behind or lost the leader, zero when it's not
+}
+
+type followPosition struct {
+	Leader string `json:"leader"`
+	Epoch  string `json:"epoch"`
+	Seq    uint64 `json:"seq"`
+}
+
+// Follow turns the Driver into a read only follower of the leader serving
+// ReplicationHandler at leaderURL. Writes fail with ErrReadOnly while changes of
+// the leader are applied in the background, reconnecting after disconnects and
+// catching up from where the follower left off. A follower whose position the
+// leader no longer has is brought up to date with a snapshot, which also removes
+// records the leader doesn't have.
+func (d *Driver) Follow(leaderURL string, opts *FollowOptions) error {
+	if _, err := url.Parse(leaderURL); err != nil {
+		return fmt.Errorf("invalid leader URL: %v", err)
+	}
+
+	f := &follower{leader: leaderURL, done: make(chan struct{})}
+	if opts != nil {
+		f.opts = *opts
+	}
+	if f.opts.RetryInterval <= 0 {
+		f.opts.RetryInterval = time.Second
+	}
+	if f.opts.Client == nil {
+		f.opts.Client = http.DefaultClient
+	}
+	f.status.Leader = leaderURL
+	f.behind = time.Now()
+
+	// the epoch tells whether the position is still good, whatever the leader's URL
+	pos, err := d.readFollowPosition()
+	if err != nil {
+		return err
+	}
+	f.status.Epoch, f.status.Seq, f.status.LeaderSeq = pos.Epoch, pos.Seq, pos.Seq
+
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+	if d.follower != nil {
+		return fmt.Errorf("already following %v", d.follower.leader)
+	}
+	if d.raft != nil {
+		return fmt.Errorf("a node of a cluster can't follow another leader")
+	}
+	select {
+	case <-d.done:
+		return fmt.Errorf("database is closed")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	d.follower = f
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer close(f.done)
+		d.follow(ctx, f)
+	}()
+	go func() {
+		select {
+		case <-d.done:
+			cancel()
+		case <-f.done:
+		}
+	}()
+	return nil
+}
+
+// Unfollow stops applying the leader's changes and makes the Driver writable again,
+// e.g. to promote it when the leader is gone for good
+func (d *Driver) Unfollow() {
+	d.fmu.Lock()
+	f := d.follower
+	d.fmu.Unlock()
+	if f == nil {
+		return
+	}
+
+	f.cancel()
+	<-f.done
+
+	d.fmu.Lock()
+	d.follower = nil
+	d.fmu.Unlock()
+}
+
+// ReplicationStatus reports how the follower is doing and false if the Driver
+// isn't following a leader
+func (d *Driver) ReplicationStatus() (ReplicationStatus, bool) {
+	f := d.currentFollower()
+	if f == nil {
+		return ReplicationStatus{}, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status, true
+}
+
+func (d *Driver) currentFollower() *follower {
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+	return d.follower
+}
+
+// writable fails with ErrReadOnly while the Driver follows a leader or is in a
+// cluster, where only Write and Delete are replicated
+func (d *Driver) writable() error {
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+	if d.follower != nil {
+		return fmt.Errorf("%w: following %v", ErrReadOnly, d.follower.leader)
+	}
+	if d.raft != nil {
+		return fmt.Errorf("%w: in a cluster only Write and Delete are replicated", ErrReadOnly)
+	}
+	return nil
+}
+
+// follow streams from the leader until ctx is cancelled, reconnecting with backoff
+func (d *Driver) follow(ctx context.Context, f *follower) {
+	wait := f.opts.RetryInterval
+	for {
+		applied, err := d.followOnce(ctx, f)
+		if ctx.Err() != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.status.Connected = false
+		f.status.Err = err
+		if f.behind.IsZero() {
+			f.behind = time.Now()
+		}
+		f.mu.Unlock()
+		d.logf(LevelWarning, "Replication stream broke", "operation", "follow", "leader", f.leader, "error", err)
+		d.background.set("replication", err)
+
+		if applied {
+			wait = f.opts.RetryInterval // the leader was there, start over with short waits
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > time.Minute {
+			wait = time.Minute
+		}
+	}
+}
+
+// followOnce runs one replication stream and reports whether it got anywhere
+func (d *Driver) followOnce(ctx context.Context, f *follower) (bool, error) {
+	f.mu.Lock()
+	epoch, seq := f.status.Epoch, f.status.Seq
+	f.mu.Unlock()
+
+	u, err := url.Parse(f.leader)
+	if err != nil {
+		return false, err
+	}
+	q := u.Query()
+	q.Set("epoch", epoch)
+	q.Set("seq", strconv.FormatUint(seq, 10))
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := f.opts.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("leader answered %v: %w", resp.Status, readError(resp))
+	}
+
+	// the leader pings every watchKeepAlive, hearing nothing for longer means it's gone
+	watchdog := time.AfterFunc(2*watchKeepAlive, cancel)
+	defer watchdog.Stop()
+
+	var seen map[string]map[string]bool // records of the snapshot, while one runs
+	var snapshotEpoch string
+	applied := false
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return applied, err
+		}
+		watchdog.Reset(2 * watchKeepAlive)
+
+		var e ReplicationEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			return applied, fmt.Errorf("invalid replication event: %v", err)
+		}
+
+		switch e.Type {
+		case ReplStart:
+			f.mu.Lock()
+			f.status.Connected = true
+			f.status.Err = nil
+			f.status.LeaderSeq = e.Seq // the leader may have restarted and counts anew
+			if !e.Snapshot {
+				f.status.Epoch, f.status.Seq = e.Epoch, e.Seq
+			}
+			f.mu.Unlock()
+			if e.Snapshot {
+				// the position moves once the snapshot is complete, a broken one starts over
+				seen = map[string]map[string]bool{}
+				snapshotEpoch = e.Epoch
+			}
+			d.background.set("replication", nil)
+
+		case ReplRecord:
+			if seen == nil || e.Change == nil {
+				return applied, fmt.Errorf("snapshot record outside a snapshot")
+			}
+			if err := d.applyChange(e.Change); err != nil {
+				return applied, err
+			}
+			if seen[e.Change.Collection] == nil {
+				seen[e.Change.Collection] = map[string]bool{}
+			}
+			seen[e.Change.Collection][e.Change.Resource] = true
+
+		case ReplSnapshotEnd:
+			if err := d.pruneSnapshot(seen); err != nil {
+				return applied, err
+			}
+			seen = nil
+			applied = true
+			f.mu.Lock()
+			f.status.Epoch, f.status.Seq = snapshotEpoch, e.Seq
+			f.mu.Unlock()
+
+		case ReplChange:
+			if e.Change == nil {
+				return applied, fmt.Errorf("change event without a change")
+			}
+			if err := d.applyChange(e.Change); err != nil {
+				return applied, err
+			}
+			applied = true
+			f.mu.Lock()
+			f.status.Seq = e.Seq
+			f.status.Lag = time.Since(e.Change.Time)
+			f.mu.Unlock()
+
+		case ReplPing:
+		}
+
+		f.mu.Lock()
+		f.status.LastContact = time.Now()
+		if e.Seq > f.status.LeaderSeq {
+			f.status.LeaderSeq = e.Seq
+		}
+		caughtUp := seen == nil && f.status.Seq >= f.status.LeaderSeq && br.Buffered() == 0
+		if caughtUp {
+			f.status.Lag = 0
+			f.behind = time.Time{}
+		} else if f.behind.IsZero() {
+			f.behind = time.Now()
+		}
+		pos := followPosition{Leader: f.leader, Epoch: f.status.Epoch, Seq: f.status.Seq}
+		f.mu.Unlock()
+
+		// saved whenever the stream pauses rather than after every change, applying a
+		// change twice after a restart does no harm
+		if seen == nil && br.Buffered() == 0 && e.Type != ReplPing {
+			if err := d.writeFollowPosition(pos); err != nil {
+				return applied, err
+			}
+		}
+	}
+}
+
+// applyChange makes a change of the leader's on the follower
+func (d *Driver) applyChange(c *Change) error {
+	if c.Collection == "" {
+		return fmt.Errorf("change without a collection")
+	}
+	if err := d.checkNames(c.Collection, c.Resource); err != nil {
+		return err
+	}
+	mutex := d.lockFor(c.Collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	switch c.Op {
+	case ChangeWrite:
+		if err := d.checkResourceName(c.Resource); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(d.dir, c.Collection), 0755); err != nil {
+			return err
+		}
+		// stored the way Write stores records
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, c.Record, "", "\t"); err != nil {
+			return fmt.Errorf("invalid record %v/%v: %v", c.Collection, c.Resource, err)
+		}
+		buf.WriteByte('\n')
+		if err := d.storeRecord(c.Collection, c.Resource, buf.Bytes()); err != nil {
+			return err
+		}
+		return d.takeClock(c.Collection, c.Resource, c.Clock)
+
+	case ChangeDelete:
+		if _, err := d.removeRecord(c.Collection, c.Resource); err != nil {
+			return err
+		}
+		return d.takeClock(c.Collection, c.Resource, c.Clock)
+
+	case ChangeDrop:
+		if _, err := os.Stat(filepath.Join(d.dir, c.Collection)); os.IsNotExist(err) {
+			return nil
+		}
+		return d.dropCollection(c.Collection)
+	}
+	return fmt.Errorf("unknown change %q", c.Op)
+}
+
+// pruneSnapshot removes what the follower has and the snapshot didn't
+func (d *Driver) pruneSnapshot(seen map[string]map[string]bool) error {
+	collections, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if seen[collection] == nil {
+			if err := d.applyChange(&Change{Op: ChangeDrop, Collection: collection}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		names, err := d.listRecords(collection)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, name := range names {
+			if seen[collection][name] {
+				continue
+			}
+			if err := d.applyChange(&Change{Op: ChangeDelete, Collection: collection, Resource: name}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Driver) readFollowPosition() (followPosition, error) {
+	var pos followPosition
+	b, err := ioutil.ReadFile(filepath.Join(d.dir, followPositionFile))
+	if os.IsNotExist(err) {
+		return pos, nil
+	}
+	if err != nil {
+		return pos, err
+	}
+	if err := json.Unmarshal(b, &pos); err != nil {
+		return pos, fmt.Errorf("invalid %v: %v", followPositionFile, err)
+	}
+	return pos, nil
+}
+
+func (d *Driver) writeFollowPosition(pos followPosition) error {
+	b, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(d.dir, followPositionFile), b)
+}
+
+// followHealth adds the replication problems of a follower to Health
+func (d *Driver) followHealth(problem func(format string, args ...interface{})) {
+	f := d.currentFollower()
+	if f == nil || f.opts.MaxLag <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.behind.IsZero() && time.Since(f.behind) > f.opts.MaxLag {
+		if f.status.Connected {
+			problem("replica %d changes behind %v for %v", f.status.LeaderSeq-f.status.Seq, f.leader, time.Since(f.behind).Round(time.Second))
+		} else {
+			problem("replica lost %v %v ago", f.leader, time.Since(f.behind).Round(time.Second))
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the manifest in the database directory, next to the collections
+const formatFile = "_format.json"
+
+// formatVersion is the layout this Driver writes. Bump it along with a new entry in
+// formatUpgrades whenever the files change in a way older layouts have to be moved to.
+const formatVersion = 1
+
+// formatUpgrades moves a database from format i to i+1, in turn until it's at
+// formatVersion. Each runs before anything else reads the database.
+var formatUpgrades = []func(d *Driver) error{
+	// 0, databases from before the manifest, are laid out as format 1 already
+	0: func(d *Driver) error { return nil },
+}
+
+// Manifest describes how a database is stored, it's what its _format.json holds.
+// Drivers refuse to open databases whose manifest they can't read the records of.
+type Manifest struct {
+	Format   int            `json:"format"`
+	Driver   string         `json:"driver"`           // the Version that last wrote it
+	Codec    string         `json:"codec"`            // of the records, "json"
+	Keys     string         `json:"keys"`             // how names are kept in files, "plain" or "portable"
+	Shards   map[string]int `json:"shards,omitempty"` // by collection, which Options.Shards has to match
+	Engine   string         `json:"engine,omitempty"` // "lsm" for LSMEngine, files if empty
+	Created  time.Time      `json:"created"`
+	Upgraded time.Time      `json:"upgraded"`
+}
+
+// Manifest returns the manifest of the database as it was opened
+func (d *Driver) Manifest() Manifest {
+	return d.manifest
+}
+
+// layoutManifest is the manifest of a database written with the Driver's options
+func (d *Driver) layoutManifest() Manifest {
+	m := Manifest{Format: formatVersion, Driver: Version, Codec: "json", Keys: "plain"}
+	if d.portableKeys {
+		m.Keys = "portable"
+	}
+	if d.engine == LSMEngine {
+		m.Engine = d.engine.String()
+	}
+	for collection, n := range d.shards {
+		if n > 1 {
+			if m.Shards == nil {
+				m.Shards = map[string]int{}
+			}
+			m.Shards[collection] = n
+		}
+	}
+	return m
+}
+
+// createManifest writes the manifest of a new database
+func (d *Driver) createManifest() error {
+	d.manifest = d.layoutManifest()
+	d.manifest.Created = time.Now()
+	return d.storeManifest()
+}
+
+// openManifest checks that the database can be read with the Driver's options and
+// upgrades it to formatVersion if it's older, failing with ErrFormat otherwise
+func (d *Driver) openManifest() error {
+	want := d.layoutManifest()
+	b, err := ioutil.ReadFile(filepath.Join(d.dir, formatFile))
+	switch {
+	case os.IsNotExist(err):
+		// from before the manifest, it's taken to have been written with these options
+		d.manifest = want
+		d.manifest.Format = 0
+		d.manifest.Created = time.Now()
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &d.manifest); err != nil {
+			return fmt.Errorf("%w: invalid %v: %v", ErrFormat, formatFile, err)
+		}
+	}
+
+	m := d.manifest
+	if m.Format > formatVersion {
+		return fmt.Errorf("%w: the database is format %d, written by version %v, this is version %v which reads format %d at most",
+			ErrFormat, m.Format, m.Driver, Version, formatVersion)
+	}
+	if m.Codec != want.Codec {
+		return fmt.Errorf("%w: the records are stored as %v, not %v", ErrFormat, m.Codec, want.Codec)
+	}
+	if m.Keys != want.Keys {
+		return fmt.Errorf("%w: the database was written with %v keys, open it with Options.PortableKeys %v",
+			ErrFormat, m.Keys, m.Keys == "portable")
+	}
+	if m.Engine != want.Engine {
+		stored := FileEngine
+		if m.Engine == LSMEngine.String() {
+			stored = LSMEngine
+		}
+		return fmt.Errorf("%w: the records are stored by the %v engine, not %v", ErrFormat, stored, d.engine)
+	}
+	added, problems := d.shardMismatch(m.Shards, want.Shards)
+	if problems != "" {
+		return fmt.Errorf("%w: Options.Shards doesn't match how the records are stored: %v", ErrFormat, problems)
+	}
+	d.manifest.Shards = want.Shards
+
+	if m.Format == formatVersion {
+		if m.Driver == Version && !added {
+			return nil
+		}
+		d.manifest.Driver = Version
+		return d.storeManifest()
+	}
+	for m.Format < formatVersion {
+		d.logf(LevelInfo, "Upgrading database format", "dir", d.dir, "from", m.Format, "to", m.Format+1)
+		if err := formatUpgrades[m.Format](d); err != nil {
+			return fmt.Errorf("upgrading the database from format %d: %w", m.Format, err)
+		}
+		m.Format++
+		// after each step, so an upgrade cut short picks up where it stopped
+		d.manifest.Format, d.manifest.Driver, d.manifest.Upgraded = m.Format, Version, time.Now()
+		if err := d.storeManifest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardMismatch tells the collections sharded differently in stored and options.
+// Collections with no records yet can be sharded, it reports whether any were.
+func (d *Driver) shardMismatch(stored, options map[string]int) (bool, string) {
+	added := false
+	var problems []string
+	for collection, n := range stored {
+		if options[collection] != n {
+			problems = append(problems, fmt.Sprintf("%v has %d shards, not %d", collection, n, options[collection]))
+		}
+	}
+	for collection, n := range options {
+		if _, ok := stored[collection]; ok {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(d.dir, collection)); err == nil {
+			problems = append(problems, fmt.Sprintf("%v isn't sharded, not %d ways", collection, n))
+		}
+		added = true
+	}
+	sort.Strings(problems)
+	return added, strings.Join(problems, ", ")
+}
+
+func (d *Driver) storeManifest() error {
+	b, err := json.MarshalIndent(d.manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(d.dir, formatFile), append(b, '\n'))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how old the files a crashed write leaves behind have to be for CollectGarbage to
+// remove them, so it never takes the files of a write still under way
+const staleAfter = time.Hour
+
+// GarbageKind is what sort of leftover CollectGarbage found
+type GarbageKind string
+
+const (
+	GarbageTmpFile     GarbageKind = "tmp_file"    // of a write that never finished
+	GarbageChunks      GarbageKind = "chunks"      // a generation of chunks no record points at
+	GarbageAttachments GarbageKind = "attachments" // the attachments of a record that's gone
+	GarbageIndexEntry  GarbageKind = "index_entry" // an index entry of a record that's gone
+)
+
+// Garbage is a leftover CollectGarbage found, and removed unless it was a dry run
+type Garbage struct {
+	Kind       GarbageKind
+	Path       string // of the file or directory, the index file for index entries
+	Collection string // of attachments and index entries
+	Resource   string
+	Size       int64
+}
+
+// GarbageReport is what CollectGarbage found
+type GarbageReport struct {
+	DryRun    bool
+	Found     []Garbage
+	Reclaimed int64 // bytes freed, or that would be without DryRun
+}
+
+// CollectGarbage removes what's left behind of records and writes that are gone:
+// tmp files and generations of chunks of writes that crashed, attachments of
+// records deleted by something else than Delete and index entries of records that
+// aren't stored anymore. Files are only taken once staleAfter old, so writes still
+// under way keep theirs. With dryRun nothing is removed, the report says what would
+// be. It runs online like Vacuum, which collects garbage too.
+func (d *Driver) CollectGarbage(dryRun bool) (GarbageReport, error) {
+	if err := d.enter(); err != nil {
+		return GarbageReport{DryRun: dryRun}, err
+	}
+	defer d.leave()
+	return d.collectGarbage(dryRun)
+}
+
+func (d *Driver) collectGarbage(dryRun bool) (GarbageReport, error) {
+	report := GarbageReport{DryRun: dryRun}
+	found := func(g Garbage) {
+		report.Found = append(report.Found, g)
+		report.Reclaimed += g.Size
+	}
+	before := time.Now().Add(-staleAfter)
+
+	err := filepath.Walk(d.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		switch name := fi.Name(); {
+		case fi.IsDir() && strings.HasSuffix(name, chunkSuffix):
+			garbage, err := staleChunks(p, before)
+			if err == nil && !dryRun {
+				err = removeGarbage(garbage)
+			}
+			for _, g := range garbage {
+				found(g)
+			}
+			if err != nil {
+				return err
+			}
+			return filepath.SkipDir
+
+		case fi.IsDir() && strings.HasSuffix(name, attachmentSuffix):
+			g, orphaned, err := d.orphanedAttachments(p, dryRun)
+			if err != nil {
+				return err
+			}
+			if orphaned {
+				found(g)
+				return filepath.SkipDir
+			}
+
+		case fi.Mode().IsRegular() && filepath.Ext(name) == ".tmp" && fi.ModTime().Before(before):
+			g := Garbage{Kind: GarbageTmpFile, Path: p, Size: fi.Size()}
+			if !dryRun {
+				if err := removeGarbage([]Garbage{g}); err != nil {
+					return err
+				}
+			}
+			found(g)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	entries, err := d.danglingIndexEntries(dryRun)
+	for _, g := range entries {
+		found(g)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Found"
+	}
+	d.logf(LevelInfo, verb+" garbage", "operation", "gc", "artifacts", len(report.Found), "bytes", report.Reclaimed)
+	return report, nil
+}
+
+func removeGarbage(garbage []Garbage) error {
+	for _, g := range garbage {
+		if err := os.RemoveAll(g.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleChunks lists the generations of chunks in dir the manifest of their record
+// doesn't point at (all of them without a record) that were written before then
+func staleChunks(dir string, before time.Time) ([]Garbage, error) {
+	var current string
+	if b, err := ioutil.ReadFile(strings.TrimSuffix(dir, chunkSuffix) + ".json"); err == nil && isChunked(b) {
+		if m, err := parseManifest(b); err == nil {
+			current = m.Gen
+		}
+	}
+
+	gens, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var garbage []Garbage
+	for _, gen := range gens {
+		// generations are named after the time they were written
+		written := gen.ModTime()
+		if ns, err := strconv.ParseInt(gen.Name(), 36, 64); err == nil {
+			written = time.Unix(0, ns)
+		}
+		if gen.Name() == current || !written.Before(before) {
+			continue
+		}
+		p := filepath.Join(dir, gen.Name())
+		size, err := dirSize(p)
+		if err != nil {
+			return nil, err
+		}
+		garbage = append(garbage, Garbage{Kind: GarbageChunks, Path: p, Size: size})
+	}
+	return garbage, nil
+}
+
+// orphanedAttachments tells whether the attachments in dir belong to a record that's
+// gone, and removes them unless dryRun
+func (d *Driver) orphanedAttachments(dir string, dryRun bool) (Garbage, bool, error) {
+	collection, err := d.collectionOf(filepath.Dir(dir))
+	if err != nil {
+		return Garbage{}, false, err
+	}
+	resource, ok := d.recordName(strings.TrimSuffix(filepath.Base(dir), attachmentSuffix) + ".json")
+	if !ok {
+		return Garbage{}, false, nil
+	}
+
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if d.recordExists(collection, resource) {
+		return Garbage{}, false, nil
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		return Garbage{}, false, err
+	}
+	g := Garbage{Kind: GarbageAttachments, Path: dir, Collection: collection, Resource: resource, Size: size}
+	if !dryRun {
+		if err := removeGarbage([]Garbage{g}); err != nil {
+			return g, false, err
+		}
+	}
+	return g, true, nil
+}
+
+// collectionOf is the collection whose records are in dir, a directory below the
+// database directory
+func (d *Driver) collectionOf(dir string) (string, error) {
+	rel, err := filepath.Rel(d.dir, dir)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if parent := path.Dir(rel); parent != "." {
+		if n := d.shardCount(parent); n > 0 && isShard(path.Base(rel), n) {
+			return parent, nil
+		}
+	}
+	return rel, nil
+}
+
+// danglingIndexEntries lists the index entries of records that aren't stored, and
+// removes them unless dryRun
+func (d *Driver) danglingIndexEntries(dryRun bool) ([]Garbage, error) {
+	d.imu.RLock()
+	var indexes []*index
+	for _, byField := range d.indexes {
+		for _, ix := range byField {
+			indexes = append(indexes, ix)
+		}
+	}
+	d.imu.RUnlock()
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].path < indexes[j].path })
+
+	var garbage []Garbage
+	for _, ix := range indexes {
+		mutex := d.lockFor(ix.collection)
+		mutex.Lock()
+		ix.mu.RLock()
+		names, err := ix.names()
+		ix.mu.RUnlock()
+		if err != nil {
+			mutex.Unlock()
+			return garbage, fmt.Errorf("index %v(%v): %w", ix.collection, indexName(ix.fields), err)
+		}
+		var dangling []string
+		for _, name := range names {
+			if !d.recordExists(ix.collection, name) {
+				dangling = append(dangling, name)
+			}
+		}
+
+		for _, name := range dangling {
+			garbage = append(garbage, Garbage{Kind: GarbageIndexEntry, Path: ix.path, Collection: ix.collection, Resource: name})
+			if dryRun {
+				continue
+			}
+			if err := ix.del(name); err != nil {
+				mutex.Unlock()
+				return garbage, fmt.Errorf("index %v(%v): %w", ix.collection, indexName(ix.fields), err)
+			}
+		}
+		mutex.Unlock()
+	}
+	return garbage, nil
+}
@@ -0,0 +1,849 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// RegisterType tells the GraphQL layer what the records of a collection look like,
+// e.g. RegisterType("users", User{}). Every registered collection gets a field in
+// the Query type and write/delete fields in the Mutation type:
+//
+//	type Query {
+//		users(id: ID, filter: JSON, orderBy: String, desc: Boolean, limit: Int, after: ID): [User!]!
+//	}
+//	type Mutation {
+//		writeUsers(id: ID!, input: JSON!): User
+//		deleteUsers(id: ID!): Boolean!
+//	}
+//
+// filter is a filter document as ParseFilter takes it and every record type has an
+// _id field holding its resource name, which after takes to page through the records
+// as After does and orderBy takes to sort on it. Field names follow the json tags.
+func (d *Driver) RegisterType(collection string, v interface{}) error {
+	if collection == "" {
+		return fmt.Errorf("%w - unable to register type", ErrEmptyCollection)
+	}
+	if err := d.checkNames(collection, ""); err != nil {
+		return err
+	}
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("records of %v must be structs, not %v", collection, reflect.TypeOf(v))
+	}
+	if !gqlNameRe.MatchString(gqlFieldName(collection)) {
+		return fmt.Errorf("collection %q has no usable GraphQL name", collection)
+	}
+
+	d.gmu.Lock()
+	defer d.gmu.Unlock()
+	if d.gqlTypes == nil {
+		d.gqlTypes = map[string]reflect.Type{}
+	}
+	d.gqlTypes[collection] = t
+	d.gqlSchema = nil // built again on next use
+	return nil
+}
+
+// GraphQLSchema returns the schema of the registered collections in the GraphQL
+// schema language
+func (d *Driver) GraphQLSchema() string {
+	return d.schema().sdl()
+}
+
+// how big the body of a GraphQL POST may be
+const maxGQLBody = 1 << 20
+
+// GraphQLHandler serves GraphQL queries and mutations over HTTP, as a POST of
+// {"query": ..., "variables": ..., "operationName": ...} or a GET with a query
+// parameter. A GET without one returns the schema. Bodies over 1MB are refused.
+func (d *Driver) GraphQLHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query         string                 `json:"query"`
+			Variables     map[string]interface{} `json:"variables"`
+			OperationName string                 `json:"operationName"`
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			req.Query = r.URL.Query().Get("query")
+			req.OperationName = r.URL.Query().Get("operationName")
+			if req.Query == "" {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				fmt.Fprint(w, d.GraphQLSchema())
+				return
+			}
+			if vars := r.URL.Query().Get("variables"); vars != "" {
+				dec := json.NewDecoder(strings.NewReader(vars))
+				dec.UseNumber()
+				if err := dec.Decode(&req.Variables); err != nil {
+					writeGQLError(w, http.StatusBadRequest, fmt.Errorf("invalid variables: %v", err))
+					return
+				}
+			}
+
+		case http.MethodPost:
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGQLBody))
+			dec.UseNumber()
+			if err := dec.Decode(&req); err != nil {
+				writeGQLError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+				return
+			}
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, CodeMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		data, err := d.graphQL(req.Query, req.Variables, req.OperationName, clientOf(r), d.authorizer(r))
+		if err != nil {
+			writeGQLError(w, http.StatusOK, err) // GraphQL errors still come back as 200
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	})
+}
+
+func writeGQLError(w http.ResponseWriter, status int, err error) {
+	code := CodeOf(err)
+	if status == http.StatusBadRequest {
+		code = CodeBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": nil,
+		"errors": []map[string]interface{}{{
+			"message":    err.Error(),
+			"extensions": map[string]ErrorCode{"code": code},
+		}},
+	})
+}
+
+// GraphQL runs a GraphQL document against the registered collections and returns
+// the data of the operation, which can be marshalled to JSON as is. operationName
+// picks one of several operations.
+func (d *Driver) GraphQL(query string, variables map[string]interface{}, operationName string) (interface{}, error) {
+	return d.graphQL(query, variables, operationName, "", nil)
+}
+
+// graphQL runs a document for who, who may do what authorize allows, anything if
+// it's nil
+func (d *Driver) graphQL(query string, variables map[string]interface{}, operationName, who string, authorize func(string, Permission) error) (interface{}, error) {
+	ops, err := parseGraphQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var op *gqlOperation
+	for _, o := range ops {
+		if operationName == "" && len(ops) == 1 || o.name == operationName && operationName != "" {
+			op = o
+		}
+	}
+	if op == nil {
+		if operationName == "" {
+			return nil, fmt.Errorf("query has %d operations, pick one with operationName", len(ops))
+		}
+		return nil, fmt.Errorf("query has no operation %v", operationName)
+	}
+
+	vars := map[string]interface{}{}
+	for k, v := range op.variables {
+		vars[k] = v
+	}
+	for k, v := range variables {
+		vars[k] = v
+	}
+
+	ex := &gqlExec{d: d, schema: d.schema(), vars: vars, who: who, authorize: authorize}
+	return ex.operation(op)
+}
+
+// the schema, built from the registered types
+
+var gqlNameRe = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+type gqlType struct {
+	name   string
+	fields []*gqlField
+	byName map[string]*gqlField
+	record bool // the type of a collection's records, which have an _id
+}
+
+type gqlField struct {
+	name   string   // in GraphQL and in the JSON of the record
+	scalar string   // String, Int, Float, Boolean or JSON, empty for objects
+	object *gqlType // for fields holding structs
+	list   bool
+}
+
+func (f *gqlField) typeName() string {
+	t := f.scalar
+	if f.object != nil {
+		t = f.object.name
+	}
+	if f.list {
+		return "[" + t + "]"
+	}
+	return t
+}
+
+type gqlRoot struct {
+	collection string
+	typ        *gqlType
+}
+
+type gqlSchemaDef struct {
+	types     []*gqlType          // object types in the order they were found
+	queries   map[string]*gqlRoot // users -> users
+	writes    map[string]*gqlRoot // writeUsers -> users
+	deletes   map[string]*gqlRoot // deleteUsers -> users
+	rootNames []string            // sorted query field names
+}
+
+// gqlFieldName is the Query field of a collection
+func gqlFieldName(collection string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return '_'
+	}, collection)
+}
+
+func gqlCapitalize(name string) string {
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func (d *Driver) schema() *gqlSchemaDef {
+	d.gmu.Lock()
+	defer d.gmu.Unlock()
+	if d.gqlSchema != nil {
+		return d.gqlSchema
+	}
+
+	s := &gqlSchemaDef{queries: map[string]*gqlRoot{}, writes: map[string]*gqlRoot{}, deletes: map[string]*gqlRoot{}}
+	b := &gqlBuilder{schema: s, byType: map[reflect.Type]*gqlType{}, names: map[string]bool{}}
+
+	collections := make([]string, 0, len(d.gqlTypes))
+	for collection := range d.gqlTypes {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	for _, collection := range collections {
+		t := d.gqlTypes[collection]
+		typ := b.object(t, gqlCapitalize(gqlFieldName(collection)))
+		typ.record = true
+
+		root := &gqlRoot{collection: collection, typ: typ}
+		name := gqlFieldName(collection)
+		s.queries[name] = root
+		s.writes["write"+gqlCapitalize(name)] = root
+		s.deletes["delete"+gqlCapitalize(name)] = root
+		s.rootNames = append(s.rootNames, name)
+	}
+
+	d.gqlSchema = s
+	return s
+}
+
+type gqlBuilder struct {
+	schema *gqlSchemaDef
+	byType map[reflect.Type]*gqlType
+	names  map[string]bool
+}
+
+var (
+	jsonNumberType = reflect.TypeOf(json.Number(""))
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	timeType       = reflect.TypeOf(time.Time{})
+)
+
+// object returns the GraphQL type of a struct, fallback naming anonymous ones
+func (b *gqlBuilder) object(t reflect.Type, fallback string) *gqlType {
+	if typ, ok := b.byType[t]; ok {
+		return typ
+	}
+
+	name := t.Name()
+	if name == "" {
+		name = fallback
+	}
+	// two Go types of the same name from different packages
+	for base, i := name, 2; b.names[name]; i++ {
+		name = fmt.Sprintf("%v%d", base, i)
+	}
+	b.names[name] = true
+
+	typ := &gqlType{name: name, byName: map[string]*gqlField{}}
+	b.byType[t] = typ // before the fields, they may lead back to t
+	b.schema.types = append(b.schema.types, typ)
+	b.fields(typ, t)
+	return typ
+}
+
+// fields adds the fields of struct t to typ the way encoding/json sees them
+func (b *gqlBuilder) fields(typ *gqlType, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := sf.Name
+		if tag := sf.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			} else if sf.Anonymous {
+				name = ""
+			}
+		} else if sf.Anonymous {
+			name = ""
+		}
+
+		ft := sf.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		// fields of embedded structs are promoted
+		if name == "" && ft.Kind() == reflect.Struct {
+			b.fields(typ, ft)
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if sf.PkgPath != "" || !gqlNameRe.MatchString(name) || strings.HasPrefix(name, "__") || name == "_id" {
+			continue
+		}
+		if _, dup := typ.byName[name]; dup {
+			continue
+		}
+
+		f := &gqlField{name: name}
+		b.fieldType(f, ft, typ.name+gqlCapitalize(name))
+		typ.fields = append(typ.fields, f)
+		typ.byName[name] = f
+	}
+}
+
+func (b *gqlBuilder) fieldType(f *gqlField, t reflect.Type, fallback string) {
+	switch {
+	case t == jsonNumberType:
+		f.scalar = "Float"
+		return
+	case t == rawMessageType:
+		f.scalar = "JSON"
+		return
+	case t == timeType:
+		f.scalar = "String"
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		f.scalar = "String"
+	case reflect.Bool:
+		f.scalar = "Boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f.scalar = "Int"
+	case reflect.Float32, reflect.Float64:
+		f.scalar = "Float"
+	case reflect.Struct:
+		f.object = b.object(t, fallback)
+	case reflect.Slice, reflect.Array:
+		elem := t.Elem()
+		for elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		if elem.Kind() == reflect.Uint8 {
+			f.scalar = "String" // []byte is base64 in JSON
+			return
+		}
+		if k := elem.Kind(); k == reflect.Slice || k == reflect.Array {
+			f.scalar = "JSON" // lists of lists
+			return
+		}
+		f.list = true
+		b.fieldType(f, elem, fallback)
+	default:
+		f.scalar = "JSON"
+	}
+}
+
+func (s *gqlSchemaDef) sdl() string {
+	var b strings.Builder
+	b.WriteString("scalar JSON\n")
+
+	for _, t := range s.types {
+		fmt.Fprintf(&b, "\ntype %v {\n", t.name)
+		if t.record {
+			b.WriteString("\t_id: ID!\n")
+		}
+		for _, f := range t.fields {
+			fmt.Fprintf(&b, "\t%v: %v\n", f.name, f.typeName())
+		}
+		b.WriteString("}\n")
+	}
+
+	if len(s.rootNames) == 0 {
+		return b.String()
+	}
+
+	b.WriteString("\ntype Query {\n")
+	for _, name := range s.rootNames {
+		fmt.Fprintf(&b, "\t%v(id: ID, filter: JSON, orderBy: String, desc: Boolean, limit: Int, after: ID): [%v!]!\n", name, s.queries[name].typ.name)
+	}
+	b.WriteString("}\n\ntype Mutation {\n")
+	for _, name := range s.rootNames {
+		typ := s.queries[name].typ.name
+		fmt.Fprintf(&b, "\twrite%v(id: ID!, input: JSON!): %v\n", gqlCapitalize(name), typ)
+		fmt.Fprintf(&b, "\tdelete%v(id: ID!): Boolean!\n", gqlCapitalize(name))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// execution
+
+type gqlExec struct {
+	d         *Driver
+	schema    *gqlSchemaDef
+	vars      map[string]interface{}
+	who       string                                      // for the read audit log
+	authorize func(collection string, p Permission) error // nil allows anything
+}
+
+func (ex *gqlExec) allow(collection string, p Permission) error {
+	if ex.authorize == nil {
+		return nil
+	}
+	return ex.authorize(collection, p)
+}
+
+// redacted masks doc, the decoded r, like reads of collection are
+func (ex *gqlExec) redacted(collection string, r *record, doc map[string]interface{}) (map[string]interface{}, error) {
+	if !ex.d.redacts(collection, nil) {
+		return doc, nil
+	}
+	r, err := ex.d.redactRecord(collection, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.decode()
+}
+
+// gqlObject keeps the fields of a result in the order they were selected
+type gqlObject []gqlPair
+
+type gqlPair struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, p := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(p.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(p.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (ex *gqlExec) operation(op *gqlOperation) (interface{}, error) {
+	var out gqlObject
+	for _, sel := range op.selections {
+		include, err := ex.included(sel)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+
+		var v interface{}
+		switch {
+		case sel.name == "__typename":
+			v = gqlCapitalize(op.kind)
+		case op.kind == "mutation":
+			v, err = ex.mutation(sel)
+		default:
+			v, err = ex.query(sel)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", sel.key(), err)
+		}
+		out = append(out, gqlPair{sel.key(), v})
+	}
+	return out, nil
+}
+
+// included applies @skip(if:) and @include(if:)
+func (ex *gqlExec) included(sel *gqlSelection) (bool, error) {
+	for _, dir := range sel.directives {
+		if dir.name != "skip" && dir.name != "include" {
+			return false, fmt.Errorf("unknown directive @%v", dir.name)
+		}
+		v, err := resolveGQLValue(dir.args["if"], ex.vars)
+		if err != nil {
+			return false, err
+		}
+		cond, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("@%v needs a Boolean if argument", dir.name)
+		}
+		if cond == (dir.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// args resolves the arguments of a field, failing on any it doesn't take
+func (ex *gqlExec) args(sel *gqlSelection, allowed ...string) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	for name, v := range sel.args {
+		known := false
+		for _, a := range allowed {
+			known = known || a == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown argument %v", name)
+		}
+		r, err := resolveGQLValue(v, ex.vars)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			out[name] = r
+		}
+	}
+	return out, nil
+}
+
+func (ex *gqlExec) query(sel *gqlSelection) (interface{}, error) {
+	root, ok := ex.schema.queries[sel.name]
+	if !ok {
+		return nil, fmt.Errorf("no field %v in type Query", sel.name)
+	}
+	if err := ex.allow(root.collection, PermRead); err != nil {
+		return nil, err
+	}
+	args, err := ex.args(sel, "id", "filter", "orderBy", "desc", "limit", "after")
+	if err != nil {
+		return nil, err
+	}
+
+	var filter Filter
+	if doc, ok := args["filter"]; ok {
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("filter must be an object")
+		}
+		if filter, err = DocumentFilter(m); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := []QueryOption{AuditAs(ex.who)}
+	if field, ok := args["orderBy"].(string); ok {
+		dir := Asc
+		if desc, _ := args["desc"].(bool); desc {
+			dir = Desc
+		}
+		if field == "_id" {
+			opts = append(opts, OrderByKey(dir))
+		} else {
+			opts = append(opts, OrderBy(field, dir))
+		}
+	}
+	if v, ok := args["limit"]; ok {
+		n, err := gqlInt(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("limit must be a positive Int")
+		}
+		opts = append(opts, Limit(n))
+	}
+	if v, ok := args["after"]; ok {
+		after, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("after must be a string")
+		}
+		opts = append(opts, After(after))
+	}
+
+	type found struct {
+		name string
+		doc  map[string]interface{}
+	}
+	var results []found
+
+	if id, ok := args["id"]; ok {
+		name, ok := id.(string)
+		if !ok {
+			return nil, fmt.Errorf("id must be a string")
+		}
+		_, name = ex.d.fold(root.collection, name)
+		r, err := ex.d.loadRecord(root.collection, name)
+		if os.IsNotExist(err) {
+			return []interface{}{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		doc, err := r.decode()
+		if err != nil {
+			return nil, err
+		}
+		if filter == nil || filter.Match(doc) {
+			if err := ex.d.auditRead(ex.who, opRead, root.collection, []string{name}); err != nil {
+				return nil, err
+			}
+			if doc, err = ex.redacted(root.collection, r, doc); err != nil {
+				return nil, err
+			}
+			results = append(results, found{name, doc})
+		}
+	} else {
+		err := ex.d.find(context.Background(), root.collection, filter, opts, func(records []*record, q *query) error {
+			records, err := ex.d.arrange(root.collection, records, q)
+			if err != nil {
+				return err
+			}
+			for _, r := range records {
+				// decoded into fresh maps, r.raw may sit in a pooled buffer
+				doc, err := r.decode()
+				if err != nil {
+					return err
+				}
+				if doc, err = ex.redacted(root.collection, r, doc); err != nil {
+					return err
+				}
+				results = append(results, found{r.name, doc})
+			}
+			return nil
+		})
+		if os.IsNotExist(err) {
+			return []interface{}{}, nil // no collection yet
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]interface{}, 0, len(results))
+	for _, f := range results {
+		obj, err := ex.object(root.typ, f.doc, f.name, sel)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, obj)
+	}
+	return out, nil
+}
+
+func gqlInt(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err
+	case float64:
+		if n == float64(int(n)) {
+			return int(n), nil
+		}
+	}
+	return 0, fmt.Errorf("not an Int: %v", v)
+}
+
+func (ex *gqlExec) mutation(sel *gqlSelection) (interface{}, error) {
+	if root, ok := ex.schema.writes[sel.name]; ok {
+		if err := ex.allow(root.collection, PermWrite); err != nil {
+			return nil, err
+		}
+		args, err := ex.args(sel, "id", "input")
+		if err != nil {
+			return nil, err
+		}
+		id, ok := args["id"].(string)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("id must be a non-empty string")
+		}
+		input, ok := args["input"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("input must be an object")
+		}
+
+		// through the registered type, so only its fields with the right types get in
+		b, err := json.Marshal(input)
+		if err != nil {
+			return nil, err
+		}
+		v := reflect.New(ex.d.gqlType(root.collection))
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(v.Interface()); err != nil {
+			return nil, fmt.Errorf("invalid input: %v", err)
+		}
+		if err := ex.d.Write(root.collection, id, v.Interface()); err != nil {
+			return nil, err
+		}
+
+		_, id = ex.d.fold(root.collection, id)
+		r, err := ex.d.loadRecord(root.collection, id)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := r.decode()
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = ex.redacted(root.collection, r, doc); err != nil {
+			return nil, err
+		}
+		return ex.object(root.typ, doc, id, sel)
+	}
+
+	if root, ok := ex.schema.deletes[sel.name]; ok {
+		if err := ex.allow(root.collection, PermDelete); err != nil {
+			return nil, err
+		}
+		args, err := ex.args(sel, "id")
+		if err != nil {
+			return nil, err
+		}
+		id, ok := args["id"].(string)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("id must be a non-empty string")
+		}
+		if len(sel.selections) > 0 {
+			return nil, fmt.Errorf("Boolean has no fields to select")
+		}
+
+		if err := ex.d.writable(); err != nil {
+			return nil, err
+		}
+		mutex := ex.d.lockFor(root.collection)
+		mutex.Lock()
+		defer mutex.Unlock()
+		return ex.d.removeRecord(root.collection, id)
+	}
+
+	return nil, fmt.Errorf("no field %v in type Mutation", sel.name)
+}
+
+func (d *Driver) gqlType(collection string) reflect.Type {
+	d.gmu.Lock()
+	defer d.gmu.Unlock()
+	return d.gqlTypes[collection]
+}
+
+// object picks the selected fields of a record (or a struct within one)
+func (ex *gqlExec) object(t *gqlType, doc map[string]interface{}, resource string, sel *gqlSelection) (gqlObject, error) {
+	if len(sel.selections) == 0 {
+		return nil, fmt.Errorf("%v of type %v needs a selection of its fields", sel.name, t.name)
+	}
+
+	out := make(gqlObject, 0, len(sel.selections))
+	for _, sub := range sel.selections {
+		include, err := ex.included(sub)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+		if len(sub.args) > 0 {
+			return nil, fmt.Errorf("%v.%v takes no arguments", t.name, sub.name)
+		}
+
+		switch {
+		case sub.name == "__typename":
+			out = append(out, gqlPair{sub.key(), t.name})
+			continue
+		case sub.name == "_id" && t.record:
+			out = append(out, gqlPair{sub.key(), resource})
+			continue
+		}
+
+		f, ok := t.byName[sub.name]
+		if !ok {
+			return nil, fmt.Errorf("no field %v in type %v", sub.name, t.name)
+		}
+		v, err := ex.value(f, doc[f.name], sub)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, gqlPair{sub.key(), v})
+	}
+	return out, nil
+}
+
+func (ex *gqlExec) value(f *gqlField, v interface{}, sel *gqlSelection) (interface{}, error) {
+	if f.object == nil {
+		if len(sel.selections) > 0 {
+			return nil, fmt.Errorf("%v of type %v has no fields to select", sel.name, f.typeName())
+		}
+		return v, nil
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	if f.list {
+		items, ok := v.([]interface{})
+		if !ok {
+			return nil, nil
+		}
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			obj, err := ex.object(f.object, m, "", sel)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = obj
+		}
+		return out, nil
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	return ex.object(f.object, m, "", sel)
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// the subset of GraphQL documents the GraphQL layer runs: operations with variables,
+// fields with aliases, arguments and nested selections, and @skip/@include.
+// Fragments aren't supported.
+
+type gqlOperation struct {
+	kind       string // query or mutation
+	name       string
+	variables  map[string]interface{} // defaults of the declared variables
+	selections []*gqlSelection
+}
+
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]gqlValue
+	directives []gqlDirective
+	selections []*gqlSelection
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]gqlValue
+}
+
+// gqlValue is an argument as written, resolved against the variables when used
+type gqlValue interface{}
+
+// gqlVariable is a $name in an argument
+type gqlVariable string
+
+// key is what a selection shows up as in the result
+func (s *gqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlTokenKind int
+
+const (
+	gqlTokEOF gqlTokenKind = iota
+	gqlTokName
+	gqlTokInt
+	gqlTokFloat
+	gqlTokString
+	gqlTokPunct
+)
+
+type gqlToken struct {
+	kind gqlTokenKind
+	text string
+	pos  int
+}
+
+func gqlTokenize(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++ // commas are insignificant in GraphQL
+
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+
+		case c == '.':
+			if !strings.HasPrefix(src[i:], "...") {
+				return nil, fmt.Errorf("unexpected . in query at %d", i)
+			}
+			tokens = append(tokens, gqlToken{gqlTokPunct, "...", i})
+			i += 3
+
+		case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+			tokens = append(tokens, gqlToken{gqlTokPunct, string(c), i})
+			i++
+
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, gqlToken{gqlTokName, src[i:j], i})
+			i = j
+
+		case c == '-' || c >= '0' && c <= '9':
+			j, kind := i+1, gqlTokInt
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || strings.IndexByte(".eE+-", src[j]) >= 0) {
+				if src[j] == '.' || src[j] == 'e' || src[j] == 'E' {
+					kind = gqlTokFloat
+				}
+				j++
+			}
+			tokens = append(tokens, gqlToken{kind, src[i:j], i})
+			i = j
+
+		case c == '"':
+			s, n, err := gqlString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v in query at %d", err, i)
+			}
+			tokens = append(tokens, gqlToken{gqlTokString, s, i})
+			i += n
+
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("unexpected %q in query at %d", r, i)
+		}
+	}
+	return append(tokens, gqlToken{kind: gqlTokEOF, pos: len(src)}), nil
+}
+
+// gqlString reads the string literal src starts with, returning its value and length
+func gqlString(src string) (string, int, error) {
+	if strings.HasPrefix(src, `"""`) {
+		end := strings.Index(src[3:], `"""`)
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated block string")
+		}
+		return strings.TrimSpace(src[3 : 3+end]), end + 6, nil
+	}
+
+	// GraphQL escapes are JSON's
+	for j := 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '\n':
+			return "", 0, fmt.Errorf("unterminated string")
+		case '"':
+			var s string
+			if err := json.Unmarshal([]byte(src[:j+1]), &s); err != nil {
+				return "", 0, fmt.Errorf("invalid string: %v", err)
+			}
+			return s, j + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// how deep selections, lists and objects may be nested in a query, so one can't
+// recurse the parser out of stack
+const maxGQLDepth = 64
+
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+	depth  int // of the selection, value or type being read
+}
+
+// nest enters a level of nesting, to be left with unnest
+func (p *gqlParser) nest() error {
+	p.depth++
+	if p.depth > maxGQLDepth {
+		return fmt.Errorf("query nested deeper than %d levels", maxGQLDepth)
+	}
+	return nil
+}
+
+func (p *gqlParser) unnest() {
+	p.depth--
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != gqlTokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *gqlParser) punct(s string) bool {
+	if t := p.peek(); t.kind == gqlTokPunct && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(s string) error {
+	if !p.punct(s) {
+		t := p.peek()
+		return fmt.Errorf("expected %v in query at %d, got %q", s, t.pos, t.text)
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	t := p.next()
+	if t.kind != gqlTokName {
+		return "", fmt.Errorf("expected a name in query at %d, got %q", t.pos, t.text)
+	}
+	return t.text, nil
+}
+
+// parseGraphQL parses a document into its operations
+func parseGraphQL(src string) ([]*gqlOperation, error) {
+	tokens, err := gqlTokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+
+	var ops []*gqlOperation
+	for p.peek().kind != gqlTokEOF {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("query has no operation")
+	}
+	return ops, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query", variables: map[string]interface{}{}}
+
+	// a bare { ... } is a query
+	if t := p.peek(); t.kind == gqlTokName {
+		switch t.text {
+		case "query", "mutation":
+			op.kind = t.text
+		case "subscription":
+			return nil, fmt.Errorf("subscriptions aren't supported")
+		case "fragment":
+			return nil, fmt.Errorf("fragments aren't supported")
+		default:
+			return nil, fmt.Errorf("unexpected %q in query at %d", t.text, t.pos)
+		}
+		p.next()
+
+		if p.peek().kind == gqlTokName {
+			op.name = p.next().text
+		}
+		if p.punct("(") {
+			if err := p.variableDefinitions(op); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := p.directives(); err != nil {
+			return nil, err
+		}
+	}
+
+	sels, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = sels
+	return op, nil
+}
+
+func (p *gqlParser) variableDefinitions(op *gqlOperation) error {
+	for !p.punct(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if p.punct("=") {
+			v, err := p.value()
+			if err != nil {
+				return err
+			}
+			def, err := resolveGQLValue(v, nil)
+			if err != nil {
+				return err
+			}
+			op.variables[name] = def
+		}
+	}
+	return nil
+}
+
+// typeRef skips a variable type such as [ID!]!, values are checked where they're used
+func (p *gqlParser) typeRef() error {
+	defer p.unnest()
+	if err := p.nest(); err != nil {
+		return err
+	}
+	if p.punct("[") {
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	p.punct("!")
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	defer p.unnest()
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var sels []*gqlSelection
+	for !p.punct("}") {
+		if p.peek().kind == gqlTokEOF {
+			return nil, fmt.Errorf("unterminated selection in query")
+		}
+		if p.punct("...") {
+			return nil, fmt.Errorf("fragments aren't supported")
+		}
+
+		sel := &gqlSelection{}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if p.punct(":") {
+			sel.alias = name
+			if name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		sel.name = name
+
+		if p.punct("(") {
+			if sel.args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t.kind == gqlTokPunct && t.text == "{" {
+			if sel.selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("empty selection in query")
+	}
+	return sels, nil
+}
+
+// arguments reads name: value pairs up to the closing parenthesis
+func (p *gqlParser) arguments() (map[string]gqlValue, error) {
+	args := map[string]gqlValue{}
+	for !p.punct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var dirs []gqlDirective
+	for p.punct("@") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		dir := gqlDirective{name: name}
+		if p.punct("(") {
+			if dir.args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// value reads a literal or variable. Numbers come back as json.Number, like the
+// numbers of decoded records, objects as map[string]gqlValue.
+func (p *gqlParser) value() (gqlValue, error) {
+	defer p.unnest()
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	switch t.kind {
+	case gqlTokInt, gqlTokFloat:
+		if _, err := strconv.ParseFloat(t.text, 64); err != nil {
+			return nil, fmt.Errorf("invalid number %q in query at %d", t.text, t.pos)
+		}
+		return json.Number(t.text), nil
+
+	case gqlTokString:
+		return t.text, nil
+
+	case gqlTokName:
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return t.text, nil // an enum value
+
+	case gqlTokPunct:
+		switch t.text {
+		case "$":
+			name, err := p.name()
+			return gqlVariable(name), err
+
+		case "[":
+			list := []gqlValue{}
+			for !p.punct("]") {
+				if p.peek().kind == gqlTokEOF {
+					return nil, fmt.Errorf("unterminated list in query")
+				}
+				v, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			return list, nil
+
+		case "{":
+			obj := map[string]gqlValue{}
+			for !p.punct("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.value(); err != nil {
+					return nil, err
+				}
+			}
+			return obj, nil
+		}
+	}
+	return nil, fmt.Errorf("expected a value in query at %d, got %q", t.pos, t.text)
+}
+
+// resolveGQLValue replaces the variables in an argument with their values, turning
+// it into plain JSON values
+func resolveGQLValue(v gqlValue, vars map[string]interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case gqlVariable:
+		value, ok := vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("variable $%v isn't set", string(v))
+		}
+		return value, nil
+
+	case []gqlValue:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			r, err := resolveGQLValue(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+
+	case map[string]gqlValue:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			r, err := resolveGQLValue(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// hashed fields are stored as hashPrefix and the hex HMAC-SHA256 of their JSON value
+const hashPrefix = "hmac-sha256:"
+
+// keeps the salt of hashed fields when Options.HashSalt is empty
+const hashSaltFile = "_salt"
+
+// the fields of a type tagged `db:"hash"`, by reflect.Type
+var hashTags sync.Map
+
+// Hash returns what a value of a hashed field is stored as, for looking records up by
+// it with an equality filter, which indexes of the field serve as usual:
+//
+//	ssn, err := db.Hash("078-05-1120")
+//	found, err := db.Find("users", Eq("SSN", ssn))
+func (d *Driver) Hash(v interface{}) (string, error) {
+	salt, err := d.salt()
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(b)
+	return hashPrefix + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (d *Driver) salt() ([]byte, error) {
+	d.saltOnce.Do(func() {
+		if len(d.hashSalt) > 0 {
+			return
+		}
+		path := filepath.Join(d.dir, hashSaltFile)
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			d.hashSalt, d.saltErr = hex.DecodeString(strings.TrimSpace(string(b)))
+			return
+		}
+		if !os.IsNotExist(err) {
+			d.saltErr = err
+			return
+		}
+		salt := make([]byte, 32)
+		if _, d.saltErr = rand.Read(salt); d.saltErr != nil {
+			return
+		}
+		if err := os.MkdirAll(d.dir, 0755); err != nil {
+			d.saltErr = err
+			return
+		}
+		d.hashSalt = salt
+		d.saltErr = writeAtomic(path, []byte(hex.EncodeToString(salt)+"\n"))
+	})
+	return d.hashSalt, d.saltErr
+}
+
+// hashPaths returns the fields written to collection that are stored hashed: those of
+// Options.HashFields and those v tags `db:"hash"`
+func (d *Driver) hashPaths(collection string, v interface{}) []string {
+	paths := d.hashFields[d.partitionParent(collection)]
+	if v == nil {
+		return paths
+	}
+	if tagged := taggedHashFields(reflect.TypeOf(v)); len(tagged) > 0 {
+		paths = append(append([]string(nil), paths...), tagged...)
+	}
+	return paths
+}
+
+func taggedHashFields(t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if paths, ok := hashTags.Load(t); ok {
+		return paths.([]string)
+	}
+	paths := structHashFields(t, "", map[reflect.Type]bool{})
+	hashTags.Store(t, paths)
+	return paths
+}
+
+// structHashFields walks the fields of struct t the way encoding/json names them
+func structHashFields(t reflect.Type, prefix string, seen map[reflect.Type]bool) []string {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	var paths []string
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := sf.Name
+		if tag := sf.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			} else if sf.Anonymous {
+				name = ""
+			}
+		} else if sf.Anonymous {
+			name = ""
+		}
+
+		ft := sf.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		// fields of embedded structs are promoted
+		if name == "" && ft.Kind() == reflect.Struct {
+			paths = append(paths, structHashFields(ft, prefix, seen)...)
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if sf.Tag.Get("db") == "hash" {
+			paths = append(paths, prefix+name)
+		} else if ft.Kind() == reflect.Struct {
+			paths = append(paths, structHashFields(ft, prefix+name+".", seen)...)
+		}
+	}
+	return paths
+}
+
+// hashRecord replaces the values of the fields at paths of an encoded record with
+// their hashes. Values already hashed, and nulls, are left alone.
+func (d *Driver) hashRecord(b []byte, paths []string) ([]byte, error) {
+	if len(paths) == 0 {
+		return b, nil
+	}
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	changed := false
+	for _, path := range paths {
+		parent, key, ok := fieldParent(doc, path)
+		if !ok || parent[key] == nil || isHashed(parent[key]) {
+			continue
+		}
+		h, err := d.Hash(parent[key])
+		if err != nil {
+			return nil, err
+		}
+		parent[key] = h
+		changed = true
+	}
+	if !changed {
+		return b, nil
+	}
+
+	out, err := json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+func isHashed(v interface{}) bool {
+	s, ok := v.(string)
+	if !ok || !strings.HasPrefix(s, hashPrefix) || len(s) != len(hashPrefix)+2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s[len(hashPrefix):])
+	return err == nil
+}
+
+// hashFile is hashRecord for a record file
+func (d *Driver) hashFile(path string, paths []string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	hashed, err := d.hashRecord(b, paths)
+	if err != nil || bytes.Equal(hashed, b) {
+		return err
+	}
+	return ioutil.WriteFile(path, hashed, 0644)
+}
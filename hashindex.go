@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// A hash index file is a meta page, then a page per bucket, then overflow pages
+// chained to buckets that filled up. An entry goes in the bucket of a digest of its
+// values, or of the record name for 'r' keys, so a lookup reads a bucket and whatever
+// overflowed from it. Pages are changed in place and carry a checksum; the meta page
+// says whether the file was closed cleanly, and a file that wasn't is checked page by
+// page on open. Once entries fill hashLoad of the buckets the table is rewritten with
+// twice as many.
+const (
+	hashSuffix     = ".hash"
+	hashMagic      = "GDBH"
+	hashPageSize   = 4096
+	hashPageHeader = 16 // crc32 of the rest, entry count, unused, page of the next overflow page
+	hashMinBuckets = 64
+	hashLoad       = 0.75
+	hashDigestSize = 16 // bytes of the SHA-256 of the values in 'k' keys
+)
+
+// hashMeta is what the meta page holds
+type hashMeta struct {
+	buckets uint64 // a power of two
+	next    uint64 // pages in the file
+	entries uint64
+	used    uint64 // bytes the entries take in pages
+	empty   uint64 // overflow pages left without entries, until the next rewrite
+	dirty   bool   // changed since opened, the counts above may be off after a crash
+	header  []byte // the indexHeader, as JSON
+}
+
+func (m hashMeta) encode() ([]byte, error) {
+	page := make([]byte, hashPageSize)
+	if 49+len(m.header) > hashPageSize-4 {
+		return nil, fmt.Errorf("hash index header of %d bytes doesn't fit a page", len(m.header))
+	}
+	copy(page, hashMagic)
+	binary.LittleEndian.PutUint64(page[4:], m.buckets)
+	binary.LittleEndian.PutUint64(page[12:], m.next)
+	binary.LittleEndian.PutUint64(page[20:], m.entries)
+	binary.LittleEndian.PutUint64(page[28:], m.used)
+	binary.LittleEndian.PutUint64(page[36:], m.empty)
+	if m.dirty {
+		page[44] = 1
+	}
+	binary.LittleEndian.PutUint32(page[45:], uint32(len(m.header)))
+	copy(page[49:], m.header)
+	binary.LittleEndian.PutUint32(page[hashPageSize-4:], crc32.ChecksumIEEE(page[:hashPageSize-4]))
+	return page, nil
+}
+
+func decodeHashMeta(page []byte) (hashMeta, bool) {
+	if len(page) != hashPageSize || string(page[:4]) != hashMagic ||
+		crc32.ChecksumIEEE(page[:hashPageSize-4]) != binary.LittleEndian.Uint32(page[hashPageSize-4:]) {
+		return hashMeta{}, false
+	}
+	m := hashMeta{
+		buckets: binary.LittleEndian.Uint64(page[4:]),
+		next:    binary.LittleEndian.Uint64(page[12:]),
+		entries: binary.LittleEndian.Uint64(page[20:]),
+		used:    binary.LittleEndian.Uint64(page[28:]),
+		empty:   binary.LittleEndian.Uint64(page[36:]),
+		dirty:   page[44] == 1,
+	}
+	n := int(binary.LittleEndian.Uint32(page[45:]))
+	if 49+n > hashPageSize-4 || m.buckets == 0 || m.buckets&(m.buckets-1) != 0 {
+		return hashMeta{}, false
+	}
+	m.header = append([]byte(nil), page[49:49+n]...)
+	return m, true
+}
+
+// hashPage is a bucket page or an overflow page
+type hashPage struct {
+	id       uint64
+	overflow uint64 // the next page of the bucket, 0 for none
+	keys     [][]byte
+	vals     [][]byte
+}
+
+func hashEntrySize(key, val []byte) int {
+	return uvarintSize(len(key)) + len(key) + uvarintSize(len(val)) + len(val)
+}
+
+func uvarintSize(n int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n))
+}
+
+func (p *hashPage) size() int {
+	size := hashPageHeader
+	for i, k := range p.keys {
+		size += hashEntrySize(k, p.vals[i])
+	}
+	return size
+}
+
+func (p *hashPage) encode() []byte {
+	b := make([]byte, hashPageHeader, hashPageSize)
+	for i, k := range p.keys {
+		b = appendUvarint(b, uint64(len(k)))
+		b = append(b, k...)
+		b = appendUvarint(b, uint64(len(p.vals[i])))
+		b = append(b, p.vals[i]...)
+	}
+	b = b[:hashPageSize]
+	binary.LittleEndian.PutUint16(b[4:], uint16(len(p.keys)))
+	binary.LittleEndian.PutUint64(b[8:], p.overflow)
+	binary.LittleEndian.PutUint32(b, crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+func decodeHashPage(id uint64, b []byte) (*hashPage, bool) {
+	if crc32.ChecksumIEEE(b[4:]) != binary.LittleEndian.Uint32(b) {
+		return nil, false
+	}
+	p := &hashPage{id: id, overflow: binary.LittleEndian.Uint64(b[8:])}
+	body := b[hashPageHeader:]
+	next := func() ([]byte, bool) {
+		l, k := binary.Uvarint(body)
+		if k <= 0 || uint64(len(body)-k) < l {
+			return nil, false
+		}
+		v := body[k : k+int(l)]
+		body = body[k+int(l):]
+		return v, true
+	}
+	for i := int(binary.LittleEndian.Uint16(b[4:])); i > 0; i-- {
+		k, ok := next()
+		if !ok {
+			return nil, false
+		}
+		v, ok := next()
+		if !ok {
+			return nil, false
+		}
+		p.keys, p.vals = append(p.keys, k), append(p.vals, v)
+	}
+	return p, true
+}
+
+// hashFile is an open hash index file
+type hashFile struct {
+	mu   sync.Mutex // guards the fields below
+	path string
+	f    *os.File
+	meta hashMeta
+	sync bool // fsync the pages a change wrote, for Options.Durable
+}
+
+// createHashFile makes an empty table of buckets at path, replacing whatever was there
+func createHashFile(path string, header []byte, buckets uint64, sync bool) (*hashFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h := &hashFile{path: path, f: f, sync: sync, meta: hashMeta{buckets: buckets, next: 1 + buckets, header: header}}
+	if err := h.writeMeta(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	empty := (&hashPage{}).encode()
+	buf := make([]byte, 0, 256*hashPageSize)
+	for b := uint64(0); b < buckets; b++ {
+		buf = append(buf, empty...)
+		if len(buf) == cap(buf) || b == buckets-1 {
+			if _, err := f.WriteAt(buf, int64(1+b+1)*hashPageSize-int64(len(buf))); err != nil {
+				f.Close()
+				return nil, err
+			}
+			buf = buf[:0]
+		}
+	}
+	return h, nil
+}
+
+// openHashFile opens the table at path, checking every page of it if it wasn't
+// closed cleanly
+func openHashFile(path string, sync bool) (*hashFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	page := make([]byte, hashPageSize)
+	if _, err := f.ReadAt(page, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: hash index file %v has no meta page", ErrCorrupted, path)
+	}
+	m, ok := decodeHashMeta(page)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%w: hash index file %v has no valid meta page", ErrCorrupted, path)
+	}
+	h := &hashFile{path: path, f: f, sync: sync, meta: m}
+	if m.dirty {
+		if err := h.recount(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// recount reads every bucket and its overflow pages again for the counts of the meta
+// page, which is only written when the file is closed
+func (h *hashFile) recount() error {
+	fi, err := h.f.Stat()
+	if err != nil {
+		return err
+	}
+	h.meta.next = uint64(fi.Size() / hashPageSize)
+	h.meta.entries, h.meta.used = 0, 0
+	full := uint64(0) // overflow pages with entries
+	for b := uint64(0); b < h.meta.buckets; b++ {
+		for id := 1 + b; id != 0; {
+			p, err := h.page(id)
+			if err != nil {
+				return err
+			}
+			h.meta.entries += uint64(len(p.keys))
+			h.meta.used += uint64(p.size() - hashPageHeader)
+			if id > h.meta.buckets && len(p.keys) > 0 {
+				full++
+			}
+			id = p.overflow
+		}
+	}
+	// overflow pages a crash left unchained count as empty ones
+	h.meta.empty = h.meta.next - 1 - h.meta.buckets - full
+	return nil
+}
+
+func (h *hashFile) writeMeta() error {
+	page, err := h.meta.encode()
+	if err != nil {
+		return err
+	}
+	_, err = h.f.WriteAt(page, 0)
+	return err
+}
+
+func (h *hashFile) page(id uint64) (*hashPage, error) {
+	if id == 0 || id >= h.meta.next {
+		return nil, fmt.Errorf("%w: hash index page %d of %v is out of the file", ErrCorrupted, id, h.path)
+	}
+	b := make([]byte, hashPageSize)
+	if _, err := h.f.ReadAt(b, int64(id)*hashPageSize); err != nil {
+		return nil, err
+	}
+	p, ok := decodeHashPage(id, b)
+	if !ok {
+		return nil, fmt.Errorf("%w: hash index page %d of %v", ErrCorrupted, id, h.path)
+	}
+	return p, nil
+}
+
+func (h *hashFile) writePage(p *hashPage) error {
+	_, err := h.f.WriteAt(p.encode(), int64(p.id)*hashPageSize)
+	return err
+}
+
+// bucketOf is the bucket of a key: by the digest of the values in a 'k' key, so
+// the entries of equal values share it, by FNV-1a of anything else
+func (h *hashFile) bucketOf(key []byte) uint64 {
+	var sum uint64
+	if key[0] == fileEntry && len(key) > hashDigestSize {
+		sum = binary.LittleEndian.Uint64(key[1:])
+	} else {
+		f := fnv.New64a()
+		f.Write(key)
+		sum = f.Sum64()
+	}
+	return sum & (h.meta.buckets - 1)
+}
+
+// change, read and waste make a hash file an indexFile
+func (h *hashFile) change(fn func(tx kvTx) error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return os.ErrClosed
+	}
+	if !h.meta.dirty {
+		h.meta.dirty = true
+		if err := h.writeMeta(); err != nil {
+			return err
+		}
+	}
+
+	err := fn(hashTx{h})
+	if h.sync {
+		if serr := h.f.Sync(); err == nil {
+			err = serr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if float64(h.meta.used) > hashLoad*float64(h.meta.buckets*(hashPageSize-hashPageHeader)) {
+		return h.rehash(2 * h.meta.buckets)
+	}
+	return nil
+}
+
+func (h *hashFile) read(fn func(tx kvTx) error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return os.ErrClosed
+	}
+	return fn(hashTx{h})
+}
+
+func (h *hashFile) waste() (dead, live int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return int(h.meta.empty), int(h.meta.next - 1 - h.meta.empty)
+}
+
+// rewrite rehashes the table into as many buckets as its entries need, dropping
+// empty overflow pages, or into the fewest there can be with empty
+func (h *hashFile) rewrite(empty bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return os.ErrClosed
+	}
+	buckets := uint64(hashMinBuckets)
+	for !empty && float64(h.meta.used) > hashLoad*float64(buckets*(hashPageSize-hashPageHeader)) {
+		buckets *= 2
+	}
+	if empty {
+		h.meta.used = 0
+	}
+	return h.rehash(buckets)
+}
+
+// rehash copies the entries into a fresh file of buckets and replaces the file with
+// it. A crash before the rename leaves the old file.
+func (h *hashFile) rehash(buckets uint64) error {
+	tmp := h.path + ".tmp"
+	fresh, err := createHashFile(tmp, h.meta.header, buckets, false)
+	if err != nil {
+		return err
+	}
+	if h.meta.used > 0 {
+		err = h.each(func(key, val []byte) error { return fresh.insert(key, val) })
+	}
+	if err == nil {
+		err = fresh.writeMeta()
+	}
+	if err == nil && h.sync {
+		err = fresh.f.Sync()
+	}
+	if cerr := fresh.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	h.f.Close()
+	h.f = nil
+	if err := os.Rename(tmp, h.path); err != nil {
+		return err
+	}
+	if h.f, err = os.OpenFile(h.path, os.O_RDWR, 0644); err != nil {
+		return err
+	}
+	h.meta = fresh.meta
+	return nil
+}
+
+// each calls fn with every entry of the table
+func (h *hashFile) each(fn func(key, val []byte) error) error {
+	for b := uint64(0); b < h.meta.buckets; b++ {
+		if err := h.chain(1+b, nil, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chain calls fn with the entries of the bucket starting at page id whose key
+// starts with prefix
+func (h *hashFile) chain(id uint64, prefix []byte, fn func(key, val []byte) error) error {
+	for id != 0 {
+		p, err := h.page(id)
+		if err != nil {
+			return err
+		}
+		for i, k := range p.keys {
+			if bytes.HasPrefix(k, prefix) {
+				if err := fn(k, p.vals[i]); err != nil {
+					return err
+				}
+			}
+		}
+		id = p.overflow
+	}
+	return nil
+}
+
+// insert adds an entry that isn't in the table to the first page of its bucket with
+// room for it, chaining a new overflow page if none has
+func (h *hashFile) insert(key, val []byte) error {
+	size := hashEntrySize(key, val)
+	if hashPageHeader+size > hashPageSize {
+		return fmt.Errorf("index entry of %d bytes doesn't fit a page of %v", size, h.path)
+	}
+	var last *hashPage
+	for id := 1 + h.bucketOf(key); id != 0; {
+		p, err := h.page(id)
+		if err != nil {
+			return err
+		}
+		if p.size()+size <= hashPageSize {
+			if len(p.keys) == 0 && p.id > h.meta.buckets {
+				h.meta.empty--
+			}
+			p.keys, p.vals = append(p.keys, key), append(p.vals, val)
+			if err := h.writePage(p); err != nil {
+				return err
+			}
+			h.meta.entries++
+			h.meta.used += uint64(size)
+			return nil
+		}
+		last, id = p, p.overflow
+	}
+
+	// the new page goes in before it's chained, a crash in between only leaves it unused
+	p := &hashPage{id: h.meta.next, keys: [][]byte{key}, vals: [][]byte{val}}
+	if err := h.writePage(p); err != nil {
+		return err
+	}
+	h.meta.next++
+	last.overflow = p.id
+	if err := h.writePage(last); err != nil {
+		return err
+	}
+	h.meta.entries++
+	h.meta.used += uint64(size)
+	return nil
+}
+
+// remove takes key out of the table, if it's there
+func (h *hashFile) remove(key []byte) error {
+	for id := 1 + h.bucketOf(key); id != 0; {
+		p, err := h.page(id)
+		if err != nil {
+			return err
+		}
+		for i, k := range p.keys {
+			if !bytes.Equal(k, key) {
+				continue
+			}
+			size := hashEntrySize(k, p.vals[i])
+			p.keys = append(p.keys[:i], p.keys[i+1:]...)
+			p.vals = append(p.vals[:i], p.vals[i+1:]...)
+			if err := h.writePage(p); err != nil {
+				return err
+			}
+			if len(p.keys) == 0 && p.id > h.meta.buckets {
+				h.meta.empty++
+			}
+			h.meta.entries--
+			h.meta.used -= uint64(size)
+			return nil
+		}
+		id = p.overflow
+	}
+	return nil
+}
+
+func (h *hashFile) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f == nil {
+		return nil
+	}
+	h.meta.dirty = false
+	err := h.writeMeta()
+	if err == nil && h.sync {
+		err = h.f.Sync()
+	}
+	if cerr := h.f.Close(); err == nil {
+		err = cerr
+	}
+	h.f = nil
+	return err
+}
+
+// hashTx is the kvTx of a hash file, its changes are made right away
+type hashTx struct {
+	h *hashFile
+}
+
+func (tx hashTx) get(key []byte) ([]byte, bool, error) {
+	var val []byte
+	found := false
+	err := tx.h.chain(1+tx.h.bucketOf(key), key, func(k, v []byte) error {
+		if len(k) == len(key) {
+			val, found = v, true
+		}
+		return nil
+	})
+	return val, found, err
+}
+
+func (tx hashTx) put(key, val []byte) error {
+	if err := tx.h.remove(key); err != nil {
+		return err
+	}
+	return tx.h.insert(key, val)
+}
+
+func (tx hashTx) delete(key []byte) error {
+	return tx.h.remove(key)
+}
+
+// scan reads the one bucket of the 'k' keys of a digest, and every bucket for anything
+// else
+func (tx hashTx) scan(prefix []byte, fn func(key, val []byte) error) error {
+	if prefix[0] == fileEntry && len(prefix) > hashDigestSize {
+		return tx.h.chain(1+tx.h.bucketOf(prefix), prefix, fn)
+	}
+	return tx.h.each(func(key, val []byte) error {
+		if bytes.HasPrefix(key, prefix) {
+			return fn(key, val)
+		}
+		return nil
+	})
+}
+
+// hashValuesKey is valuesKey for a hash index: 'k' and a digest of the values, which
+// only finds records having every field of the index
+func hashValuesKey(values []interface{}, present []bool) []byte {
+	var enc []byte
+	for i, v := range values {
+		enc = appendIndexValue(enc, v, present == nil || present[i])
+	}
+	sum := sha256.Sum256(enc)
+	return append([]byte{fileEntry}, sum[:hashDigestSize]...)
+}
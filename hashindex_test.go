@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFileRecountsAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ix"+hashSuffix)
+	h, err := createHashFile(path, []byte(`{}`), hashMinBuckets, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough to overflow buckets and rehash on the way, in changes of 100
+	const n = 4000
+	val := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < n; i += 100 {
+		err = h.change(func(tx kvTx) error {
+			for j := i; j < i+100; j++ {
+				if err := tx.put([]byte(fmt.Sprintf("r%d", j)), val); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h.meta.buckets == hashMinBuckets {
+		t.Fatalf("%d entries stayed in %d buckets, want a rehash", n, h.meta.buckets)
+	}
+	entries, used := h.meta.entries, h.meta.used
+
+	// a crash: the meta page on disk still has the counts from before the last
+	// change, and says the file is being changed
+	h.f.Close()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := decodeHashMeta(b[:hashPageSize]); !ok || !m.dirty || m.entries == entries {
+		t.Fatalf("the meta page on disk is %+v (valid %v), want it dirty and out of date", m, ok)
+	}
+	if h, err = openHashFile(path, false); err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	if h.meta.entries != entries || h.meta.used != used {
+		t.Fatalf("recounted %d entries in %d bytes, want %d in %d", h.meta.entries, h.meta.used, entries, used)
+	}
+	err = h.read(func(tx kvTx) error {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("r%d", i)
+			if got, ok, err := tx.get([]byte(key)); err != nil || !ok || !bytes.Equal(got, val) {
+				return fmt.Errorf("%v is %q (found %v, %v)", key, got, ok, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
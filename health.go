@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// how long Health waits for a collection lock before calling it stuck
+const healthLockTimeout = time.Second
+
+// Health is what Driver.Health found. OK is false when there are Problems.
+type Health struct {
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems,omitempty"`
+
+	Writable bool `json:"writable"`
+
+	// records written in WriteBack mode and not flushed yet
+	Unflushed int `json:"unflushed"`
+	// the most index log entries any index holds beyond its last snapshot
+	IndexBacklog int `json:"index_backlog"`
+}
+
+// backgroundErrs keeps the outcome of the last run of each background worker
+type backgroundErrs struct {
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+func (b *backgroundErrs) set(worker string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.errs == nil {
+		b.errs = map[string]error{}
+	}
+	b.errs[worker] = err
+}
+
+// Health checks that the database directory takes new files, that no collection
+// lock is stuck, that the background flush and TTL sweep didn't fail last time and
+// that index logs get compacted
+func (d *Driver) Health() Health {
+	var h Health
+	problem := func(format string, args ...interface{}) {
+		h.Problems = append(h.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if f, err := ioutil.TempFile(d.dir, ".health-*.tmp"); err != nil {
+		problem("database directory isn't writable: %v", err)
+	} else {
+		_, err = f.Write([]byte("{}"))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(f.Name())
+		if err != nil {
+			problem("database directory isn't writable: %v", err)
+		} else {
+			h.Writable = true
+		}
+	}
+
+	for _, collection := range d.stuckLocks() {
+		problem("lock of %v not obtainable within %v", collection, healthLockTimeout)
+	}
+
+	d.background.mu.Lock()
+	for worker, err := range d.background.errs {
+		if err != nil {
+			problem("last %v failed: %v", worker, err)
+		}
+	}
+	d.background.mu.Unlock()
+
+	if d.cache != nil {
+		h.Unflushed = len(d.cache.dirtyKeys())
+	}
+
+	d.imu.RLock()
+	var indexes []*index
+	for _, byField := range d.indexes {
+		for _, ix := range byField {
+			indexes = append(indexes, ix)
+		}
+	}
+	d.imu.RUnlock()
+	for _, ix := range indexes {
+		ix.mu.RLock()
+		pending, limit := ix.pending, d.compactor.threshold(len(ix.entries))
+		ix.mu.RUnlock()
+		if pending > h.IndexBacklog {
+			h.IndexBacklog = pending
+		}
+		// logs compact at limit, twice that means snapshots keep failing (or the
+		// compaction worker falls behind)
+		if pending > 2*limit {
+			problem("index %v(%v) has %d entries waiting for compaction", ix.collection, indexName(ix.fields), pending)
+		}
+	}
+
+	d.followHealth(problem)
+	if status, ok := d.ClusterStatus(); ok && status.Leader == "" {
+		problem("no cluster leader elected in term %d", status.Term)
+	}
+
+	sort.Strings(h.Problems)
+	h.OK = len(h.Problems) == 0
+	return h
+}
+
+// stuckLocks lists the collections whose lock can't be taken in healthLockTimeout
+func (d *Driver) stuckLocks() []string {
+	// one probe per lock at a time, a health check finding the probe of an earlier
+	// one still waiting waits for that rather than piling up another goroutine
+	d.mutex.Lock()
+	probes := make(map[string]chan struct{}, len(d.mutexes))
+	for collection, m := range d.mutexes {
+		if m.probe == nil {
+			m.probe = make(chan struct{})
+			go d.probeLock(m, m.probe)
+		}
+		probes[collection] = m.probe
+	}
+	d.mutex.Unlock()
+
+	timer := time.NewTimer(healthLockTimeout)
+	defer timer.Stop()
+	expired := false
+	var stuck []string
+	for collection, done := range probes {
+		if !expired {
+			select {
+			case <-done:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+		select {
+		case <-done:
+		default:
+			stuck = append(stuck, collection)
+		}
+	}
+
+	sort.Strings(stuck)
+	return stuck
+}
+
+// probeLock takes and releases m, then closes done
+func (d *Driver) probeLock(m *collectionMutex, done chan struct{}) {
+	// not through m.Lock, the health check shouldn't count as contention
+	m.Mutex.Lock()
+	m.Mutex.Unlock()
+
+	d.mutex.Lock()
+	m.probe = nil
+	d.mutex.Unlock()
+	close(done)
+}
+
+// HealthHandler serves Health as JSON for load balancer checks, e.g. on /healthz,
+// with status 200 when it's OK and 503 otherwise
+func (d *Driver) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := d.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if !h.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
@@ -0,0 +1,1089 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexes live next to the collections, one file per index
+const indexDir = "_indexes"
+
+// an index file is JSON lines: a header, then one entry per put/del. Every change
+// is appended, and once the log grows past the live entries it's rewritten as a
+// fresh snapshot (one put per record).
+type indexHeader struct {
+	Collection string   `json:"collection"`
+	Fields     []string `json:"fields"`
+	Unique     bool     `json:"unique,omitempty"`
+	TTL        string   `json:"ttl,omitempty"` // time.Duration, set on TTL indexes
+}
+
+type indexOp struct {
+	Op      string        `json:"op"` // "put" or "del"
+	Name    string        `json:"name"`
+	Values  []interface{} `json:"values,omitempty"`
+	Present []bool        `json:"present,omitempty"` // false where the record doesn't have the field
+	Mtime   int64         `json:"mtime,omitempty"`
+}
+
+type indexEntry struct {
+	values  []interface{}
+	present []bool
+	mtime   int64 // mtime of the record file when it was indexed, used to spot stale entries on open
+}
+
+// a missing field gets a key no value can have, so Eq never matches it
+const missingKey = "m:"
+
+// prefixKey is the bucket for the first n fields of an entry
+func (e indexEntry) prefixKey(n int) string {
+	parts := make([]string, n)
+	for i := 0; i < n; i++ {
+		if e.present[i] {
+			parts[i] = indexKey(e.values[i])
+		} else {
+			parts[i] = missingKey
+		}
+	}
+	return strings.Join(parts, "\x1f")
+}
+
+type index struct {
+	mu         sync.RWMutex
+	collection string
+	fields     []string
+	unique     bool
+	ttl        time.Duration // > 0 makes this a TTL index
+	path       string
+
+	entries map[string]indexEntry // resource -> entry
+
+	// prefixes[n-1] buckets resources by the values of their first n fields, which is
+	// what lets an index on (Company, Address.State) answer Company = x on its own
+	prefixes []map[string]map[string]bool
+
+	log     *os.File
+	pending int // ops appended since the last snapshot
+
+	// set on B-tree and hash indexes, which keep their entries in it instead of
+	// entries and prefixes, see EnsureBTreeIndex and EnsureHashIndex
+	file indexFile
+
+	compacted func(ops int, took time.Duration, err error) // nil unless the Driver has OnEvent
+
+	scheduled bool // compacted by Options.Compaction, not by append
+}
+
+// indexName is how an index is known within its collection, e.g. "Company,Address.State"
+func indexName(fields []string) string {
+	return strings.Join(fields, ",")
+}
+
+func newIndex(dir, collection string, fields []string) *index {
+	escaped := make([]string, len(fields))
+	for i, f := range fields {
+		escaped[i] = url.PathEscape(f)
+	}
+	name := url.PathEscape(collection) + "." + strings.Join(escaped, "+") + ".idx"
+
+	ix := &index{
+		collection: collection,
+		fields:     fields,
+		path:       filepath.Join(dir, indexDir, name),
+		entries:    map[string]indexEntry{},
+		prefixes:   make([]map[string]map[string]bool, len(fields)),
+	}
+	for i := range ix.prefixes {
+		ix.prefixes[i] = map[string]map[string]bool{}
+	}
+	return ix
+}
+
+// newIndex is newIndex reporting compactions to Options.OnEvent, and leaving them to
+// the worker of Options.Compaction if there is one
+func (d *Driver) newIndex(collection string, fields []string) *index {
+	ix := newIndex(d.dir, collection, fields)
+	ix.scheduled = d.compactor != nil
+	if d.onEvent != nil {
+		ix.compacted = func(ops int, took time.Duration, err error) {
+			d.emitEvent(Event{Type: EventCompaction, Operation: "index", Collection: collection, Path: ix.path, Duration: took, Ops: ops, Err: err})
+		}
+	}
+	return ix
+}
+
+// indexKey maps values that compare equal to the same key, so the json.Number 30
+// in a record and the int 30 in Eq("Age", 30) land in the same bucket
+func indexKey(v interface{}) string {
+	if f, ok := toFloat(v); ok {
+		return "n:" + strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	switch x := v.(type) {
+	case string:
+		return "s:" + x
+	case bool:
+		return "b:" + strconv.FormatBool(x)
+	case nil:
+		return "z:"
+	}
+	b, _ := json.Marshal(v)
+	return "j:" + string(b)
+}
+
+func (ix *index) set(name string, e indexEntry) {
+	ix.remove(name)
+	ix.entries[name] = e
+	for n := range ix.prefixes {
+		key := e.prefixKey(n + 1)
+		if ix.prefixes[n][key] == nil {
+			ix.prefixes[n][key] = map[string]bool{}
+		}
+		ix.prefixes[n][key][name] = true
+	}
+}
+
+func (ix *index) remove(name string) {
+	old, ok := ix.entries[name]
+	if !ok {
+		return
+	}
+	delete(ix.entries, name)
+	for n := range ix.prefixes {
+		key := old.prefixKey(n + 1)
+		if set := ix.prefixes[n][key]; set != nil {
+			delete(set, name)
+			if len(set) == 0 {
+				delete(ix.prefixes[n], key)
+			}
+		}
+	}
+}
+
+func (ix *index) reset() {
+	ix.entries = map[string]indexEntry{}
+	for i := range ix.prefixes {
+		ix.prefixes[i] = map[string]map[string]bool{}
+	}
+}
+
+func (ix *index) entryFor(doc map[string]interface{}, mtime int64) indexEntry {
+	e := indexEntry{
+		values:  make([]interface{}, len(ix.fields)),
+		present: make([]bool, len(ix.fields)),
+		mtime:   mtime,
+	}
+	for i, field := range ix.fields {
+		e.values[i], e.present[i] = lookup(doc, field)
+	}
+	return e
+}
+
+func (e indexEntry) op(name string) indexOp {
+	return indexOp{Op: "put", Name: name, Values: e.values, Present: e.present, Mtime: e.mtime}
+}
+
+// put indexes a record and appends the change to the index file
+func (ix *index) put(name string, doc map[string]interface{}, mtime int64) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	e := ix.entryFor(doc, mtime)
+	if ix.file != nil {
+		return ix.fileChange(func(tx kvTx) error { return ix.fileSet(tx, name, e) })
+	}
+	ix.set(name, e)
+	return ix.append(e.op(name))
+}
+
+func (ix *index) del(name string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.file != nil {
+		return ix.fileChange(func(tx kvTx) error { return ix.fileRemove(tx, name) })
+	}
+	if _, ok := ix.entries[name]; !ok {
+		return nil
+	}
+	ix.remove(name)
+	return ix.append(indexOp{Op: "del", Name: name})
+}
+
+// lookup returns the resources whose leading fields equal values, one value per
+// field from the first one on
+func (ix *index) lookup(values ...interface{}) ([]string, error) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if ix.file != nil {
+		return ix.fileLookup(values)
+	}
+	e := indexEntry{values: values, present: make([]bool, len(values))}
+	for i := range e.present {
+		e.present[i] = true
+	}
+
+	var names []string
+	for name := range ix.prefixes[len(values)-1][e.prefixKey(len(values))] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// names lists the resources the index has an entry for
+func (ix *index) names() ([]string, error) {
+	if ix.file != nil {
+		return ix.fileRecords()
+	}
+	names := make([]string, 0, len(ix.entries))
+	for name := range ix.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (ix *index) append(op indexOp) error {
+	if ix.log == nil {
+		return ix.snapshot()
+	}
+
+	b, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := ix.log.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	ix.pending++
+	if !ix.scheduled && ix.pending > 1000 && ix.pending > len(ix.entries) {
+		return ix.compactLog()
+	}
+	return nil
+}
+
+// compact snapshots the index if changes were appended since the last snapshot, or
+// rewrites the file of a B-tree or hash index with dead pages
+func (ix *index) compact() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.file != nil {
+		if dead, _ := ix.file.waste(); dead == 0 {
+			return nil
+		}
+		return ix.fileCompact()
+	}
+	if ix.pending == 0 || ix.log == nil {
+		return nil // closed or nothing to fold
+	}
+	return ix.compactLog()
+}
+
+// compactLog is snapshot reporting the compaction, ix.mu has to be locked
+func (ix *index) compactLog() error {
+	start, ops := time.Now(), ix.pending
+	err := ix.snapshot()
+	if ix.compacted != nil {
+		ix.compacted(ops, time.Since(start), err)
+	}
+	return err
+}
+
+// snapshot rewrites the index file from memory (tmp file + rename) and reopens it for appending
+func (ix *index) snapshot() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(ix.header()); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(ix.entries))
+	for name := range ix.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := enc.Encode(ix.entries[name].op(name)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ix.path), 0755); err != nil {
+		return err
+	}
+	if ix.log != nil {
+		ix.log.Close()
+		ix.log = nil
+	}
+	if err := writeAtomic(ix.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(ix.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	ix.log = f
+	ix.pending = 0
+	return nil
+}
+
+func (ix *index) header() indexHeader {
+	hdr := indexHeader{Collection: ix.collection, Fields: ix.fields, Unique: ix.unique}
+	if ix.ttl > 0 {
+		hdr.TTL = ix.ttl.String()
+	}
+	return hdr
+}
+
+func (ix *index) close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.file != nil {
+		return ix.file.close()
+	}
+
+	if ix.log == nil {
+		return nil
+	}
+	// leave a compact file behind so the next open has less to replay
+	if ix.pending > 0 {
+		if err := ix.snapshot(); err != nil {
+			return err
+		}
+	}
+	err := ix.log.Close()
+	ix.log = nil
+	return err
+}
+
+// readIndexFile replays an index file. A torn last line (crash mid append) is
+// ignored, the consistency check on open fixes whatever it was about.
+func readIndexFile(path string) (*indexHeader, []indexOp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var hdr *indexHeader
+	var ops []indexOp
+	for sc.Scan() {
+		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
+		dec.UseNumber()
+
+		if hdr == nil {
+			hdr = &indexHeader{}
+			if err := dec.Decode(hdr); err != nil {
+				return nil, nil, fmt.Errorf("index file %v has no valid header", path)
+			}
+			if hdr.Collection == "" || len(hdr.Fields) == 0 {
+				return nil, nil, fmt.Errorf("index file %v has no valid header", path)
+			}
+			continue
+		}
+
+		var op indexOp
+		if err := dec.Decode(&op); err != nil {
+			break
+		}
+		if op.Op == "put" && (len(op.Values) != len(hdr.Fields) || len(op.Present) != len(hdr.Fields)) {
+			break // not something this index wrote
+		}
+		ops = append(ops, op)
+	}
+	if hdr == nil {
+		return nil, nil, fmt.Errorf("index file %v is empty", path)
+	}
+	return hdr, ops, sc.Err()
+}
+
+// EnsureIndex indexes one or more (dotted) fields of a collection so Find can answer
+// Eq and In filters on them without a full scan. A composite index such as
+// EnsureIndex("users", "Company", "Address.State") also serves filters on just its
+// leading fields (Company), but not on Address.State alone. Indexes are kept in the
+// _indexes directory and loaded again by New. Creating an index that exists is a no-op.
+func (d *Driver) EnsureIndex(collection string, fields ...string) error {
+	return d.ensureIndex(collection, fields, false, memoryKind)
+}
+
+// EnsureUniqueIndex is EnsureIndex for fields no two records may share, e.g. an email.
+// Writes that would duplicate a value fail with ErrDuplicateKey, and FindOne on the
+// fields opens a single record. Records missing any of the fields aren't constrained.
+// It fails if the collection already holds duplicates.
+func (d *Driver) EnsureUniqueIndex(collection string, fields ...string) error {
+	return d.ensureIndex(collection, fields, true, memoryKind)
+}
+
+// EnsureBTreeIndex is EnsureIndex keeping the index in a B-tree file instead of in
+// memory: only its most recently used pages are cached, and New opens it without
+// loading or rebuilding it, only re-reading the records changed behind its back.
+// Besides Eq and In it answers ranges on its first field, Gt, Gte, Lt and Lte alone or
+// together (Age BETWEEN 25 AND 35 in Query); a range only matches values of the kind
+// of its bounds, numbers, strings or bools. It's for large collections and fields
+// queried by range, a price or a timestamp. Writes are copy-on-write, an index file
+// is never left half updated by a crash.
+func (d *Driver) EnsureBTreeIndex(collection string, fields ...string) error {
+	return d.ensureIndex(collection, fields, false, btreeKind)
+}
+
+// EnsureHashIndex is EnsureIndex keeping the index in a hash file instead of in
+// memory, for equality on fields with a value of their own per record or nearly, such
+// as an email or an external ID: Eq and In on every one of its fields read a bucket
+// of the file, whatever the size of the collection. The table is rehashed into twice
+// as many buckets as it fills up. It doesn't answer ranges, or filters on only some
+// of its fields, and values shared by many records make long buckets, EnsureIndex
+// suits those better.
+func (d *Driver) EnsureHashIndex(collection string, fields ...string) error {
+	return d.ensureIndex(collection, fields, false, hashKind)
+}
+
+func (d *Driver) ensureIndex(collection string, fields []string, unique bool, kind string) error {
+	collection = d.foldCollection(collection)
+	if collection == "" {
+		return fmt.Errorf("%w - unable to index", ErrEmptyCollection)
+	}
+	if err := d.checkNames(collection, ""); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("Missing field - unable to index %v", collection)
+	}
+	for _, f := range fields {
+		if f == "" {
+			return fmt.Errorf("Missing field - unable to index %v", collection)
+		}
+	}
+
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if ix := d.index(collection, fields...); ix != nil {
+		if ix.unique != unique {
+			return fmt.Errorf("index %v(%v) already exists with unique = %v", collection, indexName(fields), ix.unique)
+		}
+		if ix.kind() != kind {
+			return fmt.Errorf("index %v(%v) already exists as a %v index", collection, indexName(fields), ix.kind())
+		}
+		return nil
+	}
+
+	ix := d.newIndex(collection, fields)
+	ix.unique = unique
+	if kind != memoryKind {
+		if err := d.createIndexFile(ix, kind); err != nil {
+			return err
+		}
+	}
+	if unique {
+		// build it in memory first, a failed unique index leaves no file behind
+		if _, err := d.scanInto(ix); err != nil {
+			return err
+		}
+		if err := ix.duplicates(); err != nil {
+			return err
+		}
+	}
+	if _, err := d.reconcile(ix); err != nil {
+		if ix.file != nil {
+			ix.close()
+			os.Remove(ix.path)
+		}
+		return err
+	}
+
+	d.imu.Lock()
+	if d.indexes[collection] == nil {
+		d.indexes[collection] = map[string]*index{}
+	}
+	d.indexes[collection][indexName(fields)] = ix
+	d.imu.Unlock()
+	return d.indexesChanged(collection)
+}
+
+// duplicates reports the first value shared by two records of a unique index
+func (ix *index) duplicates() error {
+	full := ix.prefixes[len(ix.fields)-1]
+	for _, names := range full {
+		if len(names) < 2 {
+			continue
+		}
+		var list []string
+		for n := range names {
+			list = append(list, n)
+		}
+		sort.Strings(list)
+
+		e := ix.entries[list[0]]
+		if !e.complete() {
+			continue
+		}
+		return fmt.Errorf("%w: %v and %v share %v in %v", ErrDuplicateKey, list[0], list[1], e.describe(ix.fields), ix.collection)
+	}
+	return nil
+}
+
+// complete is true when the record has every field of the index
+func (e indexEntry) complete() bool {
+	for _, p := range e.present {
+		if !p {
+			return false
+		}
+	}
+	return true
+}
+
+func (e indexEntry) describe(fields []string) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = f + " = " + formatValue(e.values[i])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// checkUnique fails when writing raw as resource would give it the same unique key as
+// another record. Called with the collection locked, before the record is written.
+func (d *Driver) checkUnique(collection, resource string, raw []byte) error {
+	var doc map[string]interface{}
+	for _, ix := range d.collectionIndexes(collection) {
+		if !ix.unique {
+			continue
+		}
+		if doc == nil {
+			r := &record{name: resource, raw: raw}
+			var err error
+			if doc, err = r.decode(); err != nil {
+				return err
+			}
+		}
+
+		e := ix.entryFor(doc, 0)
+		if !e.complete() {
+			continue
+		}
+		others, err := ix.lookup(e.values...)
+		if err != nil {
+			return err
+		}
+		for _, other := range others {
+			if other != resource {
+				return fmt.Errorf("%w: %v already has %v in %v", ErrDuplicateKey, other, e.describe(ix.fields), collection)
+			}
+		}
+	}
+	return nil
+}
+
+// DropIndex removes an index and its file
+func (d *Driver) DropIndex(collection string, fields ...string) error {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return err
+	}
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	name := indexName(fields)
+	d.imu.Lock()
+	ix := d.indexes[collection][name]
+	delete(d.indexes[collection], name)
+	d.imu.Unlock()
+
+	if ix == nil {
+		return fmt.Errorf("no index on %v(%v)", collection, name)
+	}
+	ix.close()
+	if err := os.Remove(ix.path); err != nil {
+		return err
+	}
+	return d.indexesChanged(collection)
+}
+
+// Close is Shutdown waiting as long as it takes: operations under way and the
+// background workers are waited for, then the indexes written out and their files
+// released. The Driver shouldn't be used afterwards.
+func (d *Driver) Close() error {
+	return d.Shutdown(context.Background())
+}
+
+func (d *Driver) index(collection string, fields ...string) *index {
+	d.imu.RLock()
+	defer d.imu.RUnlock()
+	return d.indexes[collection][indexName(fields)]
+}
+
+// sortIndex finds an index led by field, preferring the narrowest one. B-tree and hash
+// indexes don't keep their values in memory to sort by.
+func (d *Driver) sortIndex(collection, field string) *index {
+	var best *index
+	for _, ix := range d.collectionIndexes(collection) {
+		if ix.file == nil && ix.fields[0] == field && (best == nil || len(ix.fields) < len(best.fields)) {
+			best = ix
+		}
+	}
+	return best
+}
+
+func (d *Driver) collectionIndexes(collection string) []*index {
+	d.imu.RLock()
+	defer d.imu.RUnlock()
+
+	var out []*index
+	for _, ix := range d.indexes[collection] {
+		out = append(out, ix)
+	}
+	return out
+}
+
+// loadIndexes opens every index in the _indexes directory and brings it up to date
+func (d *Driver) loadIndexes() error {
+	files, err := ioutil.ReadDir(filepath.Join(d.dir, indexDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if ext := filepath.Ext(file.Name()); ext == btreeSuffix || ext == hashSuffix {
+			if err := d.loadIndexFile(filepath.Join(d.dir, indexDir, file.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if filepath.Ext(file.Name()) != ".idx" {
+			continue
+		}
+
+		path := filepath.Join(d.dir, indexDir, file.Name())
+		hdr, ops, err := readIndexFile(path)
+		if err != nil {
+			// an unreadable index is only a cache, drop it and let it be rebuilt by EnsureIndex
+			d.logf(LevelWarning, "Dropping unreadable index", "operation", "load_index", "path", path, "error", err)
+			d.corrupt("", "", path, err)
+			os.Remove(path)
+			continue
+		}
+
+		ix := d.newIndex(hdr.Collection, hdr.Fields)
+		ix.unique = hdr.Unique
+		ix.path = path
+		if hdr.TTL != "" {
+			if ix.ttl, err = time.ParseDuration(hdr.TTL); err != nil || len(hdr.Fields) != 1 {
+				d.logf(LevelWarning, "Dropping index with a bad ttl", "operation", "load_index", "collection", hdr.Collection, "path", path, "ttl", hdr.TTL)
+				os.Remove(path)
+				continue
+			}
+			d.startSweeper()
+		}
+		for _, op := range ops {
+			switch op.Op {
+			case "put":
+				ix.set(op.Name, indexEntry{values: op.Values, present: op.Present, mtime: op.Mtime})
+			case "del":
+				ix.remove(op.Name)
+			}
+		}
+		ix.pending = len(ops) - len(ix.entries)
+
+		start := time.Now()
+		repaired, err := d.reconcile(ix)
+		if err != nil {
+			return err
+		}
+		if repaired > 0 {
+			d.logf(LevelInfo, "Repaired stale index entries", "operation", "load_index", "collection", hdr.Collection, "index", indexName(hdr.Fields), "repaired", repaired, "duration", time.Since(start))
+		}
+
+		if d.indexes[hdr.Collection] == nil {
+			d.indexes[hdr.Collection] = map[string]*index{}
+		}
+		d.indexes[hdr.Collection][indexName(hdr.Fields)] = ix
+	}
+	return nil
+}
+
+// reconcile compares an index with the files of its collection and re-reads only the
+// records that are new or changed since they were indexed (by mtime), then writes a
+// fresh snapshot if anything was off. For a brand new index that's a full build. An
+// index file takes the fixes as they're made.
+func (d *Driver) reconcile(ix *index) (int, error) {
+	if ix.file != nil {
+		return d.scanIntoFile(ix)
+	}
+	repaired, err := d.scanInto(ix)
+	if err != nil {
+		return repaired, err
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if repaired > 0 || ix.log == nil {
+		return repaired, ix.snapshot()
+	}
+	return repaired, nil
+}
+
+// scanInto brings the in memory part of an index up to date with the collection
+func (d *Driver) scanInto(ix *index) (int, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	files, err := d.recordFiles(ix.collection)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	repaired := 0
+	seen := map[string]bool{}
+	for _, file := range files {
+		name, ok := d.recordName(file.Name())
+		if !ok {
+			continue
+		}
+		seen[name] = true
+
+		mtime := file.ModTime().UnixNano()
+		if e, ok := ix.entries[name]; ok && e.mtime == mtime {
+			continue
+		}
+
+		r, err := d.readRecordFile(ix.collection, name)
+		if err != nil {
+			return repaired, err
+		}
+		doc, err := r.decode()
+		if err != nil {
+			return repaired, err
+		}
+		ix.set(name, ix.entryFor(doc, mtime))
+		repaired++
+	}
+
+	for name := range ix.entries {
+		if !seen[name] {
+			ix.remove(name)
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+// reindex updates the indexes of a collection after a record was written
+func (d *Driver) reindex(collection, resource string, raw []byte) error {
+	if len(d.collectionIndexes(collection)) == 0 {
+		return nil
+	}
+
+	fi, err := d.statRecord(collection, resource)
+	if err != nil {
+		return err
+	}
+	return d.reindexAt(collection, resource, raw, fi.ModTime().UnixNano())
+}
+
+// reindexAt is reindex with the mtime of the record file already known
+func (d *Driver) reindexAt(collection, resource string, raw []byte, mtime int64) error {
+	indexes := d.collectionIndexes(collection)
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	r := &record{name: resource, raw: raw}
+	doc, err := r.decode()
+	if err != nil {
+		return err
+	}
+
+	for _, ix := range indexes {
+		if err := ix.put(resource, doc, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindex drops a deleted record from the indexes of a collection
+func (d *Driver) unindex(collection, resource string) error {
+	for _, ix := range d.collectionIndexes(collection) {
+		if err := ix.del(resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexAll empties the indexes of a collection that was deleted as a whole
+func (d *Driver) unindexAll(collection string) error {
+	for _, ix := range d.collectionIndexes(collection) {
+		ix.mu.Lock()
+		var err error
+		if ix.file != nil {
+			err = ix.file.rewrite(true)
+		} else {
+			ix.reset()
+			err = ix.snapshot()
+		}
+		ix.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexCandidates finds the smallest set of resources an index can narrow a filter
+// down to. ok is false when no index applies and the collection has to be scanned.
+func (d *Driver) indexCandidates(collection string, filter Filter) (names []string, used string, ok bool) {
+	switch f := filter.(type) {
+	case eqFilter:
+		return d.eqCandidates(collection, eqConstraints(f))
+
+	case cmpFilter:
+		return d.rangeCandidates(collection, f.field, []cmpFilter{f})
+
+	case andFilter:
+		names, used, ok = d.eqCandidates(collection, eqConstraints(f))
+		// so may the comparisons on one field, a range of a B-tree index
+		ranges := cmpConstraints(f)
+		fields := make([]string, 0, len(ranges))
+		for field := range ranges {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			subNames, subUsed, subOk := d.rangeCandidates(collection, field, ranges[field])
+			if subOk && (!ok || len(subNames) < len(names)) {
+				names, used, ok = subNames, subUsed, true
+			}
+		}
+		// an indexable Or (an In) inside the And may narrow it down further
+		for _, sub := range f {
+			if _, isOr := sub.(orFilter); !isOr {
+				continue
+			}
+			subNames, subUsed, subOk := d.indexCandidates(collection, sub)
+			if subOk && (!ok || len(subNames) < len(names)) {
+				names, used, ok = subNames, subUsed, true
+			}
+		}
+		return names, used, ok
+
+	case orFilter:
+		// In() is an Or of Eqs; usable when every branch is
+		set := map[string]bool{}
+		var indexes []string
+		for _, sub := range f {
+			subNames, subUsed, subOk := d.indexCandidates(collection, sub)
+			if !subOk {
+				return nil, "", false
+			}
+			for _, n := range subNames {
+				set[n] = true
+			}
+			if len(indexes) == 0 || indexes[len(indexes)-1] != subUsed {
+				indexes = append(indexes, subUsed)
+			}
+		}
+		for n := range set {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return names, strings.Join(indexes, " + "), len(f) > 0
+	}
+	return nil, "", false
+}
+
+// eqConstraints collects the field = value parts of a filter that all have to hold
+func eqConstraints(filter Filter) map[string]interface{} {
+	eqs := map[string]interface{}{}
+	switch f := filter.(type) {
+	case eqFilter:
+		eqs[f.field] = f.value
+	case andFilter:
+		for _, sub := range f {
+			for field, v := range eqConstraints(sub) {
+				eqs[field] = v
+			}
+		}
+	}
+	return eqs
+}
+
+// eqCandidates picks, among the indexes whose leading fields are all constrained,
+// the one returning the fewest resources
+func (d *Driver) eqCandidates(collection string, eqs map[string]interface{}) (names []string, used string, ok bool) {
+	if len(eqs) == 0 {
+		return nil, "", false
+	}
+
+	for _, ix := range d.collectionIndexes(collection) {
+		var values []interface{}
+		for _, field := range ix.fields {
+			v, has := eqs[field]
+			if !has {
+				break
+			}
+			values = append(values, v)
+		}
+		if len(values) == 0 || ix.kind() == hashKind && len(values) < len(ix.fields) {
+			continue // a hash index has a digest of all its fields
+		}
+
+		found, err := ix.lookup(values...)
+		if err != nil {
+			d.lookupFailed(ix, err)
+			continue
+		}
+		if !ok || len(found) < len(names) {
+			names, used, ok = found, indexName(ix.fields), true
+		}
+	}
+	return names, used, ok
+}
+
+// cmpConstraints collects the comparisons of an And by field
+func cmpConstraints(f andFilter) map[string][]cmpFilter {
+	cmps := map[string][]cmpFilter{}
+	for _, sub := range f {
+		if c, ok := sub.(cmpFilter); ok {
+			cmps[c.field] = append(cmps[c.field], c)
+		}
+	}
+	return cmps
+}
+
+// rangeCandidates picks, among the B-tree indexes led by field, the narrowest one
+// and returns the resources within the range of the comparisons on it
+func (d *Driver) rangeCandidates(collection, field string, cmps []cmpFilter) (names []string, used string, ok bool) {
+	var best *index
+	for _, ix := range d.collectionIndexes(collection) {
+		if ix.tree() != nil && ix.fields[0] == field && (best == nil || len(ix.fields) < len(best.fields)) {
+			best = ix
+		}
+	}
+	if best == nil {
+		return nil, "", false
+	}
+	names, ok, err := best.rangeLookup(cmps)
+	if err != nil {
+		d.lookupFailed(best, err)
+		return nil, "", false
+	}
+	return names, indexName(best.fields), ok
+}
+
+// lookupFailed reports an index that couldn't be read, the query scans instead
+func (d *Driver) lookupFailed(ix *index, err error) {
+	d.logf(LevelError, "Index lookup failed", "operation", "find", "collection", ix.collection, "index", indexName(ix.fields), "error", err)
+	if errors.Is(err, ErrCorrupted) {
+		d.corrupt(ix.collection, "", ix.path, err)
+	}
+}
+
+// indexedSort sorts records by a single indexed field using the values kept in the
+// index, so no record has to be decoded just to be ordered
+func (d *Driver) indexedSort(collection string, records []*record, o ordering) bool {
+	ix := d.sortIndex(collection, o.field)
+	if ix == nil {
+		return false
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	for _, r := range records {
+		if _, ok := ix.entries[r.name]; !ok {
+			return false // not indexed yet, fall back to decoding
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return ix.before(records[i].name, records[j].name, o.dir)
+	})
+	return true
+}
+
+// before tells whether resource a goes before b sorted on the first field of the
+// index, by name where they tie. ix.mu has to be locked.
+func (ix *index) before(a, b string, dir Direction) bool {
+	c := ix.compareFirst(a, b)
+	if c == 0 {
+		return a < b
+	}
+	if dir == Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// compareFirst compares resources a and b on the first field of the index, those
+// without it first. ix.mu has to be locked.
+func (ix *index) compareFirst(a, b string) int {
+	ea, eb := ix.entries[a], ix.entries[b]
+	switch {
+	case !ea.present[0] && !eb.present[0]:
+		return 0
+	case !ea.present[0]:
+		return -1
+	case !eb.present[0]:
+		return 1
+	}
+	c, _ := compareValues(ea.values[0], eb.values[0])
+	return c
+}
+
+// indexOrder lists the first n resources of a collection sorted on a field, and any
+// tying with the last of them, from an index on it without reading a record. ok is
+// false if there's no such index.
+func (d *Driver) indexOrder(collection string, o ordering, n int) (names []string, ok bool, err error) {
+	if ix := d.sortIndex(collection, o.field); ix != nil {
+		ix.mu.RLock()
+		defer ix.mu.RUnlock()
+
+		names = make([]string, 0, len(ix.entries))
+		for name := range ix.entries {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return ix.before(names[i], names[j], o.dir) })
+		end := n
+		for end > 0 && end < len(names) && ix.compareFirst(names[n-1], names[end]) == 0 {
+			end++
+		}
+		if end < len(names) {
+			names = names[:end]
+		}
+		return names, true, nil
+	}
+	// a B-tree on more fields has the ties on the first in the order of the others
+	for _, ix := range d.collectionIndexes(collection) {
+		if ix.kind() == btreeKind && len(ix.fields) == 1 && ix.fields[0] == o.field {
+			names, err = ix.treeOrder(o.dir, n)
+			return names, err == nil, err
+		}
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// where an index keeps its entries: in memory, backed by a log (the default), or in
+// a file of its own kind
+const (
+	memoryKind = "memory"
+	btreeKind  = "btree"
+	hashKind   = "hash"
+)
+
+// indexFile is the file a B-tree or hash index keeps its entries in, instead of the
+// entries and prefixes of an index in memory
+type indexFile interface {
+	// change runs fn and keeps what it changed; a B-tree keeps nothing if fn fails
+	change(fn func(tx kvTx) error) error
+	read(fn func(tx kvTx) error) error
+
+	// waste is the pages a rewrite would drop, and those it would keep
+	waste() (dead, live int)
+	rewrite(empty bool) error
+	close() error
+}
+
+// kvTx reads and changes the keys of an index file
+type kvTx interface {
+	get(key []byte) ([]byte, bool, error)
+	put(key, val []byte) error
+	delete(key []byte) error
+	scan(prefix []byte, fn func(key, val []byte) error) error // the keys starting with prefix
+}
+
+// the keys of an index file: 'k', the values of the record and its name map to the
+// name; 'r' and the name map to the mtime of the record and its 'k' key, to replace
+// the entry of a record
+const (
+	fileEntry  = 'k'
+	fileRecord = 'r'
+)
+
+// index files rewrite themselves once they're more dead pages than live ones, and at
+// least this big
+const fileMinPages = 256
+
+// changes per transaction when an index file is built or rewritten
+const fileBatch = 4096
+
+func (ix *index) kind() string {
+	switch ix.file.(type) {
+	case *btree:
+		return btreeKind
+	case *hashFile:
+		return hashKind
+	}
+	return memoryKind
+}
+
+// tree is the B-tree of a B-tree index, nil for other indexes
+func (ix *index) tree() *btree {
+	t, _ := ix.file.(*btree)
+	return t
+}
+
+// valuesKey is what the 'k' keys of the records with values start with. A B-tree
+// keys them in order, a hash index by a digest of them all.
+func (ix *index) valuesKey(values []interface{}, present []bool) []byte {
+	if ix.kind() == hashKind {
+		return hashValuesKey(values, present)
+	}
+	b := []byte{fileEntry}
+	for i, v := range values {
+		b = appendIndexValue(b, v, present == nil || present[i])
+	}
+	return b
+}
+
+func recordFileKey(name string) []byte {
+	return append([]byte{fileRecord}, name...)
+}
+
+// prefixEnd is the first key past every key starting with prefix, nil if there's none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// fileSet puts the entry of a record in place of the one it had. The 'r' key goes in
+// last: whatever a crash leaves of the change, the mtime in it is the old one and
+// reconcile redoes it.
+func (ix *index) fileSet(tx kvTx, name string, e indexEntry) error {
+	if err := ix.fileRemove(tx, name); err != nil {
+		return err
+	}
+	key := append(append(ix.valuesKey(e.values, e.present), 0), name...)
+	if err := tx.put(key, []byte(name)); err != nil {
+		return err
+	}
+	val := make([]byte, 8+len(key))
+	binary.LittleEndian.PutUint64(val, uint64(e.mtime))
+	copy(val[8:], key)
+	return tx.put(recordFileKey(name), val)
+}
+
+// fileRemove takes out the entry of a record, its 'r' key last
+func (ix *index) fileRemove(tx kvTx, name string) error {
+	old, ok, err := tx.get(recordFileKey(name))
+	if err != nil || !ok {
+		return err
+	}
+	if len(old) < 8 {
+		return fmt.Errorf("%w: index entry of %v in %v", ErrCorrupted, name, ix.path)
+	}
+	if err := tx.delete(old[8:]); err != nil {
+		return err
+	}
+	return tx.delete(recordFileKey(name))
+}
+
+// fileMtime is the mtime of a record when the file indexed it
+func fileMtime(tx kvTx, name string) (int64, bool, error) {
+	v, ok, err := tx.get(recordFileKey(name))
+	if err != nil || !ok || len(v) < 8 {
+		return 0, false, err
+	}
+	return int64(binary.LittleEndian.Uint64(v)), true, nil
+}
+
+// fileRecords lists the resources with an entry
+func (ix *index) fileRecords() ([]string, error) {
+	var names []string
+	err := ix.file.read(func(tx kvTx) error {
+		return tx.scan([]byte{fileRecord}, func(key, _ []byte) error {
+			names = append(names, string(key[1:]))
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// fileLookup is lookup on an index file
+func (ix *index) fileLookup(values []interface{}) ([]string, error) {
+	var names []string
+	err := ix.file.read(func(tx kvTx) error {
+		return tx.scan(ix.valuesKey(values, nil), func(_, val []byte) error {
+			names = append(names, string(val))
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// fileChange makes a change to an index file and rewrites the file once it's mostly
+// dead pages, unless that's left to Options.Compaction. ix.mu has to be locked.
+func (ix *index) fileChange(fn func(tx kvTx) error) error {
+	if err := ix.file.change(fn); err != nil {
+		return err
+	}
+	if dead, live := ix.file.waste(); !ix.scheduled && dead+live > fileMinPages && dead > live {
+		return ix.fileCompact()
+	}
+	return nil
+}
+
+// fileCompact rewrites an index file without its dead pages, reporting the
+// compaction like compactLog, ix.mu has to be locked
+func (ix *index) fileCompact() error {
+	start := time.Now()
+	dead, _ := ix.file.waste()
+	err := ix.file.rewrite(false)
+	if ix.compacted != nil {
+		ix.compacted(dead, time.Since(start), err)
+	}
+	return err
+}
+
+// createIndexFile makes the file of a new B-tree or hash index
+func (d *Driver) createIndexFile(ix *index, kind string) error {
+	hdr, err := json.Marshal(ix.header())
+	if err != nil {
+		return err
+	}
+	ix.path = strings.TrimSuffix(ix.path, ".idx") + "." + kind
+	if err := os.MkdirAll(filepath.Dir(ix.path), 0755); err != nil {
+		return err
+	}
+	if kind == hashKind {
+		ix.file, err = createHashFile(ix.path, hdr, hashMinBuckets, d.durable)
+	} else {
+		ix.file, err = createBTree(ix.path, hdr, d.durable)
+	}
+	return err
+}
+
+// loadIndexFile opens a B-tree or hash index file and brings it up to date, what
+// loadIndexes does for the logs of the other indexes
+func (d *Driver) loadIndexFile(path string) error {
+	var file indexFile
+	var header []byte
+	var err error
+	if filepath.Ext(path) == hashSuffix {
+		var h *hashFile
+		if h, err = openHashFile(path, d.durable); err == nil {
+			file, header = h, h.meta.header
+		}
+	} else {
+		var t *btree
+		if t, err = openBTree(path, d.durable); err == nil {
+			file, header = t, t.meta.header
+		}
+	}
+	var hdr indexHeader
+	if err == nil {
+		if err = json.Unmarshal(header, &hdr); err == nil && (hdr.Collection == "" || len(hdr.Fields) == 0) {
+			err = fmt.Errorf("index file %v has no valid header", path)
+		}
+	}
+	drop := func(err error) {
+		// like any index it's only a cache, EnsureBTreeIndex or EnsureHashIndex builds it again
+		d.logf(LevelWarning, "Dropping unreadable index", "operation", "load_index", "path", path, "error", err)
+		d.corrupt("", "", path, err)
+		if file != nil {
+			file.close()
+		}
+		os.Remove(path)
+	}
+	if err != nil {
+		drop(err)
+		return nil
+	}
+
+	ix := d.newIndex(hdr.Collection, hdr.Fields)
+	ix.path, ix.file = path, file
+	start := time.Now()
+	repaired, err := d.reconcile(ix)
+	if errors.Is(err, ErrCorrupted) {
+		drop(err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if repaired > 0 {
+		d.logf(LevelInfo, "Repaired stale index entries", "operation", "load_index", "collection", hdr.Collection, "index", indexName(hdr.Fields), "repaired", repaired, "duration", time.Since(start))
+	}
+
+	if d.indexes[hdr.Collection] == nil {
+		d.indexes[hdr.Collection] = map[string]*index{}
+	}
+	d.indexes[hdr.Collection][indexName(hdr.Fields)] = ix
+	return nil
+}
+
+// scanIntoFile is scanInto for an index file, making the changes fileBatch records
+// at a time
+func (d *Driver) scanIntoFile(ix *index) (int, error) {
+	files, err := d.recordFiles(ix.collection)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	repaired := 0
+	seen := make(map[string]bool, len(files))
+	for start := 0; start < len(files); start += fileBatch {
+		err := ix.file.change(func(tx kvTx) error {
+			for _, file := range files[start:min(start+fileBatch, len(files))] {
+				name, ok := d.recordName(file.Name())
+				if !ok {
+					continue
+				}
+				seen[name] = true
+
+				mtime := file.ModTime().UnixNano()
+				if indexed, ok, err := fileMtime(tx, name); err != nil {
+					return err
+				} else if ok && indexed == mtime {
+					continue
+				}
+
+				r, err := d.readRecordFile(ix.collection, name)
+				if err != nil {
+					return err
+				}
+				doc, err := r.decode()
+				if err != nil {
+					return err
+				}
+				if err := ix.fileSet(tx, name, ix.entryFor(doc, mtime)); err != nil {
+					return err
+				}
+				repaired++
+			}
+			return nil
+		})
+		if err != nil {
+			return repaired, err
+		}
+	}
+
+	indexed, err := ix.fileRecords()
+	if err != nil {
+		return repaired, err
+	}
+	var gone []string
+	for _, name := range indexed {
+		if !seen[name] {
+			gone = append(gone, name)
+		}
+	}
+	for start := 0; start < len(gone); start += fileBatch {
+		err := ix.file.change(func(tx kvTx) error {
+			for _, name := range gone[start:min(start+fileBatch, len(gone))] {
+				if err := ix.fileRemove(tx, name); err != nil {
+					return err
+				}
+				repaired++
+			}
+			return nil
+		})
+		if err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
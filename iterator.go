@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Iterator reads records one at a time, the way bufio.Scanner reads lines, so only
+// the current one is held in memory:
+//
+//	it := db.ScanPrefix("orders", "order-2024-")
+//	for it.Next() {
+//		var o Order
+//		if err := it.Decode(&o); err != nil {
+//			...
+//		}
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// The names are listed up front, records deleted since are skipped.
+type Iterator struct {
+	d          *Driver
+	collection string
+	q          *query
+	names      []string
+	next       int
+
+	name string
+	raw  []byte
+	buf  bytes.Buffer // reused for records read from disk
+	err  error
+}
+
+// ScanPrefix iterates over the records of a collection whose names start with prefix,
+// in key order, such as the orders of a year with composite keys like
+// "order-2024-0042". Only the names are listed at first, each record is read by the
+// Next call reaching it. It takes After, Limit, Offset, OrderByKey and Select.
+func (d *Driver) ScanPrefix(collection, prefix string, opts ...QueryOption) *Iterator {
+	it := &Iterator{d: d, collection: d.foldCollection(collection), q: newQuery(opts)}
+	out, err := d.timed("scan_prefix", collection, "", func() (interface{}, error) {
+		names, err := d.list(collection, prefix)
+		if err != nil {
+			return nil, err
+		}
+		names = it.q.page(names, true)
+		from, to := it.q.window(len(names))
+		return names[from:to], nil
+	})
+	it.names, _ = out.([]string)
+	it.err = err
+	return it
+}
+
+// Next reads the next record, false once there are none left or reading one failed,
+// which Err tells apart
+func (it *Iterator) Next() bool {
+	for it.err == nil && it.next < len(it.names) {
+		name := it.names[it.next]
+		it.next++
+		raw, err := it.d.timed("scan_prefix", it.collection, name, func() (interface{}, error) {
+			return it.read(name)
+		})
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			break
+		}
+		it.name, it.raw = name, raw.([]byte)
+		return true
+	}
+	it.name, it.raw = "", nil
+	return false
+}
+
+// read returns the current record. With Options.OperationTimeout it's read into a
+// buffer of its own, a read outliving the timeout mustn't change the next record.
+func (it *Iterator) read(name string) ([]byte, error) {
+	d := it.d
+	collection, err := d.partitionFor(it.collection, name)
+	if err != nil {
+		return nil, err
+	}
+	buf := &it.buf
+	if d.opTimeout > 0 {
+		buf = new(bytes.Buffer)
+	}
+
+	var raw []byte
+	if d.cache != nil {
+		r, err := d.loadRecord(collection, name)
+		if err != nil {
+			return nil, err
+		}
+		raw = r.raw
+	} else {
+		buf.Reset()
+		if err := d.readRecordInto(buf, collection, name); err != nil {
+			return nil, err
+		}
+		raw = buf.Bytes()
+	}
+
+	if raw, err = d.redact(collection, raw, it.q); err != nil {
+		return nil, err
+	}
+	if len(it.q.fields) > 0 {
+		if raw, err = project(raw, it.q.fields); err != nil {
+			return nil, fmt.Errorf("unable to select fields of record %v: %v", name, err)
+		}
+	}
+	if err := d.auditRead(it.q.who, opRead, collection, []string{name}); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// Key is the resource name of the current record
+func (it *Iterator) Key() string {
+	return it.name
+}
+
+// Bytes is the JSON of the current record, only valid until the next call to Next
+func (it *Iterator) Bytes() []byte {
+	return it.raw
+}
+
+// Decode unmarshals the current record into v
+func (it *Iterator) Decode(v interface{}) error {
+	if it.raw == nil {
+		return fmt.Errorf("no record to decode, Next returned false")
+	}
+	return json.Unmarshal(it.raw, v)
+}
+
+// Err is the error that ended the iteration, nil if it ran out of records
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a compiled JSONPath is a list of steps applied to the set of nodes matched so far
+type pathStep struct {
+	key       string // object member, "" with wildcard set means any member
+	index     int
+	isIndex   bool
+	wildcard  bool
+	recursive bool // ..key, matches key at any depth
+}
+
+type jsonPath []pathStep
+
+// compilePath understands the common JSONPath subset: $, .name, ['name'], [n] (negative
+// counts from the end), [*], .* and ..name
+func compilePath(path string) (jsonPath, error) {
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with $", path)
+	}
+
+	var steps jsonPath
+	for i := 1; i < len(path); {
+		switch {
+		case strings.HasPrefix(path[i:], ".."):
+			name, n := pathName(path[i+2:])
+			if name == "" {
+				return nil, fmt.Errorf("JSONPath %q: missing name after ..", path)
+			}
+			steps = append(steps, pathStep{key: name, recursive: true, wildcard: name == "*"})
+			i += 2 + n
+
+		case path[i] == '.':
+			name, n := pathName(path[i+1:])
+			if name == "" {
+				return nil, fmt.Errorf("JSONPath %q: missing name after .", path)
+			}
+			steps = append(steps, pathStep{key: name, wildcard: name == "*"})
+			i += 1 + n
+
+		case path[i] == '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q: missing ]", path)
+			}
+			inner := strings.TrimSpace(path[i+1 : i+end])
+			i += end + 1
+
+			switch {
+			case inner == "*":
+				steps = append(steps, pathStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, pathStep{key: inner[1 : len(inner)-1]})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("JSONPath %q: bad subscript [%v]", path, inner)
+				}
+				steps = append(steps, pathStep{index: n, isIndex: true})
+			}
+
+		default:
+			return nil, fmt.Errorf("JSONPath %q: unexpected %q", path, path[i])
+		}
+	}
+	return steps, nil
+}
+
+// pathName reads a member name up to the next . or [
+func pathName(s string) (string, int) {
+	n := strings.IndexAny(s, ".[")
+	if n < 0 {
+		n = len(s)
+	}
+	return s[:n], n
+}
+
+// eval returns every node the path selects in doc
+func (p jsonPath) eval(doc interface{}) []interface{} {
+	nodes := []interface{}{doc}
+	for _, step := range p {
+		var next []interface{}
+		for _, n := range nodes {
+			if step.recursive {
+				next = append(next, descend(n, step)...)
+				continue
+			}
+			next = append(next, step.apply(n)...)
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+func (s pathStep) apply(n interface{}) []interface{} {
+	switch v := n.(type) {
+	case map[string]interface{}:
+		if s.wildcard {
+			// map order is random, keep results stable
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			out := make([]interface{}, 0, len(keys))
+			for _, k := range keys {
+				out = append(out, v[k])
+			}
+			return out
+		}
+		if s.isIndex {
+			return nil
+		}
+		if child, ok := v[s.key]; ok {
+			return []interface{}{child}
+		}
+	case []interface{}:
+		if s.wildcard {
+			return v
+		}
+		if s.isIndex {
+			i := s.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				return []interface{}{v[i]}
+			}
+		}
+	}
+	return nil
+}
+
+// descend applies a step at n and at every node below it
+func descend(n interface{}, s pathStep) []interface{} {
+	out := s.apply(n)
+	switch v := n.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out = append(out, descend(v[k], s)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			out = append(out, descend(child, s)...)
+		}
+	}
+	return out
+}
+
+type pathFilter struct {
+	expr  string
+	path  jsonPath
+	op    string // "" only checks the path selects something
+	value interface{}
+}
+
+// ParsePathFilter builds a Filter from a JSONPath comparison such as
+//
+//	$.Address.City == "Brooklyn"
+//	$.Tags[*] == 'admin'
+//	$.Age >= 30
+//
+// The record matches when any node the path selects satisfies the comparison.
+// A bare path ($.Address.Postcode) matches records where it selects anything.
+func ParsePathFilter(expr string) (Filter, error) {
+	path, rest := splitPathExpr(expr)
+	compiled, err := compilePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := pathFilter{expr: strings.TrimSpace(expr), path: compiled}
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return f, nil
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(rest, op) {
+			f.op = op
+			rest = strings.TrimSpace(rest[len(op):])
+			break
+		}
+	}
+	if f.op == "" {
+		return nil, fmt.Errorf("JSONPath filter %q: expected a comparison after the path", expr)
+	}
+
+	// single quoted strings are common in JSONPath, JSON only knows double quotes
+	if len(rest) >= 2 && rest[0] == '\'' && rest[len(rest)-1] == '\'' {
+		f.value = rest[1 : len(rest)-1]
+		return f, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(rest))
+	dec.UseNumber()
+	if err := dec.Decode(&f.value); err != nil {
+		return nil, fmt.Errorf("JSONPath filter %q: bad value: %v", expr, err)
+	}
+	return f, nil
+}
+
+// splitPathExpr cuts "$.a['b c'] == 1" into the path and the rest, ignoring
+// spaces and operators inside brackets
+func splitPathExpr(expr string) (string, string) {
+	expr = strings.TrimSpace(expr)
+	depth := 0
+	var quote byte
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case depth == 0 && strings.IndexByte(" =!<>", c) >= 0:
+			return expr[:i], expr[i:]
+		}
+	}
+	return expr, ""
+}
+
+func (f pathFilter) String() string {
+	return f.expr
+}
+
+func (f pathFilter) Match(record map[string]interface{}) bool {
+	for _, n := range f.path.eval(record) {
+		if f.op == "" {
+			return true
+		}
+
+		c, ok := compareValues(n, f.value)
+		if !ok {
+			if f.op == "!=" {
+				return true
+			}
+			continue
+		}
+		switch f.op {
+		case "==":
+			ok = c == 0
+		case "!=":
+			ok = c != 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadPath decodes the part of a record selected by a JSONPath into v, e.g.
+// ReadPath("users", "john", "$.Address", &addr). A path matching several nodes
+// ($.Orders[*].Id) is decoded as a JSON array.
+func (d *Driver) ReadPath(collection, resource, path string, v interface{}, opts ...QueryOption) error {
+	_, err := d.timedDecode("read_path", collection, resource, v, func(v interface{}) (interface{}, error) {
+		return nil, d.readPath(collection, resource, path, v, opts...)
+	})
+	return err
+}
+
+func (d *Driver) readPath(collection, resource, path string, v interface{}, opts ...QueryOption) (err error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return err
+	}
+	if collection == "" {
+		return fmt.Errorf("%w - unable to read!", ErrEmptyCollection)
+	}
+
+	if resource == "" {
+		return fmt.Errorf("%w - unable to read record!", ErrEmptyResource)
+	}
+	defer func() { err = notFound("read", collection, resource, err) }()
+	if collection, err = d.partitionFor(collection, resource); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err == nil {
+			err = d.auditRead("", opRead, collection, []string{resource})
+		}
+	}()
+
+	compiled, err := compilePath(path)
+	if err != nil {
+		return err
+	}
+
+	q := newQuery(opts)
+	var doc interface{}
+	decode := func(b []byte) error {
+		b, err := d.redact(collection, b, q)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		return dec.Decode(&doc)
+	}
+
+	if d.cache != nil {
+		r, err := d.loadRecord(collection, resource)
+		if err != nil {
+			return err
+		}
+		err = decode(r.raw)
+	} else {
+		if d.lsm != nil {
+			if _, err := d.statRecord(collection, resource); err != nil {
+				return err
+			}
+		} else if _, err := stat(filepath.Join(d.recordDir(collection, resource), d.keyFile(resource))); err != nil {
+			return err
+		}
+		err = d.withRecordBytes(collection, resource, decode)
+	}
+	if err != nil {
+		return err
+	}
+
+	var selected interface{}
+	switch nodes := compiled.eval(doc); {
+	case len(nodes) == 0:
+		return fmt.Errorf("%v matched nothing in %v/%v", path, collection, resource)
+	case len(nodes) == 1 && !compiled.multi():
+		selected = nodes[0]
+	default:
+		selected = nodes
+	}
+
+	b, err := json.Marshal(selected)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// multi reports whether the path can select more than one node
+func (p jsonPath) multi() bool {
+	for _, s := range p {
+		if s.wildcard || s.recursive {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyDir is the set of resource names of one collection, kept in memory so Exists,
+// List and reads of missing records don't have to go to the disk. Unlike a bloom
+// filter it forgets deleted names, so it answers both ways.
+type keyDir struct {
+	mu    sync.RWMutex
+	names map[string]bool
+}
+
+func (k *keyDir) has(name string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.names[name]
+}
+
+func (k *keyDir) add(name string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.names[name] = true
+}
+
+func (k *keyDir) remove(name string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.names, name)
+}
+
+// list returns the names starting with prefix, sorted
+func (k *keyDir) list(prefix string) []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	names := make([]string, 0, len(k.names))
+	for name := range k.names {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// collectionKeys returns the key directory of a collection, listing the collection
+// the first time. Writes and deletes wait for the listing, so none slips past it.
+func (d *Driver) collectionKeys(collection string) (*keyDir, error) {
+	d.kmu.Lock()
+	defer d.kmu.Unlock()
+
+	if k := d.keyDirs[collection]; k != nil {
+		return k, nil
+	}
+
+	names, err := d.scanRecords(collection)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	k := &keyDir{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		k.names[name] = true
+	}
+	d.keyDirs[collection] = k
+	return k, nil
+}
+
+// knownKey tells whether a resource exists from the key directory of its collection.
+// known is false without Options.KeyDirectory, or if the collection can't be listed.
+func (d *Driver) knownKey(collection, resource string) (exists, known bool) {
+	if !d.keyDirectory {
+		return false, false
+	}
+	k, err := d.collectionKeys(collection)
+	if err != nil {
+		return false, false // can't tell, let the caller look on disk
+	}
+	return k.has(resource), true
+}
+
+// knownKeys lists the resources of a collection starting with prefix from its key
+// directory. ok is false when they have to be listed from the disk instead.
+func (d *Driver) knownKeys(collection, prefix string) (names []string, ok bool) {
+	if !d.keyDirectory {
+		return nil, false
+	}
+	k, err := d.collectionKeys(collection)
+	if err != nil {
+		return nil, false
+	}
+	names = k.list(prefix)
+	// an empty collection may not exist at all, which the disk tells apart
+	return names, len(names) > 0
+}
+
+// keyAdd records a written resource in the key directory of its collection
+func (d *Driver) keyAdd(collection, resource string) {
+	if !d.keyDirectory {
+		return
+	}
+	d.kmu.Lock()
+	k := d.keyDirs[collection]
+	d.kmu.Unlock()
+
+	// not listed yet, the listing will pick the new record up
+	if k != nil {
+		k.add(resource)
+	}
+}
+
+// keyRemove forgets a deleted resource
+func (d *Driver) keyRemove(collection, resource string) {
+	if !d.keyDirectory {
+		return
+	}
+	d.kmu.Lock()
+	k := d.keyDirs[collection]
+	d.kmu.Unlock()
+
+	if k != nil {
+		k.remove(resource)
+	}
+}
+
+// forgetKeys drops the key directory of a dropped collection
+func (d *Driver) forgetKeys(collection string) {
+	if !d.keyDirectory {
+		return
+	}
+	d.kmu.Lock()
+	delete(d.keyDirs, collection)
+	d.kmu.Unlock()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often idle clients are forgotten
+const limitSweepInterval = time.Minute
+
+type LimitOptions struct {
+	// requests a second a client may make on average, in bursts of up to Burst (1 if
+	// lower). No limit if zero.
+	Rate  float64
+	Burst int
+
+	// requests served at once across all clients. Further requests wait for up to
+	// MaxWait for one to finish, then get 503. No cap if zero.
+	MaxConcurrent int
+	MaxWait       time.Duration
+
+	// tells clients apart: the subject of the Principal if there is one, else the
+	// remote address, if nil
+	ClientOf func(r *http.Request) string
+}
+
+// Limiter keeps one client from starving the others:
+//
+//	limiter := NewLimiter(&LimitOptions{Rate: 50, Burst: 100, MaxConcurrent: 32})
+//	http.Handle("/graphql", limiter.Handler(db.GraphQLHandler()))
+//
+// Watch, replication and other streams hold their slot for as long as they last,
+// so they're better left out of MaxConcurrent.
+type Limiter struct {
+	opts  LimitOptions
+	slots chan struct{} // nil without MaxConcurrent
+
+	mu      sync.Mutex // guards buckets and swept
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(opts *LimitOptions) *Limiter {
+	l := &Limiter{buckets: map[string]*tokenBucket{}, swept: time.Now()}
+	if opts != nil {
+		l.opts = *opts
+	}
+	if l.opts.Burst < 1 {
+		l.opts.Burst = 1
+	}
+	if l.opts.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, l.opts.MaxConcurrent)
+	}
+	if l.opts.ClientOf == nil {
+		l.opts.ClientOf = clientOf
+	}
+	return l
+}
+
+// Handler answers 429 to clients over their rate and 503 when no slot frees up in
+// time, and passes the other requests on to h
+func (l *Limiter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := l.take(l.opts.ClientOf(r)); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, CodeRateLimited, "rate limit exceeded, retry in %v", wait.Round(time.Millisecond))
+			return
+		}
+
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				timer := time.NewTimer(l.opts.MaxWait)
+				select {
+				case l.slots <- struct{}{}:
+					timer.Stop()
+				case <-timer.C:
+					w.Header().Set("Retry-After", "1")
+					writeError(w, CodeUnavailable, "too many concurrent requests")
+					return
+				case <-r.Context().Done():
+					timer.Stop()
+					return
+				}
+			}
+			defer func() { <-l.slots }()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// take spends a token of client's bucket, or returns how long until there is one
+func (l *Limiter) take(client string) time.Duration {
+	if l.opts.Rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	burst := float64(l.opts.Burst)
+	if now.Sub(l.swept) > limitSweepInterval {
+		// full buckets are no different from new ones
+		for c, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.opts.Rate >= burst {
+				delete(l.buckets, c)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.opts.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.opts.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+func clientOf(r *http.Request) string {
+	if p, ok := PrincipalFrom(r.Context()); ok && p.Subject != "" {
+		return "sub:" + p.Subject
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
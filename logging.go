@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jcelliott/lumber"
+)
+
+// log levels, named after the Logger methods
+const (
+	LevelTrace   = "trace"
+	LevelDebug   = "debug"
+	LevelInfo    = "info"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+// FieldLogger is a Logger that takes structured fields. The Driver hands a Logger
+// implementing it a message plus key/value pairs (operation, collection, resource,
+// duration, error, ...) instead of a formatted line, see NewSlogLogger.
+type FieldLogger interface {
+	Logger
+	LogFields(level, msg string, keyvals ...interface{})
+}
+
+// logf logs msg with its fields, as they are for a FieldLogger and as a
+// "msg key=value ..." line for any other Logger
+func (d *Driver) logf(level, msg string, keyvals ...interface{}) {
+	if fl, ok := d.log.(FieldLogger); ok {
+		fl.LogFields(level, msg, keyvals...)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		v := fmt.Sprint(keyvals[i+1])
+		if strings.ContainsAny(v, " \t\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], v)
+	}
+	b.WriteByte('\n')
+	line := strings.ReplaceAll(b.String(), "%", "%%") // the Logger methods take a format
+
+	switch level {
+	case LevelTrace:
+		d.log.Trace(line)
+	case LevelDebug:
+		d.log.Debug(line)
+	case LevelInfo:
+		d.log.Info(line)
+	case LevelWarning:
+		d.log.Warning(line)
+	default:
+		d.log.Error(line)
+	}
+}
+
+// lumberLogger is lumber's console logger as a Logger, lumber names Warning Warn
+type lumberLogger struct {
+	*lumber.ConsoleLogger
+}
+
+func (l lumberLogger) Warning(format string, args ...interface{}) {
+	l.Warn(format, args...)
+}
@@ -0,0 +1,902 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// where LSMEngine keeps its write-ahead log, segments and their manifest
+const lsmDir = "_lsm"
+
+const (
+	lsmWAL      = "wal.log"
+	lsmManifest = "manifest.json"
+
+	segmentMagic = 0x4c534d31 // "LSM1"
+	blockEntries = 16         // entries per block, the index has the first key of each
+	footerSize   = 32
+)
+
+// LSMOptions tunes LSMEngine. The defaults suit records of up to a few KB.
+type LSMOptions struct {
+	// how many bytes of records the memtable, and the write-ahead log backing it,
+	// take before they're written out as a segment of level 0. 4MB if zero.
+	MemtableSize int64
+
+	// level 0 is merged into level 1 once it has L0Segments segments, 4 if zero
+	L0Segments int
+
+	// level 1 holds LevelBase bytes of segments and every level after it LevelRatio
+	// times as many as the one before; past that a segment of it is merged into the
+	// next level. 16MB and 10 if zero.
+	LevelBase  int64
+	LevelRatio int
+
+	// segments written by merges are split at about this size, 4MB if zero
+	SegmentSize int64
+}
+
+func (o LSMOptions) withDefaults() LSMOptions {
+	if o.MemtableSize <= 0 {
+		o.MemtableSize = 4 << 20
+	}
+	if o.L0Segments <= 0 {
+		o.L0Segments = 4
+	}
+	if o.LevelBase <= 0 {
+		o.LevelBase = 16 << 20
+	}
+	if o.LevelRatio <= 1 {
+		o.LevelRatio = 10
+	}
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = 4 << 20
+	}
+	return o
+}
+
+// lsmEntry is the latest write of a key
+type lsmEntry struct {
+	value []byte // nil for a delete, a tombstone until merged into the last level
+	mtime int64  // UnixNano of the write
+}
+
+type lsmItem struct {
+	key string
+	lsmEntry
+}
+
+// lsmTree is the log-structured merge tree of LSMEngine. Writes go to a memtable
+// and its write-ahead log; a full memtable becomes a sorted, immutable segment file
+// of level 0, and the compactor merges segments down into levels of
+// non-overlapping segments growing tenfold each. Lookups go from the memtable
+// through the levels, skipping segments with their bloom filters. Keys are the
+// cacheKey of collection and resource, so a collection's records are next to each
+// other.
+type lsmTree struct {
+	dir  string
+	opts LSMOptions
+
+	mu      sync.RWMutex // guards the fields below, held for reading by lookups
+	mem     map[string]lsmEntry
+	memSize int64
+	wal     *os.File
+	levels  [][]*segment // level 0 newest first, the others sorted by key
+	next    uint64       // id of the next segment
+	cursor  map[int]string
+
+	compacting sync.Mutex    // one merge at a time
+	kick       chan struct{} // wakes the compactor after a flush
+}
+
+type lsmManifestFile struct {
+	Next   uint64     `json:"next"`
+	Levels [][]uint64 `json:"levels"`
+}
+
+func openLSM(dir string, opts LSMOptions) (*lsmTree, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	t := &lsmTree{dir: dir, opts: opts.withDefaults(), mem: map[string]lsmEntry{}, next: 1,
+		cursor: map[int]string{}, kick: make(chan struct{}, 1)}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, lsmManifest))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	live := map[string]bool{}
+	if err == nil {
+		var m lsmManifestFile
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("%w: invalid %v: %v", ErrFormat, filepath.Join(lsmDir, lsmManifest), err)
+		}
+		t.next = m.Next
+		for _, ids := range m.Levels {
+			var level []*segment
+			for _, id := range ids {
+				s, err := openSegment(t.segmentPath(id), id)
+				if err != nil {
+					t.closeSegments()
+					return nil, err
+				}
+				level = append(level, s)
+				live[filepath.Base(s.path)] = true
+			}
+			t.levels = append(t.levels, level)
+		}
+	}
+
+	// segments of a flush or merge that crashed before the manifest took them
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.closeSegments()
+		return nil, err
+	}
+	for _, f := range files {
+		if name := f.Name(); (strings.HasSuffix(name, ".seg") || strings.HasSuffix(name, ".tmp")) && !live[name] {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+
+	if err := t.replayWAL(); err != nil {
+		t.closeSegments()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *lsmTree) segmentPath(id uint64) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%06d.seg", id))
+}
+
+func (t *lsmTree) walPath() string {
+	return filepath.Join(t.dir, lsmWAL)
+}
+
+// replayWAL puts the writes not in a segment yet back in the memtable. A write torn
+// by a crash ends the log, it's cut off there.
+func (t *lsmTree) replayWAL() error {
+	f, err := os.OpenFile(t.walPath(), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header[:4]))
+		if _, err := io.ReadFull(r, payload); err != nil || crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+		key, e, rest, err := decodeEntry(payload, false)
+		if err != nil {
+			break
+		}
+		if e.value != nil {
+			e.value = rest
+		}
+		t.mem[key] = e
+		t.memSize += entrySize(key, e)
+		good += int64(len(header) + len(payload))
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	t.wal = f
+	return nil
+}
+
+func entrySize(key string, e lsmEntry) int64 {
+	return int64(len(key)+len(e.value)) + 16
+}
+
+// put writes value under key, a tombstone for a nil value
+func (t *lsmTree) put(key string, value []byte) error {
+	e := lsmEntry{mtime: time.Now().UnixNano()}
+	if value != nil {
+		e.value = append([]byte{}, value...) // callers hand in pooled buffers
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.wal == nil {
+		return ErrClosed
+	}
+
+	// the log holds the same encoding as segments, with the value last and unprefixed
+	var payload bytes.Buffer
+	encodeEntry(&payload, key, e, false)
+	record := make([]byte, 8, 8+payload.Len())
+	binary.LittleEndian.PutUint32(record[:4], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	if _, err := t.wal.Write(append(record, payload.Bytes()...)); err != nil {
+		return err
+	}
+
+	if old, ok := t.mem[key]; ok {
+		t.memSize -= entrySize(key, old)
+	}
+	t.mem[key] = e
+	t.memSize += entrySize(key, e)
+	if t.memSize < t.opts.MemtableSize {
+		return nil
+	}
+	return t.flushLocked()
+}
+
+// flushLocked writes the memtable out as the newest segment of level 0 and starts a
+// new log. t.mu has to be held.
+func (t *lsmTree) flushLocked() error {
+	if len(t.mem) == 0 {
+		return nil
+	}
+	items := make([]lsmItem, 0, len(t.mem))
+	for key, e := range t.mem {
+		items = append(items, lsmItem{key, e})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+
+	id := t.next
+	s, err := writeSegment(t.segmentPath(id), id, items)
+	if err != nil {
+		return err
+	}
+	t.next++
+	if len(t.levels) == 0 {
+		t.levels = append(t.levels, nil)
+	}
+	t.levels[0] = append([]*segment{s}, t.levels[0]...)
+	if err := t.storeManifest(); err != nil {
+		return err
+	}
+
+	// the segment and manifest are synced, the log can go
+	if err := t.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := t.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	t.mem, t.memSize = map[string]lsmEntry{}, 0
+
+	select {
+	case t.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// storeManifest records which segments make up each level. t.mu has to be held.
+func (t *lsmTree) storeManifest() error {
+	m := lsmManifestFile{Next: t.next, Levels: make([][]uint64, len(t.levels))}
+	for i, level := range t.levels {
+		m.Levels[i] = []uint64{}
+		for _, s := range level {
+			m.Levels[i] = append(m.Levels[i], s.id)
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(t.dir, lsmManifest)
+	if err := writeSynced(path, b); err != nil {
+		return err
+	}
+	return syncPath(t.dir)
+}
+
+// get looks a key up, newest first. A tombstone is found with a nil value.
+func (t *lsmTree) get(key string) (lsmEntry, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if e, ok := t.mem[key]; ok {
+		return e, true, nil
+	}
+	for n, level := range t.levels {
+		if n == 0 {
+			for _, s := range level {
+				if e, ok, err := s.get(key); ok || err != nil {
+					return e, ok, err
+				}
+			}
+			continue
+		}
+		// the segments of a level don't overlap, at most one can have the key
+		i := sort.Search(len(level), func(i int) bool { return level[i].last >= key })
+		if i < len(level) {
+			if e, ok, err := level[i].get(key); ok || err != nil {
+				return e, ok, err
+			}
+		}
+	}
+	return lsmEntry{}, false, nil
+}
+
+// lsmStat is what listing the keys of a tree tells about each
+type lsmStat struct {
+	key   string
+	size  int64
+	mtime int64
+}
+
+// list returns the live keys starting with prefix, sorted
+func (t *lsmTree) list(prefix string) ([]lsmStat, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// the newest write of a key decides, tombstones are kept as a size of -1
+	seen := map[string]lsmStat{}
+	note := func(key string, e lsmEntry) {
+		if _, ok := seen[key]; !ok {
+			st := lsmStat{key: key, size: int64(len(e.value)), mtime: e.mtime}
+			if e.value == nil {
+				st.size = -1
+			}
+			seen[key] = st
+		}
+	}
+	for key, e := range t.mem {
+		if strings.HasPrefix(key, prefix) {
+			note(key, e)
+		}
+	}
+	for _, level := range t.levels {
+		for _, s := range level {
+			if s.last < prefix {
+				continue
+			}
+			err := s.scan(prefix, func(key string, e lsmEntry) bool {
+				if !strings.HasPrefix(key, prefix) {
+					return false
+				}
+				note(key, e)
+				return true
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	stats := make([]lsmStat, 0, len(seen))
+	for _, st := range seen {
+		if st.size >= 0 {
+			stats = append(stats, st)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].key < stats[j].key })
+	return stats, nil
+}
+
+// compact merges one level into the next if it's over its size, and reports whether
+// it did, so the compactor calls it until it doesn't
+func (t *lsmTree) compact() (bool, error) {
+	t.compacting.Lock()
+	defer t.compacting.Unlock()
+
+	t.mu.RLock()
+	n, inputs, overlaps := t.pick()
+	bottom := true
+	for _, level := range t.levels[min(n+2, len(t.levels)):] {
+		bottom = bottom && len(level) == 0
+	}
+	t.mu.RUnlock()
+	if inputs == nil {
+		return false, nil
+	}
+
+	// inputs come newest first, so the first write of a key seen is its latest
+	merged := map[string]lsmEntry{}
+	for _, s := range append(append([]*segment{}, inputs...), overlaps...) {
+		err := s.scan("", func(key string, e lsmEntry) bool {
+			if _, ok := merged[key]; !ok {
+				merged[key] = e
+			}
+			return true
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	items := make([]lsmItem, 0, len(merged))
+	for key, e := range merged {
+		// nothing older is left below for a tombstone to hide
+		if e.value == nil && bottom {
+			continue
+		}
+		items = append(items, lsmItem{key, e})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+
+	// split into segments of about SegmentSize
+	var outputs []*segment
+	for len(items) > 0 {
+		end, size := 0, int64(0)
+		for end < len(items) && (end == 0 || size < t.opts.SegmentSize) {
+			size += entrySize(items[end].key, items[end].lsmEntry)
+			end++
+		}
+		t.mu.Lock()
+		id := t.next
+		t.next++
+		t.mu.Unlock()
+		s, err := writeSegment(t.segmentPath(id), id, items[:end])
+		if err != nil {
+			for _, s := range outputs {
+				s.remove()
+			}
+			return false, err
+		}
+		outputs = append(outputs, s)
+		items = items[end:]
+	}
+
+	t.mu.Lock()
+	for len(t.levels) <= n+1 {
+		t.levels = append(t.levels, nil)
+	}
+	t.levels[n] = without(t.levels[n], inputs)
+	next := append(without(t.levels[n+1], overlaps), outputs...)
+	sort.Slice(next, func(i, j int) bool { return next[i].first < next[j].first })
+	t.levels[n+1] = next
+	if len(inputs) > 0 {
+		t.cursor[n] = inputs[len(inputs)-1].last
+	}
+	err := t.storeManifest()
+	t.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range append(inputs, overlaps...) {
+		s.remove()
+	}
+	return true, nil
+}
+
+// pick chooses what compact merges: all of level 0 once it has L0Segments, else a
+// segment of the first level over its size, going round its key range, with the
+// segments of the next level it overlaps. t.mu has to be held for reading.
+func (t *lsmTree) pick() (int, []*segment, []*segment) {
+	overlapping := func(n int, first, last string) []*segment {
+		if n >= len(t.levels) {
+			return nil
+		}
+		var found []*segment
+		for _, s := range t.levels[n] {
+			if s.last >= first && s.first <= last {
+				found = append(found, s)
+			}
+		}
+		return found
+	}
+
+	if len(t.levels) > 0 && len(t.levels[0]) >= t.opts.L0Segments {
+		inputs := append([]*segment{}, t.levels[0]...)
+		first, last := inputs[0].first, inputs[0].last
+		for _, s := range inputs {
+			if s.first < first {
+				first = s.first
+			}
+			if s.last > last {
+				last = s.last
+			}
+		}
+		return 0, inputs, overlapping(1, first, last)
+	}
+
+	limit := t.opts.LevelBase
+	for n := 1; n < len(t.levels); n++ {
+		var size int64
+		for _, s := range t.levels[n] {
+			size += s.size
+		}
+		if size > limit {
+			level := t.levels[n]
+			s := level[0]
+			for _, candidate := range level {
+				if candidate.first > t.cursor[n] {
+					s = candidate
+					break
+				}
+			}
+			return n, []*segment{s}, overlapping(n+1, s.first, s.last)
+		}
+		limit *= int64(t.opts.LevelRatio)
+	}
+	return 0, nil, nil
+}
+
+func without(segments, drop []*segment) []*segment {
+	out := make([]*segment, 0, len(segments))
+	for _, s := range segments {
+		dropped := false
+		for _, d := range drop {
+			dropped = dropped || s == d
+		}
+		if !dropped {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// close writes the memtable out, so the next open has no log to replay, and closes
+// the files
+func (t *lsmTree) close() error {
+	t.compacting.Lock()
+	defer t.compacting.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.wal == nil {
+		return nil
+	}
+
+	err := t.flushLocked()
+	if cerr := t.wal.Close(); err == nil {
+		err = cerr
+	}
+	t.wal = nil
+	t.closeSegments()
+	return err
+}
+
+func (t *lsmTree) closeSegments() {
+	for _, level := range t.levels {
+		for _, s := range level {
+			s.f.Close()
+		}
+	}
+}
+
+// segment is an immutable file of entries sorted by key, in blocks of blockEntries
+// with a CRC each, followed by the first key and position of every block and a bloom
+// filter of the keys. The index and filter are kept in memory.
+type segment struct {
+	id          uint64
+	path        string
+	f           *os.File
+	size        int64
+	count       int
+	first, last string
+	index       []blockHandle
+	bloom       *bloom
+}
+
+type blockHandle struct {
+	first    string
+	off, len int64
+	crc      uint32
+}
+
+// encodeEntry appends an entry: flags (1 for a tombstone), mtime, the key and the
+// value, which is length prefixed unless it's last
+func encodeEntry(buf *bytes.Buffer, key string, e lsmEntry, prefixed bool) {
+	var scratch [binary.MaxVarintLen64]byte
+	if e.value == nil {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.Write(scratch[:binary.PutVarint(scratch[:], e.mtime)])
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(key)))])
+	buf.WriteString(key)
+	if prefixed {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(e.value)))])
+	}
+	buf.Write(e.value)
+}
+
+// decodeEntry reads an entry off b and returns what follows it. Without prefixed
+// values the value is the rest, which is returned whole.
+func decodeEntry(b []byte, prefixed bool) (string, lsmEntry, []byte, error) {
+	var e lsmEntry
+	if len(b) < 1 {
+		return "", e, nil, io.ErrUnexpectedEOF
+	}
+	tombstone := b[0] == 1
+	b = b[1:]
+	mtime, n := binary.Varint(b)
+	if n <= 0 {
+		return "", e, nil, io.ErrUnexpectedEOF
+	}
+	e.mtime, b = mtime, b[n:]
+	klen, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < klen {
+		return "", e, nil, io.ErrUnexpectedEOF
+	}
+	key := string(b[n : n+int(klen)])
+	b = b[n+int(klen):]
+	if !prefixed {
+		if !tombstone {
+			e.value = []byte{}
+		}
+		return key, e, b, nil
+	}
+	vlen, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < vlen {
+		return "", e, nil, io.ErrUnexpectedEOF
+	}
+	if !tombstone {
+		e.value = b[n : n+int(vlen) : n+int(vlen)]
+	}
+	return key, e, b[n+int(vlen):], nil
+}
+
+// writeSegment writes items, sorted, as a segment file and opens it
+func writeSegment(path string, id uint64, items []lsmItem) (*segment, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+
+	var index []blockHandle
+	var block bytes.Buffer
+	var off int64
+	bl := newBloom(len(items))
+	endBlock := func(first string) {
+		if block.Len() > 0 {
+			index = append(index, blockHandle{first: first, off: off, len: int64(block.Len()), crc: crc32.ChecksumIEEE(block.Bytes())})
+			off += int64(block.Len())
+			w.Write(block.Bytes())
+			block.Reset()
+		}
+	}
+	var first string
+	for i, it := range items {
+		if i%blockEntries == 0 {
+			endBlock(first)
+			first = it.key
+		}
+		encodeEntry(&block, it.key, it.lsmEntry, true)
+		bl.add(it.key)
+	}
+	endBlock(first)
+
+	// the last key, the index and the bloom filter, with a CRC over them in the footer
+	var meta bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	putString := func(s string) {
+		meta.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(s)))])
+		meta.WriteString(s)
+	}
+	last := ""
+	if len(items) > 0 {
+		last = items[len(items)-1].key
+	}
+	putString(last)
+	meta.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(index)))])
+	for _, h := range index {
+		putString(h.first)
+		meta.Write(scratch[:binary.PutUvarint(scratch[:], uint64(h.off))])
+		meta.Write(scratch[:binary.PutUvarint(scratch[:], uint64(h.len))])
+		binary.Write(&meta, binary.LittleEndian, h.crc)
+	}
+	binary.Write(&meta, binary.LittleEndian, bl.k)
+	meta.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(bl.bits)))])
+	binary.Write(&meta, binary.LittleEndian, bl.bits)
+
+	var footer [footerSize]byte
+	binary.LittleEndian.PutUint64(footer[0:], uint64(off))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(meta.Len()))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(len(items)))
+	binary.LittleEndian.PutUint32(footer[24:], crc32.ChecksumIEEE(meta.Bytes()))
+	binary.LittleEndian.PutUint32(footer[28:], segmentMagic)
+	w.Write(meta.Bytes())
+	w.Write(footer[:])
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return openSegment(path, id)
+}
+
+func openSegment(path string, id uint64) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := readSegment(f, path, id)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("segment %v: %w", path, corrupted(err))
+	}
+	return s, nil
+}
+
+func readSegment(f *os.File, path string, id uint64) (*segment, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var footer [footerSize]byte
+	if fi.Size() < footerSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if _, err := f.ReadAt(footer[:], fi.Size()-footerSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[28:]) != segmentMagic {
+		return nil, fmt.Errorf("not a segment")
+	}
+	metaOff, metaLen := int64(binary.LittleEndian.Uint64(footer[0:])), int64(binary.LittleEndian.Uint64(footer[8:]))
+	if metaOff+metaLen+footerSize != fi.Size() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	meta := make([]byte, metaLen)
+	if _, err := f.ReadAt(meta, metaOff); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(meta) != binary.LittleEndian.Uint32(footer[24:]) {
+		return nil, errChecksum
+	}
+
+	s := &segment{id: id, path: path, f: f, size: fi.Size(), count: int(binary.LittleEndian.Uint64(footer[16:]))}
+	r := bytes.NewReader(meta)
+	getString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		b := make([]byte, n)
+		r.Read(b)
+		return string(b), nil
+	}
+	if s.last, err = getString(); err != nil {
+		return nil, err
+	}
+	blocks, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < blocks; i++ {
+		var h blockHandle
+		if h.first, err = getString(); err != nil {
+			return nil, err
+		}
+		off, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		h.off, h.len = int64(off), int64(n)
+		if err := binary.Read(r, binary.LittleEndian, &h.crc); err != nil {
+			return nil, err
+		}
+		s.index = append(s.index, h)
+	}
+	if len(s.index) > 0 {
+		s.first = s.index[0].first
+	}
+
+	s.bloom = &bloom{n: s.count, limit: s.count}
+	if err := binary.Read(r, binary.LittleEndian, &s.bloom.k); err != nil {
+		return nil, err
+	}
+	words, err := binary.ReadUvarint(r)
+	if err != nil || words*8 > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	s.bloom.bits = make([]uint64, words)
+	if err := binary.Read(r, binary.LittleEndian, s.bloom.bits); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *segment) readBlock(i int) ([]byte, error) {
+	h := s.index[i]
+	b := make([]byte, h.len)
+	if _, err := s.f.ReadAt(b, h.off); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(b) != h.crc {
+		return nil, fmt.Errorf("segment %v, block %d: %w", s.path, i, errChecksum)
+	}
+	return b, nil
+}
+
+func (s *segment) get(key string) (lsmEntry, bool, error) {
+	if len(s.index) == 0 || key < s.first || key > s.last || !s.bloom.mayContain(key) {
+		return lsmEntry{}, false, nil
+	}
+	i := sort.Search(len(s.index), func(i int) bool { return s.index[i].first > key }) - 1
+	b, err := s.readBlock(i)
+	if err != nil {
+		return lsmEntry{}, false, err
+	}
+	for len(b) > 0 {
+		k, e, rest, err := decodeEntry(b, true)
+		if err != nil {
+			return lsmEntry{}, false, fmt.Errorf("segment %v: %w", s.path, corrupted(err))
+		}
+		if k == key {
+			return e, true, nil
+		}
+		if k > key {
+			break
+		}
+		b = rest
+	}
+	return lsmEntry{}, false, nil
+}
+
+// scan calls fn with the entries from the key from on, in order, until it returns
+// false
+func (s *segment) scan(from string, fn func(key string, e lsmEntry) bool) error {
+	start := sort.Search(len(s.index), func(i int) bool { return s.index[i].first > from }) - 1
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < len(s.index); i++ {
+		b, err := s.readBlock(i)
+		if err != nil {
+			return err
+		}
+		for len(b) > 0 {
+			k, e, rest, err := decodeEntry(b, true)
+			if err != nil {
+				return fmt.Errorf("segment %v: %w", s.path, corrupted(err))
+			}
+			b = rest
+			if k < from {
+				continue
+			}
+			if !fn(k, e) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (s *segment) remove() {
+	s.f.Close()
+	os.Remove(s.path)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crashLSM drops t like a crash would: the log stays as written, the memtable isn't
+// flushed
+func crashLSM(t *lsmTree) {
+	t.wal.Close()
+	t.wal = nil
+	t.closeSegments()
+}
+
+func requireLSM(t *testing.T, tree *lsmTree, key, want string) {
+	t.Helper()
+	e, ok, err := tree.get(key)
+	if err != nil {
+		t.Fatalf("getting %v: %v", key, err)
+	}
+	switch {
+	case want == "" && ok && e.value != nil:
+		t.Fatalf("%v is %q, want none", key, e.value)
+	case want != "" && (!ok || string(e.value) != want):
+		t.Fatalf("%v is %q (found %v), want %q", key, e.value, ok, want)
+	}
+}
+
+func TestLSMReplaysWALUpToTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := openLSM(dir, LSMOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := tree.put(key, []byte("value of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal := filepath.Join(dir, lsmWAL)
+	intact, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.put("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	crashLSM(tree)
+
+	// the last write, the delete of a, lost its last bytes
+	fi, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(wal, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	if tree, err = openLSM(dir, LSMOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat(wal); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != intact.Size() {
+		t.Fatalf("the log has %d bytes, want the %d before the torn write", fi.Size(), intact.Size())
+	}
+	requireLSM(t, tree, "a", "value of a")
+	requireLSM(t, tree, "b", "value of b")
+	requireLSM(t, tree, "c", "value of c")
+
+	// the torn write is cut off, so what's logged after it replays too
+	if err := tree.put("d", []byte("value of d")); err != nil {
+		t.Fatal(err)
+	}
+	crashLSM(tree)
+	if tree, err = openLSM(dir, LSMOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.close()
+	requireLSM(t, tree, "a", "value of a")
+	requireLSM(t, tree, "d", "value of d")
+}
+
+func TestLSMCompactionDropsTombstonesAtTheBottom(t *testing.T) {
+	dir := t.TempDir()
+	// every write is a segment of its own, and every level past 0 is over its size
+	opts := LSMOptions{MemtableSize: 1, L0Segments: 2, LevelBase: 1, LevelRatio: 2}
+	tree, err := openLSM(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := func() {
+		t.Helper()
+		if ok, err := tree.compact(); err != nil || !ok {
+			t.Fatalf("compacting: %v, merged %v", err, ok)
+		}
+	}
+
+	// a and b go down to level 2
+	tree.put("a", []byte("1"))
+	tree.put("b", []byte("1"))
+	compact()
+	compact()
+	if len(tree.levels) != 3 || len(tree.levels[2]) == 0 {
+		t.Fatalf("levels %v, want a and b on level 2", tree.levels)
+	}
+
+	// merged into level 1 the delete of a has to stay, it hides a below
+	tree.put("a", nil)
+	tree.put("c", []byte("1"))
+	compact()
+	if e, ok, err := tree.get("a"); err != nil || !ok || e.value != nil {
+		t.Fatalf("a is %q (found %v, %v), want a tombstone", e.value, ok, err)
+	}
+	stats, err := tree.list("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].key != "b" || stats[1].key != "c" {
+		t.Fatalf("listed %v, want b and c", stats)
+	}
+
+	// merged into the last level there's nothing left for it to hide
+	compact()
+	if e, ok, err := tree.get("a"); err != nil || ok {
+		t.Fatalf("a is %q (found %v, %v), want nothing", e.value, ok, err)
+	}
+	if err := tree.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tree, err = openLSM(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.close()
+	requireLSM(t, tree, "a", "")
+	requireLSM(t, tree, "b", "1")
+	requireLSM(t, tree, "c", "1")
+}
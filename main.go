@@ -1,14 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jcelliott/lumber"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const Version = "1.0.1"
@@ -24,15 +32,328 @@ type (
 	}
 
 	Driver struct{
+		metrics metrics // first, for 64 bit atomic access on 32 bit platforms
+
 		mutex sync.Mutex // to write and delete
-		mutexes map[string]*sync.Mutex // a pointer to sync.Mutex
+		mutexes map[string]*collectionMutex
 		dir string
 		log Logger
+
+		imu sync.RWMutex // guards indexes
+		indexes map[string]map[string]*index // collection -> field -> index
+
+		mmapMinSize int64 // 0 unless Options.MMap
+		parallelism int // workers reading a collection
+
+		cache *lru // nil without Options.CacheSize
+		cacheMode CacheMode
+
+		bloomFilter bool
+		bmu sync.Mutex // guards blooms
+		blooms map[string]*bloom
+
+		keyDirectory bool
+		kmu sync.Mutex // guards keyDirs
+		keyDirs map[string]*keyDir
+
+		chunkSize int64 // 0 unless Options.ChunkSize
+
+		maxRecordSize int64
+		quotas *quotas
+
+		metaMu sync.Mutex // guards metas
+		metas map[string]*metaEntry
+
+		tracer Tracer
+
+		onEvent func(Event)
+		slowOperation time.Duration
+		lockWaitThreshold time.Duration
+
+		ttlInterval time.Duration
+		sweeper sync.Once
+
+		scheduler sync.Once
+		scheduled chan struct{} // wakes the scheduler for a new WriteAt
+		smu sync.Mutex // keeps Unschedule and the scheduler apart
+
+		omu sync.Mutex // one RelayOutbox at a time
+		outboxed chan struct{} // wakes the relay for a new event
+		relay sync.Once
+
+		schemaMu sync.Mutex
+		schemas map[string]*schemaState // by collection, nil for none, read as needed
+
+		manifest Manifest
+		retry *RetryPolicy
+		opTimeout time.Duration
+		compactor *compactor // nil without Options.Compaction
+
+		durable bool
+		groupCommit time.Duration
+		commitMu sync.Mutex // guards commits
+		commits map[string]*commitGroup // by collection
+
+		writeBuffer int
+		engine Engine
+		lsm *lsmTree // nil with FileEngine
+		flushNow chan struct{} // wakes the flusher once the write buffer is full
+
+		// operations are counted in and out by timed, for Shutdown to wait for
+		opMu sync.Mutex // guards the fields below
+		stopped bool // by Shutdown, operations fail with ErrClosed
+		inflight int
+		drained chan struct{} // closed once stopped with no operations left
+		released sync.Once
+		releaseErr error
+
+		// background workers watch done and are waited for by Shutdown
+		done chan struct{}
+		closing sync.Once
+		wg sync.WaitGroup
+		background backgroundErrs // of their last runs, for Health
+
+		gmu sync.Mutex // guards gqlTypes and gqlSchema
+		gqlTypes map[string]reflect.Type
+		gqlSchema *gqlSchemaDef
+
+		wmu sync.Mutex // guards watchers
+		watchers map[*Watcher]struct{}
+		repl *replLog // nil without Options.ReplicationLog
+
+		crdtCollections map[string]bool
+		resolveConflict ConflictResolver
+		vclocks bool
+		tombstoneRetention time.Duration
+		access *AccessControl
+		audit *auditLog // nil without Options.AuditReads
+		piiFields map[string][]string
+		redactions map[string][]Redaction
+		hashFields map[string][]string
+		foldKeys bool
+		portableKeys bool
+		naming *NamingPolicy
+		partitions map[string]TimePartition
+		shards map[string]int
+		timeSeries map[string]TimeSeries
+		queues map[string]QueueOptions
+		queueMu sync.Mutex // guards lastQueued
+		lastQueued int64 // UnixNano of the newest message ID, IDs only go up
+		hashSalt []byte // Options.HashSalt, or made up on first use
+		saltOnce sync.Once
+		saltErr error
+		crdtMu sync.Mutex // guards crdtClock
+		crdtClock int64 // of the latest stamp made or merged
+
+		node string // Options.NodeID, or made up on first use
+		nodeOnce sync.Once
+		nodeErr error
+
+		fmu sync.Mutex // guards follower and raft
+		follower *follower // nil unless following a leader
+		raft *raftNode // nil unless in a cluster
 	}
 )
 
 type Options struct {
+	// lumber's console logger at INFO if nil, NewSlogLogger adapts a *slog.Logger.
+	// Loggers implementing FieldLogger get structured fields.
 	Logger
+
+	// how often expired records of TTL indexes are removed, a minute if zero
+	TTLInterval time.Duration
+
+	// retries of record file reads, writes and removes that failed for a passing
+	// reason, none if nil
+	Retry *RetryPolicy
+
+	// compaction of index logs in the background, by the writes to them if nil
+	Compaction *CompactionPolicy
+
+	// how long Write, Read, Find and the other operations of DB may take, waiting
+	// for collection locks included, before they fail with a TimeoutError. No
+	// limit if zero.
+	OperationTimeout time.Duration
+
+	// fsync record files, and the directories they're put in, before Write,
+	// WriteStream and UpdateWhere return, so what they wrote survives a crash or
+	// power loss. A record is synced before it's renamed over the old one, so one
+	// a write hadn't returned for yet is found either as it was or as written.
+	Durable bool
+
+	// with Durable, the writes to a collection within GroupCommit of the first are
+	// synced together, each waiting up to that long more but sharing the syncs of
+	// their directories and leaving the collection unlocked meanwhile, which lets
+	// far more writes through under sustained load. Every write syncs alone if zero.
+	GroupCommit time.Duration
+
+	// how records are stored, a file each if zero, see Engine. A database is always
+	// opened with the engine it was made with, or fails with ErrFormat. LSM tunes
+	// LSMEngine, its defaults if nil.
+	Engine Engine
+	LSM    *LSMOptions
+
+	// how many records to keep in an in memory read cache, no cache if zero. Like
+	// BloomFilter it assumes nothing else writes to the database directory.
+	CacheSize int
+
+	// what Write does with the cache, see CacheMode. WriteBack flushes every
+	// FlushInterval, a second if zero.
+	CacheMode     CacheMode
+	FlushInterval time.Duration
+
+	// keep written records in memory, where reads find them, and write them to disk
+	// in batches sorted by collection and name every FlushInterval, or as soon as
+	// WriteBuffer of them are waiting, which absorbs bursts of writes such as
+	// ingest spikes. It's WriteBack mode, with a cache of WriteBuffer records if
+	// CacheSize is zero; the buffer is flushed in the background, so it may grow
+	// past WriteBuffer while a flush catches up.
+	WriteBuffer int
+
+	// how many files ReadAll, Find and the bulk operations read at once, the
+	// number of CPUs if zero. 1 reads one file after the other.
+	ReadParallelism int
+
+	// memory map large record files (64KB and up, or MMapMinSize) when reading them
+	// instead of copying them into memory with read calls. Reads through the cache
+	// still copy, since the cache has to keep the bytes.
+	MMap        bool
+	MMapMinSize int64
+
+	// keep a bloom filter of resource names per collection so Read and Exists answer
+	// most misses without touching the disk. Only safe when nothing else writes to
+	// the database directory.
+	BloomFilter bool
+
+	// keep the resource names of each collection in memory, listed the first time the
+	// collection is used, so Exists, List and reads of missing records don't make a
+	// syscall. Costs memory per record and, like BloomFilter, is only safe when
+	// nothing else writes to the database directory.
+	KeyDirectory bool
+
+	// collections to load when the database is opened, so their first reads are as
+	// fast as the rest: their names go into the key directory and bloom filter (with
+	// KeyDirectory or BloomFilter), and with PreloadValues their records into the
+	// cache, as many as CacheSize holds. Opening takes that much longer.
+	Preload       []string
+	PreloadValues bool
+
+	// records encoding to more than ChunkSize bytes are stored as chunk files of that
+	// size next to a small manifest and put back together on read, so huge records
+	// don't run into filesystem limits. Zero never splits records.
+	ChunkSize int64
+
+	// writes of records encoding to more than MaxRecordSize bytes fail with
+	// ErrRecordTooLarge. Writes that would take the records of the database, or of a
+	// collection in CollectionQuotas, over that many bytes fail with ErrQuotaExceeded.
+	// Zero means no limit. Attachments don't count.
+	MaxRecordSize    int64
+	DatabaseQuota    int64
+	CollectionQuotas map[string]int64
+
+	// reads of these collections, or of all with AnyCollection, are logged with who
+	// made them (see AuditAs) to AuditLog, or to _audit/reads.log in the database
+	// directory if nil
+	AuditReads []string
+	AuditLog   io.Writer
+
+	// the fields holding personal data by collection, as dotted paths, for Erase
+	PIIFields map[string][]string
+
+	// fields masked by collection in what Read, ReadAll, Find and the HTTP handlers
+	// return, unless read with Unredacted. Filters and OrderBy still see the stored
+	// values; replication and sync pass the records on as they are.
+	Redact map[string][]Redaction
+
+	// fields stored as salted one-way hashes by collection, as dotted paths, on top of
+	// the fields of written structs tagged `db:"hash"`. Records are looked up by them
+	// with Hash. The salt is HashSalt, or made up and kept in the database directory
+	// if empty; Drivers that replicate or sync each other need the same one to look
+	// up each other's records.
+	HashFields map[string][]string
+	HashSalt   []byte
+
+	// resource names are stored in lower case and looked up folded, so "John" and
+	// "john" are the same record on every platform rather than two on Linux and one
+	// on macOS. Records already stored under names with upper case letters aren't
+	// found once it's on.
+	CaseInsensitiveKeys bool
+
+	// percent-encode the bytes of resource names that Windows or macOS would refuse or
+	// change in file names (\ : * ? " < > |, control characters, anything but ASCII,
+	// a leading dot, device names such as CON), so any name but _meta is a key and
+	// the database directory can be moved between systems. % is encoded too, so
+	// records with % or those bytes in their names have to be written again after
+	// turning it on.
+	PortableKeys bool
+
+	// limits on the length, characters and nesting of names, failing with
+	// ErrInvalidName. None if nil.
+	Naming *NamingPolicy
+
+	// collections kept in a directory per period of a timestamp field, see
+	// TimePartition
+	Partitions map[string]TimePartition
+
+	// collections whose records are spread over this many subdirectories by a hash of
+	// their names, users/_a3/john.json, since listing and looking up files slows down
+	// on most filesystems once a directory holds a few hundred thousand. It's
+	// transparent to the API, but records written before changing it have to be
+	// written again.
+	Shards map[string]int
+
+	// collections that keep time series, Points added with Append, see TimeSeries
+	TimeSeries map[string]TimeSeries
+
+	// retry limits and dead-letter collections of queues, see Enqueue. Queues not in
+	// here retry forever.
+	Queues map[string]QueueOptions
+
+	// gets a span for every Write, Read, ReadAll, Find and Delete, none if nil
+	Tracer Tracer
+
+	// makes the Tracer if Tracer is nil, see NewOTelTracer
+	TracerProvider trace.TracerProvider
+
+	// OnEvent is told about operations taking SlowOperation or longer, writers waiting
+	// LockWaitThreshold or longer for a collection lock, files that can't be read back
+	// and index compactions. No events for a zero threshold. It's called synchronously,
+	// possibly with locks held, so it should hand the event off and not use the Driver.
+	OnEvent           func(Event)
+	SlowOperation     time.Duration
+	LockWaitThreshold time.Duration
+
+	// how many changes to keep for followers of ReplicationHandler to catch up from
+	// after a disconnect, further behind they start over from a snapshot. Zero means
+	// the Driver can't be replicated.
+	ReplicationLog int
+
+	// names this Driver in what it writes for CRDTCollections and VectorClocks. Made
+	// up and kept in the database directory if empty.
+	NodeID string
+
+	// collections whose records are last-writer-wins maps of their top level fields,
+	// so the databases of two Drivers that were written apart can be put back
+	// together with MergeCRDT. Their records have to be JSON objects.
+	CRDTCollections []string
+
+	// keep a vector clock per record, counting the writes and deletes of each node, so
+	// SyncWith, SyncRemote and followers tell versions written concurrently from
+	// stale ones. See Driver.Clock.
+	VectorClocks bool
+
+	// how long Vacuum keeps the CRDT and vector clock tombstones of deleted records,
+	// which make merges and syncs delete them on the other side too. A Driver that
+	// was apart for longer brings the records back. Forever if zero.
+	TombstoneRetention time.Duration
+
+	// merges the versions of records changed on both sides of SyncWith or SyncRemote
+	// with the SyncMerge strategy
+	ResolveConflict ConflictResolver
+
+	// restricts what callers of the HTTP handlers may do by their roles, anything
+	// goes if nil
+	AccessControl *AccessControl
 }
 
 //These are Struct methods, not exactly functions
@@ -45,54 +366,356 @@ func New(dir string, options *Options)(*Driver, error){ // initialise and create
 		opts = *options 
 	}
 	if opts.Logger == nil {
-		opts.Logger = lumber.NewConsoleLogger((lumber.INFO))
+		opts.Logger = lumberLogger{lumber.NewConsoleLogger(lumber.INFO)}
+	}
+	if opts.Tracer == nil && opts.TracerProvider != nil {
+		opts.Tracer = NewOTelTracer(opts.TracerProvider)
+	}
+	if err := checkCacheOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := checkEngineOptions(opts); err != nil {
+		return nil, err
+	}
+	var compaction *compactor
+	if opts.Compaction != nil {
+		c, err := newCompactor(*opts.Compaction)
+		if err != nil {
+			return nil, err
+		}
+		compaction = c
 	}
 	driver := Driver{
 		dir: dir,
-		mutexes: make(map[string]*sync.Mutex),
+		mutexes: make(map[string]*collectionMutex),
 		log: opts.Logger,
+		indexes: make(map[string]map[string]*index),
+		bloomFilter: opts.BloomFilter,
+		blooms: make(map[string]*bloom),
+		keyDirectory: opts.KeyDirectory,
+		keyDirs: make(map[string]*keyDir),
+		ttlInterval: opts.TTLInterval,
+		chunkSize: opts.ChunkSize,
+		maxRecordSize: opts.MaxRecordSize,
+		quotas: newQuotas(opts.DatabaseQuota, opts.CollectionQuotas),
+		metas: make(map[string]*metaEntry),
+		tracer: opts.Tracer,
+		onEvent: opts.OnEvent,
+		slowOperation: opts.SlowOperation,
+		lockWaitThreshold: opts.LockWaitThreshold,
+		done: make(chan struct{}),
+		scheduled: make(chan struct{}, 1),
+		outboxed: make(chan struct{}, 1),
+	}
+	driver.node = opts.NodeID
+	driver.resolveConflict = opts.ResolveConflict
+	driver.vclocks = opts.VectorClocks
+	driver.tombstoneRetention = opts.TombstoneRetention
+	driver.access = opts.AccessControl
+	driver.audit = newAuditLog(opts.AuditReads, opts.AuditLog)
+	driver.piiFields = opts.PIIFields
+	driver.redactions = opts.Redact
+	driver.hashFields = opts.HashFields
+	driver.hashSalt = opts.HashSalt
+	driver.foldKeys = opts.CaseInsensitiveKeys
+	driver.portableKeys = opts.PortableKeys
+	driver.naming = opts.Naming
+	driver.partitions = opts.Partitions
+	driver.shards = opts.Shards
+	driver.timeSeries = opts.TimeSeries
+	driver.queues = opts.Queues
+	driver.retry = opts.Retry
+	driver.opTimeout = opts.OperationTimeout
+	driver.compactor = compaction
+	driver.durable = opts.Durable
+	driver.engine = opts.Engine
+	driver.groupCommit = opts.GroupCommit
+	driver.commits = make(map[string]*commitGroup)
+	driver.crdtCollections = make(map[string]bool)
+	for _, collection := range opts.CRDTCollections {
+		driver.crdtCollections[collection] = true
+	}
+	if opts.ReplicationLog > 0 {
+		driver.repl = newReplLog(opts.ReplicationLog)
+	}
+	if driver.parallelism = opts.ReadParallelism; driver.parallelism <= 0 {
+		driver.parallelism = runtime.NumCPU()
+	}
+	if opts.MMap && mmapSupported {
+		driver.mmapMinSize = opts.MMapMinSize
+		if driver.mmapMinSize <= 0 {
+			driver.mmapMinSize = defaultMMapMinSize
+		}
+	}
+	if opts.WriteBuffer > 0 {
+		opts.CacheMode = WriteBack
+		if opts.CacheSize <= 0 {
+			opts.CacheSize = opts.WriteBuffer
+		}
+		driver.writeBuffer = opts.WriteBuffer
+		driver.flushNow = make(chan struct{}, 1)
+	}
+	if opts.CacheSize > 0 {
+		driver.cache = newLRU(opts.CacheSize)
+		driver.cacheMode = opts.CacheMode
+	}
+	if driver.cacheMode == WriteBack {
+		if opts.FlushInterval <= 0 {
+			opts.FlushInterval = time.Second
+		}
+		driver.startFlusher(opts.FlushInterval)
+	}
+	if driver.ttlInterval <= 0 {
+		driver.ttlInterval = time.Minute
+	}
+	for _, ts := range driver.timeSeries {
+		if ts.Retention > 0 {
+			driver.startSweeper()
+			break
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, scheduleDir)); err == nil {
+		driver.startScheduler() // writes scheduled before a restart
+	}
+	if driver.compactor != nil {
+		driver.startCompactor()
 	}
 	// check if the database exist, if it does then we just use the directory
 	if _,err := os.Stat(dir); err == nil{
-		opts.Logger.Debug("Using '%s' (database already exists)\n", dir)
-		return  &driver, nil
+		driver.logf(LevelDebug, "Using existing database", "dir", dir)
+		if err := driver.openManifest(); err != nil {
+			return &driver, err
+		}
+		if err := driver.openEngine(opts); err != nil {
+			return &driver, err
+		}
+		if err := driver.loadIndexes(); err != nil {
+			return &driver, err
+		}
+		if err := driver.preload(opts.Preload, opts.PreloadValues); err != nil {
+			return &driver, err
+		}
+		return &driver, driver.recoverOutbox()
 	}
 
-	opts.Logger.Debug("Creating the database at '%s'...\n", dir)
-	return &driver, os.Mkdir(dir, 0755) //0755 is the access permission
+	driver.logf(LevelDebug, "Creating database", "dir", dir)
+	if err := os.Mkdir(dir, 0755); err != nil { //0755 is the access permission
+		return &driver, err
+	}
+	if err := driver.createManifest(); err != nil {
+		return &driver, err
+	}
+	return &driver, driver.openEngine(opts)
 }
 
 func (d *Driver) Write(collection, resource string, v interface{}) error { //retuns error only
+	return d.WriteContext(context.Background(), collection, resource, v)
+}
+
+// WriteContext is Write tracing the write as part of the span in ctx, see Tracer
+func (d *Driver) WriteContext(ctx context.Context, collection, resource string, v interface{}) error {
+	_, err := d.timed("write", collection, resource, func() (interface{}, error) {
+		return nil, d.write(ctx, collection, resource, v)
+	})
+	return err
+}
+
+func (d *Driver) write(ctx context.Context, collection, resource string, v interface{}) error {
+	if err := d.put(ctx, collection, resource, v); err != nil {
+		return err
+	}
+	// with Options.GroupCommit the write is synced with others once the collection is unlocked
+	return d.awaitCommit(d.foldCollection(collection))
+}
+
+// put is write without waiting for Options.GroupCommit
+func (d *Driver) put(ctx context.Context, collection, resource string, v interface{}) (err error) {
+	collection, resource = d.fold(collection, resource)
+	op := d.begin(ctx, opWrite, collection, resource)
+	defer op.end(&err)
+
 	if collection == ""{
-		return fmt.Errorf("Missing collection - no place to save record!")
+		return fmt.Errorf("%w - no place to save record!", ErrEmptyCollection)
 	}
 
 	if resource == ""{
-		return fmt.Errorf("Missing resource - unable to save record (no name)!")
+		return fmt.Errorf("%w - unable to save record (no name)!", ErrEmptyResource)
 	}
 
-	mutex := d.GetOrCreateMutex(collection)
-	mutex.Lock()
+	if err := d.checkNames(collection, resource); err != nil {
+		return err
+	}
+	if _, ok := d.partitions[collection]; ok {
+		return d.writePartitioned(collection, resource, v)
+	}
+
+	if r := d.cluster(); r != nil {
+		return r.write(collection, resource, v)
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	mutex := d.lockFor(collection)
+	if err := op.lock(mutex); err != nil {
+		return err
+	}
 	
 	// defer is used when you want something to run at the end of the function
 	// everything is locked until the right function is completed, otherwise it wont allow anything to work with the db
 	defer mutex.Unlock()
 
-	dir := filepath.Join(d.dir, collection)
-	fnlPath := filepath.Join(dir, resource + ".json")
-	tmpPath := fnlPath + ".tmp"
+	dir := d.recordDir(collection, resource)
 
 	if err := os.MkdirAll(dir, 0755); err != nil{
 		return err
 	}
 
-	// converting 
-	b, err := json.MarshalIndent(v, "", "\t")
+	// converting, into a pooled buffer. Encode ends the record with a newline
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	enc := json.NewEncoder(buf)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+
+	b, err := d.hashRecord(buf.Bytes(), d.hashPaths(collection, v))
 	if err != nil {
 		return err
 	}
+	if d.cache != nil {
+		b = append([]byte(nil), b...) // the cache keeps the record, the buffer goes back to the pool
+	}
+
+	if err := d.checkSchema(collection, resource, b); err != nil {
+		return err
+	}
+	if err := d.checkUnique(collection, resource, b); err != nil {
+		return err
+	}
+
+	return d.storeRecord(collection, resource, b)
+}
+
+// storeRecord puts an encoded record in place and brings the cache, bloom filter and
+// indexes up to date. The collection has to be locked.
+func (d *Driver) storeRecord(collection, resource string, b []byte) error {
+	delta, err := d.checkQuota(collection, resource, int64(len(b)))
+	if err != nil {
+		return err
+	}
+
+	var stamps *crdtMeta
+	if d.isCRDT(collection) {
+		if stamps, err = d.stampWrite(collection, resource, b); err != nil {
+			return err
+		}
+	}
+	if d.vclocks {
+		if err := d.tickClock(collection, resource); err != nil {
+			return err
+		}
+	}
+
+	created := !d.recordExists(collection, resource)
+	r := &record{name: resource, raw: b}
+	key := cacheKey(collection, resource)
+
+	if d.cacheMode == WriteBack {
+		d.cache.putDirty(collection, key, r)
+		d.bufferWrite()
+		if stamps != nil {
+			if err := d.writeCRDTMeta(collection, resource, stamps); err != nil {
+				return err
+			}
+		}
+		d.notify(ChangeWrite, collection, resource, b)
+		d.addUsage(collection, delta)
+		d.bloomAdd(collection, resource)
+		d.keyAdd(collection, resource)
+		if created {
+			if err := d.addRecordCount(collection, 1); err != nil {
+				return err
+			}
+		}
+		return d.reindexAt(collection, resource, b, 0) // no file yet, so no mtime
+	}
+
+	if err := d.writeRecordFile(collection, resource, b); err != nil {
+		return err
+	}
+	if stamps != nil {
+		if err := d.writeCRDTMeta(collection, resource, stamps); err != nil {
+			return err
+		}
+	}
+	d.notify(ChangeWrite, collection, resource, b)
+	d.addUsage(collection, delta)
+	if created {
+		if err := d.addRecordCount(collection, 1); err != nil {
+			return err
+		}
+	}
+	if d.cacheMode == WriteThrough {
+		d.cache.put(key, r)
+	} else {
+		d.uncache(collection, resource)
+	}
+	d.bloomAdd(collection, resource)
+	d.keyAdd(collection, resource)
+
+	return d.reindex(collection, resource, b)
+}
+
+// removeRecord deletes a record file, or its unflushed write, and forgets it in the
+// cache and indexes. The collection has to be locked. It reports false if there was
+// nothing to remove.
+func (d *Driver) removeRecord(collection, resource string) (bool, error) {
+	dirty := d.isDirty(collection, resource)
+	size, err := d.usageOf(collection, resource)
+	if err != nil {
+		return false, err
+	}
+
+	err = d.withRetry(func() error { return d.removeRecordFile(collection, resource) })
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err != nil && !dirty {
+		return false, nil
+	}
+	if d.isCRDT(collection) {
+		if err := d.stampDelete(collection, resource); err != nil {
+			return true, err
+		}
+	}
+	if d.vclocks {
+		if err := d.tickClock(collection, resource); err != nil {
+			return true, err
+		}
+	}
+	d.notify(ChangeDelete, collection, resource, nil)
+
+	d.uncache(collection, resource)
+	d.keyRemove(collection, resource)
+	d.addUsage(collection, -size)
+	if err := d.addRecordCount(collection, -1); err != nil {
+		return true, err
+	}
+	if err := os.RemoveAll(d.attachmentDir(collection, resource)); err != nil {
+		return true, err
+	}
+	if err := d.dropOldChunks(collection, resource, ""); err != nil {
+		return true, err
+	}
+	return true, d.unindex(collection, resource)
+}
 
-	b = append(b, byte('\n'))
+// writes to a .tmp file first and renames it over the record, so readers never see half a record
+func writeAtomic(fnlPath string, b []byte) error {
+	tmpPath := fnlPath + ".tmp"
 
 	if err := ioutil.WriteFile(tmpPath, b, 0644); err != nil {
 		return err
@@ -101,92 +724,476 @@ func (d *Driver) Write(collection, resource string, v interface{}) error { //ret
 	return os.Rename(tmpPath, fnlPath)
 }
 
-func (d *Driver) Read(collection, resource string, v interface{}) error {
+// writeSynced is writeAtomic syncing the .tmp file before the rename, so a crash
+// leaves the old content or the new one but never an empty or torn file. The rename
+// itself is durable once the directory is synced, see syncFiles.
+func writeSynced(fnlPath string, b []byte) error {
+	tmpPath := fnlPath + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, fnlPath)
+}
+
+func (d *Driver) Read(collection, resource string, v interface{}, opts ...QueryOption) error {
+	return d.ReadContext(context.Background(), collection, resource, v, opts...)
+}
+
+// ReadContext is Read tracing the read as part of the span in ctx, see Tracer
+func (d *Driver) ReadContext(ctx context.Context, collection, resource string, v interface{}, opts ...QueryOption) error {
+	_, err := d.timedDecode("read", collection, resource, v, func(v interface{}) (interface{}, error) {
+		return nil, d.read(ctx, collection, resource, v, opts...)
+	})
+	return err
+}
+
+func (d *Driver) read(ctx context.Context, collection, resource string, v interface{}, opts ...QueryOption) (err error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return err
+	}
+	op := d.begin(ctx, opRead, collection, resource)
+	defer op.end(&err)
+	defer func() { err = notFound("read", collection, resource, err) }()
+
 	if collection == ""{
-		return fmt.Errorf("Missing collection - unable to read!")
+		return fmt.Errorf("%w - unable to read!", ErrEmptyCollection)
 	}
 
 	if resource == ""{
-		return fmt.Errorf("Missing resource - unable to read record!")
+		return fmt.Errorf("%w - unable to read record!", ErrEmptyResource)
+	}
+	if collection, err = d.partitionFor(collection, resource); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err == nil {
+			err = d.auditRead("", opRead, collection, []string{resource})
+		}
+	}()
+
+	q := newQuery(opts)
+	unmarshal := func(b []byte) error {
+		b, err := d.redact(collection, b, q)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, &v)
 	}
 
-	record := filepath.Join(d.dir, collection, resource)
+	record := filepath.Join(d.recordDir(collection, resource), d.keyFile(resource))
+
+	if !d.mayExist(collection, resource) {
+		return notExist(record + ".json")
+	}
+
+	if d.cache != nil {
+		if r, ok := d.cache.get(cacheKey(collection, resource)); ok {
+			return unmarshal(r.raw)
+		}
+	}
 
-	if _, err := stat(record); err != nil{
+	if d.lsm != nil {
+		if _, err := d.statRecord(collection, resource); err != nil {
+			return err
+		}
+	} else if _, err := stat(record); err != nil{
 		return err
 	}
 
-	b, err := ioutil.ReadFile(record + ".json")
+	if d.cache == nil {
+		// the bytes go straight into v, so they can come from the pool (or an mmap)
+		return d.withRecordBytes(collection, resource, unmarshal)
+	}
+
+	r, err := d.fetchRecord(collection, resource)
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(b, &v)
+	return unmarshal(r.raw)
 }
 
-func (d *Driver) ReadAll(collection string)([]string, error){
-	
-	if collection == ""{
-		return nil, fmt.Errorf("Missing collection - unable to read")
+// ReadInto is Read for hot loops: it puts the JSON of a record into buf, reusing its
+// memory, and returns it for the caller to decode as it likes (into the same value
+// every time, with a json.Decoder it keeps). With a buf as big as the record nothing
+// is allocated for the bytes, and no decoder either.
+//
+//	buf := make([]byte, 0, 4096)
+//	for _, id := range ids {
+//		if buf, err = db.ReadInto("users", id, buf); err != nil { ... }
+//		...
+//	}
+func (d *Driver) ReadInto(collection, resource string, buf []byte, opts ...QueryOption) ([]byte, error) {
+	into := buf
+	if d.opTimeout > 0 {
+		into = nil // a read outliving the timeout mustn't write to buf, it's copied in
+	}
+	out, err := d.timed("read", collection, resource, func() (interface{}, error) {
+		return d.readInto(collection, resource, into, opts...)
+	})
+	b, ok := out.([]byte)
+	if !ok {
+		return buf[:0], err
 	}
-	dir := filepath.Join(d.dir, collection)
+	if d.opTimeout > 0 {
+		b = append(buf[:0], b...)
+	}
+	return b, err
+}
 
-	// checks if the collection or directory exists
-	if _, err := stat(dir); err != nil {
+// readInto skips the stat of read, the open of the file tells a missing record
+func (d *Driver) readInto(collection, resource string, buf []byte, opts ...QueryOption) (out []byte, err error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
 		return nil, err
 	}
+	op := d.begin(context.Background(), opRead, collection, resource)
+	defer op.end(&err)
+	defer func() { err = notFound("read", collection, resource, err) }()
 
-	files, _ := ioutil.ReadDir(dir)
-
-	var records []string
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to read!", ErrEmptyCollection)
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("%w - unable to read record!", ErrEmptyResource)
+	}
+	if collection, err = d.partitionFor(collection, resource); err != nil {
+		return nil, err
+	}
+	if !d.mayExist(collection, resource) {
+		return nil, notExist(d.recordPath(collection, resource))
+	}
 
-	for _, file := range files{
-		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+	var raw []byte
+	if d.cache != nil {
+		r, err := d.loadRecord(collection, resource)
 		if err != nil {
 			return nil, err
 		}
-		records = append(records, string(b))
+		raw = r.raw
+	} else {
+		b := bytes.NewBuffer(buf[:0])
+		if err := d.readRecordInto(b, collection, resource); err != nil {
+			return nil, err
+		}
+		raw = b.Bytes()
 	}
 
-	return records, nil
+	q := newQuery(opts)
+	if raw, err = d.redact(collection, raw, q); err != nil {
+		return nil, err
+	}
+	if err := d.auditRead("", opRead, collection, []string{resource}); err != nil {
+		return nil, err
+	}
+	if d.cache != nil || !sameArray(raw, buf) {
+		raw = append(buf[:0], raw...) // cached or redacted bytes aren't the caller's
+	}
+	return raw, nil
 }
 
-func (d *Driver) Delete(collection, resource string)error{
-	
+// sameArray tells whether b starts at the memory of buf, which it was read into
+func sameArray(b, buf []byte) bool {
+	return len(b) > 0 && cap(buf) > 0 && &b[0] == &buf[:1][0]
+}
+
+// ReadAll returns every record of a collection, optionally sorted with OrderBy
+func (d *Driver) ReadAll(collection string, opts ...QueryOption)([]string, error){
+	return d.ReadAllContext(context.Background(), collection, opts...)
+}
+
+// ReadAllContext is ReadAll tracing the read as part of the span in ctx, see Tracer
+func (d *Driver) ReadAllContext(ctx context.Context, collection string, opts ...QueryOption) ([]string, error) {
+	out, err := d.timed("read_all", collection, "", func() (interface{}, error) {
+		return d.readAll(ctx, collection, opts...)
+	})
+	records, _ := out.([]string)
+	return records, err
+}
+
+func (d *Driver) readAll(ctx context.Context, collection string, opts ...QueryOption)(_ []string, err error){
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return nil, err
+	}
+	op := d.begin(ctx, opReadAll, collection, "")
+	defer op.end(&err)
+
+	if collection == ""{
+		return nil, fmt.Errorf("%w - unable to read", ErrEmptyCollection)
+	}
+
+	q := newQuery(opts)
+	records, release, err := d.readPartitioned(collection, q, func(collection string) ([]*record, func(), error) {
+		return d.readQueried(collection, q, false, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := d.auditRead(q.who, opReadAll, collection, recordNames(records)); err != nil {
+		return nil, err
+	}
+	return d.finish(collection, records, q)
+}
+
+// ReadAllRaw is ReadAll without turning the records into strings. Nothing is decoded
+// unless an option needs it, the stored JSON is handed back as is.
+func (d *Driver) ReadAllRaw(collection string, opts ...QueryOption)([]json.RawMessage, error){
+	out, err := d.timed("read_all", collection, "", func() (interface{}, error) {
+		return d.readAllRaw(collection, opts...)
+	})
+	records, _ := out.([]json.RawMessage)
+	return records, err
+}
+
+func (d *Driver) readAllRaw(collection string, opts ...QueryOption)(_ []json.RawMessage, err error){
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return nil, err
+	}
+	op := d.begin(context.Background(), opReadAll, collection, "")
+	defer op.end(&err)
+
+	if collection == ""{
+		return nil, fmt.Errorf("%w - unable to read", ErrEmptyCollection)
+	}
+
+	q := newQuery(opts)
+	records, release, err := d.readPartitioned(collection, q, func(collection string) ([]*record, func(), error) {
+		return d.readQueried(collection, q, false, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := d.auditRead(q.who, opReadAll, collection, recordNames(records)); err != nil {
+		return nil, err
+	}
+	return d.finishRaw(collection, records, q)
+}
+
+func (d *Driver) Delete(collection, resource string) error {
+	return d.DeleteContext(context.Background(), collection, resource)
+}
+
+// DeleteContext is Delete tracing the delete as part of the span in ctx, see Tracer
+func (d *Driver) DeleteContext(ctx context.Context, collection, resource string) error {
+	_, err := d.timed("delete", collection, resource, func() (interface{}, error) {
+		return nil, d.remove(ctx, collection, resource)
+	})
+	return err
+}
+
+func (d *Driver) remove(ctx context.Context, collection, resource string)(err error){
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return err
+	}
+	op := d.begin(ctx, opDelete, collection, resource)
+	defer op.end(&err)
+	defer func() { err = notFound("delete", collection, resource, err) }()
+	if collection, err = d.partitionFor(collection, resource); err != nil {
+		return err
+	}
+
+	if r := d.cluster(); r != nil {
+		return r.remove(collection, resource)
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+
 	path := filepath.Join(collection, resource)
-	mutex := d.GetOrCreateMutex(collection)
-	mutex.Lock()
+	mutex := d.lockFor(collection)
+	if err := op.lock(mutex); err != nil {
+		return err
+	}
 	defer mutex.Unlock()
 
 	dir := filepath.Join(d.dir, path)
+	if resource != "" {
+		// the directory of that name holds the record's subcollections
+		dir = d.recordPath(collection, resource)
+	}
+
+	// written in WriteBack mode but not flushed, so there's no file to stat
+	if resource != "" && d.isDirty(collection, resource) {
+		_, err := d.removeRecord(collection, resource)
+		return err
+	}
+	// nor are there with LSMEngine
+	if resource != "" && d.lsm != nil {
+		removed, err := d.removeRecord(collection, resource)
+		if err == nil && !removed {
+			return notExist(path)
+		}
+		return err
+	}
 
 	switch fi, err := stat(dir); {
 	case fi == nil, err != nil:
-		return fmt.Errorf("unable to find file or directory named %v\n", path)
+		return notExist(path)
 	
 	case fi.Mode().IsDir():
-		return os.RemoveAll(dir)
+		return d.dropCollection(collection)
 		
 	case fi.Mode().IsRegular():
-		return os.RemoveAll(dir + ".json") //removing all the files in the folder
+		_, err := d.removeRecord(collection, resource)
+		return err
 	}
 	
 	return nil
 }
 
-func (d *Driver) GetOrCreateMutex(collection string) *sync.Mutex{ //returns pointer to sync.mutex
-	
+// dropCollection deletes a collection with all its records, indexes and
+// subcollections. The collection has to be locked.
+func (d *Driver) dropCollection(collection string) error {
+	nested, err := d.nestedCollections(collection)
+	if err != nil {
+		return err
+	}
+	for _, sub := range nested {
+		mutex := d.lockFor(sub)
+		mutex.Lock()
+		err := d.dropOne(sub)
+		mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return d.dropOne(collection)
+}
+
+// dropOne is dropCollection for a collection without subcollections
+func (d *Driver) dropOne(collection string) error {
+	if d.isCRDT(collection) || d.vclocks {
+		// merges and syncs have to know the records are gone
+		names, err := d.listRecords(collection)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, name := range names {
+			if d.isCRDT(collection) {
+				if err := d.stampDelete(collection, name); err != nil {
+					return err
+				}
+			}
+			if d.vclocks {
+				if err := d.tickClock(collection, name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if d.lsm != nil {
+		if err := d.dropLSMCollection(collection); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(d.dir, collection)); err != nil {
+		return err
+	}
+	d.notify(ChangeDrop, collection, "", nil)
+	if d.cache != nil {
+		d.cache.removeCollection(collection)
+	}
+	d.forgetKeys(collection)
+	d.forgetUsage(collection)
+	d.forgetMeta(collection)
+	return d.unindexAll(collection)
+}
+
+// GetOrCreateMutex returns the lock of a collection, the one writes take, counted in
+// Stats as theirs
+func (d *Driver) GetOrCreateMutex(collection string) sync.Locker {
+	return d.lockFor(collection)
+}
+
+// lockFor returns the lock of a collection, with lockBy and lockWait
+func (d *Driver) lockFor(collection string) *collectionMutex {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	m, ok := d.mutexes[collection]
 
 	if !ok {
-		m = &sync.Mutex{}
+		m = &collectionMutex{}
+		if d.onEvent != nil && d.lockWaitThreshold > 0 {
+			m.waitedLong = func(waited time.Duration) {
+				d.emitEvent(Event{Type: EventLockContention, Collection: collection, Duration: waited})
+			}
+			m.threshold = d.lockWaitThreshold
+		}
 		d.mutexes[collection] = m
 	}
 	return m
 }
 
+// collectionMutex is a sync.Mutex keeping count of how often it was taken, how often
+// that meant waiting for another holder and how long those waits were
+type collectionMutex struct {
+	// first, for 64 bit atomic access on 32 bit platforms
+	locks     uint64
+	contended uint64
+	waited    int64 // nanoseconds
+
+	sync.Mutex
+	holders int32 // holding or waiting
+
+	// closed once the lock probe of Health got the lock, under Driver.mutex
+	probe chan struct{}
+
+	// called once a wait reaches threshold
+	waitedLong func(time.Duration)
+	threshold  time.Duration
+}
+
+func (m *collectionMutex) Lock() {
+	m.lockWait()
+}
+
+// lockWait locks m and returns how long that meant waiting for another holder
+func (m *collectionMutex) lockWait() time.Duration {
+	atomic.AddUint64(&m.locks, 1)
+	if atomic.AddInt32(&m.holders, 1) == 1 {
+		m.Mutex.Lock()
+		return 0
+	}
+
+	atomic.AddUint64(&m.contended, 1)
+	start := time.Now()
+	m.Mutex.Lock()
+	waited := time.Since(start)
+	atomic.AddInt64(&m.waited, int64(waited))
+	if m.waitedLong != nil && waited >= m.threshold {
+		m.waitedLong(waited)
+	}
+	return waited
+}
+
+func (m *collectionMutex) Unlock() {
+	atomic.AddInt32(&m.holders, -1)
+	m.Mutex.Unlock()
+}
+
 // checks for the file with json
 func stat(path string)(fi os.FileInfo, err error){
 	if fi, err = os.Stat(path); os.IsNotExist(err){
@@ -211,6 +1218,24 @@ type User struct {
 }
 
 func main() {
+	// tui [dir] browses a database interactively instead of running the demo
+	if len(os.Args) > 1 && os.Args[1] == "tui" {
+		dir := "./"
+		if len(os.Args) > 2 {
+			dir = os.Args[2]
+		}
+		db, err := New(dir, nil)
+		if err == nil {
+			err = runTUI(db, os.Stdin, os.Stdout)
+			db.Close()
+		}
+		if err != nil {
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	dir := "./"
 
 	db, err := New(dir, nil)
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// every collection directory holds a _meta.json next to its records, which is why
+// _meta can't be used as a resource name
+const (
+	metaResource = "_meta"
+	metaFile     = metaResource + ".json"
+)
+
+// CollectionMeta describes a collection, it's what its _meta.json holds
+type CollectionMeta struct {
+	Collection string      `json:"collection"`
+	Created    time.Time   `json:"created"`
+	Records    int         `json:"records"`
+	Indexes    []IndexMeta `json:"indexes,omitempty"`
+}
+
+type IndexMeta struct {
+	Fields []string `json:"fields"`
+	Unique bool     `json:"unique,omitempty"`
+	TTL    string   `json:"ttl,omitempty"`  // time.Duration, set on TTL indexes
+	Kind   string   `json:"kind,omitempty"` // "btree" or "hash" for the indexes kept in a file of their own
+}
+
+// metaEntry is the in memory copy of a _meta.json, nil until first used
+type metaEntry struct {
+	mu   sync.Mutex
+	meta *CollectionMeta
+}
+
+// recordName returns the resource a file of a collection directory holds, false if
+// it's no record (a .tmp file or the _meta.json)
+func (d *Driver) recordName(file string) (string, bool) {
+	if filepath.Ext(file) != ".json" || file == metaFile {
+		return "", false
+	}
+	name := strings.TrimSuffix(file, ".json")
+	if !d.portableKeys {
+		return strings.Replace(name, keySeparator, "/", -1), true
+	}
+	name, err := url.PathUnescape(name)
+	return name, err == nil
+}
+
+// the / of path keys, "2024/05/invoice-1", is kept as keySeparator in the file names
+// so the records of a collection stay in one directory, apart from subcollections
+const keySeparator = "%2F"
+
+// Windows keeps these names for devices, whatever the extension
+var deviceNames = map[string]bool{"CON": true, "PRN": true, "AUX": true, "NUL": true}
+
+// recordFile is the file name of a record, without the directory
+func (d *Driver) recordFile(resource string) string {
+	return d.keyFile(resource) + ".json"
+}
+
+// keyFile is the file name of a resource without the extension. With
+// Options.PortableKeys every byte that some filesystem would object to or change is
+// percent-encoded, so the name is the same on Linux, macOS and Windows.
+func (d *Driver) keyFile(resource string) string {
+	if !d.portableKeys {
+		return strings.Replace(resource, "/", keySeparator, -1)
+	}
+	var b strings.Builder
+	for i := 0; i < len(resource); i++ {
+		c := resource[i]
+		// a leading dot hides the file, or makes it . or ..
+		if portableByte(c) && !(i == 0 && (c == '.' || isDeviceName(resource))) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// portableByte tells the bytes that stand for themselves in file names everywhere.
+// Anything but ASCII is encoded too, macOS would normalize it.
+func portableByte(c byte) bool {
+	return c >= 0x20 && c < 0x7f && !strings.ContainsRune(`%/\:*?"<>|`, rune(c))
+}
+
+func isDeviceName(resource string) bool {
+	base := resource
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	base = strings.ToUpper(strings.TrimRight(base, " "))
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return base[3] >= '1' && base[3] <= '9'
+	}
+	return deviceNames[base]
+}
+
+func (d *Driver) recordPath(collection, resource string) string {
+	return filepath.Join(d.recordDir(collection, resource), d.recordFile(resource))
+}
+
+// fold makes names of Options.CaseInsensitiveKeys Drivers lower case: the resource
+// and the resources in a subcollection path
+func (d *Driver) fold(collection, resource string) (string, string) {
+	if !d.foldKeys {
+		return collection, resource
+	}
+	return d.foldCollection(collection), strings.ToLower(resource)
+}
+
+func (d *Driver) foldCollection(collection string) string {
+	if !d.foldKeys || !strings.Contains(collection, "/") {
+		return collection
+	}
+	parts := strings.Split(collection, "/")
+	for i := 1; i < len(parts); i += 2 {
+		parts[i] = strings.ToLower(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// checkNames keeps collection and resource names from leading out of the database
+// directory, or into the Driver's own files, and holds them to Options.Naming. Empty
+// names are left for the callers to complain about.
+func (d *Driver) checkNames(collection, resource string) error {
+	if collection != "" {
+		if err := d.checkCollectionName(collection); err != nil {
+			return err
+		}
+	}
+	if resource != "" {
+		if err := d.checkResourceName(resource); err != nil {
+			return err
+		}
+	}
+	return d.naming.check(collection, resource)
+}
+
+func (d *Driver) checkResourceName(resource string) error {
+	if resource == metaResource {
+		return fmt.Errorf("%w: %v is reserved for collection metadata", ErrInvalidName, resource)
+	}
+	if n := len(d.keyFile(resource) + attachmentSuffix); n > maxFileName {
+		return fmt.Errorf("%w: resource %q is too long, its attachments would be in a %d byte file name, the limit is %d",
+			ErrInvalidName, resource, n, maxFileName)
+	}
+	if d.portableKeys {
+		return nil // any other name can be encoded
+	}
+	// / is escaped in file names, but \ is a separator on Windows
+	if resource == "." || resource == ".." || strings.ContainsAny(resource, "\\\x00") {
+		return fmt.Errorf("%w: resource %q", ErrInvalidName, resource)
+	}
+	if strings.Contains(resource, keySeparator) {
+		return fmt.Errorf("%w: resource %q, %v stands for / in file names", ErrInvalidName, resource, keySeparator)
+	}
+	return nil
+}
+
+// internalDir tells the directories the Driver keeps next to the collections apart
+// from them
+func internalDir(name string) bool {
+	switch name {
+	case indexDir, raftDir, crdtDir, syncDir, clockDir, auditDir, cursorDir, scheduleDir, outboxDir,
+		migrationDir, schemaDir, quarantineDir, lsmDir:
+		return true
+	}
+	return false
+}
+
+// Collections lists the collections of the database, sorted
+func (d *Driver) Collections() ([]string, error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var collections []string
+	for _, file := range files {
+		if file.IsDir() && !internalDir(file.Name()) {
+			seen[file.Name()] = true
+			collections = append(collections, file.Name())
+		}
+	}
+	// only written to the WriteBack cache so far
+	for _, collection := range d.dirtyCollections() {
+		if !seen[collection] {
+			collections = append(collections, collection)
+		}
+	}
+	sort.Strings(collections)
+	return collections, nil
+}
+
+// Meta returns the metadata of a collection, writing its _meta.json first if the
+// collection predates them
+func (d *Driver) Meta(collection string) (CollectionMeta, error) {
+	collection = d.foldCollection(collection)
+	if collection == "" {
+		return CollectionMeta{}, fmt.Errorf("%w - unable to read metadata", ErrEmptyCollection)
+	}
+	if err := d.checkNames(collection, ""); err != nil {
+		return CollectionMeta{}, err
+	}
+	if _, err := os.Stat(filepath.Join(d.dir, collection)); err != nil {
+		return CollectionMeta{}, err
+	}
+
+	var m CollectionMeta
+	err := d.updateMeta(collection, func(meta *CollectionMeta, fresh bool) bool {
+		m = *meta
+		m.Indexes = append([]IndexMeta(nil), meta.Indexes...)
+		return fresh
+	})
+	return m, err
+}
+
+// addRecordCount adds delta to the record count of a collection after a record was
+// created or removed. The collection has to be locked.
+func (d *Driver) addRecordCount(collection string, delta int) error {
+	return d.updateMeta(collection, func(m *CollectionMeta, fresh bool) bool {
+		if !fresh {
+			// a fresh count already saw the change
+			m.Records += delta
+		}
+		return true
+	})
+}
+
+// indexesChanged records the indexes of a collection after one was made or dropped
+func (d *Driver) indexesChanged(collection string) error {
+	return d.updateMeta(collection, func(m *CollectionMeta, fresh bool) bool {
+		m.Indexes = d.indexMeta(collection)
+		return true
+	})
+}
+
+// forgetMeta drops the cached metadata of a deleted collection
+func (d *Driver) forgetMeta(collection string) {
+	d.metaMu.Lock()
+	defer d.metaMu.Unlock()
+	delete(d.metas, collection)
+}
+
+// updateMeta hands fn the metadata of a collection and writes it out if fn says it
+// changed. fresh is set when it was just built from the collection itself.
+func (d *Driver) updateMeta(collection string, fn func(m *CollectionMeta, fresh bool) bool) error {
+	d.metaMu.Lock()
+	e, ok := d.metas[collection]
+	if !ok {
+		e = &metaEntry{}
+		d.metas[collection] = e
+	}
+	d.metaMu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	fresh := false
+	if e.meta == nil {
+		m, err := d.readMeta(collection)
+		if err != nil {
+			return err
+		}
+		e.meta, fresh = m, m.Records < 0
+		if fresh {
+			if err := d.buildMeta(m); err != nil {
+				e.meta = nil
+				return err
+			}
+		}
+	}
+
+	if !fn(e.meta, fresh) {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(e.meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = writeAtomic(filepath.Join(d.dir, collection, metaFile), append(b, '\n'))
+	if os.IsNotExist(err) {
+		return nil // no directory yet (an index of an empty collection), wait for the first write
+	}
+	return err
+}
+
+// readMeta loads a _meta.json, or returns one with Records -1 if there's none
+func (d *Driver) readMeta(collection string) (*CollectionMeta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(d.dir, collection, metaFile))
+	if os.IsNotExist(err) {
+		return &CollectionMeta{Collection: collection, Records: -1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m CollectionMeta
+	if err := json.Unmarshal(b, &m); err != nil {
+		err = fmt.Errorf("invalid %v of %v: %v", metaFile, collection, err)
+		d.corrupt(collection, "", filepath.Join(d.dir, collection, metaFile), err)
+		return nil, err
+	}
+	return &m, nil
+}
+
+// buildMeta fills in metadata for a collection without a _meta.json
+func (d *Driver) buildMeta(m *CollectionMeta) error {
+	names, err := d.listRecords(m.Collection)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m.Created = time.Now().UTC()
+	m.Records = len(names)
+	m.Indexes = d.indexMeta(m.Collection)
+	return nil
+}
+
+func (d *Driver) indexMeta(collection string) []IndexMeta {
+	var out []IndexMeta
+	for _, ix := range d.collectionIndexes(collection) {
+		ix.mu.RLock()
+		m := IndexMeta{Fields: ix.fields, Unique: ix.unique}
+		if k := ix.kind(); k != memoryKind {
+			m.Kind = k
+		}
+		if ix.ttl > 0 {
+			m.TTL = ix.ttl.String()
+		}
+		ix.mu.RUnlock()
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return indexName(out[i].Fields) < indexName(out[j].Fields)
+	})
+	return out
+}
+
+// recordExists tells storeRecord whether a write creates a record
+func (d *Driver) recordExists(collection, resource string) bool {
+	if d.cache != nil {
+		if _, ok := d.cache.peekDirty(cacheKey(collection, resource)); ok {
+			return true
+		}
+	}
+	_, err := d.statRecord(collection, resource)
+	return err == nil
+}
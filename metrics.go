@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+// the operations the Driver keeps metrics for
+const (
+	opWrite = iota
+	opRead
+	opReadAll
+	opFind
+	opDelete
+	numOps
+)
+
+var opNames = [numOps]string{"write", "read", "read_all", "find", "delete"}
+
+// upper bounds of the latency histogram buckets in seconds, from 100µs to a second
+// since most operations are a file or two
+var latencyBuckets = [...]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type opMetrics struct {
+	count   uint64
+	errors  uint64
+	nanos   uint64
+	buckets [len(latencyBuckets)]uint64 // not cumulative
+}
+
+type metrics struct {
+	ops [numOps]opMetrics
+}
+
+// observe counts an operation that started at start and failed with *err, if it
+// did. Not finding a record isn't an error.
+func (d *Driver) observe(op int, start time.Time, err *error) {
+	took := time.Since(start)
+	m := &d.metrics.ops[op]
+
+	atomic.AddUint64(&m.count, 1)
+	atomic.AddUint64(&m.nanos, uint64(took))
+	if *err != nil && !os.IsNotExist(*err) && !errors.Is(*err, ErrNotFound) {
+		atomic.AddUint64(&m.errors, 1)
+	}
+
+	seconds := took.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			atomic.AddUint64(&m.buckets[i], 1)
+			break
+		}
+	}
+}
+
+// Collector returns the operation counts, errors and latency histograms plus the
+// cache hit rate and replication lag as a prometheus.Collector, for the registry of
+// the application to serve along with its own metrics:
+//
+//	prometheus.MustRegister(db.Collector())
+func (d *Driver) Collector() prometheus.Collector {
+	return metricsCollector{d}
+}
+
+var (
+	operationsDesc = prometheus.NewDesc("golangdb_operations_total",
+		"Operations run by the database.", []string{"op"}, nil)
+	operationErrorsDesc = prometheus.NewDesc("golangdb_operation_errors_total",
+		"Operations that failed, not counting missing records.", []string{"op"}, nil)
+	operationDurationDesc = prometheus.NewDesc("golangdb_operation_duration_seconds",
+		"How long operations took.", []string{"op"}, nil)
+	cacheHitsDesc = prometheus.NewDesc("golangdb_cache_hits_total",
+		"Reads answered by the read cache.", nil, nil)
+	cacheMissesDesc = prometheus.NewDesc("golangdb_cache_misses_total",
+		"Reads that went to the disk.", nil, nil)
+	replicationConnectedDesc = prometheus.NewDesc("golangdb_replication_connected",
+		"Whether the follower is connected to its leader.", nil, nil)
+	replicationLagChangesDesc = prometheus.NewDesc("golangdb_replication_lag_changes",
+		"Changes of the leader the follower hasn't applied yet.", nil, nil)
+	replicationLagSecondsDesc = prometheus.NewDesc("golangdb_replication_lag_seconds",
+		"How old the last applied change of the leader was.", nil, nil)
+)
+
+type metricsCollector struct {
+	d *Driver
+}
+
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- operationsDesc
+	ch <- operationErrorsDesc
+	ch <- operationDurationDesc
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- replicationConnectedDesc
+	ch <- replicationLagChangesDesc
+	ch <- replicationLagSecondsDesc
+}
+
+// Collect reads the counters as they are, the cache and replication metrics only
+// when the Driver has a cache or follows a leader
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	d := c.d
+	for op := range d.metrics.ops {
+		m := &d.metrics.ops[op]
+		count := atomic.LoadUint64(&m.count)
+		ch <- prometheus.MustNewConstMetric(operationsDesc, prometheus.CounterValue, float64(count), opNames[op])
+		ch <- prometheus.MustNewConstMetric(operationErrorsDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&m.errors)), opNames[op])
+
+		buckets := make(map[float64]uint64, len(latencyBuckets))
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&m.buckets[i])
+			buckets[le] = cumulative
+		}
+		sum := time.Duration(atomic.LoadUint64(&m.nanos)).Seconds()
+		ch <- prometheus.MustNewConstHistogram(operationDurationDesc, count, sum, buckets, opNames[op])
+	}
+
+	if d.cache != nil {
+		hits, misses := d.CacheStats()
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(hits))
+		ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(misses))
+	}
+
+	if status, ok := d.ReplicationStatus(); ok {
+		connected := 0.0
+		if status.Connected {
+			connected = 1
+		}
+		ch <- prometheus.MustNewConstMetric(replicationConnectedDesc, prometheus.GaugeValue, connected)
+		ch <- prometheus.MustNewConstMetric(replicationLagChangesDesc, prometheus.GaugeValue, float64(status.LeaderSeq-status.Seq))
+		ch <- prometheus.MustNewConstMetric(replicationLagSecondsDesc, prometheus.GaugeValue, status.Lag.Seconds())
+	}
+}
+
+// metricsRegistry is a registry of the Collector alone, for MetricsHandler and
+// WriteMetrics
+func (d *Driver) metricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(d.Collector())
+	return reg
+}
+
+// MetricsHandler serves the metrics of Collector in the Prometheus text format, for a
+// Prometheus server to scrape when the application doesn't serve metrics of its own:
+//
+//	http.Handle("/metrics", db.MetricsHandler())
+func (d *Driver) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(d.metricsRegistry(), promhttp.HandlerOpts{})
+}
+
+// WriteMetrics writes the metrics of Collector to w in the Prometheus text format
+func (d *Driver) WriteMetrics(w io.Writer) error {
+	families, err := d.metricsRegistry().Gather()
+	if err != nil {
+		return err
+	}
+	enc := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// where the migrations applied to each collection are kept
+const migrationDir = "_migrations"
+
+// Migration changes the shape of the records of a collection, one record at a time.
+// Up and Down change the decoded record in place. A migration that fails part way
+// leaves the records it got through changed and isn't recorded as applied, so running
+// it again has to be harmless for records it changed already.
+type Migration struct {
+	Collection string
+	Version    int    // from 1, applied in order for each collection
+	Name       string // what it does, for the history
+
+	Up   func(doc map[string]interface{}) error
+	Down func(doc map[string]interface{}) error // for Rollback, which fails without it
+}
+
+// MigrationResult tells what a migration did, or would have done for a dry run
+type MigrationResult struct {
+	Collection string    `json:"collection"`
+	Version    int       `json:"version"`
+	Name       string    `json:"name"`
+	Direction  string    `json:"direction"` // "up" or "down"
+	Records    int       `json:"records"`   // changed by it
+	Time       time.Time `json:"time"`
+}
+
+// migrationState is the file of a collection in migrationDir
+type migrationState struct {
+	Version int               `json:"version"`
+	History []MigrationResult `json:"history"`
+}
+
+// Migrate applies the migrations not applied yet, in version order for each
+// collection, and returns what each one did. The collection is locked while a
+// migration goes through it.
+//
+//	results, err := db.Migrate(
+//		Migration{Collection: "users", Version: 1, Name: "split name", Up: splitName, Down: joinName},
+//		Migration{Collection: "users", Version: 2, Name: "default plan", Up: defaultPlan},
+//	)
+func (d *Driver) Migrate(migrations ...Migration) ([]MigrationResult, error) {
+	return d.migrate(migrations, false)
+}
+
+// MigrateDryRun is Migrate without writing anything, reporting how many records each
+// migration would change, each run on the records as they are now
+func (d *Driver) MigrateDryRun(migrations ...Migration) ([]MigrationResult, error) {
+	return d.migrate(migrations, true)
+}
+
+// Rollback reverts the migrations of a collection applied after version, the newest
+// first, with their Down functions
+func (d *Driver) Rollback(collection string, version int, migrations ...Migration) ([]MigrationResult, error) {
+	return d.rollback(collection, version, migrations, false)
+}
+
+// RollbackDryRun is Rollback without writing anything
+func (d *Driver) RollbackDryRun(collection string, version int, migrations ...Migration) ([]MigrationResult, error) {
+	return d.rollback(collection, version, migrations, true)
+}
+
+// MigrationVersion returns the version of the last migration applied to a collection,
+// 0 for none
+func (d *Driver) MigrationVersion(collection string) (int, error) {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return 0, err
+	}
+	state, err := d.migrationState(collection)
+	return state.Version, err
+}
+
+func (d *Driver) migrate(migrations []Migration, dryRun bool) ([]MigrationResult, error) {
+	byCollection, err := d.sortMigrations(migrations)
+	if err != nil {
+		return nil, err
+	}
+	collections := make([]string, 0, len(byCollection))
+	for collection := range byCollection {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	var results []MigrationResult
+	for _, collection := range collections {
+		state, err := d.migrationState(collection)
+		if err != nil {
+			return results, err
+		}
+		for _, m := range byCollection[collection] {
+			if m.Version <= state.Version {
+				continue
+			}
+			if m.Up == nil {
+				return results, fmt.Errorf("migration %v of %v has no Up", m.Version, collection)
+			}
+			r, err := d.applyMigration(m, "up", m.Up, m.Version, &state, dryRun)
+			if err != nil {
+				return results, err
+			}
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+func (d *Driver) rollback(collection string, version int, migrations []Migration, dryRun bool) ([]MigrationResult, error) {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return nil, err
+	}
+	byCollection, err := d.sortMigrations(migrations)
+	if err != nil {
+		return nil, err
+	}
+	state, err := d.migrationState(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []MigrationResult
+	ms := byCollection[collection]
+	for i := len(ms) - 1; i >= 0; i-- {
+		m := ms[i]
+		if m.Version <= version || m.Version > state.Version {
+			continue
+		}
+		if m.Down == nil {
+			return results, fmt.Errorf("migration %v of %v has no Down", m.Version, collection)
+		}
+		// back to the one before, whichever that was
+		previous := 0
+		if i > 0 {
+			previous = ms[i-1].Version
+		}
+		r, err := d.applyMigration(m, "down", m.Down, previous, &state, dryRun)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// sortMigrations groups migrations by their (folded) collection, in version order
+func (d *Driver) sortMigrations(migrations []Migration) (map[string][]Migration, error) {
+	byCollection := map[string][]Migration{}
+	for _, m := range migrations {
+		m.Collection = d.foldCollection(m.Collection)
+		if err := d.checkNames(m.Collection, ""); err != nil {
+			return nil, err
+		}
+		if m.Collection == "" || m.Version <= 0 {
+			return nil, fmt.Errorf("migration %q needs a collection and a version from 1", m.Name)
+		}
+		byCollection[m.Collection] = append(byCollection[m.Collection], m)
+	}
+	for collection, ms := range byCollection {
+		sort.SliceStable(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+		for i := 1; i < len(ms); i++ {
+			if ms[i].Version == ms[i-1].Version {
+				return nil, fmt.Errorf("migrations %q and %q of %v are both version %v", ms[i-1].Name, ms[i].Name, collection, ms[i].Version)
+			}
+		}
+	}
+	return byCollection, nil
+}
+
+// applyMigration runs fn over the records of a migration's collection, a partition at
+// a time for a partitioned one, and records the collection as being at version
+func (d *Driver) applyMigration(m Migration, direction string, fn func(map[string]interface{}) error, version int, state *migrationState, dryRun bool) (MigrationResult, error) {
+	result := MigrationResult{Collection: m.Collection, Version: m.Version, Name: m.Name, Direction: direction, Time: time.Now()}
+	if !dryRun {
+		if err := d.writable(); err != nil {
+			return result, err
+		}
+	}
+
+	collections := []string{m.Collection}
+	if _, ok := d.partitions[m.Collection]; ok {
+		var err error
+		if collections, err = d.partitionsOf(m.Collection, &query{}); err != nil {
+			return result, err
+		}
+	}
+	for _, collection := range collections {
+		n, err := d.migrateRecords(collection, fn, dryRun)
+		result.Records += n
+		if err != nil {
+			return result, fmt.Errorf("migration %v (%v) of %v, %v: %w", m.Version, m.Name, m.Collection, direction, err)
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	state.Version = version
+	state.History = append(state.History, result)
+	d.logf(LevelInfo, "Migrated collection", "operation", "migrate", "collection", m.Collection,
+		"version", m.Version, "direction", direction, "records", result.Records)
+	return result, d.storeMigrationState(m.Collection, state)
+}
+
+// migrateRecords rewrites the records of a collection fn changes, returning how many
+func (d *Driver) migrateRecords(collection string, fn func(map[string]interface{}) error, dryRun bool) (int, error) {
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	records, release, err := d.readRecords(collection, false)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	changed := 0
+	for _, r := range records {
+		// a fresh copy, the decoded doc may be shared with the read cache
+		doc, err := (&record{name: r.name, raw: r.raw}).decode()
+		if err != nil {
+			return changed, err
+		}
+		before, err := json.Marshal(doc)
+		if err != nil {
+			return changed, err
+		}
+		if err := fn(doc); err != nil {
+			return changed, fmt.Errorf("record %v: %w", r.name, err)
+		}
+		after, err := json.Marshal(doc)
+		if err != nil {
+			return changed, err
+		}
+		if bytes.Equal(before, after) {
+			continue
+		}
+		changed++
+		if dryRun {
+			continue
+		}
+
+		b, err := json.MarshalIndent(doc, "", "\t")
+		if err != nil {
+			return changed, err
+		}
+		b = append(b, '\n')
+		if b, err = d.hashRecord(b, d.hashPaths(collection, nil)); err != nil {
+			return changed, err
+		}
+		if err := d.checkUnique(collection, r.name, b); err != nil {
+			return changed, err
+		}
+		if err := d.storeRecord(collection, r.name, b); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+func (d *Driver) migrationPath(collection string) string {
+	return filepath.Join(d.dir, migrationDir, d.keyFile(collection)+".json")
+}
+
+func (d *Driver) migrationState(collection string) (migrationState, error) {
+	var state migrationState
+	b, err := ioutil.ReadFile(d.migrationPath(collection))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, fmt.Errorf("invalid migration state of %v: %v", collection, err)
+	}
+	return state, nil
+}
+
+func (d *Driver) storeMigrationState(collection string, state *migrationState) error {
+	path := d.migrationPath(collection)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, append(b, '\n'))
+}
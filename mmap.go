@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// files smaller than this are read normally even with Options.MMap, mapping them
+// costs more than the read it saves
+const defaultMMapMinSize = 64 * 1024
+
+// withRecordBytes hands fn the content of a record file. With Options.MMap large files
+// are memory mapped instead of read, so the bytes are only valid until fn returns and
+// fn must copy anything it keeps (json.Unmarshal does).
+func (d *Driver) withRecordBytes(collection, resource string, fn func(b []byte) error) error {
+	path := d.recordPath(collection, resource)
+
+	if d.mmapMinSize <= 0 {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if err := d.readRecordInto(buf, collection, resource); err != nil {
+			return err
+		}
+		return fn(buf.Bytes())
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() < d.mmapMinSize || int64(int(fi.Size())) != fi.Size() {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if _, err := buf.ReadFrom(f); err != nil {
+			return err
+		}
+		if isChunked(buf.Bytes()) {
+			buf.Reset()
+			if err := d.readRecordInto(buf, collection, resource); err != nil {
+				return err
+			}
+		}
+		return fn(buf.Bytes())
+	}
+
+	b, err := mmapFile(f, int(fi.Size()))
+	if err != nil {
+		// not every filesystem can be mapped, fall back to reading
+		d.logf(LevelDebug, "Unable to mmap record, reading it instead", "operation", "read", "collection", collection, "resource", resource, "error", err)
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	}
+	defer munmap(b)
+
+	if isChunked(b) {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if err := d.readRecordInto(buf, collection, resource); err != nil {
+			return err
+		}
+		return fn(buf.Bytes())
+	}
+	return fn(b)
+}
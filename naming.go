@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// the longest file name most filesystems take. Resources need room for the longest
+// suffix the Driver adds to their names, attachmentSuffix.
+const maxFileName = 255
+
+// NamingPolicy restricts the names of collections and resources further than what the
+// Driver can store, see Options.Naming. Zero fields don't restrict anything.
+type NamingPolicy struct {
+	// in bytes, for each collection of a subcollection path on its own
+	MaxCollectionLength int
+	MaxResourceLength   int
+
+	// names have to match these, e.g. regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	CollectionPattern *regexp.Regexp
+	ResourcePattern   *regexp.Regexp
+
+	// how many collections deep subcollection paths may go, 1 allows none and 2
+	// allows users/john/orders
+	MaxDepth int
+}
+
+func (p *NamingPolicy) check(collection, resource string) error {
+	if p == nil {
+		return nil
+	}
+	if collection != "" {
+		parts := strings.Split(collection, "/")
+		if depth := (len(parts) + 1) / 2; p.MaxDepth > 0 && depth > p.MaxDepth {
+			return fmt.Errorf("%w: %v is %d collections deep, the limit is %d", ErrInvalidName, collection, depth, p.MaxDepth)
+		}
+		for i, part := range parts {
+			if i%2 == 1 {
+				if err := p.checkResource(part); err != nil {
+					return err
+				}
+				continue
+			}
+			if p.MaxCollectionLength > 0 && len(part) > p.MaxCollectionLength {
+				return fmt.Errorf("%w: collection %q is %d bytes long, the limit is %d", ErrInvalidName, part, len(part), p.MaxCollectionLength)
+			}
+			if p.CollectionPattern != nil && !p.CollectionPattern.MatchString(part) {
+				return fmt.Errorf("%w: collection %q doesn't match %v", ErrInvalidName, part, p.CollectionPattern)
+			}
+		}
+	}
+	if resource != "" {
+		return p.checkResource(resource)
+	}
+	return nil
+}
+
+func (p *NamingPolicy) checkResource(resource string) error {
+	if p.MaxResourceLength > 0 && len(resource) > p.MaxResourceLength {
+		return fmt.Errorf("%w: resource %q is %d bytes long, the limit is %d", ErrInvalidName, resource, len(resource), p.MaxResourceLength)
+	}
+	if p.ResourcePattern != nil && !p.ResourcePattern.MatchString(resource) {
+		return fmt.Errorf("%w: resource %q doesn't match %v", ErrInvalidName, resource, p.ResourcePattern)
+	}
+	return nil
+}
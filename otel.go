@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the instrumentation name of the spans from Options.TracerProvider
+const otelTracerName = "github.com/akhil/golang-database"
+
+// NewOTelTracer turns an OpenTelemetry TracerProvider into a Tracer for
+// Options.Tracer, which is what Options.TracerProvider does. Spans are of kind
+// client, with the attributes as strings; a failed operation records its error and
+// sets the status of its span to Error.
+func NewOTelTracer(tp trace.TracerProvider) Tracer {
+	return otelTracer{tp.Tracer(otelTracerName)}
+}
+
+type otelTracer struct {
+	t trace.Tracer
+}
+
+func (o otelTracer) Start(ctx context.Context, operation string, attrs map[string]string) (context.Context, Span) {
+	ctx, span := o.t.Start(ctx, operation, trace.WithAttributes(otelAttributes(attrs)...), trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, otelSpan{span}
+}
+
+type otelSpan struct {
+	s trace.Span
+}
+
+func (o otelSpan) Event(name string, attrs map[string]string) {
+	o.s.AddEvent(name, trace.WithAttributes(otelAttributes(attrs)...))
+}
+
+func (o otelSpan) End(err error) {
+	if err != nil {
+		o.s.RecordError(err)
+		o.s.SetStatus(codes.Error, err.Error())
+	}
+	o.s.End()
+}
+
+func otelAttributes(attrs map[string]string) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+	return kvs
+}
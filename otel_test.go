@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracerProviderSpans(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	d := NewTestDriver(t, &Options{TracerProvider: tp})
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	if err := d.WriteContext(ctx, "users", "1", User{Name: "ann"}); err != nil {
+		t.Fatal(err)
+	}
+	var u User
+	if err := d.ReadContext(ctx, "users", "2", &u); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("reading users/2: %v, want %v", err, ErrNotFound)
+	}
+	parent.End()
+
+	spans := rec.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("%d spans ended, want the write, the read and the request", len(spans))
+	}
+	for i, want := range []struct {
+		name, resource string
+		status         codes.Code
+	}{{"golangdb.write", "1", codes.Unset}, {"golangdb.read", "2", codes.Error}} {
+		span := spans[i]
+		if span.Name() != want.name || span.SpanKind() != trace.SpanKindClient {
+			t.Fatalf("span %d is %v of kind %v, want %v of kind client", i, span.Name(), span.SpanKind(), want.name)
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() || span.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+			t.Fatalf("%v isn't a child of the request span", span.Name())
+		}
+		attrs := attribute.NewSet(span.Attributes()...)
+		if v, _ := attrs.Value("db.collection"); v.AsString() != "users" {
+			t.Fatalf("%v has db.collection %q, want users", span.Name(), v.AsString())
+		}
+		if v, _ := attrs.Value("db.resource"); v.AsString() != want.resource {
+			t.Fatalf("%v has db.resource %q, want %v", span.Name(), v.AsString(), want.resource)
+		}
+		if span.Status().Code != want.status {
+			t.Fatalf("%v has status %v, want %v", span.Name(), span.Status().Code, want.status)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// where the events of WriteWithEvent wait for the relay, a file each
+const outboxDir = "_outbox"
+
+// OutboxEvent is an event of the outbox as the relay hands it on
+type OutboxEvent struct {
+	ID         string          `json:"id"` // sorts in the order the events were written
+	Collection string          `json:"collection"`
+	Resource   string          `json:"resource"`
+	Event      json.RawMessage `json:"event"`
+	Time       time.Time       `json:"time"`
+}
+
+// outboxEntry is an event as it's stored, with the write it goes with until that's
+// been made
+type outboxEntry struct {
+	OutboxEvent
+	Record  json.RawMessage `json:"record,omitempty"`
+	Applied bool            `json:"applied"`
+}
+
+// WriteWithEvent writes a record and puts an event in the outbox with it, so the
+// event goes out if and only if the write was made, e.g. an "order placed" message
+// for the order written. The event is stored first along with the write, which is
+// made again when the Driver is opened should it have been cut short. Events are
+// handed on by RelayOutbox or StartRelay. A TimeoutError that's Pending leaves it
+// unknown whether the write, and so the event, was made.
+func (d *Driver) WriteWithEvent(collection, resource string, v interface{}, event interface{}) (string, error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return "", err
+	}
+	if collection == "" || resource == "" {
+		return "", missingName(collection, "unable to save record")
+	}
+	if err := d.writable(); err != nil {
+		return "", err
+	}
+	record, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	ev, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+
+	e := &outboxEntry{
+		OutboxEvent: OutboxEvent{ID: d.nextMessageID(), Collection: collection, Resource: resource, Event: ev, Time: time.Now()},
+		Record:      record,
+	}
+	path := filepath.Join(d.dir, outboxDir, e.ID+".json")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := storeOutboxEntry(path, e); err != nil {
+		return "", err
+	}
+	// the event is settled by the same operation as the write, which one outliving
+	// Options.OperationTimeout finishes in the background
+	_, err = d.timed("write", collection, resource, func() (interface{}, error) {
+		if err := d.write(context.Background(), collection, resource, json.RawMessage(record)); err != nil {
+			os.Remove(path) // no write, no event
+			return nil, err
+		}
+		e.Applied, e.Record = true, nil
+		if err := storeOutboxEntry(path, e); err != nil {
+			return nil, err
+		}
+
+		select {
+		case d.outboxed <- struct{}{}:
+		default: // the relay has a wake up pending already
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return e.ID, nil
+}
+
+func storeOutboxEntry(path string, e *outboxEntry) error {
+	b, err := json.MarshalIndent(e, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, append(b, '\n'))
+}
+
+type outboxFile struct {
+	path  string
+	entry outboxEntry
+	mtime time.Time
+}
+
+// outboxEntries reads the outbox, oldest event first
+func (d *Driver) outboxEntries() ([]outboxFile, error) {
+	dir := filepath.Join(d.dir, outboxDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	var entries []outboxFile
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue // half written .tmp files
+		}
+		path := filepath.Join(dir, file.Name())
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e outboxEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			d.corrupt("", "", path, err)
+			continue
+		}
+		entries = append(entries, outboxFile{path: path, entry: e, mtime: file.ModTime()})
+	}
+	return entries, nil
+}
+
+// recoverOutbox makes the writes of events whose WriteWithEvent was cut short. A
+// record changed since its event was stored had the write made already, or a later
+// one, and is left alone.
+func (d *Driver) recoverOutbox() error {
+	entries, err := d.outboxEntries()
+	if err != nil {
+		return err
+	}
+	for _, f := range entries {
+		e := f.entry
+		if e.Applied {
+			continue
+		}
+		fi, err := d.statRecord(e.Collection, e.Resource)
+		if err != nil || fi.ModTime().Before(f.mtime) {
+			if err := d.Write(e.Collection, e.Resource, e.Record); err != nil {
+				return fmt.Errorf("outbox write of %v/%v: %w", e.Collection, e.Resource, err)
+			}
+		}
+		e.Applied, e.Record = true, nil
+		if err := storeOutboxEntry(f.path, &e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RelayOutbox hands the events waiting in the outbox to send in order, dropping each
+// from the outbox once send returns nil. It stops at the first error, leaving that
+// event and the ones after it for the next run, and returns how many were sent.
+// Events can be sent again if the process stops between send and the drop, so
+// whatever receives them should be idempotent.
+func (d *Driver) RelayOutbox(send func(OutboxEvent) error) (int, error) {
+	d.omu.Lock()
+	defer d.omu.Unlock()
+
+	entries, err := d.outboxEntries()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, f := range entries {
+		if !f.entry.Applied {
+			break // still being written, the events keep their order
+		}
+		if err := send(f.entry.OutboxEvent); err != nil {
+			return sent, fmt.Errorf("sending outbox event %v: %w", f.entry.ID, err)
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// StartRelay runs RelayOutbox in the background as events are written, and every
+// interval to retry events send failed on, until the Driver is closed. Only the first
+// call starts a relay.
+func (d *Driver) StartRelay(send func(OutboxEvent) error, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	d.relay.Do(func() {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				_, err := d.RelayOutbox(send)
+				if err != nil {
+					d.logf(LevelError, "Outbox relay failed", "operation", "relay", "error", err)
+				}
+				d.background.set("outbox relay", err)
+
+				select {
+				case <-d.done:
+					return
+				case <-d.outboxed:
+				case <-ticker.C:
+				}
+			}
+		}()
+	})
+}
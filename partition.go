@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PartitionPeriod is the stretch of time a partition of a collection covers
+type PartitionPeriod int
+
+const (
+	PartitionByDay PartitionPeriod = iota
+	PartitionByHour
+	PartitionByMonth
+)
+
+// layout names the partitions, in UTC, so they sort in time order
+func (p PartitionPeriod) layout() string {
+	switch p {
+	case PartitionByHour:
+		return "2006-01-02T15"
+	case PartitionByMonth:
+		return "2006-01"
+	}
+	return "2006-01-02"
+}
+
+// next returns the start of the partition after the one starting at t
+func (p PartitionPeriod) next(t time.Time) time.Time {
+	switch p {
+	case PartitionByHour:
+		return t.Add(time.Hour)
+	case PartitionByMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// TimePartition keeps the records of a collection in a directory per day (or hour,
+// or month) of a timestamp field, events/2024-06-01/<id>.json, so collections that
+// are mostly appended to don't pile up files in one directory. See Options.Partitions.
+//
+// The collection is used by its name as usual: Write routes the record by its field,
+// Read and Delete find the partition holding it, ReadAll, Find and List go through
+// every partition, or those Between limits them to. A partition is a collection of
+// its own too, "events/2024-06-01", for what works on one collection at a time, such
+// as indexes, or dropping the partitions that are past keeping.
+type TimePartition struct {
+	// dotted path of the timestamp, an RFC 3339 string (as time.Time encodes) or Unix
+	// seconds. Records without it can't be written.
+	Field string
+
+	Period PartitionPeriod
+}
+
+// Between limits a ReadAll or Find of a partitioned collection to the records whose
+// timestamp is from from up to, not including, to. Only the partitions covering that
+// are read. A zero time leaves that end open.
+func Between(from, to time.Time) QueryOption {
+	return func(q *query) {
+		q.from, q.to = from, to
+	}
+}
+
+// Partitions lists the partitions of a partitioned collection, oldest first, by their
+// collection names
+func (d *Driver) Partitions(collection string) ([]string, error) {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return nil, err
+	}
+	if _, ok := d.partitions[collection]; !ok {
+		return nil, fmt.Errorf("%v isn't partitioned", collection)
+	}
+	return d.partitionsOf(collection, &query{})
+}
+
+// partitionParent returns the partitioned collection a partition belongs to, or the
+// collection itself, for the settings given by collection name
+func (d *Driver) partitionParent(collection string) string {
+	if parent, _, ok := d.splitPartition(collection); ok {
+		return parent
+	}
+	return collection
+}
+
+func (d *Driver) isPartition(collection string) bool {
+	_, _, ok := d.splitPartition(collection)
+	return ok
+}
+
+// splitPartition tells whether collection is a partition, parent/name, and when it
+// starts
+func (d *Driver) splitPartition(collection string) (string, time.Time, bool) {
+	i := strings.IndexByte(collection, '/')
+	if i < 0 || strings.Contains(collection[i+1:], "/") {
+		return "", time.Time{}, false
+	}
+	parent := collection[:i]
+	tp, ok := d.partitions[parent]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	start, err := time.Parse(tp.Period.layout(), collection[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parent, start, true
+}
+
+// partitionsOf lists the partitions of collection overlapping q's time range, sorted
+func (d *Driver) partitionsOf(collection string, q *query) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(d.dir, collection))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, file := range files {
+		if file.IsDir() {
+			seen[collection+"/"+file.Name()] = true
+			names = append(names, collection+"/"+file.Name())
+		}
+	}
+	// only written to the WriteBack cache so far
+	for _, c := range d.dirtyCollections() {
+		if strings.HasPrefix(c, collection+"/") && !seen[c] {
+			names = append(names, c)
+		}
+	}
+
+	period := d.partitions[collection].Period
+	partitions := names[:0]
+	for _, name := range names {
+		_, start, ok := d.splitPartition(name)
+		if !ok {
+			continue
+		}
+		if !q.to.IsZero() && !start.Before(q.to) {
+			continue
+		}
+		if !q.from.IsZero() && !period.next(start).After(q.from) {
+			continue
+		}
+		partitions = append(partitions, name)
+	}
+	sort.Strings(partitions)
+	return partitions, nil
+}
+
+// partitionFor returns the partition of collection holding resource, the collection
+// itself if there's none, so reads of it find nothing
+func (d *Driver) partitionFor(collection, resource string) (string, error) {
+	if _, ok := d.partitions[collection]; !ok || resource == "" {
+		return collection, nil
+	}
+	partitions, err := d.partitionsOf(collection, &query{})
+	if err != nil {
+		return "", err
+	}
+	// records are mostly read while they're recent
+	for i := len(partitions) - 1; i >= 0; i-- {
+		if d.mayExist(partitions[i], resource) && d.recordExists(partitions[i], resource) {
+			return partitions[i], nil
+		}
+	}
+	return collection, nil
+}
+
+// writePartitioned writes a record to the partition of its timestamp, moving it out
+// of the one it was in if the timestamp changed
+func (d *Driver) writePartitioned(collection, resource string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// hashed by the collection's fields, the partition has none of its own
+	if b, err = d.hashRecord(b, d.hashPaths(collection, v)); err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	tp := d.partitions[collection]
+	t, ok := timeOf(doc, tp.Field)
+	if !ok {
+		return fmt.Errorf("%v is partitioned by %v, which %v doesn't have as a time", collection, tp.Field, resource)
+	}
+	partition := collection + "/" + t.UTC().Format(tp.Period.layout())
+
+	// one write of the collection at a time, so a record is only ever in one partition
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current, err := d.partitionFor(collection, resource)
+	if err != nil {
+		return err
+	}
+	if current != collection && current != partition {
+		if err := d.remove(context.Background(), current, resource); err != nil {
+			return err
+		}
+	}
+	return d.put(context.Background(), partition, resource, json.RawMessage(b))
+}
+
+// listPartitions is List for a partitioned collection
+func (d *Driver) listPartitions(collection, prefix string) ([]string, error) {
+	partitions, err := d.partitionsOf(collection, &query{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, partition := range partitions {
+		found, err := d.list(partition, prefix)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		names = append(names, found...)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// deletePartitioned is DeleteWhere for a partitioned collection, a partition at a time
+func (d *Driver) deletePartitioned(collection string, filter Filter) (int, error) {
+	partitions, err := d.partitionsOf(collection, &query{})
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, partition := range partitions {
+		n, err := d.deleteWhere(partition, filter)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// updatePartitioned is UpdateWhere for a partitioned collection. A record whose
+// timestamp the patch changes moves to its new partition.
+func (d *Driver) updatePartitioned(collection string, filter Filter, patch map[string]interface{}) (int, error) {
+	records, release, err := d.readPartitioned(collection, &query{}, func(collection string) ([]*record, func(), error) {
+		return d.readRecords(collection, true)
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	updated := 0
+	for _, r := range records {
+		doc, err := r.decode()
+		if err != nil {
+			return updated, err
+		}
+		if filter != nil && !filter.Match(doc) {
+			continue
+		}
+		// the decoded doc may be shared with the read cache, patch a fresh copy
+		if doc, err = (&record{name: r.name, raw: r.raw}).decode(); err != nil {
+			return updated, err
+		}
+		if err := d.writePartitioned(collection, r.name, mergePatch(doc, patch)); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// readPartitioned reads the records of collection with read, going through its
+// partitions if it's partitioned and keeping those in q's time range
+func (d *Driver) readPartitioned(collection string, q *query, read func(collection string) ([]*record, func(), error)) ([]*record, func(), error) {
+	tp, ok := d.partitions[collection]
+	if !ok {
+		return read(collection)
+	}
+	partitions, err := d.partitionsOf(collection, q)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	var records []*record
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, partition := range partitions {
+		found, r, err := read(partition)
+		releases = append(releases, r)
+		if err != nil {
+			release()
+			return nil, func() {}, err
+		}
+		records = append(records, found...)
+	}
+	if q.from.IsZero() && q.to.IsZero() {
+		return records, release, nil
+	}
+
+	// the partitions at either end hold records on the other side of it too
+	within := records[:0]
+	for _, r := range records {
+		doc, err := r.decode()
+		if err != nil {
+			release()
+			return nil, func() {}, err
+		}
+		t, ok := timeOf(doc, tp.Field)
+		if !ok || !q.from.IsZero() && t.Before(q.from) || !q.to.IsZero() && !t.Before(q.to) {
+			continue
+		}
+		within = append(within, r)
+	}
+	return within, release, nil
+}
+
+// timeOf reads a timestamp field, an RFC 3339 string or Unix seconds
+func timeOf(doc map[string]interface{}, field string) (time.Time, bool) {
+	v, ok := lookup(doc, field)
+	if !ok {
+		return time.Time{}, false
+	}
+	return asTime(v)
+}
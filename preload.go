@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// preload loads the collections of Options.Preload when the database is opened: their
+// names into the key directory and bloom filter, and with values their records into
+// the cache, as many as it holds
+func (d *Driver) preload(collections []string, values bool) error {
+	for _, collection := range collections {
+		collection = d.foldCollection(collection)
+		if err := d.checkNames(collection, ""); err != nil {
+			return err
+		}
+		targets := []string{collection}
+		if _, ok := d.partitions[collection]; ok {
+			var err error
+			if targets, err = d.partitionsOf(collection, &query{}); err != nil {
+				return err
+			}
+		}
+
+		start := time.Now()
+		loaded := 0
+		for _, target := range targets {
+			n, err := d.preloadOne(target, values)
+			if err != nil {
+				return err
+			}
+			loaded += n
+		}
+		d.logf(LevelInfo, "Preloaded collection", "operation", "preload", "collection", collection, "records", loaded, "values", values, "duration", time.Since(start))
+	}
+	return nil
+}
+
+// preloadOne is preload for a collection that isn't partitioned, returning how many
+// records it has
+func (d *Driver) preloadOne(collection string, values bool) (int, error) {
+	if d.keyDirectory {
+		if _, err := d.collectionKeys(collection); err != nil {
+			return 0, err
+		}
+	}
+	if d.bloomFilter {
+		if _, err := d.collectionBloom(collection); err != nil {
+			return 0, err
+		}
+	}
+
+	names, err := d.listRecords(collection)
+	if os.IsNotExist(err) {
+		return 0, nil // nothing written to it yet
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !values || d.cache == nil {
+		return len(names), nil
+	}
+
+	// readNamed puts the records in the cache on the way
+	_, release, err := d.readNamed(collection, names, false)
+	release()
+	return len(names), err
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// where the cursors of named subscribers are kept, _cursors/<topic>/<subscriber>
+const cursorDir = "_cursors"
+
+// Publication is a message of a topic as a Subscription delivers it
+type Publication struct {
+	Topic string
+	ID    string // sorts in publishing order
+	Body  json.RawMessage
+	Time  time.Time
+}
+
+// Decode unmarshals the body of a publication into v
+func (p *Publication) Decode(v interface{}) error {
+	return json.Unmarshal(p.Body, v)
+}
+
+// Publish sends msg to the subscribers of a topic and returns its ID. A topic is a
+// collection holding its messages as records named by their ID, so they outlast
+// restarts and replicate like any record. They're kept until deleted like any record
+// too.
+func (d *Driver) Publish(topic string, msg interface{}) (string, error) {
+	topic = d.foldCollection(topic)
+	if err := d.checkNames(topic, ""); err != nil {
+		return "", err
+	}
+	if topic == "" {
+		return "", fmt.Errorf("%w - no topic to publish to", ErrEmptyCollection)
+	}
+	id := d.nextMessageID()
+	return id, d.Write(topic, id, msg)
+}
+
+// Subscription delivers the messages of a topic on C, in the order they were
+// published. C is closed when the Subscription or the Driver is closed; Err tells why.
+type Subscription struct {
+	C <-chan Publication
+
+	d          *Driver
+	topic      string
+	subscriber string
+	c          chan Publication
+	done       chan struct{}
+	closing    sync.Once
+
+	mu    sync.Mutex
+	acked string
+	err   error
+}
+
+// Subscribe starts delivering the messages of a topic. A named subscriber has a
+// cursor kept in the database, moved by Ack, and picks up after the last message it
+// acknowledged, every message of the topic for a new one, so nothing is missed across
+// restarts, though unacknowledged messages come again. With no name, only messages
+// published from now on are delivered. The Subscription has to be closed when it's
+// no longer read.
+func (d *Driver) Subscribe(topic, subscriber string) (*Subscription, error) {
+	topic = d.foldCollection(topic)
+	if err := d.checkNames(topic, subscriber); err != nil {
+		return nil, err
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("%w - no topic to subscribe to", ErrEmptyCollection)
+	}
+
+	cursor := fmt.Sprintf("%019d", time.Now().UnixNano())
+	if subscriber != "" {
+		b, err := ioutil.ReadFile(d.cursorPath(topic, subscriber))
+		switch {
+		case err == nil:
+			cursor = strings.TrimSpace(string(b))
+		case os.IsNotExist(err):
+			cursor = ""
+		default:
+			return nil, err
+		}
+	}
+
+	c := make(chan Publication)
+	s := &Subscription{C: c, d: d, topic: topic, subscriber: subscriber, c: c, done: make(chan struct{}), acked: cursor}
+	go s.run(cursor)
+	return s, nil
+}
+
+func (d *Driver) cursorPath(topic, subscriber string) string {
+	return filepath.Join(d.dir, cursorDir, topic, d.keyFile(subscriber))
+}
+
+// run delivers the stored messages after last, then those the change feed brings.
+// When the feed falls behind it goes back to reading what's stored.
+func (s *Subscription) run(last string) {
+	defer close(s.c)
+	for {
+		// watching first, so nothing published while catching up is missed
+		w := s.d.Watch(s.topic)
+		var ok bool
+		if last, ok = s.catchUp(last); !ok {
+			w.Close()
+			return
+		}
+
+		for ok {
+			select {
+			case <-s.done:
+				w.Close()
+				return
+			case c, open := <-w.C:
+				if !open {
+					if err := w.Err(); err != ErrWatcherLagging {
+						s.fail(err)
+						return
+					}
+					ok = false
+					break
+				}
+				if c.Op != ChangeWrite || c.Resource <= last {
+					continue
+				}
+				body := c.Record
+				if body == nil {
+					r, err := s.d.loadRecord(s.topic, c.Resource)
+					if err != nil {
+						continue // deleted already
+					}
+					body = r.raw
+				}
+				if !s.deliver(c.Resource, body) {
+					w.Close()
+					return
+				}
+				last = c.Resource
+			}
+		}
+	}
+}
+
+// catchUp delivers the stored messages after last, returning the last one delivered.
+// It reports false when the Subscription should stop.
+func (s *Subscription) catchUp(last string) (string, bool) {
+	names, err := s.d.listRecords(s.topic)
+	if err != nil && !os.IsNotExist(err) {
+		s.fail(err)
+		return last, false
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name <= last {
+			continue
+		}
+		r, err := s.d.loadRecord(s.topic, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			s.fail(err)
+			return last, false
+		}
+		if !s.deliver(name, r.raw) {
+			return last, false
+		}
+		last = name
+	}
+	return last, true
+}
+
+func (s *Subscription) deliver(id string, body []byte) bool {
+	p := Publication{Topic: s.topic, ID: id, Body: append(json.RawMessage(nil), body...)}
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		p.Time = time.Unix(0, n)
+	}
+	select {
+	case s.c <- p:
+		return true
+	case <-s.done:
+		return false
+	case <-s.d.done:
+		return false
+	}
+}
+
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Ack moves the cursor of a named subscriber past p, so it isn't delivered again
+// after a restart. Acknowledging a message acknowledges those before it too.
+func (s *Subscription) Ack(p Publication) error {
+	if s.subscriber == "" {
+		return nil // nothing to resume
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.ID <= s.acked {
+		return nil
+	}
+	path := s.d.cursorPath(s.topic, s.subscriber)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeAtomic(path, []byte(p.ID+"\n")); err != nil {
+		return err
+	}
+	s.acked = p.ID
+	return nil
+}
+
+// Close stops the Subscription and closes C
+func (s *Subscription) Close() {
+	s.closing.Do(func() { close(s.done) })
+}
+
+// Err tells why C was closed, nil if the Subscription or the Driver was closed
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
@@ -0,0 +1,1058 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction is the sort direction used by OrderBy
+type Direction int
+
+const (
+	Asc Direction = iota
+	Desc
+)
+
+// QueryOption changes how Find and ReadAll build their result set. Read, ReadPath
+// and ReadStream take Unredacted and ignore the others.
+type QueryOption func(*query)
+
+type query struct {
+	orderBy []ordering
+	fields  []string
+	limit   int    // 0 means no limit
+	offset  int    // results skipped
+	who     string // for the read audit log
+
+	keyset bool   // After was given
+	after  string // its key
+
+	ranged     bool   // by Range
+	start, end string // its keys, end "" for none
+
+	keyRe *regexp.Regexp // KeyMatchesRegex, nil for any name
+
+	unredacted bool
+	from, to   time.Time // Between, for partitioned collections
+}
+
+type ordering struct {
+	by    orderKind
+	field string // with byField
+	dir   Direction
+}
+
+// what an ordering sorts on
+type orderKind int
+
+const (
+	byField   orderKind = iota
+	byKey               // the resource name
+	byModTime           // when the record was last written
+)
+
+// OrderBy sorts the results on a (dotted) field, e.g. OrderBy("Address.City", Asc),
+// from an index on it if there is one. Calling it more than once, or with OrderByKey
+// and OrderByModTime, adds tie breakers in the order given. Results sorted alike by
+// all of them come in key order, and without any in key order altogether, so they
+// are the same on every filesystem and engine.
+func OrderBy(field string, dir Direction) QueryOption {
+	return func(q *query) {
+		q.orderBy = append(q.orderBy, ordering{field: field, dir: dir})
+	}
+}
+
+// OrderByKey sorts the results on their resource names
+func OrderByKey(dir Direction) QueryOption {
+	return func(q *query) {
+		q.orderBy = append(q.orderBy, ordering{by: byKey, dir: dir})
+	}
+}
+
+// OrderByModTime sorts the results on when they were last written, records not on
+// disk yet (in the WriteBack cache) last
+func OrderByModTime(dir Direction) QueryOption {
+	return func(q *query) {
+		q.orderBy = append(q.orderBy, ordering{by: byModTime, dir: dir})
+	}
+}
+
+// Select trims every result down to the given (dotted) fields, e.g. Select("Name", "Address.City").
+// Fields a record doesn't have are left out rather than returned as null.
+func Select(fields ...string) QueryOption {
+	return func(q *query) {
+		q.fields = append(q.fields, fields...)
+	}
+}
+
+// Limit returns no more than n results, all of them if n is zero
+func Limit(n int) QueryOption {
+	return func(q *query) {
+		if n >= 0 {
+			q.limit = n
+		}
+	}
+}
+
+// Offset skips the first n results, in the order OrderBy or After puts them in. Deep
+// offsets still read the skipped records, After doesn't.
+func Offset(n int) QueryOption {
+	return func(q *query) {
+		if n >= 0 {
+			q.offset = n
+		}
+	}
+}
+
+// After pages through a collection by resource name, handing out the last name of a
+// page as the cursor of the next, as infinite scroll APIs do: only the records named
+// after key are returned, in name order unless OrderBy sorts them otherwise. After("")
+// is the first page. Records up to the cursor aren't read at all, so deep pages cost
+// no more than the first. With OrderByKey(Desc) it pages backwards, through the
+// records named before key.
+//
+//	page, _ := db.List("users", "", After(last))
+func After(key string) QueryOption {
+	return func(q *query) {
+		q.keyset, q.after = true, key
+	}
+}
+
+// KeyMatchesRegex keeps the records whose resource name matches pattern, the way
+// MatchesRegex does for a field, e.g. in List("logs", "", opt) and Find. Names
+// that don't match are dropped before any record is read. Patterns too big to match
+// quickly are an error, as with MatchesRegex.
+func KeyMatchesRegex(pattern string) (QueryOption, error) {
+	re, err := compileRegex("resource names", pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(q *query) {
+		q.keyRe = re
+	}, nil
+}
+
+// keyDesc tells whether the results go by key backwards, with OrderByKey(Desc)
+func (q *query) keyDesc() bool {
+	return len(q.orderBy) > 0 && q.orderBy[0].by == byKey && q.orderBy[0].dir == Desc
+}
+
+// picksKeys tells whether the query drops records by name, see wants
+func (q *query) picksKeys() bool {
+	return q.keyset || q.ranged || q.keyRe != nil
+}
+
+// wants tells whether a name comes after the After cursor (before it going backwards),
+// within Range and matches KeyMatchesRegex
+func (q *query) wants(name string) bool {
+	if q.ranged && (name < q.start || q.end != "" && name >= q.end) {
+		return false
+	}
+	if q.keyRe != nil && !q.keyRe.MatchString(name) {
+		return false
+	}
+	switch {
+	case !q.keyset:
+		return true
+	case q.keyDesc():
+		return q.after == "" || name < q.after
+	}
+	return name > q.after
+}
+
+// page drops the names up to the After cursor, out of Range or not matching
+// KeyMatchesRegex and sorts the rest. When every name is a result, as without a
+// filter, and they're sorted by key alone, no more than Offset and Limit take are
+// kept, so no more are read.
+func (q *query) page(names []string, all bool) []string {
+	if q.picksKeys() {
+		out := make([]string, 0, len(names))
+		for _, name := range names {
+			if q.wants(name) {
+				out = append(out, name)
+			}
+		}
+		names = out
+	}
+	byKey := len(q.orderBy) == 0 || len(q.orderBy) == 1 && q.orderBy[0].by == byKey
+	truncate := all && byKey && q.limit > 0 && len(names) > q.offset+q.limit
+	if q.keyset || q.ranged || q.keyDesc() || truncate {
+		// the order of the results
+		if q.keyDesc() {
+			sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		} else {
+			sort.Strings(names)
+		}
+	}
+	if truncate {
+		names = names[:q.offset+q.limit]
+	}
+	return names
+}
+
+// window is where Offset and Limit cut n results in their final order
+func (q *query) window(n int) (from, to int) {
+	from, to = min(q.offset, n), n
+	if q.limit > 0 && from+q.limit < to {
+		to = from + q.limit
+	}
+	return from, to
+}
+
+func newQuery(opts []QueryOption) *query {
+	q := &query{}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// record is a single file of a collection, decoded on demand. A record can be shared
+// through the read cache, so raw and doc must not be modified once set.
+type record struct {
+	name string
+	raw  []byte
+
+	mu  sync.Mutex // guards decoding doc
+	doc map[string]interface{}
+}
+
+func (r *record) decode() (map[string]interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.doc != nil {
+		return r.doc, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(r.raw))
+	dec.UseNumber()
+	if err := dec.Decode(&r.doc); err != nil {
+		return nil, fmt.Errorf("unable to decode record %v: %w", r.name, corrupted(err))
+	}
+	return r.doc, nil
+}
+
+// Find returns the records of a collection matching filter (a nil filter matches everything)
+func (d *Driver) Find(collection string, filter Filter, opts ...QueryOption) ([]string, error) {
+	return d.FindContext(context.Background(), collection, filter, opts...)
+}
+
+// FindContext is Find tracing the query as part of the span in ctx, see Tracer
+func (d *Driver) FindContext(ctx context.Context, collection string, filter Filter, opts ...QueryOption) ([]string, error) {
+	found, err := d.timed("find", collection, "", func() (interface{}, error) {
+		var out []string
+		err := d.find(ctx, collection, filter, opts, func(records []*record, q *query) (err error) {
+			out, err = d.finish(collection, records, q)
+			return err
+		})
+		return out, err
+	})
+	out, _ := found.([]string)
+	return out, err
+}
+
+// FindRaw is Find returning the records as raw JSON, ready to be written to an
+// HTTP response or embedded in another document without decoding them again
+func (d *Driver) FindRaw(collection string, filter Filter, opts ...QueryOption) ([]json.RawMessage, error) {
+	found, err := d.timed("find", collection, "", func() (interface{}, error) {
+		var out []json.RawMessage
+		err := d.find(context.Background(), collection, filter, opts, func(records []*record, q *query) (err error) {
+			out, err = d.finishRaw(collection, records, q)
+			return err
+		})
+		return out, err
+	})
+	out, _ := found.([]json.RawMessage)
+	return out, err
+}
+
+// find reads and filters the records of a query and hands the matches to finish
+// while their buffers are still held
+func (d *Driver) find(ctx context.Context, collection string, filter Filter, opts []QueryOption, finish func([]*record, *query) error) (err error) {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return err
+	}
+	op := d.begin(ctx, opFind, collection, "")
+	defer op.end(&err)
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to find", ErrEmptyCollection)
+	}
+
+	q := newQuery(opts)
+	records, release, err := d.readPartitioned(collection, q, func(collection string) ([]*record, func(), error) {
+		p, err := d.plan(collection, filter, q)
+		if err != nil {
+			return nil, func() {}, err
+		}
+		// filters need the decoded records, let the read workers decode them too
+		if p.Scan == IndexScan {
+			return d.readNamed(collection, q.page(p.candidates, false), filter != nil)
+		}
+		return d.readQueried(collection, q, filter != nil, filter == nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// the index only narrows things down, every candidate still gets the full filter
+	if filter != nil {
+		matched := records[:0]
+		for _, r := range records {
+			doc, err := r.decode()
+			if err != nil {
+				return err
+			}
+			if filter.Match(doc) {
+				matched = append(matched, r)
+			}
+		}
+		records = matched
+	}
+
+	if err := d.auditRead(q.who, opFind, collection, recordNames(records)); err != nil {
+		return err
+	}
+	return finish(records, q)
+}
+
+// readRecords loads every record file of a collection, decoding them too if asked.
+// Without a read cache the files are read into pooled buffers, which release hands
+// back, so the records must not be used after calling it.
+func (d *Driver) readRecords(collection string, decode bool) ([]*record, func(), error) {
+	names, err := d.listRecords(collection)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	return d.readNamed(collection, names, decode)
+}
+
+// readQueried is readRecords for a query, which reads nothing up to an After cursor
+// or past a Limit, in key order or the order of an index. all tells whether every
+// record is a result, see page.
+func (d *Driver) readQueried(collection string, q *query, decode, all bool) ([]*record, func(), error) {
+	if all && q.limit > 0 && !q.picksKeys() && len(q.orderBy) == 1 && q.orderBy[0].by == byField {
+		// the first records in the order of an index on the field are the results
+		names, ok, err := d.indexOrder(collection, q.orderBy[0], q.offset+q.limit)
+		if err != nil {
+			return nil, func() {}, err
+		}
+		if ok {
+			return d.readNamed(collection, names, decode)
+		}
+	}
+	if !q.picksKeys() && (!all || q.limit == 0) {
+		return d.readRecords(collection, decode)
+	}
+	names, err := d.listRecords(collection)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	return d.readNamed(collection, q.page(names, all), decode)
+}
+
+// listRecords returns the resource names of a collection without opening any record
+func (d *Driver) listRecords(collection string) ([]string, error) {
+	if names, ok := d.knownKeys(collection, ""); ok {
+		return names, nil
+	}
+	return d.scanRecords(collection)
+}
+
+// scanRecords is listRecords from the directory of the collection
+func (d *Driver) scanRecords(collection string) ([]string, error) {
+	var dirty []string
+	if d.cache != nil {
+		dirty = d.cache.dirtyNames(collection)
+	}
+
+	dir := filepath.Join(d.dir, collection)
+
+	// checks if the collection or directory exists
+	if _, err := stat(dir); err != nil {
+		if os.IsNotExist(err) && len(dirty) > 0 {
+			return dirty, nil // only written to the WriteBack cache so far
+		}
+		return nil, err
+	}
+
+	files, err := d.recordFiles(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for _, file := range files {
+		// skip half written .tmp files and the _meta.json
+		name, ok := d.recordName(file.Name())
+		if !ok {
+			continue
+		}
+		names = append(names, name)
+		seen[name] = true
+	}
+	for _, name := range dirty {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// List returns the resources of a collection starting with prefix, sorted. With path
+// keys such as "2024/05/invoice-1" it lists a part of the key space the way S3 does,
+// List("invoices", "2024/05/"). Only the names of the files are read, no records.
+// After, Offset and Limit page through the names.
+func (d *Driver) List(collection, prefix string, opts ...QueryOption) ([]string, error) {
+	out, err := d.timed("list", collection, "", func() (interface{}, error) {
+		names, err := d.list(collection, prefix)
+		q := newQuery(opts)
+		names = q.page(names, true)
+		from, to := q.window(len(names))
+		return names[from:to], err
+	})
+	names, _ := out.([]string)
+	return names, err
+}
+
+// Glob lists the resources of a collection matching a pattern, sorted, e.g.
+// Glob("logs", "app-*-error"). Patterns are those of path.Match: * is any run of
+// characters but /, ? any one character and [a-z] one of a class. Only the names
+// starting with the part of the pattern before its first wildcard are looked at,
+// from the key directory with Options.KeyDirectory. After, Offset and Limit page
+// through them.
+func (d *Driver) Glob(collection, pattern string, opts ...QueryOption) ([]string, error) {
+	out, err := d.timed("glob", collection, "", func() (interface{}, error) {
+		_, pattern := d.fold(collection, pattern)
+		if err := checkGlob(pattern); err != nil {
+			return nil, err
+		}
+		names, err := d.list(collection, globPrefix(pattern))
+		if err != nil {
+			return nil, err
+		}
+		q := newQuery(opts)
+		names = q.page(matchGlob(names, pattern), true)
+		from, to := q.window(len(names))
+		return names[from:to], nil
+	})
+	names, _ := out.([]string)
+	return names, err
+}
+
+func checkGlob(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// globPrefix is what every name matching pattern starts with
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// matchGlob keeps the names matching a valid pattern
+func matchGlob(names []string, pattern string) []string {
+	matched := names[:0]
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			matched = append(matched, name)
+		}
+	}
+	return matched
+}
+
+// ReadRange returns the records named from startKey up to, but not including, endKey, in
+// key order, without reading any other. With time prefixed keys those are the records
+// of an interval:
+//
+//	db.ReadRange("events", "2024-06-01", "2024-06-02")
+//
+// An empty endKey has no end. It takes the QueryOptions of ReadAll.
+func (d *Driver) ReadRange(collection, startKey, endKey string, opts ...QueryOption) ([]string, error) {
+	out, err := d.timed("read_range", collection, "", func() (interface{}, error) {
+		_, startKey := d.fold(collection, startKey)
+		_, endKey := d.fold(collection, endKey)
+		return d.readAll(context.Background(), collection, append(opts, keyRange(startKey, endKey))...)
+	})
+	records, _ := out.([]string)
+	return records, err
+}
+
+func keyRange(start, end string) QueryOption {
+	return func(q *query) {
+		q.ranged, q.start, q.end = true, start, end
+	}
+}
+
+func (d *Driver) list(collection, prefix string) ([]string, error) {
+	collection, prefix = d.fold(collection, prefix)
+	if err := d.checkNames(collection, ""); err != nil {
+		return nil, err
+	}
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to list", ErrEmptyCollection)
+	}
+	if _, ok := d.partitions[collection]; ok {
+		return d.listPartitions(collection, prefix)
+	}
+	if names, ok := d.knownKeys(collection, prefix); ok {
+		return names, nil
+	}
+
+	var names []string
+	if d.cache != nil {
+		for _, name := range d.cache.dirtyNames(collection) {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	files, err := d.recordFiles(collection)
+	if os.IsNotExist(err) && len(names) > 0 {
+		return names, nil // only written to the WriteBack cache so far
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		seen[name] = true
+	}
+	// the file names start like the resources do, so most are skipped unparsed. Not
+	// with PortableKeys, where the first byte is encoded or not depending on the rest.
+	filePrefix := d.keyFile(prefix)
+	for _, file := range files {
+		if !d.portableKeys && !strings.HasPrefix(file.Name(), filePrefix) {
+			continue
+		}
+		if name, ok := d.recordName(file.Name()); ok && strings.HasPrefix(name, prefix) && !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readNamed is readRecords for the given records, skipping any that were deleted in
+// the meantime. Files are read (and decoded) by up to Options.ReadParallelism
+// workers, the records come back in the order of names.
+func (d *Driver) readNamed(collection string, names []string, decode bool) ([]*record, func(), error) {
+	records := make([]*record, len(names))
+	buffers := make([]*bytes.Buffer, len(names))
+	errs := make([]error, len(names))
+
+	release := func() {
+		for _, buf := range buffers {
+			if buf != nil {
+				putBuffer(buf)
+			}
+		}
+	}
+
+	readOne := func(i int) {
+		name := names[i]
+		var r *record
+		var err error
+		if d.cache != nil {
+			// cached records outlive this call, they can't sit in pooled buffers
+			r, err = d.loadRecord(collection, name)
+		} else {
+			buffers[i] = getBuffer()
+			err = d.readRecordInto(buffers[i], collection, name)
+			r = &record{name: name, raw: buffers[i].Bytes()}
+		}
+
+		if os.IsNotExist(err) {
+			return
+		}
+		if err == nil && decode {
+			if _, err = r.decode(); err != nil {
+				d.corrupt(collection, name, d.recordPath(collection, name), err)
+			}
+		}
+		records[i], errs[i] = r, err
+	}
+
+	workers := d.parallelism
+	if workers > len(names) {
+		workers = len(names)
+	}
+	if workers <= 1 {
+		for i := range names {
+			readOne(i)
+		}
+	} else {
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					readOne(i)
+				}
+			}()
+		}
+		for i := range names {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+	}
+
+	out := records[:0]
+	for i, r := range records {
+		if errs[i] != nil {
+			release()
+			return nil, func() {}, errs[i]
+		}
+		if r != nil {
+			out = append(out, r)
+		}
+	}
+	return out, release, nil
+}
+
+// loadRecord reads a record, from the read cache when it's there
+func (d *Driver) loadRecord(collection, name string) (*record, error) {
+	if d.cache == nil {
+		return d.readRecordFile(collection, name)
+	}
+
+	if r, ok := d.cache.get(cacheKey(collection, name)); ok {
+		return r, nil
+	}
+	return d.fetchRecord(collection, name)
+}
+
+// fetchRecord reads a record from disk and puts it in the read cache
+func (d *Driver) fetchRecord(collection, name string) (*record, error) {
+	if d.cache == nil {
+		return d.readRecordFile(collection, name)
+	}
+
+	key := cacheKey(collection, name)
+	gen := d.cache.generation(key)
+	r, err := d.readRecordFile(collection, name)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.add(key, r, gen)
+	return r, nil
+}
+
+// readRecordFile always goes to the disk
+func (d *Driver) readRecordFile(collection, name string) (*record, error) {
+	var buf bytes.Buffer
+	if err := d.readRecordInto(&buf, collection, name); err != nil {
+		return nil, err
+	}
+	return &record{name: name, raw: buf.Bytes()}, nil
+}
+
+// finish applies the query options to the matched records and returns them as strings
+func (d *Driver) finish(collection string, records []*record, q *query) ([]string, error) {
+	out := make([]string, 0, len(records))
+	err := d.emit(collection, records, q, func(b []byte) {
+		out = append(out, string(b))
+	})
+	return out, err
+}
+
+// finishRaw is finish for callers that want the bytes. They're copied, since the
+// records may sit in pooled buffers.
+func (d *Driver) finishRaw(collection string, records []*record, q *query) ([]json.RawMessage, error) {
+	out := make([]json.RawMessage, 0, len(records))
+	err := d.emit(collection, records, q, func(b []byte) {
+		out = append(out, append(json.RawMessage(nil), b...))
+	})
+	return out, err
+}
+
+// emit sorts, limits and projects records and hands each result to fn in order
+func (d *Driver) emit(collection string, records []*record, q *query, fn func(b []byte)) error {
+	records, err := d.arrange(collection, records, q)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		raw, err := d.redact(collection, r.raw, q)
+		if err != nil {
+			return err
+		}
+		if len(q.fields) == 0 {
+			fn(raw)
+			continue
+		}
+		b, err := project(raw, q.fields)
+		if err != nil {
+			return fmt.Errorf("unable to select fields of record %v: %v", r.name, err)
+		}
+		fn(b)
+	}
+	return nil
+}
+
+// arrange sorts records and applies Offset and Limit as the query asks
+func (d *Driver) arrange(collection string, records []*record, q *query) ([]*record, error) {
+	// a single ordering on an indexed field can be sorted from the index alone
+	sorted := len(q.orderBy) == 1 && q.orderBy[0].by == byField && d.indexedSort(collection, records, q.orderBy[0])
+	switch {
+	case len(q.orderBy) == 0:
+		// listings come in whatever order the filesystem or engine has
+		sort.Slice(records, func(i, j int) bool { return records[i].name < records[j].name })
+	case !sorted:
+		var mtimes map[string]int64
+		if q.ordersBy(byModTime) {
+			var err error
+			if mtimes, err = d.modTimes(collection, records); err != nil {
+				return nil, err
+			}
+		}
+		if err := sortRecords(records, q.orderBy, mtimes); err != nil {
+			return nil, err
+		}
+	}
+
+	from, to := q.window(len(records))
+	return records[from:to], nil
+}
+
+func (q *query) ordersBy(by orderKind) bool {
+	for _, o := range q.orderBy {
+		if o.by == by {
+			return true
+		}
+	}
+	return false
+}
+
+// modTimes looks up when records were last written, for OrderByModTime
+func (d *Driver) modTimes(collection string, records []*record) (map[string]int64, error) {
+	mtimes := make(map[string]int64, len(records))
+	for _, r := range records {
+		c, err := d.partitionFor(collection, r.name)
+		if err != nil {
+			return nil, err
+		}
+		if d.isDirty(c, r.name) {
+			mtimes[r.name] = math.MaxInt64
+			continue
+		}
+		fi, err := d.statRecord(c, r.name)
+		if os.IsNotExist(err) {
+			continue // deleted since it was read
+		}
+		if err != nil {
+			return nil, err
+		}
+		mtimes[r.name] = fi.ModTime().UnixNano()
+	}
+	return mtimes, nil
+}
+
+// project keeps only the requested fields of a raw record. Only the objects on the
+// way to a selected field get decoded, everything else stays as raw bytes.
+func project(raw []byte, fields []string) ([]byte, error) {
+	picked, err := pick(raw, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.MarshalIndent(picked, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, byte('\n')), nil
+}
+
+func pick(raw []byte, fields []string) (map[string]interface{}, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	// group the nested fields by their top level key, "Address.City" -> Address: [City]
+	nested := map[string][]string{}
+	picked := map[string]interface{}{}
+	for _, field := range fields {
+		parts := strings.SplitN(field, ".", 2)
+		v, ok := doc[parts[0]]
+		if !ok {
+			continue
+		}
+		if len(parts) == 1 {
+			picked[parts[0]] = v
+			continue
+		}
+		nested[parts[0]] = append(nested[parts[0]], parts[1])
+	}
+
+	for key, sub := range nested {
+		if _, whole := picked[key]; whole {
+			continue
+		}
+		// not an object, so there is nothing to pick from
+		if v := bytes.TrimSpace(doc[key]); len(v) == 0 || v[0] != '{' {
+			continue
+		}
+		p, err := pick(doc[key], sub)
+		if err != nil {
+			return nil, err
+		}
+		if len(p) > 0 {
+			picked[key] = p
+		}
+	}
+	return picked, nil
+}
+
+func sortRecords(records []*record, orderBy []ordering, mtimes map[string]int64) error {
+	for _, o := range orderBy {
+		if o.by != byField {
+			continue
+		}
+		for _, r := range records {
+			if _, err := r.decode(); err != nil {
+				return err
+			}
+		}
+		break
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		for _, o := range orderBy {
+			c := 0
+			switch o.by {
+			case byKey:
+				c = strings.Compare(records[i].name, records[j].name)
+			case byModTime:
+				a, b := mtimes[records[i].name], mtimes[records[j].name]
+				if a != b {
+					c = -1
+					if a > b {
+						c = 1
+					}
+				}
+			default:
+				a, aok := lookup(records[i].doc, o.field)
+				b, bok := lookup(records[j].doc, o.field)
+
+				switch {
+				case !aok && !bok:
+				case !aok: // records missing the field go first
+					c = -1
+				case !bok:
+					c = 1
+				default:
+					c, _ = compareValues(a, b)
+				}
+			}
+
+			if c == 0 {
+				continue
+			}
+			if o.dir == Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return records[i].name < records[j].name
+	})
+	return nil
+}
+
+// lookup walks a dotted path like "Address.State" through a decoded record
+func lookup(record map[string]interface{}, field string) (interface{}, bool) {
+	var cur interface{} = record
+	for _, part := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// compareValues orders two values the way a user would expect: numbers numerically
+// (json.Number "23" equals the int 23), strings lexically, false before true.
+// ok is false when the values are not comparable.
+func compareValues(a, b interface{}) (c int, ok bool) {
+	if x, xok := toFloat(a); xok {
+		y, yok := toFloat(b)
+		if !yok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch x := a.(type) {
+	case string:
+		y, yok := b.(string)
+		if !yok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case bool:
+		y, yok := b.(bool)
+		if !yok {
+			return 0, false
+		}
+		switch {
+		case x == y:
+			return 0, true
+		case !x:
+			return -1, true
+		}
+		return 1, true
+	case nil:
+		if b == nil {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// FindOne decodes the first record matching filter into v, or returns ErrNotFound.
+// Without OrderBy and Offset, and outside partitioned collections, it stops reading at
+// the first match instead of loading the whole collection; After and KeyMatchesRegex
+// skip names without reading their records.
+func (d *Driver) FindOne(collection string, filter Filter, v interface{}, opts ...QueryOption) error {
+	_, err := d.timedDecode("find_one", collection, "", v, func(v interface{}) (interface{}, error) {
+		return nil, d.findOne(collection, filter, v, opts...)
+	})
+	return err
+}
+
+func (d *Driver) findOne(collection string, filter Filter, v interface{}, opts ...QueryOption) error {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return err
+	}
+	if collection == "" {
+		return fmt.Errorf("%w - unable to find", ErrEmptyCollection)
+	}
+
+	q := newQuery(opts)
+	// skipping matches needs them all in their order, as Find has them
+	if _, partitioned := d.partitions[collection]; len(q.orderBy) > 0 || q.offset > 0 || partitioned {
+		var found []string
+		err := d.find(context.Background(), collection, filter, append(opts, Limit(1)), func(records []*record, q *query) (err error) {
+			found, err = d.finish(collection, records, q)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			return ErrNotFound
+		}
+		return json.Unmarshal([]byte(found[0]), v)
+	}
+
+	// with an index (a unique one especially) there are only a few candidates to open
+	names, _, ok := d.indexCandidates(collection, filter)
+	if !ok {
+		var err error
+		if names, err = d.listRecords(collection); err != nil {
+			return err
+		}
+		sort.Strings(names) // the first in key order, as Find would return it
+	}
+	// the After cursor, KeyMatchesRegex and Range apply before any record is read,
+	// page sorts the names after a cursor
+	names = q.page(names, false)
+
+	for _, name := range names {
+		r, err := d.loadRecord(collection, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if filter != nil {
+			doc, err := r.decode()
+			if err != nil {
+				return err
+			}
+			if !filter.Match(doc) {
+				continue
+			}
+		}
+
+		out, err := d.finish(collection, []*record{r}, q)
+		if err != nil {
+			return err
+		}
+		if len(out) == 0 {
+			return ErrNotFound
+		}
+		return json.Unmarshal([]byte(out[0]), v)
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// writeNames writes a record named after each name, with the name as its Name
+func writeNames(t *testing.T, d *Driver, collection string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := d.Write(collection, name, User{Name: name}); err != nil {
+			t.Fatalf("writing %v/%v: %v", collection, name, err)
+		}
+	}
+}
+
+func requireFindOne(t *testing.T, d *Driver, want string, opts ...QueryOption) {
+	t.Helper()
+	var u User
+	err := d.FindOne("users", nil, &u, opts...)
+	if want == "" {
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("FindOne found %q (%v), want %v", u.Name, err, ErrNotFound)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("FindOne: %v", err)
+	}
+	if u.Name != want {
+		t.Fatalf("FindOne found %q, want %q", u.Name, want)
+	}
+}
+
+func TestFindOneOffset(t *testing.T) {
+	d := NewTestDriver(t, nil)
+	writeNames(t, d, "users", "a", "b", "c")
+
+	requireFindOne(t, d, "a", Offset(0))
+	requireFindOne(t, d, "b", Offset(1))
+	requireFindOne(t, d, "c", Offset(2))
+	requireFindOne(t, d, "", Offset(3))
+}
+
+func TestFindOneKeyMatchesRegex(t *testing.T) {
+	d := NewTestDriver(t, nil)
+	writeNames(t, d, "users", "a", "b", "bb")
+
+	b, err := KeyMatchesRegex("^b$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireFindOne(t, d, "b", b)
+	none, err := KeyMatchesRegex("^c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireFindOne(t, d, "", none)
+}
+
+func TestFindOneAfter(t *testing.T) {
+	d := NewTestDriver(t, nil)
+	writeNames(t, d, "users", "a", "b", "c")
+
+	requireFindOne(t, d, "a", After(""))
+	requireFindOne(t, d, "b", After("a"))
+	requireFindOne(t, d, "c", After("bb"))
+	requireFindOne(t, d, "", After("c"))
+}
+
+func TestIndexOrderKeepsTies(t *testing.T) {
+	d := NewTestDriver(t, nil)
+	if err := d.EnsureIndex("users", "Age"); err != nil {
+		t.Fatal(err)
+	}
+	for name, age := range map[string]string{"a": "1", "b": "2", "c": "2", "d": "3"} {
+		if err := d.Write("users", name, User{Name: name, Age: json.Number(age)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		dir  Direction
+		n    int
+		want string
+	}{{Asc, 1, "a"}, {Asc, 2, "abc"}, {Asc, 3, "abc"}, {Desc, 2, "dbc"}, {Asc, 9, "abcd"}} {
+		names, ok, err := d.indexOrder("users", ordering{field: "Age", dir: tc.dir}, tc.n)
+		if err != nil || !ok {
+			t.Fatalf("indexOrder: %v, from an index %v", err, ok)
+		}
+		if got := strings.Join(names, ""); got != tc.want {
+			t.Fatalf("the first %d by Age %v are %q, want %q", tc.n, tc.dir, got, tc.want)
+		}
+	}
+}
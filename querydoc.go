@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseFilter turns a MongoDB style query document into a Filter, e.g.
+//
+//	{"Address.State": "New York", "Age": {"$gte": 30}}
+//
+// Supported operators are $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists,
+// $regex (see MatchesRegex), $not and the top level $and, $or and $nor.
+func ParseFilter(doc []byte) (Filter, error) {
+	var m map[string]interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber() // so numbers compare the same way they do against records
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid query document: %v", err)
+	}
+	return DocumentFilter(m)
+}
+
+// DocumentFilter is ParseFilter for a query document that is already decoded
+func DocumentFilter(doc map[string]interface{}) (Filter, error) {
+	// sorted so the filters are built (and errors reported) in a stable order
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var filters []Filter
+	for _, key := range keys {
+		f, err := docClause(key, doc[key])
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return And(filters...), nil
+}
+
+func docClause(key string, value interface{}) (Filter, error) {
+	switch key {
+	case "$and", "$or", "$nor":
+		list, ok := value.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("%v needs a non empty array of query documents", key)
+		}
+
+		var filters []Filter
+		for _, item := range list {
+			sub, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%v needs a non empty array of query documents", key)
+			}
+			f, err := DocumentFilter(sub)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, f)
+		}
+
+		switch key {
+		case "$and":
+			return And(filters...), nil
+		case "$or":
+			return Or(filters...), nil
+		}
+		return Not(Or(filters...)), nil
+	}
+
+	if strings.HasPrefix(key, "$") {
+		return nil, fmt.Errorf("unknown top level operator %v", key)
+	}
+
+	if ops, ok := value.(map[string]interface{}); ok && isOperatorDoc(ops) {
+		return fieldOperators(key, ops)
+	}
+	return Eq(key, value), nil
+}
+
+// isOperatorDoc tells {"$gte": 30} apart from a plain object compared by value
+func isOperatorDoc(m map[string]interface{}) bool {
+	if len(m) == 0 {
+		return false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func fieldOperators(field string, ops map[string]interface{}) (Filter, error) {
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+
+	var filters []Filter
+	for _, op := range names {
+		arg := ops[op]
+
+		var f Filter
+		switch op {
+		case "$eq":
+			f = Eq(field, arg)
+		case "$ne":
+			f = Ne(field, arg)
+		case "$gt":
+			f = Gt(field, arg)
+		case "$gte":
+			f = Gte(field, arg)
+		case "$lt":
+			f = Lt(field, arg)
+		case "$lte":
+			f = Lte(field, arg)
+		case "$in", "$nin":
+			list, ok := arg.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%v on %v needs an array", op, field)
+			}
+			f = In(field, list...)
+			if op == "$nin" {
+				f = Not(f)
+			}
+		case "$exists":
+			exists, ok := arg.(bool)
+			if !ok {
+				return nil, fmt.Errorf("$exists on %v needs true or false", field)
+			}
+			f = Exists(field, exists)
+		case "$regex":
+			pattern, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("$regex on %v needs a string", field)
+			}
+			var err error
+			if f, err = MatchesRegex(field, pattern); err != nil {
+				return nil, err
+			}
+		case "$not":
+			sub, ok := arg.(map[string]interface{})
+			if !ok || !isOperatorDoc(sub) {
+				return nil, fmt.Errorf("$not on %v needs an operator document", field)
+			}
+			inner, err := fieldOperators(field, sub)
+			if err != nil {
+				return nil, err
+			}
+			f = Not(inner)
+		default:
+			return nil, fmt.Errorf("unknown operator %v on %v", op, field)
+		}
+		filters = append(filters, f)
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return And(filters...), nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// how long a dequeued message stays hidden from other consumers when Dequeue isn't
+// given a visibility timeout
+const defaultVisibility = 30 * time.Second
+
+// QueueOptions are the settings of a queue, see Options.Queues
+type QueueOptions struct {
+	// deliveries of a message before it's dead-lettered, unlimited if 0
+	MaxAttempts int
+
+	// where dead-lettered messages are moved to, as records named by their ID. They
+	// are dropped if empty.
+	DeadLetter string
+}
+
+// Message is a message of a queue as Dequeue hands it out
+type Message struct {
+	ID       string
+	Body     json.RawMessage
+	Attempts int // deliveries so far, this one included
+	Enqueued time.Time
+}
+
+// Decode unmarshals the body of a message into v
+func (m *Message) Decode(v interface{}) error {
+	return json.Unmarshal(m.Body, v)
+}
+
+// queueEntry is how a message is stored, a record of the queue's collection
+type queueEntry struct {
+	Body      json.RawMessage `json:"body"`
+	Enqueued  time.Time       `json:"enqueued"`
+	Attempts  int             `json:"attempts"`
+	VisibleAt time.Time       `json:"visible_at"`
+}
+
+// Enqueue adds a message to the back of a queue, which is a collection of its own,
+// and returns its ID. Messages survive restarts like any record:
+//
+//	db.Enqueue("emails", email)
+//
+//	m, err := db.Dequeue("emails", time.Minute)
+//	if err == nil {
+//		if send(m) == nil {
+//			db.Ack("emails", m)
+//		} else {
+//			db.Nack("emails", m, 10*time.Second)
+//		}
+//	}
+func (d *Driver) Enqueue(queue string, v interface{}) (string, error) {
+	return d.EnqueueAt(queue, v, time.Now())
+}
+
+// EnqueueAt is Enqueue for a message Dequeue doesn't hand out before deliverAt, its
+// place in the queue is still by when it was enqueued
+func (d *Driver) EnqueueAt(queue string, v interface{}, deliverAt time.Time) (string, error) {
+	queue = d.foldCollection(queue)
+	if err := d.checkNames(queue, ""); err != nil {
+		return "", err
+	}
+	if queue == "" {
+		return "", fmt.Errorf("%w - no queue to enqueue to", ErrEmptyCollection)
+	}
+	if err := d.writable(); err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	mutex := d.lockFor(queue)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	id := d.nextMessageID()
+	return id, d.storeEntry(queue, id, &queueEntry{Body: body, Enqueued: time.Now(), VisibleAt: deliverAt})
+}
+
+// nextMessageID makes IDs that sort in the order the messages were enqueued
+func (d *Driver) nextMessageID() string {
+	d.queueMu.Lock()
+	defer d.queueMu.Unlock()
+	n := time.Now().UnixNano()
+	if n <= d.lastQueued {
+		n = d.lastQueued + 1
+	}
+	d.lastQueued = n
+	return fmt.Sprintf("%019d", n)
+}
+
+// Dequeue hands out the oldest message of a queue that's ready, or ErrQueueEmpty. The
+// message is hidden from other consumers for the visibility timeout (30 seconds if
+// 0), then delivered again unless it was acknowledged with Ack by then.
+func (d *Driver) Dequeue(queue string, visibility time.Duration) (*Message, error) {
+	queue = d.foldCollection(queue)
+	if err := d.checkNames(queue, ""); err != nil {
+		return nil, err
+	}
+	if queue == "" {
+		return nil, fmt.Errorf("%w - no queue to dequeue from", ErrEmptyCollection)
+	}
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	if visibility <= 0 {
+		visibility = defaultVisibility
+	}
+
+	mutex := d.lockFor(queue)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	names, err := d.listRecords(queue)
+	if os.IsNotExist(err) {
+		return nil, ErrQueueEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	opts := d.queues[queue]
+	for _, name := range names {
+		e, err := d.loadEntry(queue, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.VisibleAt.After(now) {
+			continue
+		}
+		// its last delivery timed out
+		if opts.MaxAttempts > 0 && e.Attempts >= opts.MaxAttempts {
+			if err := d.deadLetter(queue, name, e); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		e.Attempts++
+		e.VisibleAt = now.Add(visibility)
+		if err := d.storeEntry(queue, name, e); err != nil {
+			return nil, err
+		}
+		return &Message{ID: name, Body: e.Body, Attempts: e.Attempts, Enqueued: e.Enqueued}, nil
+	}
+	return nil, ErrQueueEmpty
+}
+
+// Ack removes a message that was dealt with from its queue. It fails with
+// ErrStaleMessage if the message's visibility timeout ran out and it went to another
+// consumer meanwhile.
+func (d *Driver) Ack(queue string, m *Message) error {
+	return d.settleMessage(queue, m, func(queue string, e *queueEntry) error {
+		_, err := d.removeRecord(queue, m.ID)
+		return err
+	})
+}
+
+// Nack hands a message back to its queue to be delivered again after delay, or
+// dead-letters it if it's out of attempts
+func (d *Driver) Nack(queue string, m *Message, delay time.Duration) error {
+	return d.settleMessage(queue, m, func(queue string, e *queueEntry) error {
+		if opts := d.queues[queue]; opts.MaxAttempts > 0 && e.Attempts >= opts.MaxAttempts {
+			return d.deadLetter(queue, m.ID, e)
+		}
+		e.VisibleAt = time.Now().Add(delay)
+		return d.storeEntry(queue, m.ID, e)
+	})
+}
+
+// settleMessage runs what Ack or Nack do to a message with the queue locked, if the
+// message is still the delivery m was
+func (d *Driver) settleMessage(queue string, m *Message, fn func(queue string, e *queueEntry) error) error {
+	queue = d.foldCollection(queue)
+	if err := d.checkNames(queue, m.ID); err != nil {
+		return err
+	}
+	if queue == "" || m.ID == "" {
+		return missingName(queue, "unable to settle message")
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	mutex := d.lockFor(queue)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	e, err := d.loadEntry(queue, m.ID)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %v/%v is gone", ErrStaleMessage, queue, m.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if e.Attempts != m.Attempts {
+		return fmt.Errorf("%w: %v/%v was delivered again", ErrStaleMessage, queue, m.ID)
+	}
+	return fn(queue, e)
+}
+
+// deadLetter moves a message out of its queue, to the dead-letter collection if it has
+// one. The queue has to be locked.
+func (d *Driver) deadLetter(queue, id string, e *queueEntry) error {
+	if dl := d.queues[queue].DeadLetter; dl != "" {
+		if err := d.Write(dl, id, e); err != nil {
+			return err
+		}
+	}
+	d.logf(LevelWarning, "Dead-lettered message", "operation", "dequeue", "collection", queue,
+		"resource", id, "attempts", e.Attempts)
+	_, err := d.removeRecord(queue, id)
+	return err
+}
+
+func (d *Driver) loadEntry(queue, id string) (*queueEntry, error) {
+	r, err := d.loadRecord(queue, id)
+	if err != nil {
+		return nil, err
+	}
+	var e queueEntry
+	if err := json.Unmarshal(r.raw, &e); err != nil {
+		return nil, fmt.Errorf("invalid message %v/%v: %v", queue, id, err)
+	}
+	return &e, nil
+}
+
+// storeEntry writes a message the way Write would. The queue has to be locked.
+func (d *Driver) storeEntry(queue, id string, e *queueEntry) error {
+	if err := os.MkdirAll(d.recordDir(queue, id), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(e, "", "\t")
+	if err != nil {
+		return err
+	}
+	return d.storeRecord(queue, id, append(b, '\n'))
+}
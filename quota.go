@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// quotas keeps count of how many bytes the records of each collection take, loaded
+// the first time a collection is written to. Without quotas nothing is counted.
+type quotas struct {
+	database    int64
+	collections map[string]int64
+
+	mu        sync.Mutex
+	usage     map[string]int64 // collection -> bytes, known collections only
+	allLoaded bool             // usage has every collection, for the database quota
+}
+
+func newQuotas(database int64, collections map[string]int64) *quotas {
+	q := &quotas{database: database, collections: map[string]int64{}, usage: map[string]int64{}}
+	for collection, max := range collections {
+		if max > 0 {
+			q.collections[collection] = max
+		}
+	}
+	return q
+}
+
+func (q *quotas) enabled() bool {
+	return q.database > 0 || len(q.collections) > 0
+}
+
+// checkQuota fails if a record of size bytes can't be written as resource. It
+// returns how much the usage of the collection grows with it, for addUsage once the
+// write went through. The collection has to be locked.
+func (d *Driver) checkQuota(collection, resource string, size int64) (int64, error) {
+	if d.maxRecordSize > 0 && size > d.maxRecordSize {
+		return 0, fmt.Errorf("%w: %v in %v has %d bytes, at most %d are allowed", ErrRecordTooLarge, resource, collection, size, d.maxRecordSize)
+	}
+	if !d.quotas.enabled() {
+		return 0, nil
+	}
+
+	old, err := d.usageOf(collection, resource)
+	if err != nil {
+		return 0, err
+	}
+	delta := size - old
+	if delta <= 0 {
+		return delta, nil // shrinking a record is always fine
+	}
+
+	if max, ok := d.quotas.collections[collection]; ok {
+		used, err := d.collectionUsage(collection)
+		if err != nil {
+			return 0, err
+		}
+		if used+delta > max {
+			return 0, fmt.Errorf("%w: %v would take %d bytes, the quota is %d", ErrQuotaExceeded, collection, used+delta, max)
+		}
+	}
+
+	if d.quotas.database > 0 {
+		used, err := d.databaseUsage()
+		if err != nil {
+			return 0, err
+		}
+		if used+delta > d.quotas.database {
+			return 0, fmt.Errorf("%w: the database would take %d bytes, the quota is %d", ErrQuotaExceeded, used+delta, d.quotas.database)
+		}
+	}
+	return delta, nil
+}
+
+// sizeLimit is the most bytes a record may have, and the error for one over it
+type sizeLimit struct {
+	max int64
+	err error // nil for no limit
+}
+
+func (l *sizeLimit) lower(max int64, err error) {
+	if l.err == nil || max < l.max {
+		l.max, l.err = max, err
+	}
+}
+
+// recordSizeLimit is the limit of Options.MaxRecordSize alone
+func (d *Driver) recordSizeLimit(collection, resource string) sizeLimit {
+	if d.maxRecordSize <= 0 {
+		return sizeLimit{}
+	}
+	return sizeLimit{d.maxRecordSize, fmt.Errorf("%w: %v in %v has more than the %d bytes allowed", ErrRecordTooLarge, resource, collection, d.maxRecordSize)}
+}
+
+// sizeLimit is the limit Options.MaxRecordSize and the quotas put on a record written
+// as resource, for streamed writes to stop reading once over it; checkQuota still has
+// the last word. The collection has to be locked.
+func (d *Driver) sizeLimit(collection, resource string) (sizeLimit, error) {
+	limit := d.recordSizeLimit(collection, resource)
+	if !d.quotas.enabled() {
+		return limit, nil
+	}
+
+	old, err := d.usageOf(collection, resource)
+	if err != nil {
+		return limit, err
+	}
+	if max, ok := d.quotas.collections[collection]; ok {
+		used, err := d.collectionUsage(collection)
+		if err != nil {
+			return limit, err
+		}
+		limit.lower(max-used+old, fmt.Errorf("%w: %v would take more than its quota of %d bytes", ErrQuotaExceeded, collection, max))
+	}
+	if d.quotas.database > 0 {
+		used, err := d.databaseUsage()
+		if err != nil {
+			return limit, err
+		}
+		limit.lower(d.quotas.database-used+old, fmt.Errorf("%w: the database would take more than its quota of %d bytes", ErrQuotaExceeded, d.quotas.database))
+	}
+	return limit, nil
+}
+
+// addUsage counts a write or delete of delta bytes in collection
+func (d *Driver) addUsage(collection string, delta int64) {
+	if delta == 0 || !d.quotas.enabled() {
+		return
+	}
+
+	d.quotas.mu.Lock()
+	defer d.quotas.mu.Unlock()
+	if used, ok := d.quotas.usage[collection]; ok {
+		d.quotas.usage[collection] = used + delta
+	} else if d.quotas.allLoaded {
+		d.quotas.usage[collection] = delta // a new collection
+	}
+}
+
+// forgetUsage is addUsage for a collection that was deleted
+func (d *Driver) forgetUsage(collection string) {
+	d.quotas.mu.Lock()
+	defer d.quotas.mu.Unlock()
+	delete(d.quotas.usage, collection)
+}
+
+// usageOf returns the size of a record as it counts against the quotas, or 0 if
+// it doesn't exist or there are no quotas
+func (d *Driver) usageOf(collection, resource string) (int64, error) {
+	if !d.quotas.enabled() {
+		return 0, nil
+	}
+
+	if d.cache != nil {
+		if r, ok := d.cache.peekDirty(cacheKey(collection, resource)); ok {
+			return int64(len(r.raw)), nil
+		}
+	}
+
+	path := d.recordPath(collection, resource)
+	fi, err := d.statRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d.lsm != nil {
+		return fi.Size(), nil
+	}
+
+	// chunked records leave only a small manifest in the record file
+	if fi.Size() < 256 {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		if isChunked(b) {
+			m, err := parseManifest(b)
+			return m.Size, err
+		}
+	}
+	return fi.Size(), nil
+}
+
+func (d *Driver) collectionUsage(collection string) (int64, error) {
+	d.quotas.mu.Lock()
+	used, ok := d.quotas.usage[collection]
+	d.quotas.mu.Unlock()
+	if ok {
+		return used, nil
+	}
+
+	names, err := d.listRecords(collection)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	for _, name := range names {
+		size, err := d.usageOf(collection, name)
+		if err != nil {
+			return 0, err
+		}
+		used += size
+	}
+
+	d.quotas.mu.Lock()
+	defer d.quotas.mu.Unlock()
+	if known, ok := d.quotas.usage[collection]; ok {
+		return known, nil // another write got there first
+	}
+	d.quotas.usage[collection] = used
+	return used, nil
+}
+
+// databaseUsage adds up the usage of every collection. Writes to other collections
+// go on meanwhile, so with several of them writing at once the database quota can be
+// overshot by a record or so.
+func (d *Driver) databaseUsage() (int64, error) {
+	d.quotas.mu.Lock()
+	allLoaded := d.quotas.allLoaded
+	d.quotas.mu.Unlock()
+
+	if !allLoaded {
+		collections, err := d.Collections()
+		if err != nil {
+			return 0, err
+		}
+		for _, collection := range collections {
+			if _, err := d.collectionUsage(collection); err != nil {
+				return 0, err
+			}
+		}
+
+		d.quotas.mu.Lock()
+		d.quotas.allLoaded = true
+		d.quotas.mu.Unlock()
+	}
+
+	d.quotas.mu.Lock()
+	defer d.quotas.mu.Unlock()
+	var used int64
+	for _, n := range d.quotas.usage {
+		used += n
+	}
+	return used, nil
+}
@@ -0,0 +1,852 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the Raft state of a clustered node: its term, vote and log
+const raftDir = "_raft"
+
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+var raftRoles = [...]string{"follower", "candidate", "leader"}
+
+// the most entries an AppendEntries request carries
+const raftMaxBatch = 256
+
+// how long Write and Delete wait for their change to be committed
+const raftProposeTimeout = 10 * time.Second
+
+// a no-op the leader appends when elected, committing it commits the entries of
+// earlier terms
+const raftNoop = "noop"
+
+type ClusterOptions struct {
+	// the ID of this node, a key of Peers
+	ID string
+	// the base URL each node serves RaftHandler at, by node ID, this node included.
+	// Three or five nodes tolerate one or two failures.
+	Peers map[string]string
+
+	// the secret the nodes share, sent as a bearer token with every request they
+	// make of each other. RaftHandler turns down requests without it, since the log
+	// entries a leader sends are applied as writes. Required.
+	Secret string
+
+	// how long a follower waits to hear from the leader before standing for
+	// election, randomised up to twice that. A second if zero.
+	ElectionTimeout time.Duration
+	// how often the leader sends heartbeats, a tenth of ElectionTimeout if zero
+	HeartbeatInterval time.Duration
+
+	// http.DefaultClient if nil
+	Client *http.Client
+}
+
+// ClusterStatus tells what a node knows about its cluster, see Driver.ClusterStatus
+type ClusterStatus struct {
+	ID      string
+	Role    string // follower, candidate or leader
+	Leader  string // ID of the leader, empty during elections
+	Term    uint64
+	Commit  uint64 // index of the last committed log entry
+	Applied uint64 // index of the last log entry applied to the database
+}
+
+type raftEntry struct {
+	Term   uint64 `json:"term"`
+	Index  uint64 `json:"index"`
+	Change Change `json:"change"`
+}
+
+type raftState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+	Applied  uint64 `json:"applied"`
+}
+
+type raftWaiter struct {
+	term uint64
+	ch   chan error
+}
+
+type raftNode struct {
+	d      *Driver
+	opts   ClusterOptions
+	dir    string
+	client *http.Client
+
+	mu       sync.Mutex // guards everything below
+	term     uint64
+	votedFor string
+	log      []raftEntry // log[0] is a sentinel at index 0
+	logFile  *os.File
+	commit   uint64
+	applied  uint64
+	role     int
+	leader   string
+	deadline time.Time // of the election timeout
+	next     map[string]uint64
+	match    map[string]uint64
+	sending  map[string]bool // peers with an AppendEntries in flight
+	waiters  map[uint64]raftWaiter
+
+	applyCh chan struct{} // wakes the apply loop
+}
+
+// JoinCluster makes the Driver a node of a Raft cluster: Write and Delete go to
+// the leader, which commits them once most nodes have them in their log, and every
+// node applies them in the same order. Write and Delete on other nodes fail with
+// ErrNotLeader, which names the leader; the other ways of writing fail with
+// ErrReadOnly since they aren't replicated. Reads are served by every node from
+// what it has applied, so followers may trail the leader a little.
+//
+// The nodes reach each other through RaftHandler, which has to be mounted at the
+// URLs in opts.Peers. Membership is fixed, and the log isn't compacted.
+func (d *Driver) JoinCluster(opts ClusterOptions) error {
+	if _, ok := opts.Peers[opts.ID]; !ok {
+		return fmt.Errorf("node %q isn't one of the peers", opts.ID)
+	}
+	if opts.Secret == "" {
+		return fmt.Errorf("no secret for the nodes of the cluster to authenticate with")
+	}
+	if opts.ElectionTimeout <= 0 {
+		opts.ElectionTimeout = time.Second
+	}
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = opts.ElectionTimeout / 10
+	}
+	r := &raftNode{
+		d:       d,
+		opts:    opts,
+		dir:     filepath.Join(d.dir, raftDir),
+		client:  opts.Client,
+		waiters: map[uint64]raftWaiter{},
+		applyCh: make(chan struct{}, 1),
+	}
+	if r.client == nil {
+		r.client = http.DefaultClient
+	}
+	if err := r.load(); err != nil {
+		return err
+	}
+	r.resetDeadline()
+
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+	if d.follower != nil {
+		r.logFile.Close()
+		return fmt.Errorf("already following %v", d.follower.leader)
+	}
+	if d.raft != nil {
+		r.logFile.Close()
+		return fmt.Errorf("already in a cluster")
+	}
+	d.raft = r
+
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		r.run()
+	}()
+	go func() {
+		defer d.wg.Done()
+		r.applyLoop()
+	}()
+	return nil
+}
+
+// ClusterStatus reports the node's view of the cluster and false if the Driver
+// isn't in one
+func (d *Driver) ClusterStatus() (ClusterStatus, bool) {
+	r := d.cluster()
+	if r == nil {
+		return ClusterStatus{}, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return ClusterStatus{
+		ID:      r.opts.ID,
+		Role:    raftRoles[r.role],
+		Leader:  r.leader,
+		Term:    r.term,
+		Commit:  r.commit,
+		Applied: r.applied,
+	}, true
+}
+
+func (d *Driver) cluster() *raftNode {
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+	return d.raft
+}
+
+// load reads the term, vote and log a node had before a restart
+func (r *raftNode) load() error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(r.dir, "state.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var st raftState
+		if err := json.Unmarshal(b, &st); err != nil {
+			return fmt.Errorf("invalid Raft state: %v", err)
+		}
+		r.term, r.votedFor, r.applied = st.Term, st.VotedFor, st.Applied
+	}
+
+	r.log = []raftEntry{{}}
+	path := filepath.Join(r.dir, "log")
+	if f, err := os.Open(path); err == nil {
+		br := bufio.NewReader(f)
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(line) > 0 && line[len(line)-1] == '\n' {
+				var e raftEntry
+				if err := json.Unmarshal(line, &e); err != nil {
+					f.Close()
+					return fmt.Errorf("invalid Raft log entry: %v", err)
+				}
+				r.log = append(r.log, e)
+			}
+			if err != nil {
+				break // a torn last line was never acknowledged, it goes
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if r.applied > r.lastIndex() {
+		r.applied = r.lastIndex()
+	}
+	// applied entries are committed, and applying them again does no harm
+	r.commit = r.applied
+
+	return r.rewriteLog()
+}
+
+func (r *raftNode) lastIndex() uint64 {
+	return r.log[len(r.log)-1].Index
+}
+
+func (r *raftNode) lastTerm() uint64 {
+	return r.log[len(r.log)-1].Term
+}
+
+// saveState writes term, vote and applied index, with r.mu held
+func (r *raftNode) saveState() error {
+	b, err := json.Marshal(raftState{Term: r.term, VotedFor: r.votedFor, Applied: r.applied})
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(r.dir, "state.json"), b)
+}
+
+// appendLog adds entries to the log and syncs them to disk, with r.mu held
+func (r *raftNode) appendLog(entries []raftEntry) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if _, err := r.logFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := r.logFile.Sync(); err != nil {
+		return err
+	}
+	r.log = append(r.log, entries...)
+	return nil
+}
+
+// truncateLog drops the entries from index on, with r.mu held
+func (r *raftNode) truncateLog(index uint64) error {
+	r.log = r.log[:index]
+	return r.rewriteLog()
+}
+
+// rewriteLog writes the log file anew from r.log and reopens it for appending
+func (r *raftNode) rewriteLog() error {
+	if r.logFile != nil {
+		r.logFile.Close()
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range r.log[1:] {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(r.dir, "log")
+	if err := writeAtomic(path, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	r.logFile = f
+	return nil
+}
+
+func (r *raftNode) resetDeadline() {
+	timeout := r.opts.ElectionTimeout + time.Duration(rand.Int63n(int64(r.opts.ElectionTimeout)))
+	r.deadline = time.Now().Add(timeout)
+}
+
+// becomeFollower steps down to follower of term, with r.mu held
+func (r *raftNode) becomeFollower(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.leader = ""
+		if err := r.saveState(); err != nil {
+			r.d.logf(LevelError, "Saving Raft state failed", "operation", "raft", "error", err)
+		}
+	}
+	if r.role == raftLeader {
+		// whether they commit is up to the next leader now
+		for index, w := range r.waiters {
+			w.ch <- fmt.Errorf("%w: lost leadership before the change was committed, it may still be", ErrNotLeader)
+			delete(r.waiters, index)
+		}
+	}
+	r.role = raftFollower
+}
+
+func (r *raftNode) majority() int {
+	return len(r.opts.Peers)/2 + 1
+}
+
+// run holds elections and sends heartbeats until the Driver closes
+func (r *raftNode) run() {
+	ticker := time.NewTicker(r.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.d.done:
+			r.mu.Lock()
+			r.logFile.Close()
+			r.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		switch {
+		case r.role == raftLeader:
+			r.broadcast()
+		case time.Now().After(r.deadline):
+			r.startElection()
+		}
+		r.mu.Unlock()
+	}
+}
+
+type raftVoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type raftVoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// startElection stands for leader of the next term, with r.mu held
+func (r *raftNode) startElection() {
+	r.role = raftCandidate
+	r.term++
+	r.votedFor = r.opts.ID
+	r.leader = ""
+	r.resetDeadline()
+	if err := r.saveState(); err != nil {
+		r.d.logf(LevelError, "Saving Raft state failed", "operation", "raft", "error", err)
+		return
+	}
+	r.d.logf(LevelInfo, "Standing for Raft leader", "operation", "raft", "term", r.term)
+
+	term := r.term
+	req := raftVoteRequest{Term: term, Candidate: r.opts.ID, LastIndex: r.lastIndex(), LastTerm: r.lastTerm()}
+	votes := 1
+	if votes >= r.majority() {
+		r.becomeLeader()
+		return
+	}
+	for id, url := range r.opts.Peers {
+		if id == r.opts.ID {
+			continue
+		}
+		go func(url string) {
+			var resp raftVoteResponse
+			if err := r.call(url, "vote", req, &resp); err != nil {
+				return
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if resp.Term > r.term {
+				r.becomeFollower(resp.Term)
+				return
+			}
+			if r.role != raftCandidate || r.term != term || !resp.Granted {
+				return
+			}
+			if votes++; votes >= r.majority() {
+				r.becomeLeader()
+			}
+		}(url)
+	}
+}
+
+// becomeLeader takes over after winning an election, with r.mu held
+func (r *raftNode) becomeLeader() {
+	r.role = raftLeader
+	r.leader = r.opts.ID
+	r.next = map[string]uint64{}
+	r.match = map[string]uint64{}
+	r.sending = map[string]bool{}
+	for id := range r.opts.Peers {
+		r.next[id] = r.lastIndex() + 1
+	}
+	r.d.logf(LevelInfo, "Elected Raft leader", "operation", "raft", "term", r.term)
+
+	noop := raftEntry{Term: r.term, Index: r.lastIndex() + 1, Change: Change{Op: raftNoop}}
+	if err := r.appendLog([]raftEntry{noop}); err != nil {
+		r.d.logf(LevelError, "Appending to the Raft log failed", "operation", "raft", "error", err)
+	}
+	r.match[r.opts.ID] = r.lastIndex()
+	r.advanceCommit()
+	r.broadcast()
+}
+
+type raftAppendRequest struct {
+	Term      uint64      `json:"term"`
+	Leader    string      `json:"leader"`
+	PrevIndex uint64      `json:"prev_index"`
+	PrevTerm  uint64      `json:"prev_term"`
+	Entries   []raftEntry `json:"entries"`
+	Commit    uint64      `json:"commit"`
+}
+
+type raftAppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"` // of the follower's log, to skip back quickly
+}
+
+// broadcast sends the entries each follower is missing, or a heartbeat, with r.mu
+// held
+func (r *raftNode) broadcast() {
+	for id, url := range r.opts.Peers {
+		if id == r.opts.ID || r.sending[id] {
+			continue
+		}
+
+		next := r.next[id]
+		if next < 1 {
+			next = 1
+		}
+		prev := r.log[next-1]
+		end := r.lastIndex() + 1
+		if end-next > raftMaxBatch {
+			end = next + raftMaxBatch
+		}
+		req := raftAppendRequest{
+			Term:      r.term,
+			Leader:    r.opts.ID,
+			PrevIndex: prev.Index,
+			PrevTerm:  prev.Term,
+			Entries:   append([]raftEntry(nil), r.log[next:end]...),
+			Commit:    r.commit,
+		}
+
+		r.sending[id] = true
+		go func(id, url string) {
+			var resp raftAppendResponse
+			err := r.call(url, "append", req, &resp)
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.sending[id] = false
+			if err != nil {
+				return
+			}
+			if resp.Term > r.term {
+				r.becomeFollower(resp.Term)
+				return
+			}
+			if r.role != raftLeader || r.term != req.Term {
+				return
+			}
+			if resp.Success {
+				match := req.PrevIndex + uint64(len(req.Entries))
+				if match > r.match[id] {
+					r.match[id] = match
+				}
+				r.next[id] = match + 1
+				r.advanceCommit()
+				if r.next[id] <= r.lastIndex() {
+					r.broadcast() // more to send
+				}
+				return
+			}
+			// back up to where the logs may agree
+			next := req.PrevIndex
+			if resp.LastIndex+1 < next {
+				next = resp.LastIndex + 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			r.next[id] = next
+		}(id, url)
+	}
+}
+
+// advanceCommit commits what most nodes have in their logs, with r.mu held. Only
+// entries of the current term count, as in the Raft paper.
+func (r *raftNode) advanceCommit() {
+	for n := r.lastIndex(); n > r.commit; n-- {
+		if r.log[n].Term != r.term {
+			break
+		}
+		count := 0
+		for id := range r.opts.Peers {
+			if id == r.opts.ID || r.match[id] >= n {
+				count++
+			}
+		}
+		if count >= r.majority() {
+			r.commit = n
+			r.wakeApplier()
+			return
+		}
+	}
+}
+
+func (r *raftNode) wakeApplier() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// applyLoop applies committed entries to the database in log order
+func (r *raftNode) applyLoop() {
+	for {
+		select {
+		case <-r.d.done:
+			return
+		case <-r.applyCh:
+		}
+
+		for {
+			r.mu.Lock()
+			if r.applied >= r.commit {
+				if err := r.saveState(); err != nil {
+					r.d.logf(LevelError, "Saving Raft state failed", "operation", "raft", "error", err)
+				}
+				r.mu.Unlock()
+				break
+			}
+			e := r.log[r.applied+1]
+			r.mu.Unlock()
+
+			var err error
+			if e.Change.Op != raftNoop {
+				err = r.d.applyChange(&e.Change)
+				if err != nil {
+					r.d.logf(LevelError, "Applying a Raft log entry failed", "operation", "raft", "index", e.Index, "error", err)
+				}
+				r.d.background.set("Raft apply", err)
+			}
+
+			r.mu.Lock()
+			r.applied = e.Index
+			if w, ok := r.waiters[e.Index]; ok {
+				delete(r.waiters, e.Index)
+				if w.term != e.Term {
+					err = fmt.Errorf("%w: the change was replaced by a new leader", ErrNotLeader)
+				}
+				w.ch <- err
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// propose has the leader commit a change and waits until it's applied
+func (r *raftNode) propose(c Change) error {
+	r.mu.Lock()
+	if r.role != raftLeader {
+		leader := r.leader
+		r.mu.Unlock()
+		if leader == "" {
+			return fmt.Errorf("%w: no leader elected", ErrNotLeader)
+		}
+		return fmt.Errorf("%w: the leader is %v at %v", ErrNotLeader, leader, r.opts.Peers[leader])
+	}
+
+	e := raftEntry{Term: r.term, Index: r.lastIndex() + 1, Change: c}
+	if err := r.appendLog([]raftEntry{e}); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	ch := make(chan error, 1)
+	r.waiters[e.Index] = raftWaiter{term: e.Term, ch: ch}
+	r.match[r.opts.ID] = e.Index
+	r.advanceCommit()
+	r.broadcast()
+	r.mu.Unlock()
+
+	timer := time.NewTimer(raftProposeTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-ch:
+		return err
+	case <-timer.C:
+		r.mu.Lock()
+		delete(r.waiters, e.Index)
+		r.mu.Unlock()
+		return fmt.Errorf("change not committed within %v, it may still be", raftProposeTimeout)
+	case <-r.d.done:
+		return fmt.Errorf("database closed before the change was committed")
+	}
+}
+
+func (r *raftNode) isLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role == raftLeader
+}
+
+// write is Write on a clustered Driver
+func (r *raftNode) write(collection, resource string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// on the leader, so every member stores the same hashes
+	if b, err = r.d.hashRecord(b, r.d.hashPaths(collection, v)); err != nil {
+		return err
+	}
+	if err := r.d.checkSchema(collection, resource, b); err != nil {
+		return err
+	}
+	if err := r.d.checkUnique(collection, resource, b); err != nil {
+		return err
+	}
+	return r.propose(Change{Op: ChangeWrite, Collection: collection, Resource: resource, Record: b, Time: time.Now()})
+}
+
+// remove is Delete on a clustered Driver
+func (r *raftNode) remove(collection, resource string) error {
+	path := filepath.Join(collection, resource)
+	if resource == "" {
+		if _, err := stat(filepath.Join(r.d.dir, collection)); err != nil {
+			return notExist(path)
+		}
+		return r.propose(Change{Op: ChangeDrop, Collection: collection, Time: time.Now()})
+	}
+	if !r.d.recordExists(collection, resource) {
+		return notExist(path)
+	}
+	return r.propose(Change{Op: ChangeDelete, Collection: collection, Resource: resource, Time: time.Now()})
+}
+
+// call posts a Raft RPC to a peer
+func (r *raftNode) call(url, rpc string, req, resp interface{}) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	client := *r.client
+	if client.Timeout == 0 {
+		client.Timeout = r.opts.ElectionTimeout
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(url, "/")+"/"+rpc, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+r.opts.Secret)
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v answered %v", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// RaftHandler serves the requests the nodes of a cluster send each other, under
+// the URLs given in ClusterOptions.Peers. Requests without ClusterOptions.Secret
+// are turned down, the handler still belongs on the network of the cluster only:
+//
+//	http.Handle("/raft/", http.StripPrefix("/raft", db.RaftHandler()))
+func (d *Driver) RaftHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := d.cluster()
+		if r == nil {
+			writeError(w, CodeUnavailable, "not in a cluster")
+			return
+		}
+		if !r.authentic(req) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="golang-database raft"`)
+			writeError(w, CodeUnauthenticated, "not a node of the cluster")
+			return
+		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, CodeMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		var resp interface{}
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/vote"):
+			var vr raftVoteRequest
+			if err := json.NewDecoder(req.Body).Decode(&vr); err != nil {
+				writeError(w, CodeBadRequest, "%v", err)
+				return
+			}
+			resp = r.handleVote(vr)
+		case strings.HasSuffix(req.URL.Path, "/append"):
+			var ar raftAppendRequest
+			if err := json.NewDecoder(req.Body).Decode(&ar); err != nil {
+				writeError(w, CodeBadRequest, "%v", err)
+				return
+			}
+			var err error
+			if resp, err = r.handleAppend(ar); err != nil {
+				WriteError(w, err)
+				return
+			}
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// authentic tells whether req carries the secret of the cluster
+func (r *raftNode) authentic(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if len(auth) <= 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[7:])), []byte(r.opts.Secret)) == 1
+}
+
+func (r *raftNode) handleVote(req raftVoteRequest) raftVoteResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Term > r.term {
+		r.becomeFollower(req.Term)
+	}
+	resp := raftVoteResponse{Term: r.term}
+	if req.Term < r.term {
+		return resp
+	}
+	// only for candidates whose log has everything this node's has
+	upToDate := req.LastTerm > r.lastTerm() || req.LastTerm == r.lastTerm() && req.LastIndex >= r.lastIndex()
+	if (r.votedFor == "" || r.votedFor == req.Candidate) && upToDate {
+		r.votedFor = req.Candidate
+		if err := r.saveState(); err != nil {
+			return resp
+		}
+		r.resetDeadline()
+		resp.Granted = true
+	}
+	return resp
+}
+
+func (r *raftNode) handleAppend(req raftAppendRequest) (raftAppendResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := raftAppendResponse{Term: r.term, LastIndex: r.lastIndex()}
+	if req.Term < r.term {
+		return resp, nil
+	}
+	if req.Term > r.term || r.role != raftFollower {
+		r.becomeFollower(req.Term)
+	}
+	resp.Term = r.term
+	r.leader = req.Leader
+	r.resetDeadline()
+
+	if req.PrevIndex > r.lastIndex() || r.log[req.PrevIndex].Term != req.PrevTerm {
+		if req.PrevIndex <= r.lastIndex() {
+			resp.LastIndex = req.PrevIndex - 1
+		}
+		return resp, nil
+	}
+
+	// skip what the log already has, drop what conflicts with the leader's
+	var fresh []raftEntry
+	for i, e := range req.Entries {
+		if e.Index > r.lastIndex() {
+			fresh = req.Entries[i:]
+			break
+		}
+		if r.log[e.Index].Term != e.Term {
+			if e.Index <= r.applied {
+				return resp, fmt.Errorf("leader conflicts with applied entry %d", e.Index)
+			}
+			if err := r.truncateLog(e.Index); err != nil {
+				return resp, err
+			}
+			fresh = req.Entries[i:]
+			break
+		}
+	}
+	if len(fresh) > 0 {
+		if err := r.appendLog(fresh); err != nil {
+			return resp, err
+		}
+	}
+
+	// committed as far as the leader says and this request shows the logs agree
+	commit := req.Commit
+	if last := req.PrevIndex + uint64(len(req.Entries)); commit > last {
+		commit = last
+	}
+	if commit > r.commit {
+		r.commit = commit
+		r.wakeApplier()
+	}
+	resp.Success = true
+	resp.LastIndex = r.lastIndex()
+	return resp, nil
+}
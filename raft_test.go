@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eventually retries fn until it succeeds or timeout passes
+func eventually(t *testing.T, timeout time.Duration, fn func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// clusterLeader is the node of dbs all of them agree leads the cluster
+func clusterLeader(dbs map[string]*Driver) (string, uint64, error) {
+	var leader string
+	var term uint64
+	for id, d := range dbs {
+		status, _ := d.ClusterStatus()
+		if status.Leader == "" || leader != "" && status.Leader != leader {
+			return "", 0, fmt.Errorf("no leader agreed on, %v follows %q in term %d", id, status.Leader, status.Term)
+		}
+		leader, term = status.Leader, status.Term
+	}
+	if _, ok := dbs[leader]; !ok {
+		return "", 0, fmt.Errorf("the leader %v is gone", leader)
+	}
+	return leader, term, nil
+}
+
+func TestRaftLeaderFailover(t *testing.T) {
+	dbs := map[string]*Driver{}
+	servers := map[string]*httptest.Server{}
+	peers := map[string]string{}
+	for _, id := range []string{"a", "b", "c"} {
+		dbs[id] = NewTestDriver(t, nil)
+		servers[id] = httptest.NewServer(dbs[id].RaftHandler())
+		defer servers[id].Close()
+		peers[id] = servers[id].URL
+	}
+	for id, d := range dbs {
+		if err := d.JoinCluster(ClusterOptions{ID: id, Peers: peers, Secret: "s3cret", ElectionTimeout: 200 * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var leader string
+	var term uint64
+	eventually(t, 5*time.Second, func() (err error) {
+		leader, term, err = clusterLeader(dbs)
+		return err
+	})
+	if err := dbs[leader].Write("users", "1", User{Name: "before"}); err != nil {
+		t.Fatalf("writing on the leader: %v", err)
+	}
+
+	// the leader goes away, the two left elect one of them
+	if err := dbs[leader].Close(); err != nil {
+		t.Fatal(err)
+	}
+	servers[leader].Close()
+	delete(dbs, leader)
+
+	var next string
+	var nextTerm uint64
+	eventually(t, 5*time.Second, func() (err error) {
+		next, nextTerm, err = clusterLeader(dbs)
+		return err
+	})
+	if nextTerm <= term {
+		t.Fatalf("%v leads in term %d, want a term after %d", next, nextTerm, term)
+	}
+	if err := dbs[next].Write("users", "2", User{Name: "after"}); err != nil {
+		t.Fatalf("writing on the new leader: %v", err)
+	}
+
+	// what the old leader committed survives, and both nodes apply what came after
+	for id, d := range dbs {
+		d := d
+		eventually(t, 5*time.Second, func() error {
+			for resource, name := range map[string]string{"1": "before", "2": "after"} {
+				var u User
+				if err := d.Read("users", resource, &u); err != nil {
+					return fmt.Errorf("reading users/%v on %v: %v", resource, id, err)
+				}
+				if u.Name != name {
+					return fmt.Errorf("users/%v on %v is %q, want %q", resource, id, u.Name, name)
+				}
+			}
+			return nil
+		})
+	}
+}
+
+func TestRaftHandlerNeedsTheSecret(t *testing.T) {
+	d := NewTestDriver(t, nil)
+	srv := httptest.NewServer(d.RaftHandler())
+	defer srv.Close()
+	if err := d.JoinCluster(ClusterOptions{ID: "a", Peers: map[string]string{"a": srv.URL}, Secret: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a write sneaked in as a log entry, as anyone reaching the handler could send
+	body := `{"term":100,"leader":"x","prev_index":0,"prev_term":0,"entries":[{"term":100,"index":1,` +
+		`"change":{"op":"write","collection":"users","resource":"evil","record":{"Name":"evil"}}}],"commit":1}`
+	for _, auth := range []string{"", "Bearer wrong", "Bearer s3cret2"} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/append", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("append with %q answered %v, want %v", auth, res.Status, http.StatusUnauthorized)
+		}
+	}
+	if status, _ := d.ClusterStatus(); status.Term >= 100 {
+		t.Fatalf("the node took term %d from an unauthenticated request", status.Term)
+	}
+	RequireNoRecord(t, d, "users", "evil")
+
+	if err := NewTestDriver(t, nil).JoinCluster(ClusterOptions{ID: "a", Peers: map[string]string{"a": srv.URL}}); err == nil {
+		t.Fatal("joined a cluster without a secret")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// ReadMany reads the records of keys in one call, the files read by up to
+// Options.ReadParallelism workers instead of one Read after the other. dest points to
+// a slice, which gets the records found in the order of keys, or to a map keyed by
+// resource name:
+//
+//	var users map[string]User
+//	missing, err := db.ReadMany("users", ids, &users)
+//
+// The keys with no record come back as missing, it isn't an error. It takes
+// Select and Unredacted.
+func (d *Driver) ReadMany(collection string, keys []string, dest interface{}, opts ...QueryOption) ([]string, error) {
+	type result struct {
+		found   map[string][]byte
+		missing []string
+	}
+	out, err := d.timed("read_many", collection, "", func() (interface{}, error) {
+		found, missing, err := d.readMany(collection, keys, opts...)
+		return result{found, missing}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// decoded here, a read outliving Options.OperationTimeout mustn't touch dest
+	res := out.(result)
+	return res.missing, decodeMany(dest, keys, res.found)
+}
+
+// readMany returns the JSON of the records found by key, and the keys of the others
+func (d *Driver) readMany(collection string, keys []string, opts ...QueryOption) (_ map[string][]byte, _ []string, err error) {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return nil, nil, err
+	}
+	op := d.begin(context.Background(), opRead, collection, "")
+	defer op.end(&err)
+
+	if collection == "" {
+		return nil, nil, fmt.Errorf("%w - unable to read!", ErrEmptyCollection)
+	}
+
+	// the names to read by partition, each once however often it's asked for
+	names := map[string][]string{}
+	keyOf := map[string]string{}
+	var partitions []string
+	for _, key := range keys {
+		if key == "" {
+			return nil, nil, fmt.Errorf("%w - unable to read record!", ErrEmptyResource)
+		}
+		_, name := d.fold(collection, key)
+		if err := d.checkNames(collection, name); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := keyOf[name]; ok {
+			continue
+		}
+		keyOf[name] = key
+		partition, err := d.partitionFor(collection, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !d.mayExist(partition, name) {
+			continue
+		}
+		if _, ok := names[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+		names[partition] = append(names[partition], name)
+	}
+
+	q := newQuery(opts)
+	found := make(map[string][]byte, len(keys))
+	for _, partition := range partitions {
+		records, release, err := d.readNamed(partition, names[partition], false)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = d.auditRead(q.who, opRead, partition, recordNames(records))
+		for _, r := range records {
+			if err != nil {
+				break
+			}
+			var raw []byte
+			if raw, err = d.redact(partition, r.raw, q); err != nil {
+				break
+			}
+			if len(q.fields) > 0 {
+				if raw, err = project(raw, q.fields); err != nil {
+					err = fmt.Errorf("unable to select fields of record %v: %v", r.name, err)
+					break
+				}
+			}
+			// the raw JSON may sit in a buffer release hands back to the pool
+			found[keyOf[r.name]] = append([]byte(nil), raw...)
+		}
+		release()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var missing []string
+	for _, key := range keys {
+		if _, ok := found[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	return found, missing, nil
+}
+
+// decodeMany unmarshals the records found into dest, a pointer to a slice, appended
+// to in the order of keys, or to a map keyed by resource name
+func decodeMany(dest interface{}, keys []string, found map[string][]byte) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("ReadMany needs a pointer to a slice or a map, not %T", dest)
+	}
+	v = v.Elem()
+
+	switch v.Kind() {
+	case reflect.Slice:
+		for _, key := range keys {
+			b, ok := found[key]
+			if !ok {
+				continue
+			}
+			elem := reflect.New(v.Type().Elem())
+			if err := json.Unmarshal(b, elem.Interface()); err != nil {
+				return fmt.Errorf("unable to decode record %v: %v", key, err)
+			}
+			v.Set(reflect.Append(v, elem.Elem()))
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("ReadMany needs a map keyed by string, not %v", v.Type())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(found)))
+		}
+		for key, b := range found {
+			elem := reflect.New(v.Type().Elem())
+			if err := json.Unmarshal(b, elem.Interface()); err != nil {
+				return fmt.Errorf("unable to decode record %v: %v", key, err)
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem.Elem())
+		}
+	default:
+		return fmt.Errorf("ReadMany needs a pointer to a slice or a map, not %T", dest)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// what masked fields read as unless their Redaction says otherwise
+const redactedValue = "[REDACTED]"
+
+// Redaction masks a field of the records read from a collection, see Options.Redact
+type Redaction struct {
+	// dotted path of the field, e.g. "Contact" or "Address.Street"
+	Field string
+
+	// what the field reads as, "[REDACTED]" if nil. Nulls stay null.
+	Mask func(v interface{}) interface{}
+}
+
+// MaskAllBut keeps the last n characters of strings, "*******4321", and masks other
+// values whole
+func MaskAllBut(n int) func(interface{}) interface{} {
+	return func(v interface{}) interface{} {
+		s, ok := v.(string)
+		if !ok {
+			return redactedValue
+		}
+		runes := []rune(s)
+		if len(runes) <= n {
+			return strings.Repeat("*", len(runes))
+		}
+		return strings.Repeat("*", len(runes)-n) + string(runes[len(runes)-n:])
+	}
+}
+
+// Unredacted reads records as they're stored, for callers trusted with the fields of
+// Options.Redact
+func Unredacted() QueryOption {
+	return func(q *query) {
+		q.unredacted = true
+	}
+}
+
+// redacts reports whether what q reads of collection gets masked
+func (d *Driver) redacts(collection string, q *query) bool {
+	return len(d.redactions[d.partitionParent(collection)]) > 0 && (q == nil || !q.unredacted)
+}
+
+// redact masks the fields of a raw record as the collection's Redactions say. The
+// record is handed back as is when nothing needs masking, so the bytes may be the
+// caller's.
+func (d *Driver) redact(collection string, raw []byte, q *query) ([]byte, error) {
+	if !d.redacts(collection, q) {
+		return raw, nil
+	}
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("unable to redact record: %v", err)
+	}
+
+	masked := false
+	for _, rule := range d.redactions[d.partitionParent(collection)] {
+		parent, key, ok := fieldParent(doc, rule.Field)
+		if !ok || parent[key] == nil {
+			continue
+		}
+		if rule.Mask == nil {
+			parent[key] = redactedValue
+		} else {
+			parent[key] = rule.Mask(parent[key])
+		}
+		masked = true
+	}
+	if !masked {
+		return raw, nil
+	}
+
+	b, err := json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// redactRecord is redact for records, which may be shared and so aren't changed
+func (d *Driver) redactRecord(collection string, r *record, q *query) (*record, error) {
+	if !d.redacts(collection, q) {
+		return r, nil
+	}
+	raw, err := d.redact(collection, r.raw, q)
+	if err != nil {
+		return nil, err
+	}
+	return &record{name: r.name, raw: raw}, nil
+}
+
+// fieldParent finds the object holding the field at a dotted path, and its key
+func fieldParent(doc map[string]interface{}, field string) (map[string]interface{}, string, bool) {
+	parts := strings.Split(field, ".")
+	cur := doc
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := cur[part].(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+		cur = next
+	}
+	last := parts[len(parts)-1]
+	if _, ok := cur[last]; !ok {
+		return nil, "", false
+	}
+	return cur, last, true
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many rounds SyncRemote goes before leaving what's left for the next sync,
+// a round after the first only pushes versions that won a conflict
+const syncRounds = 3
+
+type SyncOptions struct {
+	// settles records changed on the client and on the server since the last sync
+	Strategy SyncStrategy
+
+	// http.DefaultClient if nil
+	Client *http.Client
+}
+
+// SyncChange is a version of a record in a SyncRequest or SyncResponse
+type SyncChange struct {
+	Collection string          `json:"collection"`
+	Resource   string          `json:"resource"`
+	Record     json.RawMessage `json:"record,omitempty"` // nil if the record is deleted
+	Hash       string          `json:"hash,omitempty"`   // of Record as stored, empty if deleted
+	Time       time.Time       `json:"time"`             // when the version was written
+	Clock      VectorClock     `json:"clock,omitempty"`  // with Options.VectorClocks
+
+	// of a pushed change, the hash of the server's version the client changed,
+	// empty if it had none
+	Base string `json:"base,omitempty"`
+}
+
+// SyncRequest is what a client posts to SyncHandler: the records it changed since
+// its last sync, and the token that sync returned
+type SyncRequest struct {
+	Token   string       `json:"token,omitempty"`
+	Changes []SyncChange `json:"changes,omitempty"`
+}
+
+// SyncResponse is what SyncHandler answers: the records changed on the server since
+// the token, and the server's versions of the pushed changes it refused because
+// the record changed on the server as well
+type SyncResponse struct {
+	Token string `json:"token"`
+
+	// Changes holds every record of the server rather than the changed ones, the
+	// client's records that aren't in it were deleted
+	Full      bool         `json:"full,omitempty"`
+	Changes   []SyncChange `json:"changes,omitempty"`
+	Conflicts []SyncChange `json:"conflicts,omitempty"`
+}
+
+// SyncHandler lets clients that work offline sync with the Driver, see SyncRemote:
+//
+//	http.Handle("/sync", db.SyncHandler())
+//
+// A client posts a SyncRequest. Pushed changes made to the version the server
+// still has are applied, the others come back as conflicts for the client to
+// settle. Then the server answers the changes after the client's token, if
+// Options.ReplicationLog still holds them, or else all of its records. With
+// Options.AccessControl the client has to be allowed to read every collection,
+// and to write or delete records of those it pushes changes to.
+func (d *Driver) SyncHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, CodeMethodNotAllowed, "method not allowed")
+			return
+		}
+		var req SyncRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, CodeBadRequest, "invalid sync request: %v", err)
+			return
+		}
+
+		if err := d.authorize(r, "", PermRead); err != nil {
+			WriteError(w, err)
+			return
+		}
+		resp, err := d.serveSync(&req, d.authorizer(r))
+		if err != nil {
+			if code := CodeOf(err); code != CodeForbidden && code != CodeReadOnly {
+				d.logf(LevelWarning, "Sync failed", "operation", "sync", "error", err)
+			}
+			WriteError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// serveSync answers a client that may push what authorize allows, anything if it's
+// nil
+func (d *Driver) serveSync(req *SyncRequest, authorize func(string, Permission) error) (*SyncResponse, error) {
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	if authorize != nil {
+		// all or nothing, rather than conflicts the client can't settle
+		for _, c := range req.Changes {
+			p := PermWrite
+			if c.Record == nil {
+				p = PermDelete
+			}
+			if err := authorize(c.Collection, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	resp := &SyncResponse{}
+	for i := range req.Changes {
+		conflict, err := d.pushChange(&req.Changes[i])
+		if err != nil {
+			return nil, err
+		}
+		if conflict != nil {
+			resp.Conflicts = append(resp.Conflicts, *conflict)
+		}
+	}
+
+	if d.repl != nil {
+		epoch, seq, ok := parseSyncToken(req.Token)
+		current, _ := d.repl.position()
+		if changes, inLog, _ := d.repl.since(seq); ok && epoch == current && inLog {
+			pulled, ok, err := d.syncChanges(changes)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				resp.Changes = pulled
+				resp.Token = syncToken(epoch, seq+uint64(len(changes)))
+				return resp, nil
+			}
+		}
+	}
+
+	// the position goes first, changes made while reading come again next time
+	if d.repl != nil {
+		resp.Token = syncToken(d.repl.position())
+	}
+	resp.Full = true
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	for _, collection := range collections {
+		names, err := d.listRecords(collection)
+		if os.IsNotExist(err) {
+			continue // deleted since
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			c, err := d.syncVersion(collection, name)
+			if err != nil {
+				return nil, err
+			}
+			if c.Hash != "" {
+				resp.Changes = append(resp.Changes, c)
+			}
+		}
+	}
+	return resp, nil
+}
+
+// pushChange applies a change of a client, unless the record changed on the server
+// since the client saw it. Then it returns the server's version.
+func (d *Driver) pushChange(c *SyncChange) (*SyncChange, error) {
+	if c.Collection == "" || c.Resource == "" {
+		return nil, fmt.Errorf("sync change without a collection or resource")
+	}
+	if err := d.checkNames(c.Collection, c.Resource); err != nil {
+		return nil, err
+	}
+	theirs := c.side()
+	if c.Record != nil {
+		if !json.Valid(c.Record) {
+			return nil, fmt.Errorf("invalid record %v/%v", c.Collection, c.Resource)
+		}
+		theirs.hash = syncHash(c.Record)
+	} else {
+		theirs.hash = ""
+	}
+
+	mutex := d.lockFor(c.Collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	ours, err := d.syncSide(c.Collection, c.Resource)
+	if err != nil {
+		return nil, err
+	}
+	if ours.hash == theirs.hash {
+		return nil, d.takeClock(c.Collection, c.Resource, mergeClocks(ours.clock, theirs.clock))
+	}
+	winner, ok := causal(ours, theirs)
+	if ours.hash == c.Base || ok && winner.hash == theirs.hash {
+		if theirs.clock, err = d.settledClock(ours, theirs, theirs); err != nil {
+			return nil, err
+		}
+		return nil, d.syncApply(c.Collection, c.Resource, theirs)
+	}
+	conflict := ours.change(c.Collection, c.Resource)
+	return &conflict, nil
+}
+
+// syncChanges turns the changes of the replication log into the current versions
+// of the records they touched. It can't tell which records a dropped collection
+// had, then it returns false.
+func (d *Driver) syncChanges(changes []Change) ([]SyncChange, bool, error) {
+	var keys [][2]string
+	seen := map[[2]string]bool{}
+	for _, c := range changes {
+		if c.Op == ChangeDrop {
+			return nil, false, nil
+		}
+		key := [2]string{c.Collection, c.Resource}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	var pulled []SyncChange
+	for _, key := range keys {
+		c, err := d.syncVersion(key[0], key[1])
+		if err != nil {
+			return nil, false, err
+		}
+		pulled = append(pulled, c)
+	}
+	return pulled, true, nil
+}
+
+func (d *Driver) syncVersion(collection, resource string) (SyncChange, error) {
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	s, err := d.syncSide(collection, resource)
+	if err != nil {
+		return SyncChange{}, err
+	}
+	return s.change(collection, resource), nil
+}
+
+func (s syncSide) change(collection, resource string) SyncChange {
+	return SyncChange{
+		Collection: collection, Resource: resource,
+		Record: s.raw, Hash: s.hash, Time: s.modTime, Clock: s.clock,
+	}
+}
+
+func (c *SyncChange) side() syncSide {
+	return syncSide{raw: c.Record, hash: c.Hash, modTime: c.Time, clock: c.Clock}
+}
+
+func syncToken(epoch string, seq uint64) string {
+	return epoch + "." + strconv.FormatUint(seq, 10)
+}
+
+func parseSyncToken(token string) (string, uint64, bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(token[i+1:], 10, 64)
+	return token[:i], seq, err == nil
+}
+
+// SyncRemote syncs the Driver with the server serving SyncHandler at serverURL, for
+// apps working offline between syncs: it pushes the records written or deleted
+// here since the last sync, then pulls those changed on the server. Records
+// changed on both sides are settled by opts.Strategy, a version of the client's
+// that wins is pushed again. Call it whenever the server can be reached; a sync
+// cut short is picked up by the next one.
+func (d *Driver) SyncRemote(serverURL string, opts *SyncOptions) (SyncResult, error) {
+	var result SyncResult
+	if err := d.writable(); err != nil {
+		return result, err
+	}
+	var o SyncOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+
+	base, err := d.readSyncBase(serverURL)
+	if err != nil {
+		return result, err
+	}
+	base.Other = serverURL
+
+	for round := 0; round < syncRounds; round++ {
+		pushed, err := d.localChanges(base)
+		if err != nil {
+			return result, err
+		}
+		if round > 0 && len(pushed) == 0 {
+			break
+		}
+
+		resp, err := postSync(o.Client, serverURL, &SyncRequest{Token: base.Token, Changes: pushed})
+		if err != nil {
+			return result, err
+		}
+		again, err := d.applySync(&base, pushed, resp, o.Strategy, &result)
+		if err != nil {
+			return result, err
+		}
+		base.Time = time.Now()
+		if err := d.writeSyncBase(base); err != nil {
+			return result, err
+		}
+		if !again {
+			break
+		}
+	}
+	return result, nil
+}
+
+// localChanges lists the records that differ from the server's version as of the
+// last sync
+func (d *Driver) localChanges(base syncBase) ([]SyncChange, error) {
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	var changes []SyncChange
+	for _, collection := range collections {
+		names, err := d.listRecords(collection)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			key := collection + "/" + name
+			known[key] = true
+			c, err := d.syncVersion(collection, name)
+			if err != nil {
+				return nil, err
+			}
+			if c.Hash != base.Records[key] {
+				c.Base = base.Records[key]
+				changes = append(changes, c)
+			}
+		}
+	}
+	for key, hash := range base.Records {
+		if known[key] {
+			continue
+		}
+		i := strings.IndexByte(key, '/')
+		changes = append(changes, SyncChange{
+			Collection: key[:i], Resource: key[i+1:], Time: time.Now(), Base: hash,
+		})
+	}
+	return changes, nil
+}
+
+func postSync(client *http.Client, serverURL string, req *SyncRequest) (*SyncResponse, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Post(serverURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sync with %v: %w", serverURL, readError(res))
+	}
+	var resp SyncResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid sync response: %v", err)
+	}
+	return &resp, nil
+}
+
+// applySync takes in the server's answer and moves base along. It reports whether
+// versions of the client's won conflicts and have to be pushed again.
+func (d *Driver) applySync(base *syncBase, pushed []SyncChange, resp *SyncResponse, strategy SyncStrategy, result *SyncResult) (bool, error) {
+	mine := map[string]*SyncChange{}
+	for i := range pushed {
+		c := &pushed[i]
+		mine[c.Collection+"/"+c.Resource] = c
+	}
+
+	again := false
+	refused := map[string]bool{}
+	for i := range resp.Conflicts {
+		theirs := &resp.Conflicts[i]
+		key := theirs.Collection + "/" + theirs.Resource
+		refused[key] = true
+		ours := mine[key]
+		if ours == nil {
+			// not pushed, the server's version goes
+			ours = &SyncChange{Collection: theirs.Collection, Resource: theirs.Resource, Hash: theirs.Hash}
+		}
+		winner, ok := causal(ours.side(), theirs.side())
+		if !ok {
+			result.Conflicts++
+			var err error
+			if winner, err = d.settle(strategy, theirs.Collection, theirs.Resource, ours.side(), theirs.side()); err != nil {
+				return false, err
+			}
+		}
+		if winner.hash == theirs.Hash {
+			if err := d.pullChange(base, theirs, "", true, result); err != nil {
+				return false, err
+			}
+			continue
+		}
+		var err error
+		if winner.clock, err = d.settledClock(ours.side(), theirs.side(), winner); err != nil {
+			return false, err
+		}
+		// a merge is written here, the client's version only takes the merged clock
+		settled := winner.change(theirs.Collection, theirs.Resource)
+		if err := d.pullChange(base, &settled, ours.Hash, winner.hash != ours.Hash, result); err != nil {
+			return false, err
+		}
+		// pushed again against the server's version
+		base.set(key, theirs.Hash)
+		again = true
+	}
+	for key, c := range mine {
+		if !refused[key] {
+			base.set(key, c.Hash)
+			result.Pushed++
+		}
+	}
+
+	listed := map[string]bool{}
+	for i := range resp.Changes {
+		c := &resp.Changes[i]
+		key := c.Collection + "/" + c.Resource
+		listed[key] = true
+		if refused[key] {
+			continue // settled above
+		}
+		if err := d.pullChange(base, c, base.Records[key], false, result); err != nil {
+			return false, err
+		}
+	}
+	if resp.Full {
+		for key, hash := range base.Records {
+			if listed[key] {
+				continue
+			}
+			i := strings.IndexByte(key, '/')
+			gone := &SyncChange{Collection: key[:i], Resource: key[i+1:]}
+			if err := d.pullChange(base, gone, hash, false, result); err != nil {
+				return false, err
+			}
+			delete(base.Records, key)
+		}
+	}
+
+	base.Token = resp.Token
+	return again, nil
+}
+
+// pullChange applies a version of the server's, unless the record changed here
+// since it was last hashed as was. Those are pushed next time. force applies it
+// whatever the record holds.
+func (d *Driver) pullChange(base *syncBase, c *SyncChange, was string, force bool, result *SyncResult) error {
+	if c.Collection == "" || c.Resource == "" {
+		return fmt.Errorf("sync change without a collection or resource")
+	}
+	if err := d.checkNames(c.Collection, c.Resource); err != nil {
+		return err
+	}
+	if c.Record != nil && !json.Valid(c.Record) {
+		return fmt.Errorf("invalid record %v/%v", c.Collection, c.Resource)
+	}
+	key := c.Collection + "/" + c.Resource
+
+	mutex := d.lockFor(c.Collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	ours, err := d.syncSide(c.Collection, c.Resource)
+	if err != nil {
+		return err
+	}
+	switch {
+	case ours.hash == c.Hash:
+		if err := d.takeClock(c.Collection, c.Resource, mergeClocks(ours.clock, c.Clock)); err != nil {
+			return err
+		}
+	case force || ours.hash == was:
+		if err := d.syncApply(c.Collection, c.Resource, c.side()); err != nil {
+			return err
+		}
+		result.Pulled++
+	default:
+		return nil
+	}
+	base.set(key, c.Hash)
+	return nil
+}
+
+func (b *syncBase) set(key, hash string) {
+	if hash == "" {
+		delete(b.Records, key)
+		return
+	}
+	b.Records[key] = hash
+}
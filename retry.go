@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy is how often and how long the Driver retries record file operations
+// that failed for a reason that passes: a file busy on a network filesystem, or held
+// open by a virus scanner or indexer on Windows. Other errors aren't retried.
+type RetryPolicy struct {
+	Attempts   int           // tries in all, so 1 doesn't retry
+	Backoff    time.Duration // before the first retry, 10ms if zero, doubled after each
+	MaxBackoff time.Duration // the most a backoff grows to, a second if zero
+
+	// how much of each backoff is random, from 0 to 1, so writers that failed
+	// together don't retry together
+	Jitter float64
+}
+
+// withRetry runs fn until it succeeds, fails for good or runs out of attempts
+func (d *Driver) withRetry(fn func() error) error {
+	err := fn()
+	p := d.retry
+	if p == nil || err == nil || !transient(err) {
+		return err
+	}
+
+	backoff, limit := p.Backoff, p.MaxBackoff
+	if backoff <= 0 {
+		backoff = 10 * time.Millisecond
+	}
+	if limit <= 0 {
+		limit = time.Second
+	}
+	for attempt := 2; attempt <= p.Attempts; attempt++ {
+		wait := backoff
+		if p.Jitter > 0 {
+			wait -= time.Duration(p.Jitter * rand.Float64() * float64(backoff))
+		}
+		d.logf(LevelDebug, "Retrying", "attempt", attempt, "wait", wait, "error", err)
+		time.Sleep(wait)
+
+		if err = fn(); err == nil || !transient(err) {
+			return err
+		}
+		if backoff *= 2; backoff > limit {
+			backoff = limit
+		}
+	}
+	return err
+}
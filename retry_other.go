@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package main
+
+// transient reports whether an operation that failed with err may work if retried,
+// never where the errors aren't known
+func transient(err error) bool {
+	return false
+}
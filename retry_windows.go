@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transient reports whether an operation that failed with err may work if retried.
+// Access denied is mostly a rename over a file something else has open, though it
+// can be lasting too.
+func transient(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.ERROR_ACCESS_DENIED,
+		32, // ERROR_SHARING_VIOLATION
+		33: // ERROR_LOCK_VIOLATION
+		return true
+	}
+	return false
+}
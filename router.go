@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+type RouterOptions struct {
+	// replicas whose last applied change was older than this when applied aren't read
+	// from. Zero reads from any replica connected to its leader.
+	MaxStaleness time.Duration
+}
+
+// Router sends writes to a primary and spreads reads over replicas following it,
+// skipping replicas that lost their leader or lag too far behind and falling back
+// to the primary when none is fit. It's a DB, so code taking a DB can take a Router
+// instead of a Driver.
+type Router struct {
+	next uint64 // round robin position, first for 64 bit alignment
+
+	primary  *Driver
+	replicas []*Driver
+	opts     RouterOptions
+}
+
+// NewRouter routes between primary and replicas, typically Drivers that Follow it
+// or nodes of its cluster
+func NewRouter(primary *Driver, replicas []*Driver, opts *RouterOptions) *Router {
+	r := &Router{primary: primary, replicas: replicas}
+	if opts != nil {
+		r.opts = *opts
+	}
+	return r
+}
+
+// Primary returns the Driver writes go to
+func (r *Router) Primary() *Driver {
+	return r.primary
+}
+
+// reader picks the next fit replica, or the primary
+func (r *Router) reader() *Driver {
+	n := len(r.replicas)
+	start := atomic.AddUint64(&r.next, 1)
+	for i := 0; i < n; i++ {
+		d := r.replicas[(start+uint64(i))%uint64(n)]
+		if r.fresh(d) {
+			return d
+		}
+	}
+	return r.primary
+}
+
+// fresh reports whether a replica is within the staleness bound
+func (r *Router) fresh(d *Driver) bool {
+	if status, ok := d.ReplicationStatus(); ok {
+		return status.Connected && (r.opts.MaxStaleness <= 0 || status.Lag <= r.opts.MaxStaleness)
+	}
+	if status, ok := d.ClusterStatus(); ok {
+		return status.Leader != ""
+	}
+	return true // not replicating, nothing to fall behind
+}
+
+func (r *Router) Write(collection, resource string, v interface{}) error {
+	return r.primary.Write(collection, resource, v)
+}
+
+func (r *Router) WriteStream(collection, resource string, rd io.Reader) error {
+	return r.primary.WriteStream(collection, resource, rd)
+}
+
+func (r *Router) Delete(collection, resource string) error {
+	return r.primary.Delete(collection, resource)
+}
+
+func (r *Router) DeleteIf(collection, resource, expectedVersion string) error {
+	return r.primary.DeleteIf(collection, resource, expectedVersion)
+}
+
+func (r *Router) DeleteWhere(collection string, filter Filter) (int, error) {
+	return r.primary.DeleteWhere(collection, filter)
+}
+
+func (r *Router) UpdateWhere(collection string, filter Filter, patch interface{}) (int, error) {
+	return r.primary.UpdateWhere(collection, filter, patch)
+}
+
+func (r *Router) Read(collection, resource string, v interface{}, opts ...QueryOption) error {
+	return r.reader().Read(collection, resource, v, opts...)
+}
+
+func (r *Router) ReadVersion(collection, resource string, v interface{}, opts ...QueryOption) (string, error) {
+	return r.reader().ReadVersion(collection, resource, v, opts...)
+}
+
+func (r *Router) ReadPath(collection, resource, path string, v interface{}, opts ...QueryOption) error {
+	return r.reader().ReadPath(collection, resource, path, v, opts...)
+}
+
+func (r *Router) ReadStream(collection, resource string, opts ...QueryOption) (io.ReadCloser, error) {
+	return r.reader().ReadStream(collection, resource, opts...)
+}
+
+func (r *Router) ReadInto(collection, resource string, buf []byte, opts ...QueryOption) ([]byte, error) {
+	return r.reader().ReadInto(collection, resource, buf, opts...)
+}
+
+func (r *Router) ReadMany(collection string, keys []string, dest interface{}, opts ...QueryOption) ([]string, error) {
+	return r.reader().ReadMany(collection, keys, dest, opts...)
+}
+
+func (r *Router) ReadAll(collection string, opts ...QueryOption) ([]string, error) {
+	return r.reader().ReadAll(collection, opts...)
+}
+
+func (r *Router) ReadAllRaw(collection string, opts ...QueryOption) ([]json.RawMessage, error) {
+	return r.reader().ReadAllRaw(collection, opts...)
+}
+
+func (r *Router) Glob(collection, pattern string, opts ...QueryOption) ([]string, error) {
+	return r.reader().Glob(collection, pattern, opts...)
+}
+
+func (r *Router) ReadRange(collection, startKey, endKey string, opts ...QueryOption) ([]string, error) {
+	return r.reader().ReadRange(collection, startKey, endKey, opts...)
+}
+
+func (r *Router) List(collection, prefix string, opts ...QueryOption) ([]string, error) {
+	return r.reader().List(collection, prefix, opts...)
+}
+
+func (r *Router) Exists(collection, resource string) bool {
+	return r.reader().Exists(collection, resource)
+}
+
+func (r *Router) Find(collection string, filter Filter, opts ...QueryOption) ([]string, error) {
+	return r.reader().Find(collection, filter, opts...)
+}
+
+func (r *Router) FindRaw(collection string, filter Filter, opts ...QueryOption) ([]json.RawMessage, error) {
+	return r.reader().FindRaw(collection, filter, opts...)
+}
+
+func (r *Router) FindOne(collection string, filter Filter, v interface{}, opts ...QueryOption) error {
+	return r.reader().FindOne(collection, filter, v, opts...)
+}
+
+func (r *Router) Query(sql string) ([]string, error) {
+	return r.reader().Query(sql)
+}
+
+func (r *Router) WriteContext(ctx context.Context, collection, resource string, v interface{}) error {
+	return r.primary.WriteContext(ctx, collection, resource, v)
+}
+
+func (r *Router) DeleteContext(ctx context.Context, collection, resource string) error {
+	return r.primary.DeleteContext(ctx, collection, resource)
+}
+
+func (r *Router) ReadContext(ctx context.Context, collection, resource string, v interface{}, opts ...QueryOption) error {
+	return r.reader().ReadContext(ctx, collection, resource, v, opts...)
+}
+
+func (r *Router) ReadAllContext(ctx context.Context, collection string, opts ...QueryOption) ([]string, error) {
+	return r.reader().ReadAllContext(ctx, collection, opts...)
+}
+
+func (r *Router) FindContext(ctx context.Context, collection string, filter Filter, opts ...QueryOption) ([]string, error) {
+	return r.reader().FindContext(ctx, collection, filter, opts...)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// where Scan moves the records it quarantines, in a directory per scan
+const quarantineDir = "_quarantine"
+
+// ProblemKind is what Scan found wrong with a record
+type ProblemKind string
+
+const (
+	ProblemRead     ProblemKind = "read"     // the file couldn't be read, maybe for a passing reason
+	ProblemChunks   ProblemKind = "chunks"   // chunks are missing or don't add up to the manifest's size
+	ProblemChecksum ProblemKind = "checksum" // the chunks don't match the manifest's checksum
+	ProblemDecode   ProblemKind = "decode"   // the record isn't valid JSON
+	ProblemSchema   ProblemKind = "schema"   // the record doesn't match the latest schema of its collection
+)
+
+// irrecoverable tells the problems of files that won't ever be read, which Scan
+// quarantines. A record breaking its schema is still a record.
+func (k ProblemKind) irrecoverable() bool {
+	return k == ProblemChunks || k == ProblemChecksum || k == ProblemDecode
+}
+
+// ScanOptions says what Scan looks at and what it does about what it finds
+type ScanOptions struct {
+	// the collections to scan with their subcollections, every one if empty
+	Collections []string
+
+	// move records with irrecoverable problems, with their chunks and attachments, to
+	// _quarantine/<time of the scan>/ instead of only reporting them. They're then
+	// gone from the collection, its indexes and counts; nothing is replicated.
+	Quarantine bool
+}
+
+// ScanProblem is a record Scan found a problem with
+type ScanProblem struct {
+	Collection  string
+	Resource    string
+	Path        string // of the record file
+	Kind        ProblemKind
+	Err         error
+	Quarantined string // where the record file was moved, empty if it wasn't
+}
+
+// ScanReport is what Scan went through and found
+type ScanReport struct {
+	Collections int
+	Records     int
+	Problems    []ScanProblem
+	Quarantined int
+	Took        time.Duration
+}
+
+// Scan reads every record of the collections in opts, checks it decodes, that the
+// chunks of chunked records match the size and checksum of their manifest, and that
+// it matches the latest schema of its collection, for periodic integrity checks of
+// databases that live long. It runs online; records written only to the WriteBack
+// cache so far aren't on disk to scan.
+func (d *Driver) Scan(opts ScanOptions) (report ScanReport, err error) {
+	if err := d.enter(); err != nil {
+		return report, err
+	}
+	defer d.leave()
+	start := time.Now()
+	// the named result, so it's set on what's returned
+	defer func() { report.Took = time.Since(start) }()
+
+	collections, err := d.scanCollections(opts.Collections)
+	if err != nil {
+		return report, err
+	}
+	stamp := start.UTC().Format("20060102T150405")
+	for _, collection := range collections {
+		names, err := d.listRecords(collection)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Collections++
+
+		for _, name := range names {
+			if d.isDirty(collection, name) {
+				continue
+			}
+			report.Records++
+			kind, err := d.checkRecord(collection, name)
+			if kind == "" {
+				continue
+			}
+
+			p := ScanProblem{Collection: collection, Resource: name, Path: d.recordPath(collection, name), Kind: kind, Err: err}
+			if opts.Quarantine && kind.irrecoverable() {
+				if p.Quarantined, err = d.quarantine(collection, name, stamp); err != nil {
+					return report, err
+				}
+				if p.Quarantined != "" {
+					report.Quarantined++
+				}
+			}
+			report.Problems = append(report.Problems, p)
+		}
+	}
+
+	d.logf(LevelInfo, "Scanned database", "operation", "scan", "records", report.Records,
+		"problems", len(report.Problems), "quarantined", report.Quarantined, "duration", time.Since(start))
+	return report, nil
+}
+
+// scanCollections is the collections named, or all of them, with their
+// subcollections, sorted
+func (d *Driver) scanCollections(named []string) ([]string, error) {
+	roots := make([]string, len(named))
+	for i, collection := range named {
+		roots[i] = d.foldCollection(collection)
+	}
+	if len(roots) == 0 {
+		var err error
+		if roots, err = d.Collections(); err != nil {
+			return nil, err
+		}
+	}
+
+	var collections []string
+	for _, root := range roots {
+		nested, err := d.nestedCollections(root)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(append(collections, root), nested...)
+	}
+	sort.Strings(collections)
+	return collections, nil
+}
+
+// checkRecord reads a record and returns what's wrong with it, nothing for a record
+// deleted meanwhile
+func (d *Driver) checkRecord(collection, resource string) (ProblemKind, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := d.readRecordInto(buf, collection, resource); err != nil {
+		switch {
+		case os.IsNotExist(err):
+			return "", nil
+		case errors.Is(err, errChecksum):
+			return ProblemChecksum, err
+		case errors.Is(err, ErrCorrupted):
+			return ProblemChunks, err
+		}
+		return ProblemRead, err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		d.corrupt(collection, resource, d.recordPath(collection, resource), err)
+		return ProblemDecode, corrupted(err)
+	}
+	if err := d.checkSchema(collection, resource, buf.Bytes()); err != nil {
+		if errors.Is(err, ErrSchemaViolation) {
+			return ProblemSchema, err
+		}
+		return ProblemRead, err
+	}
+	return "", nil
+}
+
+// quarantine moves a record with its chunks and attachments out of the database and
+// forgets it, returning where the record file went. Nothing is moved if a write
+// fixed the record meanwhile.
+func (d *Driver) quarantine(collection, resource, stamp string) (string, error) {
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if kind, _ := d.checkRecord(collection, resource); !kind.irrecoverable() {
+		return "", nil
+	}
+	size, err := d.usageOf(collection, resource)
+	if err != nil {
+		return "", err
+	}
+
+	var moved string
+	for _, from := range []string{d.recordPath(collection, resource), d.chunkDir(collection, resource), d.attachmentDir(collection, resource)} {
+		rel, err := filepath.Rel(d.dir, from)
+		if err != nil {
+			return "", err
+		}
+		to := filepath.Join(d.dir, quarantineDir, stamp, rel)
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return "", err
+		}
+		if moved == "" && d.lsm != nil {
+			// the record is in a segment, what can be read of it is copied out
+			if err := d.quarantineLSM(collection, resource, to); err != nil {
+				return "", err
+			}
+			moved = to
+			continue
+		}
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if moved == "" {
+			moved = to
+		}
+	}
+
+	d.uncache(collection, resource)
+	d.keyRemove(collection, resource)
+	d.addUsage(collection, -size)
+	if err := d.addRecordCount(collection, -1); err != nil {
+		return moved, err
+	}
+	if err := d.unindex(collection, resource); err != nil {
+		return moved, err
+	}
+	d.logf(LevelWarning, "Quarantined record", "operation", "scan", "collection", collection,
+		"resource", resource, "path", moved)
+	return moved, nil
+}
+
+// quarantineLSM writes what can be read of an LSMEngine record to path and deletes it
+func (d *Driver) quarantineLSM(collection, resource, path string) error {
+	var b []byte
+	if e, ok, err := d.lsm.get(cacheKey(collection, resource)); err == nil && ok {
+		b = e.value
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return err
+	}
+	return d.lsm.put(cacheKey(collection, resource), nil)
+}
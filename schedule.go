@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// where writes scheduled with WriteAt wait for their time, a file each
+const scheduleDir = "_scheduled"
+
+// how long the scheduler sleeps at most, in case the clock jumps
+const scheduleMaxSleep = time.Minute
+
+// scheduledWrite is a write waiting in scheduleDir
+type scheduledWrite struct {
+	Collection string          `json:"collection"`
+	Resource   string          `json:"resource"`
+	DeliverAt  time.Time       `json:"deliver_at"`
+	Record     json.RawMessage `json:"record"`
+}
+
+// WriteAt writes a record at deliverAt rather than now, for reminders and the like:
+// until then Read, Find and the rest don't see it. The write waits in the database
+// directory, so it survives restarts, and is made with Write once it's due, indexes,
+// watchers and replication included. A time that has passed writes right away.
+func (d *Driver) WriteAt(collection, resource string, v interface{}, deliverAt time.Time) error {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return err
+	}
+	if collection == "" || resource == "" {
+		return missingName(collection, "unable to schedule record")
+	}
+	if !deliverAt.After(time.Now()) {
+		return d.Write(collection, resource, v)
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b, err = json.Marshal(scheduledWrite{Collection: collection, Resource: resource, DeliverAt: deliverAt, Record: b})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(d.dir, scheduleDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// named to sort in the order they were scheduled, which writes due together keep
+	if err := writeAtomic(filepath.Join(dir, d.nextMessageID()+".json"), append(b, '\n')); err != nil {
+		return err
+	}
+	d.startScheduler()
+	select {
+	case d.scheduled <- struct{}{}:
+	default: // a wake up is pending already
+	}
+	return nil
+}
+
+// Unschedule drops the writes of a record scheduled with WriteAt that aren't due yet,
+// returning how many there were
+func (d *Driver) Unschedule(collection, resource string) (int, error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return 0, err
+	}
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	pending, err := d.scheduledWrites()
+	if err != nil {
+		return 0, err
+	}
+	dropped := 0
+	for _, p := range pending {
+		if p.w.Collection != collection || p.w.Resource != resource {
+			continue
+		}
+		if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+			return dropped, err
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+type pendingWrite struct {
+	path string
+	w    scheduledWrite
+}
+
+// scheduledWrites reads the writes waiting in scheduleDir, in the order they were
+// scheduled
+func (d *Driver) scheduledWrites() ([]pendingWrite, error) {
+	dir := filepath.Join(d.dir, scheduleDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	var pending []pendingWrite
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue // half written .tmp files
+		}
+		path := filepath.Join(dir, file.Name())
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var w scheduledWrite
+		if err := json.Unmarshal(b, &w); err != nil {
+			d.corrupt("", "", path, err)
+			continue
+		}
+		pending = append(pending, pendingWrite{path: path, w: w})
+	}
+	return pending, nil
+}
+
+// startScheduler starts writing scheduled records when they're due, once
+func (d *Driver) startScheduler() {
+	d.scheduler.Do(func() {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+
+			timer := time.NewTimer(0)
+			defer timer.Stop()
+			for {
+				select {
+				case <-d.done:
+					return
+				case <-d.scheduled:
+				case <-timer.C:
+				}
+				next, err := d.deliverScheduled(time.Now())
+				if err != nil {
+					d.logf(LevelError, "Scheduled write failed", "operation", "write", "error", err)
+				}
+				d.background.set("scheduled writes", err)
+
+				sleep := scheduleMaxSleep
+				if !next.IsZero() && time.Until(next) < sleep {
+					sleep = time.Until(next)
+				}
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(sleep)
+			}
+		}()
+	})
+}
+
+// deliverScheduled writes the scheduled records due at now and returns when the next
+// one is due, zero if none is waiting
+func (d *Driver) deliverScheduled(now time.Time) (time.Time, error) {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+
+	pending, err := d.scheduledWrites()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var next time.Time
+	for _, p := range pending {
+		if p.w.DeliverAt.After(now) {
+			if next.IsZero() || p.w.DeliverAt.Before(next) {
+				next = p.w.DeliverAt
+			}
+			continue
+		}
+		if err := d.Write(p.w.Collection, p.w.Resource, p.w.Record); err != nil {
+			return next, fmt.Errorf("scheduled write of %v/%v: %w", p.w.Collection, p.w.Resource, err)
+		}
+		if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+			return next, err
+		}
+	}
+	return next, nil
+}
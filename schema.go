@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// where the schemas of each collection are kept, every version
+const schemaDir = "_schemas"
+
+// Schema declares the fields the records of a collection have. Fields it doesn't name
+// are left alone.
+type Schema struct {
+	Fields map[string]SchemaField `json:"fields"` // by dotted path
+}
+
+// SchemaField is a field of a Schema
+type SchemaField struct {
+	// "string", "number", "boolean", "object" or "array", anything if empty. Nulls
+	// count as missing.
+	Type string `json:"type,omitempty"`
+
+	Required bool `json:"required,omitempty"`
+
+	// what readers take for records without the field, which lets a required field
+	// be added or dropped without breaking compatibility
+	Default interface{} `json:"default,omitempty"`
+}
+
+// Compatibility is what a new version of a schema has to keep working, checked by
+// RegisterSchema against the version before it
+type Compatibility int
+
+const (
+	// code using the new schema reads the records written with the old one: no new
+	// required fields without a Default. The default, as with Kafka's registry.
+	CompatBackward Compatibility = iota
+	// code using the old schema reads the records written with the new one: no
+	// required fields dropped, or made optional, without a Default
+	CompatForward
+	// both
+	CompatFull
+	// anything goes
+	CompatNone
+)
+
+func (c Compatibility) String() string {
+	switch c {
+	case CompatForward:
+		return "forward"
+	case CompatFull:
+		return "full"
+	case CompatNone:
+		return "none"
+	}
+	return "backward"
+}
+
+// schemaState is the file of a collection in schemaDir
+type schemaState struct {
+	Compatibility Compatibility   `json:"compatibility"`
+	Versions      []schemaVersion `json:"versions"`
+}
+
+type schemaVersion struct {
+	Version    int       `json:"version"`
+	Schema     Schema    `json:"schema"`
+	Registered time.Time `json:"registered"`
+}
+
+func (s *schemaState) latest() *schemaVersion {
+	if s == nil || len(s.Versions) == 0 {
+		return nil
+	}
+	return &s.Versions[len(s.Versions)-1]
+}
+
+// RegisterSchema adds a version of the schema of a collection and returns its number,
+// or ErrIncompatibleSchema if it breaks the collection's Compatibility with the
+// version before. From then on writes of records that don't match the latest version
+// fail with ErrSchemaViolation. Registering the latest version again changes nothing.
+// Migrate doesn't check records, so register the schema a migration leads to once
+// it's done.
+func (d *Driver) RegisterSchema(collection string, s Schema) (int, error) {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return 0, err
+	}
+	if collection == "" {
+		return 0, fmt.Errorf("%w - unable to register schema", ErrEmptyCollection)
+	}
+	for path, f := range s.Fields {
+		switch f.Type {
+		case "", "string", "number", "boolean", "object", "array":
+		default:
+			return 0, fmt.Errorf("field %v of the schema of %v has unknown type %q", path, collection, f.Type)
+		}
+	}
+
+	d.schemaMu.Lock()
+	defer d.schemaMu.Unlock()
+	state, err := d.schemaState(collection)
+	if err != nil {
+		return 0, err
+	}
+	next := schemaState{}
+	if state != nil {
+		next = *state
+	}
+	if latest := next.latest(); latest != nil {
+		if reflect.DeepEqual(normalizedSchema(latest.Schema), normalizedSchema(s)) {
+			return latest.Version, nil
+		}
+		if err := checkCompatibility(latest.Schema, s, next.Compatibility); err != nil {
+			return 0, fmt.Errorf("%w: version %d of %v: %v", ErrIncompatibleSchema, latest.Version+1, collection, err)
+		}
+	}
+
+	version := len(next.Versions) + 1
+	next.Versions = append(append([]schemaVersion(nil), next.Versions...), schemaVersion{Version: version, Schema: s, Registered: time.Now()})
+	if err := d.storeSchemaState(collection, &next); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// normalizedSchema is a schema as it's stored, so the one read back compares equal
+func normalizedSchema(s Schema) Schema {
+	b, _ := json.Marshal(s)
+	var n Schema
+	json.Unmarshal(b, &n)
+	return n
+}
+
+// SetCompatibility sets what new versions of the schema of a collection are checked
+// for, CompatBackward until then
+func (d *Driver) SetCompatibility(collection string, c Compatibility) error {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return err
+	}
+	if collection == "" {
+		return fmt.Errorf("%w - unable to set compatibility", ErrEmptyCollection)
+	}
+
+	d.schemaMu.Lock()
+	defer d.schemaMu.Unlock()
+	state, err := d.schemaState(collection)
+	if err != nil {
+		return err
+	}
+	next := schemaState{}
+	if state != nil {
+		next = *state
+	}
+	next.Compatibility = c
+	return d.storeSchemaState(collection, &next)
+}
+
+// Schema returns a version of the schema of a collection and its number, the latest
+// for version 0, or ErrNotFound
+func (d *Driver) Schema(collection string, version int) (Schema, int, error) {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return Schema{}, 0, err
+	}
+	d.schemaMu.Lock()
+	defer d.schemaMu.Unlock()
+	state, err := d.schemaState(collection)
+	if err != nil {
+		return Schema{}, 0, err
+	}
+	if state != nil {
+		for _, v := range state.Versions {
+			if v.Version == version || version == 0 && v.Version == len(state.Versions) {
+				return v.Schema, v.Version, nil
+			}
+		}
+	}
+	return Schema{}, 0, fmt.Errorf("%w: schema version %d of %v", ErrNotFound, version, collection)
+}
+
+// checkCompatibility tells what next breaks of prev
+func checkCompatibility(prev, next Schema, c Compatibility) error {
+	var problems []string
+	for path, f := range next.Fields {
+		if p, ok := prev.Fields[path]; ok && p.Type != "" && f.Type != "" && p.Type != f.Type {
+			problems = append(problems, fmt.Sprintf("%v changes from %v to %v", path, p.Type, f.Type))
+		}
+	}
+	if c == CompatBackward || c == CompatFull {
+		for path, f := range next.Fields {
+			if f.Required && f.Default == nil && !prev.Fields[path].Required {
+				problems = append(problems, fmt.Sprintf("%v is required without a default", path))
+			}
+		}
+	}
+	if c == CompatForward || c == CompatFull {
+		for path, p := range prev.Fields {
+			if p.Required && p.Default == nil && !next.Fields[path].Required {
+				problems = append(problems, fmt.Sprintf("%v was required and has no default", path))
+			}
+		}
+	}
+	if len(problems) == 0 || c == CompatNone {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%v compatibility: %v", c, strings.Join(problems, ", "))
+}
+
+// checkSchema fails writes of records that don't match the latest schema of their
+// collection
+func (d *Driver) checkSchema(collection, resource string, raw []byte) error {
+	collection = d.partitionParent(collection)
+	d.schemaMu.Lock()
+	state, err := d.schemaState(collection)
+	d.schemaMu.Unlock()
+	if err != nil {
+		return err
+	}
+	latest := state.latest()
+	if latest == nil {
+		return nil
+	}
+
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("%w: %v/%v isn't a JSON object", ErrSchemaViolation, collection, resource)
+	}
+	var problems []string
+	for path, f := range latest.Schema.Fields {
+		v, ok := lookup(doc, path)
+		if !ok || v == nil {
+			if f.Required {
+				problems = append(problems, path+" is missing")
+			}
+			continue
+		}
+		if f.Type != "" && jsonType(v) != f.Type {
+			problems = append(problems, fmt.Sprintf("%v is %v, not %v", path, jsonType(v), f.Type))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: %v/%v, version %d: %v", ErrSchemaViolation, collection, resource, latest.Version, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case json.Number, float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return "null"
+}
+
+// hasSchema reports whether writes of a collection are checked
+func (d *Driver) hasSchema(collection string) bool {
+	d.schemaMu.Lock()
+	defer d.schemaMu.Unlock()
+	state, err := d.schemaState(d.partitionParent(collection))
+	return err != nil || state.latest() != nil
+}
+
+func (d *Driver) schemaPath(collection string) string {
+	return filepath.Join(d.dir, schemaDir, d.keyFile(collection)+".json")
+}
+
+// schemaState reads the schemas of a collection, nil if it has none. They're kept in
+// memory after the first read. d.schemaMu has to be held.
+func (d *Driver) schemaState(collection string) (*schemaState, error) {
+	if state, ok := d.schemas[collection]; ok {
+		return state, nil
+	}
+	var state *schemaState
+	b, err := ioutil.ReadFile(d.schemaPath(collection))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		state = &schemaState{}
+		if err := json.Unmarshal(b, state); err != nil {
+			return nil, fmt.Errorf("invalid schemas of %v: %v", collection, err)
+		}
+	}
+	if d.schemas == nil {
+		d.schemas = map[string]*schemaState{}
+	}
+	d.schemas[collection] = state
+	return state, nil
+}
+
+// storeSchemaState writes the schemas of a collection. d.schemaMu has to be held.
+func (d *Driver) storeSchemaState(collection string, state *schemaState) error {
+	path := d.schemaPath(collection)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(path, append(b, '\n')); err != nil {
+		return err
+	}
+	d.schemas[collection] = state
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SeedMode is what Seed does with the records already in the collections it loads
+type SeedMode int
+
+const (
+	// writes over the records of the same name and leaves the others
+	SeedUpsert SeedMode = iota
+	// removes every record of each collection loaded first
+	SeedTruncate
+)
+
+// Seed loads fixtures into the database, from a directory with os.DirFS or from
+// files embedded with embed.FS, and returns how many records it wrote. Each
+// directory is a collection and each .json file in it a record named after the file:
+//
+//	users/alice.json          record alice of users
+//	users/alice/orders/1.json record 1 of the subcollection users/alice/orders
+//	products.json             records of products, an object of them by name
+//
+// A copy of a database directory loads too, the Driver's own files are skipped. The
+// records are written with Write, so indexes, schemas and the rest apply to them.
+func (d *Driver) Seed(fsys fs.FS, mode SeedMode) (int, error) {
+	type fixture struct {
+		collection, resource string
+		record               json.RawMessage
+	}
+	var fixtures []fixture
+	collections := map[string]bool{}
+
+	err := fs.WalkDir(fsys, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if p != "." && (strings.HasPrefix(name, ".") || !strings.Contains(p, "/") && internalDir(name)) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || path.Ext(name) != ".json" || name == metaFile || name == formatFile {
+			return nil
+		}
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+
+		collection, resource := path.Dir(p), strings.TrimSuffix(name, ".json")
+		if collection == "." {
+			// products.json, the records of a collection by name
+			var records map[string]json.RawMessage
+			if err := json.Unmarshal(b, &records); err != nil {
+				return fmt.Errorf("fixture %v isn't an object of records: %v", p, err)
+			}
+			names := make([]string, 0, len(records))
+			for name := range records {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fixtures = append(fixtures, fixture{resource, name, records[name]})
+			}
+			collections[resource] = true
+			return nil
+		}
+		if !json.Valid(b) {
+			return fmt.Errorf("fixture %v isn't valid JSON", p)
+		}
+		fixtures = append(fixtures, fixture{collection, resource, b})
+		collections[collection] = true
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if mode == SeedTruncate {
+		names := make([]string, 0, len(collections))
+		for collection := range collections {
+			names = append(names, collection)
+		}
+		sort.Strings(names)
+		for _, collection := range names {
+			if _, err := d.DeleteWhere(collection, nil); err != nil && !os.IsNotExist(err) {
+				return 0, fmt.Errorf("truncating %v: %w", collection, err)
+			}
+		}
+	}
+
+	written := 0
+	for _, f := range fixtures {
+		if err := d.Write(f.collection, f.resource, f.record); err != nil {
+			return written, fmt.Errorf("seeding %v/%v: %w", f.collection, f.resource, err)
+		}
+		written++
+	}
+	d.logf(LevelInfo, "Seeded database", "operation", "seed", "records", written, "collections", len(collections))
+	return written, nil
+}
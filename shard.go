@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the shard directories of a collection are shardPrefix and the hex number of the
+// shard, users/_a3/john.json
+const shardPrefix = "_"
+
+// shardCount is how many shards the records of collection are spread over, 0 if it
+// isn't sharded. Partitions are sharded like their collection.
+func (d *Driver) shardCount(collection string) int {
+	if n := d.shards[d.partitionParent(collection)]; n > 1 {
+		return n
+	}
+	return 0
+}
+
+// shardName names shard i of n, with as many hex digits as n needs so they sort
+func shardName(i, n int) string {
+	width := len(strconv.FormatInt(int64(n-1), 16))
+	return fmt.Sprintf("%s%0*x", shardPrefix, width, i)
+}
+
+// shardOf picks the shard of a resource by the FNV-1a hash of its name
+func shardOf(resource string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(resource))
+	return int(h.Sum32() % uint32(n))
+}
+
+// isShard tells the shard directories of a collection of n shards apart from the
+// directories of its records' subcollections
+func isShard(name string, n int) bool {
+	i, err := strconv.ParseInt(strings.TrimPrefix(name, shardPrefix), 16, 64)
+	return strings.HasPrefix(name, shardPrefix) && err == nil && i >= 0 && i < int64(n) && shardName(int(i), n) == name
+}
+
+// recordDir is the directory holding the file of a record, its shard in a sharded
+// collection
+func (d *Driver) recordDir(collection, resource string) string {
+	dir := filepath.Join(d.dir, collection)
+	if n := d.shardCount(collection); n > 0 {
+		dir = filepath.Join(dir, shardName(shardOf(resource, n), n))
+	}
+	return dir
+}
+
+// recordFiles reads the files in the directories of a collection's records, every
+// shard of a sharded one. Directories are left out.
+func (d *Driver) recordFiles(collection string) ([]os.FileInfo, error) {
+	dir := filepath.Join(d.dir, collection)
+	if d.lsm != nil {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		return d.lsmRecordFiles(collection)
+	}
+	dirs := []string{dir}
+	if n := d.shardCount(collection); n > 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		dirs = dirs[:0]
+		for i := 0; i < n; i++ {
+			dirs = append(dirs, filepath.Join(dir, shardName(i, n)))
+		}
+	}
+
+	var files []os.FileInfo
+	for _, dir := range dirs {
+		found, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) && len(dirs) > 1 {
+			continue // no record has landed in this shard yet
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range found {
+			if !file.IsDir() {
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
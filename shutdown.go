@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+)
+
+// Shutdown closes the Driver gracefully. New operations fail with ErrClosed from the
+// start; the ones under way, timed out ones still running included, are waited for,
+// then the background workers (TTL janitor, WriteBack flusher, outbox relay,
+// scheduler, follower, raft), and last the watchers are stopped, unflushed writes
+// flushed and the index files released.
+//
+// If ctx ends first Shutdown returns its error, with the Driver still refusing
+// operations. Calling it again, or Close, picks up where it stopped.
+func (d *Driver) Shutdown(ctx context.Context) error {
+	d.opMu.Lock()
+	if !d.stopped {
+		d.stopped = true
+		d.drained = make(chan struct{})
+		if d.inflight == 0 {
+			close(d.drained)
+		}
+	}
+	drained := d.drained
+	d.opMu.Unlock()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	d.closing.Do(func() { close(d.done) })
+	workers := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(workers)
+	}()
+	select {
+	case <-workers:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return d.release()
+}
+
+// enter counts an operation in, unless the Driver is shut down
+func (d *Driver) enter() error {
+	d.opMu.Lock()
+	defer d.opMu.Unlock()
+	if d.stopped {
+		return ErrClosed
+	}
+	d.inflight++
+	return nil
+}
+
+// leave counts an operation out, the last one of a shutdown lets Shutdown go on
+func (d *Driver) leave() {
+	d.opMu.Lock()
+	defer d.opMu.Unlock()
+	if d.inflight--; d.inflight == 0 && d.stopped {
+		close(d.drained)
+	}
+}
+
+// release stops the watchers, flushes and syncs unflushed writes and closes the
+// indexes, once
+func (d *Driver) release() error {
+	d.released.Do(func() {
+		d.closeWatchers()
+		firstErr := d.Flush()
+		if err := d.commitAll(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		if d.lsm != nil {
+			if err := d.lsm.close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		d.imu.Lock()
+		defer d.imu.Unlock()
+		for _, byField := range d.indexes {
+			for _, ix := range byField {
+				if err := ix.close(); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		d.releaseErr = firstErr
+	})
+	return d.releaseErr
+}
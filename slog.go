@@ -0,0 +1,69 @@
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// NewSlogLogger turns a *slog.Logger into a Logger for Options.Logger. What the
+// Driver logs arrives with its fields as attributes, Fatal and Trace log at
+// LevelError+4 and LevelDebug-4 since slog has no such levels.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+const (
+	slogLevelTrace = slog.LevelDebug - 4
+	slogLevelFatal = slog.LevelError + 4
+)
+
+func (s slogLogger) logf(level slog.Level, format string, args ...interface{}) {
+	s.l.Log(context.Background(), level, fmt.Sprintf(format, args...))
+}
+
+func (s slogLogger) Fatal(format string, args ...interface{}) {
+	s.logf(slogLevelFatal, format, args...)
+}
+
+func (s slogLogger) Error(format string, args ...interface{}) {
+	s.logf(slog.LevelError, format, args...)
+}
+
+func (s slogLogger) Warning(format string, args ...interface{}) {
+	s.logf(slog.LevelWarn, format, args...)
+}
+
+func (s slogLogger) Info(format string, args ...interface{}) {
+	s.logf(slog.LevelInfo, format, args...)
+}
+
+func (s slogLogger) Debug(format string, args ...interface{}) {
+	s.logf(slog.LevelDebug, format, args...)
+}
+
+func (s slogLogger) Trace(format string, args ...interface{}) {
+	s.logf(slogLevelTrace, format, args...)
+}
+
+func (s slogLogger) LogFields(level, msg string, keyvals ...interface{}) {
+	l := slog.LevelError
+	switch level {
+	case LevelTrace:
+		l = slogLevelTrace
+	case LevelDebug:
+		l = slog.LevelDebug
+	case LevelInfo:
+		l = slog.LevelInfo
+	case LevelWarning:
+		l = slog.LevelWarn
+	}
+	s.l.Log(context.Background(), l, msg, keyvals...)
+}
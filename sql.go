@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Query runs a small SQL subset against the database, e.g.
+//
+//	SELECT Name, Age FROM users WHERE Company = 'Google' AND Age >= 30 ORDER BY Age DESC LIMIT 10 OFFSET 20
+//
+// WHERE supports =, !=, <>, <, <=, >, >=, IN (...), NOT IN (...), [NOT] BETWEEN x AND y,
+// [NOT] REGEXP 'pattern' (see MatchesRegex), IS [NOT] NULL, AND, OR, NOT and
+// parentheses. Field names may be dotted (Address.City). LIMIT 0 returns no records,
+// as in SQL.
+func (d *Driver) Query(sql string) ([]string, error) {
+	stmt, err := parseSelect(sql)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.none {
+		return nil, nil
+	}
+	return d.Find(stmt.collection, stmt.filter, stmt.opts...)
+}
+
+type selectStmt struct {
+	collection string
+	filter     Filter
+	opts       []QueryOption
+	none       bool // LIMIT 0, where Limit(0) would mean no limit
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(sql string) ([]token, error) {
+	var tokens []token
+	rs := []rune(sql)
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '\'' || r == '"':
+			// quotes are escaped by doubling them, 'O''Brien'
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(rs); j++ {
+				if rs[j] == r {
+					if j+1 < len(rs) && rs[j+1] == r {
+						sb.WriteRune(r)
+						j++
+						continue
+					}
+					break
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("unterminated string in query at %d", i)
+			}
+			tokens = append(tokens, token{tokString, sb.String()})
+			i = j + 1
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, string(rs[i:j])})
+			i = j
+
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, string(rs[i:j])})
+			i = j
+
+		default:
+			// two character operators first
+			if i+1 < len(rs) {
+				if op := string(rs[i : i+2]); op == "<=" || op == ">=" || op == "!=" || op == "<>" {
+					tokens = append(tokens, token{tokSymbol, op})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("=<>(),*;", r) {
+				return nil, fmt.Errorf("unexpected %q in query at %d", r, i)
+			}
+			tokens = append(tokens, token{tokSymbol, string(r)})
+			i++
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+type sqlParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *sqlParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the next token if it is the (case insensitive) keyword kw
+func (p *sqlParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokIdent && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) symbol(s string) bool {
+	if t := p.peek(); t.kind == tokSymbol && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expect(kw string) error {
+	if !p.keyword(kw) {
+		return fmt.Errorf("expected %v in query, got %q", kw, p.peek().text)
+	}
+	return nil
+}
+
+func (p *sqlParser) ident() (string, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return "", fmt.Errorf("expected a name in query, got %q", t.text)
+	}
+	return t.text, nil
+}
+
+func parseSelect(sql string) (*selectStmt, error) {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{tokens: tokens}
+	stmt := &selectStmt{}
+
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	if !p.symbol("*") {
+		var fields []string
+		for {
+			f, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		stmt.opts = append(stmt.opts, Select(fields...))
+	}
+
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	if stmt.collection, err = p.ident(); err != nil {
+		return nil, err
+	}
+
+	if p.keyword("WHERE") {
+		if stmt.filter, err = p.orExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			f, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			dir := Asc
+			if p.keyword("DESC") {
+				dir = Desc
+			} else {
+				p.keyword("ASC")
+			}
+			stmt.opts = append(stmt.opts, OrderBy(f, dir))
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || n < 0 {
+			return nil, fmt.Errorf("LIMIT needs a whole number, got %q", t.text)
+		}
+		stmt.opts = append(stmt.opts, Limit(n))
+		stmt.none = n == 0
+	}
+	if p.keyword("OFFSET") {
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || n < 0 {
+			return nil, fmt.Errorf("OFFSET needs a whole number, got %q", t.text)
+		}
+		stmt.opts = append(stmt.opts, Offset(n))
+	}
+
+	p.symbol(";")
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at the end of query", t.text)
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) orExpr() (Filter, error) {
+	left, err := p.andExpr()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.andExpr()
+		if err != nil {
+			return nil, err
+		}
+		left = Or(left, right)
+	}
+	return left, nil
+}
+
+func (p *sqlParser) andExpr() (Filter, error) {
+	left, err := p.notExpr()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.notExpr()
+		if err != nil {
+			return nil, err
+		}
+		left = And(left, right)
+	}
+	return left, nil
+}
+
+func (p *sqlParser) notExpr() (Filter, error) {
+	if p.keyword("NOT") {
+		f, err := p.notExpr()
+		if err != nil {
+			return nil, err
+		}
+		return Not(f), nil
+	}
+	if p.symbol("(") {
+		f, err := p.orExpr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, fmt.Errorf("missing ) in query")
+		}
+		return f, nil
+	}
+	return p.comparison()
+}
+
+func (p *sqlParser) comparison() (Filter, error) {
+	field, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword("IS") {
+		not := p.keyword("NOT")
+		if err := p.expect("NULL"); err != nil {
+			return nil, err
+		}
+		// a missing field counts as NULL, like it does in most document stores
+		isNull := Or(Exists(field, false), Eq(field, nil))
+		if not {
+			return Not(isNull), nil
+		}
+		return isNull, nil
+	}
+
+	not := p.keyword("NOT")
+	if p.keyword("IN") {
+		if !p.symbol("(") {
+			return nil, fmt.Errorf("IN needs a list of values in ( )")
+		}
+		var values []interface{}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if !p.symbol(")") {
+			return nil, fmt.Errorf("missing ) after IN list")
+		}
+		if not {
+			return Not(In(field, values...)), nil
+		}
+		return In(field, values...), nil
+	}
+	if p.keyword("BETWEEN") {
+		// both ends included, a B-tree index on the field answers it as one range
+		lo, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("AND"); err != nil {
+			return nil, err
+		}
+		hi, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		between := And(Gte(field, lo), Lte(field, hi))
+		if not {
+			return Not(between), nil
+		}
+		return between, nil
+	}
+	if p.keyword("REGEXP") {
+		t := p.next()
+		if t.kind != tokString {
+			return nil, fmt.Errorf("REGEXP needs a quoted pattern, got %q", t.text)
+		}
+		f, err := MatchesRegex(field, t.text)
+		if err != nil {
+			return nil, err
+		}
+		if not {
+			return Not(f), nil
+		}
+		return f, nil
+	}
+	if not {
+		return nil, fmt.Errorf("expected IN, BETWEEN or REGEXP after NOT, got %q", p.peek().text)
+	}
+
+	op := p.next()
+	if op.kind != tokSymbol {
+		return nil, fmt.Errorf("expected a comparison after %v, got %q", field, op.text)
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.text {
+	case "=":
+		return Eq(field, v), nil
+	case "!=", "<>":
+		return Ne(field, v), nil
+	case "<":
+		return Lt(field, v), nil
+	case "<=":
+		return Lte(field, v), nil
+	case ">":
+		return Gt(field, v), nil
+	case ">=":
+		return Gte(field, v), nil
+	}
+	return nil, fmt.Errorf("unknown comparison %q", op.text)
+}
+
+func (p *sqlParser) value() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return t.text, nil
+	case tokNumber:
+		return json.Number(t.text), nil
+	case tokIdent:
+		switch strings.ToUpper(t.text) {
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		case "NULL":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("expected a value in query, got %q", t.text)
+}
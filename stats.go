@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes what a database holds, see Driver.Stats
+type Stats struct {
+	Collections map[string]CollectionStats
+
+	Records   int
+	Size      int64 // bytes on disk, indexes included
+	IndexSize int64
+}
+
+type CollectionStats struct {
+	Records  int
+	Size     int64     // bytes on disk of records, their chunks and attachments
+	Modified time.Time // of the most recently written record file
+
+	// how often the collection was locked for a write, how many of those had to wait
+	// for another writer and for how long altogether
+	Locks     uint64
+	Contended uint64
+	LockWait  time.Duration
+}
+
+// Stats walks the database directory and reports records, sizes and lock contention
+// per collection. Records written in WriteBack mode count before they're flushed,
+// their bytes only once they are.
+func (d *Driver) Stats() (Stats, error) {
+	stats := Stats{Collections: map[string]CollectionStats{}}
+
+	collections, err := d.Collections()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, collection := range collections {
+		cs, err := d.collectionStats(collection)
+		if err != nil {
+			return stats, err
+		}
+		stats.Collections[collection] = cs
+		stats.Records += cs.Records
+		stats.Size += cs.Size
+	}
+
+	stats.IndexSize, err = dirSize(filepath.Join(d.dir, indexDir))
+	if err != nil {
+		return stats, err
+	}
+	stats.Size += stats.IndexSize
+	return stats, nil
+}
+
+func (d *Driver) collectionStats(collection string) (CollectionStats, error) {
+	var cs CollectionStats
+
+	names, err := d.listRecords(collection)
+	if err != nil && !os.IsNotExist(err) {
+		return cs, err
+	}
+	cs.Records = len(names)
+
+	dir := filepath.Join(d.dir, collection)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return cs, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			size, err := dirSize(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return cs, err
+			}
+			cs.Size += size
+			continue
+		}
+
+		cs.Size += file.Size()
+	}
+	records, err := d.recordFiles(collection)
+	if err != nil && !os.IsNotExist(err) {
+		return cs, err
+	}
+	for _, file := range records {
+		if _, ok := d.recordName(file.Name()); ok && file.ModTime().After(cs.Modified) {
+			cs.Modified = file.ModTime()
+		}
+	}
+
+	d.mutex.Lock()
+	m := d.mutexes[collection]
+	d.mutex.Unlock()
+	if m != nil {
+		cs.Locks = atomic.LoadUint64(&m.locks)
+		cs.Contended = atomic.LoadUint64(&m.contended)
+		cs.LockWait = time.Duration(atomic.LoadInt64(&m.waited))
+	}
+	return cs, nil
+}
+
+// dirSize adds up the sizes of the files below dir, 0 if it doesn't exist
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ReadStream opens a record for reading without loading it into memory, for sending
+// large documents on to a client. The caller has to Close it. A Write happening
+// meanwhile doesn't affect the stream, which keeps reading the version it opened.
+// Records of collections with Options.Redact are read whole to be masked, unless
+// read Unredacted.
+func (d *Driver) ReadStream(collection, resource string, opts ...QueryOption) (io.ReadCloser, error) {
+	r, err := d.timed("read_stream", collection, resource, func() (interface{}, error) {
+		return d.readStream(collection, resource, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.(io.ReadCloser), nil
+}
+
+func (d *Driver) readStream(collection, resource string, opts ...QueryOption) (_ io.ReadCloser, err error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return nil, err
+	}
+	if collection == "" {
+		return nil, fmt.Errorf("%w - unable to read!", ErrEmptyCollection)
+	}
+
+	if resource == "" {
+		return nil, fmt.Errorf("%w - unable to read record!", ErrEmptyResource)
+	}
+	defer func() { err = notFound("read", collection, resource, err) }()
+	if collection, err = d.partitionFor(collection, resource); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err == nil {
+			err = d.auditRead("", opRead, collection, []string{resource})
+		}
+	}()
+
+	path := d.recordPath(collection, resource)
+	if !d.mayExist(collection, resource) {
+		return nil, notExist(path)
+	}
+
+	// masking takes the whole record
+	if q := newQuery(opts); d.redacts(collection, q) {
+		r, err := d.loadRecord(collection, resource)
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.redact(collection, r.raw, q)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+
+	// cached (or not flushed yet) records are already in memory
+	if d.cache != nil {
+		if r, ok := d.cache.get(cacheKey(collection, resource)); ok {
+			return ioutil.NopCloser(bytes.NewReader(r.raw)), nil
+		}
+	}
+	// and LSMEngine records are read whole
+	if d.lsm != nil {
+		r, err := d.loadRecord(collection, resource)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(r.raw)), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(chunkMagic))
+	if n, _ := io.ReadFull(f, magic); !isChunked(magic[:n]) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	manifest, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return d.openChunks(collection, resource, append(magic, manifest...))
+}
+
+// WriteStream stores already encoded JSON read from r as a record, going through the
+// same tmp file + rename as Write without holding the whole document in memory. The
+// content is checked to be a single JSON value on the way. Collections with indexes
+// still read the record back once to index it. After a TimeoutError r may still be
+// read, by the write left to finish in the background.
+func (d *Driver) WriteStream(collection, resource string, r io.Reader) error {
+	_, err := d.timed("write_stream", collection, resource, func() (interface{}, error) {
+		return nil, d.writeStream(collection, resource, r)
+	})
+	return err
+}
+
+func (d *Driver) writeStream(collection, resource string, r io.Reader) (err error) {
+	deadline := d.deadline()
+	collection, resource = d.fold(collection, resource)
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if collection == "" {
+		return fmt.Errorf("%w - no place to save record!", ErrEmptyCollection)
+	}
+
+	if resource == "" {
+		return fmt.Errorf("%w - unable to save record (no name)!", ErrEmptyResource)
+	}
+
+	if err := d.checkNames(collection, resource); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			err = d.awaitCommit(collection)
+		}
+	}()
+	if _, ok := d.partitions[collection]; ok {
+		// routing takes the timestamp, so the record is read whole; the partition
+		// and its quota aren't known yet, only Options.MaxRecordSize is
+		b, err := ioutil.ReadAll(d.recordSizeLimit(collection, resource).reader(r))
+		if err != nil {
+			return err
+		}
+		return d.writePartitioned(collection, resource, json.RawMessage(b))
+	}
+
+	mutex := d.lockFor(collection)
+	if _, err := mutex.lockBy(deadline); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+
+	dir := d.recordDir(collection, resource)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	fnlPath := filepath.Join(dir, d.recordFile(resource))
+	tmpPath := fnlPath + ".tmp"
+
+	limit, err := d.sizeLimit(collection, resource)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	// cut off once over the limit rather than spooled whole and checked after
+	lr := limit.reader(r)
+	err = validateJSONStream(io.TeeReader(lr, f))
+	if lr, ok := lr.(*limitedReader); ok && lr.over {
+		err = limit.err
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// hashing takes the whole record, written back over the tmp file
+	if paths := d.hashPaths(collection, nil); len(paths) > 0 {
+		if err := d.hashFile(tmpPath, paths); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	var b []byte
+	var stamps *crdtMeta
+	if len(d.collectionIndexes(collection)) > 0 || d.isCRDT(collection) || d.hasSchema(collection) {
+		if b, err = ioutil.ReadFile(tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := d.checkSchema(collection, resource, b); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := d.checkUnique(collection, resource, b); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if d.isCRDT(collection) {
+		if stamps, err = d.stampWrite(collection, resource, b); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	fi, err := os.Stat(tmpPath)
+	if err != nil {
+		return err
+	}
+	delta, err := d.checkQuota(collection, resource, fi.Size())
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	created := !d.recordExists(collection, resource)
+	if err := d.renameStreamed(collection, resource, tmpPath, fi.Size()); err != nil {
+		return err
+	}
+	if stamps != nil {
+		if err := d.writeCRDTMeta(collection, resource, stamps); err != nil {
+			return err
+		}
+	}
+	if d.vclocks {
+		if err := d.tickClock(collection, resource); err != nil {
+			return err
+		}
+	}
+	d.notify(ChangeWrite, collection, resource, nil)
+	d.addUsage(collection, delta)
+	if created {
+		if err := d.addRecordCount(collection, 1); err != nil {
+			return err
+		}
+	}
+	d.uncache(collection, resource) // also drops an unflushed WriteBack copy
+	d.bloomAdd(collection, resource)
+	d.keyAdd(collection, resource)
+
+	if b == nil {
+		return nil
+	}
+	return d.reindex(collection, resource, b)
+}
+
+// renameStreamed moves a streamed record in place, splitting it up first if it's over
+// Options.ChunkSize
+func (d *Driver) renameStreamed(collection, resource, tmpPath string, size int64) error {
+	if d.lsm != nil {
+		defer os.Remove(tmpPath)
+		b, err := ioutil.ReadFile(tmpPath)
+		if err != nil {
+			return err
+		}
+		return d.writeRecordFile(collection, resource, b)
+	}
+	if d.chunkSize <= 0 || size <= d.chunkSize {
+		path := d.recordPath(collection, resource)
+		if d.durable {
+			// synced before it replaces the record, see writeSynced
+			if err := syncPath(tmpPath); err != nil {
+				return err
+			}
+		}
+		if err := d.withRetry(func() error { return os.Rename(tmpPath, path) }); err != nil {
+			return err
+		}
+		if err := d.syncWritten(collection, path); err != nil {
+			return err
+		}
+		return d.dropOldChunks(collection, resource, "")
+	}
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	return d.writeChunks(collection, resource, f, size)
+}
+
+// reader is r failing with the error of l once it read more than l.max bytes
+func (l sizeLimit) reader(r io.Reader) io.Reader {
+	if l.err == nil {
+		return r
+	}
+	max := l.max
+	if max < 0 {
+		max = 0 // over quota already
+	}
+	return &limitedReader{r: io.LimitReader(r, max+1), left: max, err: l.err}
+}
+
+type limitedReader struct {
+	r    io.Reader
+	left int64
+	err  error
+	over bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.over {
+		return 0, l.err
+	}
+	n, err := l.r.Read(p)
+	if l.left -= int64(n); l.left < 0 {
+		l.over = true
+		return n, l.err
+	}
+	return n, err
+}
+
+// validateJSONStream reads r to the end and fails unless it holds exactly one JSON
+// value. It works token by token, so only small parts of r are ever in memory.
+func validateJSONStream(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	depth, values := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid JSON in stream: %v", err)
+		}
+
+		if delim, ok := tok.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				depth++
+				continue
+			default:
+				depth--
+			}
+		}
+		if depth == 0 {
+			values++
+		}
+		if values > 1 {
+			return fmt.Errorf("invalid JSON in stream: more than one value")
+		}
+	}
+
+	if values == 0 || depth != 0 {
+		return fmt.Errorf("invalid JSON in stream: no complete value")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Subcollection names a collection nested under a record, which works like any other
+// collection:
+//
+//	orders := Subcollection("users", "john", "orders") // "users/john/orders"
+//	db.Write(orders, "42", order)
+//	db.ReadAll(orders)
+//
+// It's kept in a directory named after the record, next to its file. Deleting the
+// record leaves its subcollections, deleting the collection takes them along.
+func Subcollection(collection, resource, name string) string {
+	return collection + "/" + resource + "/" + name
+}
+
+// checkCollectionName accepts the names of collections and of subcollections,
+// collection/resource/name with any number of levels
+func (d *Driver) checkCollectionName(collection string) error {
+	parts := strings.Split(collection, "/")
+	for i, part := range parts {
+		if !pathSegment(part) {
+			return fmt.Errorf("%w: collection %q", ErrInvalidName, collection)
+		}
+		if len(part) > maxFileName {
+			return fmt.Errorf("%w: collection %q is %d bytes long, the limit is %d", ErrInvalidName, part, len(part), maxFileName)
+		}
+		if i%2 == 1 {
+			if err := d.checkResourceName(part); err != nil {
+				return err
+			}
+			if n := d.shardCount(strings.Join(parts[:i], "/")); n > 0 && isShard(part, n) {
+				return fmt.Errorf("%w: collection %q, %v is a shard of %v", ErrInvalidName, collection, part, strings.Join(parts[:i], "/"))
+			}
+		} else if strings.HasSuffix(part, attachmentSuffix) || strings.HasSuffix(part, chunkSuffix) {
+			return fmt.Errorf("%w: collection %q, %v and %v are taken", ErrInvalidName, collection, attachmentSuffix, chunkSuffix)
+		}
+	}
+	if len(parts)%2 == 0 && !d.isPartition(collection) {
+		return fmt.Errorf("%w: collection %q, a subcollection is collection/resource/name", ErrInvalidName, collection)
+	}
+	if internalDir(parts[0]) {
+		return fmt.Errorf("%w: %v is reserved for the database", ErrInvalidName, parts[0])
+	}
+	return nil
+}
+
+// pathSegment tells the parts of collection paths, which are directory names as they
+// are
+func pathSegment(part string) bool {
+	return part != "" && part != "." && part != ".." && !strings.ContainsAny(part, "\\\x00")
+}
+
+// Subcollections lists the subcollections of a record by name, sorted
+func (d *Driver) Subcollections(collection, resource string) ([]string, error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return nil, err
+	}
+	if !pathSegment(resource) || strings.Contains(resource, "/") {
+		return nil, nil // can't have any
+	}
+	if collection == "" || resource == "" {
+		return nil, missingName(collection, "unable to list subcollections")
+	}
+	files, err := ioutil.ReadDir(filepath.Join(d.dir, collection, resource))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	parent := collection + "/" + resource + "/"
+	seen := map[string]bool{}
+	var names []string
+	for _, file := range files {
+		if file.IsDir() {
+			seen[file.Name()] = true
+			names = append(names, file.Name())
+		}
+	}
+	// only written to the WriteBack cache so far
+	for _, c := range d.dirtyCollections() {
+		if name := strings.TrimPrefix(c, parent); name != c && !strings.Contains(name, "/") && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// nestedCollections lists the subcollections under a collection at every level, the
+// deepest first, so they can be dropped before the collections holding them
+func (d *Driver) nestedCollections(collection string) ([]string, error) {
+	root := filepath.Join(d.dir, collection)
+	seen := map[string]bool{}
+	var nested []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || path == root {
+			return nil
+		}
+		if name := info.Name(); strings.HasSuffix(name, attachmentSuffix) || strings.HasSuffix(name, chunkSuffix) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		// holds records, and their attachments and chunks
+		if n := d.shardCount(filepath.ToSlash(filepath.Dir(rel))); n > 0 && isShard(info.Name(), n) {
+			return filepath.SkipDir
+		}
+		// collection/resource/name, the directories of records in between, or the
+		// partitions of a partitioned collection
+		if strings.Count(rel, "/")%2 == 0 || d.isPartition(rel) {
+			seen[rel] = true
+			nested = append(nested, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range d.dirtyCollections() {
+		if strings.HasPrefix(c, collection+"/") && !seen[c] {
+			nested = append(nested, c)
+		}
+	}
+	sort.SliceStable(nested, func(i, j int) bool {
+		return strings.Count(nested[i], "/") > strings.Count(nested[j], "/")
+	})
+	return nested, nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// where SyncWith keeps what each record looked like after the last sync with a
+// directory, to tell changes on one side from changes on the other
+const syncDir = "_sync"
+
+// SyncStrategy decides records changed on both sides since the last sync
+type SyncStrategy int
+
+const (
+	// last writer wins: the version written last, a change wins over a delete
+	SyncNewest SyncStrategy = iota
+	// the Driver's version wins, the client's with SyncRemote
+	SyncOurs
+	// the other directory's version wins, the server's with SyncRemote
+	SyncTheirs
+	// Options.ResolveConflict merges the versions
+	SyncMerge
+)
+
+// Conflict is a record changed on both sides since the last sync. A nil version is
+// a delete.
+type Conflict struct {
+	Collection string
+	Resource   string
+	Ours       json.RawMessage // the Driver's, the client's with SyncRemote
+	Theirs     json.RawMessage
+	OursTime   time.Time // when the versions were written
+	TheirsTime time.Time
+
+	// with Options.VectorClocks, clocks neither of which descends the other
+	OursClock   VectorClock
+	TheirsClock VectorClock
+}
+
+// ConflictResolver returns the merged version of a conflicting record, nil to
+// delete it. An error fails the sync.
+type ConflictResolver func(c Conflict) (json.RawMessage, error)
+
+// SyncResult counts what SyncWith did
+type SyncResult struct {
+	Pulled    int // records written or deleted here from the other directory
+	Pushed    int // records written or deleted there from here
+	Conflicts int // records changed on both sides, settled by the strategy
+}
+
+// syncBase is what both sides agreed on after the last sync, hashes by
+// collection/resource
+type syncBase struct {
+	Other   string            `json:"other"`
+	Time    time.Time         `json:"time"`
+	Token   string            `json:"token,omitempty"` // of the server, for SyncRemote
+	Records map[string]string `json:"records"`
+}
+
+// syncSide is a version of a record on one side
+type syncSide struct {
+	raw     []byte
+	hash    string // empty if there's no record
+	modTime time.Time
+	clock   VectorClock // with Options.VectorClocks
+}
+
+// SyncWith reconciles the database with the one in otherDir, say on a laptop and
+// on a server share: records new, changed or deleted on one side since the last
+// sync are copied to the other, and records changed on both go by strategy. The
+// other directory is created if needed and must not be in use while syncing.
+// CRDT collections are merged with MergeCRDT both ways instead.
+func (d *Driver) SyncWith(otherDir string, strategy SyncStrategy) (SyncResult, error) {
+	var result SyncResult
+	if err := d.writable(); err != nil {
+		return result, err
+	}
+
+	otherDir, err := filepath.Abs(otherDir)
+	if err != nil {
+		return result, err
+	}
+	var crdt []string
+	for collection := range d.crdtCollections {
+		crdt = append(crdt, collection)
+	}
+	other, err := New(otherDir, &Options{Logger: d.log, CRDTCollections: crdt, VectorClocks: d.vclocks})
+	if err != nil {
+		return result, err
+	}
+	defer other.Close()
+
+	base, err := d.readSyncBase(otherDir)
+	if err != nil {
+		return result, err
+	}
+	next := syncBase{Other: otherDir, Time: time.Now(), Records: map[string]string{}}
+
+	collections, err := unionCollections(d, other)
+	if err != nil {
+		return result, err
+	}
+	for _, collection := range collections {
+		if d.isCRDT(collection) {
+			pulled, err := d.mergeCRDTCollection(other, collection)
+			result.Pulled += pulled
+			if err != nil {
+				return result, err
+			}
+			pushed, err := other.mergeCRDTCollection(d, collection)
+			result.Pushed += pushed
+			if err != nil {
+				return result, err
+			}
+			continue
+		}
+		if err := d.syncCollection(other, collection, base, &next, strategy, &result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, d.writeSyncBase(next)
+}
+
+func unionCollections(a, b *Driver) ([]string, error) {
+	ours, err := a.Collections()
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := b.Collections()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, collection := range ours {
+		seen[collection] = true
+	}
+	for _, collection := range theirs {
+		if !seen[collection] {
+			ours = append(ours, collection)
+		}
+	}
+	sort.Strings(ours)
+	return ours, nil
+}
+
+func (d *Driver) syncCollection(other *Driver, collection string, base syncBase, next *syncBase, strategy SyncStrategy, result *SyncResult) error {
+	ours := d.lockFor(collection)
+	ours.Lock()
+	defer ours.Unlock()
+	theirs := other.lockFor(collection)
+	theirs.Lock()
+	defer theirs.Unlock()
+
+	names := map[string]bool{}
+	for _, db := range []*Driver{d, other} {
+		list, err := db.listRecords(collection)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, name := range list {
+			names[name] = true
+		}
+	}
+	prefix := collection + "/"
+	for key := range base.Records {
+		if strings.HasPrefix(key, prefix) {
+			names[strings.TrimPrefix(key, prefix)] = true
+		}
+	}
+
+	for name := range names {
+		key := prefix + name
+		our, err := d.syncSide(collection, name)
+		if err != nil {
+			return err
+		}
+		their, err := other.syncSide(collection, name)
+		if err != nil {
+			return err
+		}
+		was := base.Records[key]
+
+		var winner syncSide
+		switch {
+		case our.hash == their.hash:
+			if our.hash != "" {
+				next.Records[key] = our.hash
+			}
+			continue
+		case our.hash == was:
+			winner = their
+		case their.hash == was:
+			winner = our
+		default:
+			var ok bool
+			if winner, ok = causal(our, their); ok {
+				break
+			}
+			result.Conflicts++
+			if winner, err = d.settle(strategy, collection, name, our, their); err != nil {
+				return err
+			}
+		}
+		if winner.clock, err = d.settledClock(our, their, winner); err != nil {
+			return err
+		}
+
+		if winner.hash != our.hash {
+			if err := d.syncApply(collection, name, winner); err != nil {
+				return err
+			}
+			result.Pulled++
+		} else if err := d.takeClock(collection, name, winner.clock); err != nil {
+			return err
+		}
+		if winner.hash != their.hash {
+			if err := other.syncApply(collection, name, winner); err != nil {
+				return err
+			}
+			result.Pushed++
+		} else if err := other.takeClock(collection, name, winner.clock); err != nil {
+			return err
+		}
+		if winner.hash != "" {
+			next.Records[key] = winner.hash
+		}
+	}
+	return nil
+}
+
+// settle returns the version a record changed on both sides ends up as
+func (d *Driver) settle(strategy SyncStrategy, collection, resource string, our, their syncSide) (syncSide, error) {
+	switch strategy {
+	case SyncOurs:
+		return our, nil
+	case SyncTheirs:
+		return their, nil
+	case SyncMerge:
+		if d.resolveConflict == nil {
+			return our, fmt.Errorf("SyncMerge needs Options.ResolveConflict")
+		}
+		merged, err := d.resolveConflict(Conflict{
+			Collection: collection, Resource: resource,
+			Ours: our.raw, Theirs: their.raw,
+			OursTime: our.modTime, TheirsTime: their.modTime,
+			OursClock: our.clock, TheirsClock: their.clock,
+		})
+		if err != nil {
+			return our, &RecordError{Op: "sync", Collection: collection, Resource: resource, Err: conflictError{err}}
+		}
+		s := syncSide{modTime: time.Now()}
+		if merged != nil {
+			if !json.Valid(merged) {
+				return our, &RecordError{Op: "sync", Collection: collection, Resource: resource, Err: fmt.Errorf("%w merged into invalid JSON", ErrConflict)}
+			}
+			s.raw, s.hash = merged, syncHash(merged)
+		}
+		return s, nil
+	}
+
+	// deletes have no time, a surviving version beats them
+	if our.hash == "" {
+		return their, nil
+	}
+	if their.hash == "" || !their.modTime.After(our.modTime) {
+		return our, nil
+	}
+	return their, nil
+}
+
+// syncSide reads a record's version for SyncWith. The collection has to be locked.
+func (d *Driver) syncSide(collection, resource string) (syncSide, error) {
+	var s syncSide
+	if d.vclocks {
+		var err error
+		if s.clock, err = d.readClock(collection, resource); err != nil {
+			return s, err
+		}
+	}
+	r, err := d.loadRecord(collection, resource)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	s.raw, s.hash = r.raw, syncHash(r.raw)
+	if fi, err := d.statRecord(collection, resource); err == nil {
+		s.modTime = fi.ModTime()
+	} else {
+		s.modTime = time.Now() // not flushed yet, so it's the latest
+	}
+	return s, nil
+}
+
+// syncHash hashes a record whatever its formatting, records sent over HTTP arrive
+// compacted
+func syncHash(raw []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		buf.Reset()
+		buf.Write(raw)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// syncApply makes a record look like the winning side's version. The collection has
+// to be locked.
+func (d *Driver) syncApply(collection, resource string, s syncSide) error {
+	if s.hash == "" {
+		if _, err := d.removeRecord(collection, resource); err != nil {
+			return err
+		}
+		return d.takeClock(collection, resource, s.clock)
+	}
+	if err := os.MkdirAll(d.recordDir(collection, resource), 0755); err != nil {
+		return err
+	}
+	// stored the way Write stores records
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, s.raw, "", "\t"); err != nil {
+		return fmt.Errorf("invalid record %v/%v: %v", collection, resource, err)
+	}
+	buf.WriteByte('\n')
+	if err := d.storeRecord(collection, resource, buf.Bytes()); err != nil {
+		return err
+	}
+	return d.takeClock(collection, resource, s.clock)
+}
+
+func (d *Driver) syncBasePath(otherDir string) string {
+	sum := sha256.Sum256([]byte(otherDir))
+	return filepath.Join(d.dir, syncDir, hex.EncodeToString(sum[:8])+".json")
+}
+
+func (d *Driver) readSyncBase(otherDir string) (syncBase, error) {
+	base := syncBase{Records: map[string]string{}}
+	b, err := ioutil.ReadFile(d.syncBasePath(otherDir))
+	if os.IsNotExist(err) {
+		return base, nil
+	}
+	if err != nil {
+		return base, err
+	}
+	if err := json.Unmarshal(b, &base); err != nil {
+		return base, fmt.Errorf("invalid sync state for %v: %v", otherDir, err)
+	}
+	return base, nil
+}
+
+func (d *Driver) writeSyncBase(base syncBase) error {
+	path := d.syncBasePath(base.Other)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(base)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, b)
+}
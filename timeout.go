@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// TimeoutError is the error of an operation that ran past Options.OperationTimeout.
+// errors.Is reports it as ErrTimeout, and like the errors of net it has a Timeout
+// method.
+type TimeoutError struct {
+	Op         string // "write", "read", "find", ...
+	Collection string
+	Resource   string
+	After      time.Duration
+
+	// Pending is set for writes and deletes, which may still be made in the background
+	// after timing out: whether one landed is unknown, read the record again rather
+	// than take it as not made.
+	Pending bool
+}
+
+func (e *TimeoutError) Error() string {
+	name := e.Collection
+	if e.Resource != "" {
+		name += "/" + e.Resource
+	}
+	if e.Pending {
+		return fmt.Sprintf("%v %v: %v after %v, it may still be made", e.Op, name, ErrTimeout, e.After)
+	}
+	return fmt.Sprintf("%v %v: %v after %v", e.Op, name, ErrTimeout, e.After)
+}
+
+// the operations of timed that change records, which may land after timing out
+var pendingOps = map[string]bool{
+	"write":        true,
+	"write_stream": true,
+	"delete":       true,
+	"delete_where": true,
+	"update_where": true,
+}
+
+func (e *TimeoutError) Is(target error) bool { return target == ErrTimeout }
+func (e *TimeoutError) Timeout() bool        { return true }
+
+// timed runs fn, an operation on collection (or one of its records), for at most
+// Options.OperationTimeout. The I/O of a hung mount can't be interrupted, so an
+// operation that times out is left to finish in the background, without the
+// caller, which gets a TimeoutError; one still waiting for its collection lock gives
+// up on it, see lockBy. A result coming too late that's an io.Closer is closed.
+// fn mustn't write to memory of the caller, see timedDecode.
+// Operations are counted in and out here for Shutdown, and refused after it.
+func (d *Driver) timed(op, collection, resource string, fn func() (interface{}, error)) (interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, &RecordError{Op: op, Collection: collection, Resource: resource, Err: err}
+	}
+	if d.opTimeout <= 0 {
+		defer d.leave()
+		return fn()
+	}
+
+	type result struct {
+		v     interface{}
+		err   error
+		panic interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() {
+			res.panic = recover()
+			d.leave()
+			done <- res
+		}()
+		res.v, res.err = fn()
+	}()
+
+	timer := time.NewTimer(d.opTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		if res.panic != nil {
+			panic(res.panic) // in the goroutine of the caller, who may recover it
+		}
+		return res.v, res.err
+	case <-timer.C:
+	}
+
+	go func() {
+		if c, ok := (<-done).v.(io.Closer); ok {
+			c.Close()
+		}
+	}()
+	d.logf(LevelWarning, "Operation timed out", "operation", op, "collection", collection, "resource", resource, "timeout", d.opTimeout)
+	return nil, &TimeoutError{Op: op, Collection: collection, Resource: resource, After: d.opTimeout, Pending: pendingOps[op]}
+}
+
+// timedDecode is timed for an operation decoding into v. When it can time out, fn
+// decodes into a private value instead, copied into v once it returned in time, so
+// an operation left to finish in the background doesn't write to v after its caller
+// moved on. v may be nil for fn to decode nothing.
+func (d *Driver) timedDecode(op, collection, resource string, v interface{}, fn func(v interface{}) (interface{}, error)) (interface{}, error) {
+	if d.opTimeout <= 0 || v == nil {
+		return d.timed(op, collection, resource, func() (interface{}, error) {
+			return fn(v)
+		})
+	}
+
+	raw := new(json.RawMessage)
+	out, err := d.timed(op, collection, resource, func() (interface{}, error) {
+		return fn(raw)
+	})
+	if err != nil {
+		return out, err
+	}
+	return out, json.Unmarshal(*raw, v)
+}
+
+// deadline is when an operation starting now times out, zero without
+// Options.OperationTimeout
+func (d *Driver) deadline() time.Time {
+	if d.opTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d.opTimeout)
+}
+
+// lockBy is lockWait giving up at deadline, so an operation that timed out doesn't
+// take the lock (and write) long after its caller was told it failed. A zero
+// deadline waits as long as it takes.
+func (m *collectionMutex) lockBy(deadline time.Time) (time.Duration, error) {
+	if deadline.IsZero() {
+		return m.lockWait(), nil
+	}
+
+	// sync.Mutex can't be waited for with a timeout, so a goroutine waits for it
+	locked := make(chan time.Duration, 1)
+	go func() { locked <- m.lockWait() }()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case waited := <-locked:
+		return waited, nil
+	case <-timer.C:
+		go func() {
+			<-locked
+			m.Unlock() // handed straight back once it comes
+		}()
+		return 0, fmt.Errorf("%w waiting for the collection lock", ErrTimeout)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the points of a time series are appended to a file per period, one JSON object a
+// line: metrics/2024-06-01.points
+const pointsSuffix = ".points"
+
+// Point is a measurement of a time series
+type Point struct {
+	Time   time.Time          `json:"time"`
+	Tags   map[string]string  `json:"tags,omitempty"` // host, region and the like
+	Values map[string]float64 `json:"values"`
+}
+
+// TimeSeries makes a collection a store of Points, see Options.TimeSeries. Points are
+// added with Append and read with Range, the collection's records are left alone.
+// Points aren't replicated to followers or cluster members.
+type TimeSeries struct {
+	// how much time a file of points covers, a day by default
+	Period PartitionPeriod
+
+	// how long points are kept, forever if 0. They're dropped a file at a time by the
+	// TTL sweeper, once all of its period is older.
+	Retention time.Duration
+}
+
+// Append adds points to a time series. Points without a Time are taken as now. The
+// points can come in any order, Range sorts them.
+func (d *Driver) Append(collection string, points ...Point) error {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return err
+	}
+	ts, ok := d.timeSeries[collection]
+	if !ok {
+		return fmt.Errorf("%v isn't a time series, see Options.TimeSeries", collection)
+	}
+	if d.cluster() != nil {
+		return fmt.Errorf("time series aren't replicated, Append needs a Driver outside a cluster")
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	// whole lines per file, written at once
+	now := time.Now()
+	files := map[string]*bytes.Buffer{}
+	for _, p := range points {
+		if p.Time.IsZero() {
+			p.Time = now
+		}
+		b, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		name := p.Time.UTC().Format(ts.Period.layout()) + pointsSuffix
+		if files[name] == nil {
+			files[name] = &bytes.Buffer{}
+		}
+		files[name].Write(b)
+		files[name].WriteByte('\n')
+	}
+
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dir := filepath.Join(d.dir, collection)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, buf := range files {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(buf.Bytes()); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Range returns the points of a time series from from up to, not including, to,
+// sorted by time. A zero time leaves that end open. With tags, only the points with
+// all of those tags are returned.
+func (d *Driver) Range(collection string, from, to time.Time, tags map[string]string) ([]Point, error) {
+	collection = d.foldCollection(collection)
+	if err := d.checkNames(collection, ""); err != nil {
+		return nil, err
+	}
+	ts, ok := d.timeSeries[collection]
+	if !ok {
+		return nil, fmt.Errorf("%v isn't a time series, see Options.TimeSeries", collection)
+	}
+	files, err := d.pointFiles(collection, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []Point
+	for _, f := range files {
+		if !to.IsZero() && !f.start.Before(to) || !from.IsZero() && !ts.Period.next(f.start).After(from) {
+			continue
+		}
+		found, err := d.readPoints(collection, f.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range found {
+			if !from.IsZero() && p.Time.Before(from) || !to.IsZero() && !p.Time.Before(to) || !hasTags(p, tags) {
+				continue
+			}
+			points = append(points, p)
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+	return points, nil
+}
+
+type pointFile struct {
+	path  string
+	start time.Time
+	size  int64
+}
+
+// pointFiles lists the files of a time series, oldest first
+func (d *Driver) pointFiles(collection string, ts TimeSeries) ([]pointFile, error) {
+	dir := filepath.Join(d.dir, collection)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []pointFile
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, pointsSuffix) {
+			continue
+		}
+		start, err := time.Parse(ts.Period.layout(), strings.TrimSuffix(name, pointsSuffix))
+		if err != nil {
+			continue
+		}
+		files = append(files, pointFile{path: filepath.Join(dir, name), start: start, size: e.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].start.Before(files[j].start)
+	})
+	return files, nil
+}
+
+func (d *Driver) readPoints(collection, path string) ([]Point, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil // dropped by retention meanwhile
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var points []Point
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var p Point
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			// the end of an Append cut short by a crash
+			d.logf(LevelWarning, "Skipped unreadable point", "operation", "range", "collection", collection,
+				"path", path, "error", err)
+			continue
+		}
+		points = append(points, p)
+	}
+	return points, scanner.Err()
+}
+
+func hasTags(p Point, tags map[string]string) bool {
+	for k, v := range tags {
+		if p.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Aggregation combines the values of the points downsampled into one
+type Aggregation int
+
+const (
+	Mean Aggregation = iota
+	Sum
+	Min
+	Max
+	Count
+	Last
+)
+
+// Downsample combines points into one per period of every and set of tags, timed at
+// the start of the period, e.g. hourly means of points taken every few seconds:
+//
+//	points, err := db.Range("metrics", from, to, nil)
+//	hourly := Downsample(points, time.Hour, Mean)
+//
+// The points are expected sorted by time, as Range returns them, for Last.
+func Downsample(points []Point, every time.Duration, agg Aggregation) []Point {
+	type bucket struct {
+		point  Point
+		counts map[string]int
+	}
+	var order []*bucket
+	buckets := map[string]*bucket{}
+	for _, p := range points {
+		start := p.Time.Truncate(every)
+		key := start.Format(time.RFC3339Nano) + "\x00" + tagKey(p.Tags)
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{point: Point{Time: start, Tags: p.Tags, Values: map[string]float64{}}, counts: map[string]int{}}
+			buckets[key] = b
+			order = append(order, b)
+		}
+		for name, v := range p.Values {
+			n := b.counts[name]
+			cur := b.point.Values[name]
+			switch agg {
+			case Sum, Mean:
+				cur += v
+			case Min:
+				if n == 0 || v < cur {
+					cur = v
+				}
+			case Max:
+				if n == 0 || v > cur {
+					cur = v
+				}
+			case Count:
+				cur++
+			case Last:
+				cur = v
+			}
+			b.point.Values[name] = cur
+			b.counts[name] = n + 1
+		}
+	}
+
+	out := make([]Point, len(order))
+	for i, b := range order {
+		if agg == Mean {
+			for name, n := range b.counts {
+				b.point.Values[name] /= float64(n)
+			}
+		}
+		out[i] = b.point
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Time.Before(out[j].Time)
+	})
+	return out
+}
+
+// tagKey is a set of tags as a string, the same for the same tags in any order
+func tagKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// dropExpiredPoints removes the files of time series whose period ended longer than
+// their Retention ago, returning how many and their size
+func (d *Driver) dropExpiredPoints(now time.Time) (int, int64, error) {
+	dropped, freed := 0, int64(0)
+	for collection, ts := range d.timeSeries {
+		if ts.Retention <= 0 {
+			continue
+		}
+		files, err := d.pointFiles(collection, ts)
+		if err != nil {
+			return dropped, freed, err
+		}
+		mutex := d.lockFor(collection)
+		mutex.Lock()
+		for _, f := range files {
+			if now.Sub(ts.Period.next(f.start)) < ts.Retention {
+				break // the rest are newer
+			}
+			if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				mutex.Unlock()
+				return dropped, freed, err
+			}
+			dropped++
+			freed += f.size
+		}
+		mutex.Unlock()
+	}
+	return dropped, freed, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// TLSOptions configure TLS for the Driver's HTTP handlers, and for the clients of
+// other Drivers' handlers: followers, cluster peers and SyncRemote
+type TLSOptions struct {
+	// PEM files of the certificate and its key: the server's, or the client's
+	// presented to servers asking for one
+	CertFile string
+	KeyFile  string
+
+	// for mutual TLS, servers require client certificates signed by a CA in this PEM
+	// file
+	ClientCAFile string
+
+	// clients trust servers signed by a CA in this PEM file, the system's CAs if empty
+	CAFile string
+
+	// tls.VersionTLS12 if zero
+	MinVersion uint16
+}
+
+// ServerConfig returns the TLS config of a server
+func (o *TLSOptions) ServerConfig() (*tls.Config, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, fmt.Errorf("a TLS server needs CertFile and KeyFile")
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: o.minVersion()}
+	if o.ClientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(o.ClientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig returns the TLS config of a client
+func (o *TLSOptions) ClientConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: o.minVersion()}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if o.CAFile != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(o.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// HTTPClient returns a client for FollowOptions.Client, ClusterOptions.Client and
+// SyncOptions.Client. Its Timeout is zero, replication streams don't end.
+func (o *TLSOptions) HTTPClient() (*http.Client, error) {
+	config, err := o.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
+
+func (o *TLSOptions) minVersion() uint16 {
+	if o.MinVersion == 0 {
+		return tls.VersionTLS12
+	}
+	return o.MinVersion
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates in %v", file)
+	}
+	return pool, nil
+}
+
+// ListenAndServeTLS serves handler, typically a mux of the Driver's handlers, over
+// TLS on addr until it fails. With opts.ClientCAFile only clients with a
+// certificate signed by one of its CAs get through.
+func ListenAndServeTLS(addr string, handler http.Handler, opts *TLSOptions) error {
+	if opts == nil {
+		return fmt.Errorf("TLS needs options")
+	}
+	config, err := opts.ServerConfig()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         config,
+		ReadHeaderTimeout: 10 * time.Second, // no write timeout, the streams go on
+	}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts a span for each Write, Read, ReadAll, Find and Delete when set as
+// Options.Tracer. WriteContext, ReadContext, ReadAllContext, FindContext and
+// DeleteContext make it a child of the span in their ctx, so the operation shows up
+// in the trace of the request that made it. ctx carries the trace only, it doesn't
+// cancel the operation, see Options.OperationTimeout.
+//
+// It's small enough to put in front of any tracing library. For OpenTelemetry,
+// Options.TracerProvider takes a TracerProvider instead, see NewOTelTracer.
+type Tracer interface {
+	// Start begins a span named after the operation, e.g. golangdb.write, with the
+	// db.collection and (if there is one) db.resource attributes, as a child of the
+	// span in ctx if there is one. It returns ctx with the new span.
+	Start(ctx context.Context, operation string, attrs map[string]string) (context.Context, Span)
+}
+
+type Span interface {
+	Event(name string, attrs map[string]string)
+	End(err error)
+}
+
+// opRun follows one operation for the metrics and, with a Tracer, its span
+type opRun struct {
+	d     *Driver
+	op    int
+	start time.Time
+	span  Span
+
+	deadline time.Time // of Options.OperationTimeout, zero without
+
+	collection, resource string
+}
+
+// begin starts an operation, traced as part of the span in ctx
+func (d *Driver) begin(ctx context.Context, op int, collection, resource string) opRun {
+	run := opRun{d: d, op: op, start: time.Now(), deadline: d.deadline(), collection: collection, resource: resource}
+	if d.tracer != nil {
+		attrs := map[string]string{"db.collection": collection}
+		if resource != "" {
+			attrs["db.resource"] = resource
+		}
+		_, run.span = d.tracer.Start(ctx, "golangdb."+opNames[op], attrs)
+	}
+	return run
+}
+
+// lock takes the collection lock, noting it on the span if another writer held it,
+// unless the operation times out first
+func (run opRun) lock(m *collectionMutex) error {
+	waited, err := m.lockBy(run.deadline)
+	if err != nil {
+		return err
+	}
+	if waited > 0 && run.span != nil {
+		run.span.Event("lock wait", map[string]string{"duration": waited.String()})
+	}
+	return nil
+}
+
+func (run opRun) end(err *error) {
+	run.d.observe(run.op, run.start, err)
+	if took := time.Since(run.start); run.d.slowOperation > 0 && took >= run.d.slowOperation {
+		run.d.emitEvent(Event{Type: EventSlowOperation, Operation: opNames[run.op], Collection: run.collection, Resource: run.resource, Duration: took, Err: *err})
+	}
+	if run.span != nil {
+		run.span.End(*err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// EnsureTTLIndex indexes a time field and expires records ttl after it, e.g.
+// EnsureTTLIndex("sessions", "LastSeen", 24*time.Hour). The field can hold an RFC 3339
+// timestamp (what time.Time marshals to) or unix seconds; records without it, or with
+// something else in it, never expire. Expired records are removed in the background
+// every Options.TTLInterval.
+func (d *Driver) EnsureTTLIndex(collection, field string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl of %v.%v must be positive", collection, field)
+	}
+	if err := d.ensureIndex(collection, []string{field}, false, memoryKind); err != nil {
+		return err
+	}
+
+	ix := d.index(collection, field)
+	ix.mu.Lock()
+	changed := ix.ttl != ttl
+	ix.ttl = ttl
+	var err error
+	if changed {
+		err = ix.snapshot() // the header carries the ttl
+	}
+	ix.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := d.indexesChanged(collection); err != nil {
+			return err
+		}
+	}
+
+	d.startSweeper()
+	return nil
+}
+
+func (d *Driver) startSweeper() {
+	d.sweeper.Do(func() {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+
+			ticker := time.NewTicker(d.ttlInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-d.done:
+					return
+				case <-ticker.C:
+					start := time.Now()
+					_, err := d.SweepExpired()
+					if err != nil {
+						d.logf(LevelError, "TTL sweep failed", "operation", "sweep", "duration", time.Since(start), "error", err)
+					}
+					d.background.set("TTL sweep", err)
+				}
+			}
+		}()
+	})
+}
+
+// SweepExpired removes every record past the ttl of its collection's TTL index right
+// away and returns how many were removed, and drops the points of time series past
+// their Retention. The background sweeper calls it on its own.
+func (d *Driver) SweepExpired() (int, error) {
+	if d.currentFollower() != nil {
+		return 0, nil // the leader's expiries come through replication
+	}
+	if r := d.cluster(); r != nil && !r.isLeader() {
+		return 0, nil
+	}
+	now := time.Now()
+	removed := 0
+	if _, _, err := d.dropExpiredPoints(now); err != nil {
+		return removed, err
+	}
+
+	for _, ix := range d.ttlIndexes() {
+		for _, name := range ix.expired(now) {
+			ok, err := d.expire(ix, name, now)
+			if err != nil {
+				return removed, err
+			}
+			if ok {
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
+
+func (d *Driver) ttlIndexes() []*index {
+	d.imu.RLock()
+	defer d.imu.RUnlock()
+
+	var out []*index
+	for _, byName := range d.indexes {
+		for _, ix := range byName {
+			ix.mu.RLock()
+			if ix.ttl > 0 {
+				out = append(out, ix)
+			}
+			ix.mu.RUnlock()
+		}
+	}
+	return out
+}
+
+func (ix *index) expired(now time.Time) []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var names []string
+	for name, e := range ix.entries {
+		if e.expiredAt(now, ix.ttl) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (e indexEntry) expiredAt(now time.Time, ttl time.Duration) bool {
+	if !e.present[0] {
+		return false
+	}
+	t, ok := asTime(e.values[0])
+	return ok && now.Sub(t) >= ttl
+}
+
+// asTime reads a record value as a point in time
+func asTime(v interface{}) (time.Time, bool) {
+	if s, ok := v.(string); ok {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t, err == nil
+	}
+	if f, ok := toFloat(v); ok {
+		return time.Unix(0, int64(f*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+// expire deletes a record if it is still expired once the collection is locked, so a
+// Write that just refreshed it wins
+func (d *Driver) expire(ix *index, name string, now time.Time) (bool, error) {
+	mutex := d.lockFor(ix.collection)
+	mutex.Lock()
+
+	ix.mu.RLock()
+	e, ok := ix.entries[name]
+	ttl := ix.ttl
+	ix.mu.RUnlock()
+	if !ok || !e.expiredAt(now, ttl) {
+		mutex.Unlock()
+		return false, nil
+	}
+
+	if r := d.cluster(); r != nil {
+		mutex.Unlock() // applying the delete takes the lock
+		return true, r.propose(Change{Op: ChangeDelete, Collection: ix.collection, Resource: name, Time: now})
+	}
+	defer mutex.Unlock()
+	return d.removeRecord(ix.collection, name)
+}
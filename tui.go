@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const tuiPageSize = 20
+
+const tuiHelp = `collections              list the collections
+use <collection>         switch to a collection and list its records
+ls                       list the records of the collection again
+ls <pattern>             list the records named like app-*-error
+n, p                     next / previous page
+show <resource>          print a record
+find <field>=<value>     list the records where field is value
+find {"Age":{"$gt":30}}  list the records matching a filter document
+rm <resource>            delete a record, after asking
+help                     this
+q                        quit
+`
+
+// tui is the state of an interactive session, see runTUI
+type tui struct {
+	db  *Driver
+	in  *bufio.Scanner
+	out io.Writer
+
+	collection string
+	names      []string // listed by ls or find
+	page       int
+}
+
+// runTUI lets an operator browse the database from a terminal, e.g. over SSH, by
+// typing commands (see tuiHelp) on in. It only needs a line based terminal.
+func runTUI(db *Driver, in io.Reader, out io.Writer) error {
+	t := &tui{db: db, in: bufio.NewScanner(in), out: out}
+	fmt.Fprintf(out, "golang-database %v at %v, type help for the commands\n", Version, db.dir)
+
+	for {
+		fmt.Fprintf(out, "%v> ", t.collection)
+		if !t.in.Scan() {
+			fmt.Fprintln(out)
+			return t.in.Err()
+		}
+
+		cmd, arg := splitCommand(t.in.Text())
+		var err error
+		switch cmd {
+		case "":
+		case "q", "quit", "exit":
+			return nil
+		case "help", "?":
+			fmt.Fprint(out, tuiHelp)
+		case "collections", "c":
+			err = t.collections()
+		case "use":
+			t.collection = arg
+			err = t.list()
+		case "ls":
+			if arg != "" {
+				err = t.glob(arg)
+			} else {
+				err = t.list()
+			}
+		case "n":
+			t.turn(1)
+		case "p":
+			t.turn(-1)
+		case "show":
+			err = t.show(arg)
+		case "find":
+			err = t.find(arg)
+		case "rm":
+			err = t.remove(arg)
+		default:
+			err = fmt.Errorf("unknown command %q, type help for the commands", cmd)
+		}
+		if err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+}
+
+func splitCommand(line string) (cmd, arg string) {
+	line = strings.TrimSpace(line)
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i+1:])
+	}
+	return line, ""
+}
+
+func (t *tui) collections() error {
+	collections, err := t.db.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		n, err := t.db.countRecords(collection)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(t.out, "%-30v %d records\n", collection, n)
+	}
+	return nil
+}
+
+func (t *tui) needCollection() error {
+	if t.collection == "" {
+		return fmt.Errorf("no collection, pick one with use <collection>")
+	}
+	return nil
+}
+
+func (t *tui) list() error {
+	if err := t.needCollection(); err != nil {
+		return err
+	}
+	names, err := t.db.listRecords(t.collection)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	t.names, t.page = names, 0
+	t.printPage()
+	return nil
+}
+
+func (t *tui) glob(pattern string) error {
+	if err := t.needCollection(); err != nil {
+		return err
+	}
+	names, err := t.db.Glob(t.collection, pattern)
+	if err != nil {
+		return err
+	}
+	t.names, t.page = names, 0
+	t.printPage()
+	return nil
+}
+
+func (t *tui) turn(pages int) {
+	page := t.page + pages
+	if page < 0 || page*tuiPageSize >= len(t.names) {
+		fmt.Fprintln(t.out, "no more records")
+		return
+	}
+	t.page = page
+	t.printPage()
+}
+
+// printPage lists the records of the current page with the start of their content
+func (t *tui) printPage() {
+	if len(t.names) == 0 {
+		fmt.Fprintln(t.out, "no records")
+		return
+	}
+
+	from := t.page * tuiPageSize
+	to := from + tuiPageSize
+	if to > len(t.names) {
+		to = len(t.names)
+	}
+	for _, name := range t.names[from:to] {
+		preview := ""
+		if r, err := t.db.loadRecord(t.collection, name); err == nil {
+			var buf bytes.Buffer
+			if json.Compact(&buf, r.raw) == nil {
+				preview = buf.String()
+			}
+		}
+		if len(preview) > 60 {
+			preview = preview[:57] + "..."
+		}
+		fmt.Fprintf(t.out, "%-24v %v\n", name, preview)
+	}
+	fmt.Fprintf(t.out, "-- %d-%d of %d, n/p to page\n", from+1, to, len(t.names))
+}
+
+func (t *tui) show(resource string) error {
+	if err := t.needCollection(); err != nil {
+		return err
+	}
+	r, err := t.db.loadRecord(t.collection, resource)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, r.raw, "", "  "); err != nil {
+		return err
+	}
+	fmt.Fprintln(t.out, strings.TrimRight(buf.String(), "\n"))
+	return nil
+}
+
+func (t *tui) find(arg string) error {
+	if err := t.needCollection(); err != nil {
+		return err
+	}
+
+	var filter Filter
+	if strings.HasPrefix(arg, "{") {
+		f, err := ParseFilter([]byte(arg))
+		if err != nil {
+			return err
+		}
+		filter = f
+	} else {
+		i := strings.IndexByte(arg, '=')
+		if i <= 0 {
+			return fmt.Errorf("find takes <field>=<value> or a filter document")
+		}
+		field, text := strings.TrimSpace(arg[:i]), arg[i+1:]
+		// Age=30 finds 30 as well as "30", there's no telling which was meant
+		var value interface{}
+		if err := json.Unmarshal([]byte(text), &value); err == nil && value != text {
+			filter = In(field, value, text)
+		} else {
+			filter = Eq(field, text)
+		}
+	}
+
+	var names []string
+	err := t.db.find(context.Background(), t.collection, filter, nil, func(records []*record, q *query) error {
+		for _, r := range records {
+			names = append(names, r.name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	t.names, t.page = names, 0
+	t.printPage()
+	return nil
+}
+
+func (t *tui) remove(resource string) error {
+	if err := t.needCollection(); err != nil {
+		return err
+	}
+	if resource == "" {
+		return fmt.Errorf("rm takes the resource to delete")
+	}
+
+	fmt.Fprintf(t.out, "delete %v/%v? [y/N] ", t.collection, resource)
+	if !t.in.Scan() || strings.ToLower(strings.TrimSpace(t.in.Text())) != "y" {
+		fmt.Fprintln(t.out, "kept")
+		return nil
+	}
+	if err := t.db.Delete(t.collection, resource); err != nil {
+		return err
+	}
+
+	for i, name := range t.names {
+		if name == resource {
+			t.names = append(t.names[:i], t.names[i+1:]...)
+			break
+		}
+	}
+	fmt.Fprintln(t.out, "deleted")
+	return nil
+}
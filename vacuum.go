@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// VacuumReport is what Vacuum removed
+type VacuumReport struct {
+	Tombstones int   // CRDT states and vector clocks of records deleted past Options.TombstoneRetention
+	Points     int   // time series files past their Retention
+	Garbage    int   // leftovers removed by CollectGarbage
+	Indexes    int   // index logs compacted
+	Reclaimed  int64 // bytes freed by all of it
+}
+
+// Vacuum reclaims the space of what the database keeps without needing it:
+// tombstones past Options.TombstoneRetention, time series files past their
+// Retention, the leftovers CollectGarbage removes, and index log entries not folded
+// into a snapshot yet. It runs online, locking a collection only while it removes a
+// tombstone or leftover of it, so reads and writes go on meanwhile.
+func (d *Driver) Vacuum() (VacuumReport, error) {
+	var report VacuumReport
+	if err := d.enter(); err != nil {
+		return report, err
+	}
+	defer d.leave()
+	start := time.Now()
+
+	if err := d.vacuumTombstones(&report, start); err != nil {
+		return report, err
+	}
+
+	points, freed, err := d.dropExpiredPoints(start)
+	report.Points, report.Reclaimed = points, report.Reclaimed+freed
+	if err != nil {
+		return report, err
+	}
+
+	garbage, err := d.collectGarbage(false)
+	report.Garbage, report.Reclaimed = len(garbage.Found), report.Reclaimed+garbage.Reclaimed
+	if err != nil {
+		return report, err
+	}
+
+	before, err := dirSize(filepath.Join(d.dir, indexDir))
+	if err != nil {
+		return report, err
+	}
+	if report.Indexes, err = d.compactIndexes(true, 0); err != nil {
+		return report, err
+	}
+	after, err := dirSize(filepath.Join(d.dir, indexDir))
+	if err != nil {
+		return report, err
+	}
+	if before > after { // writes meanwhile may have grown the logs more
+		report.Reclaimed += before - after
+	}
+
+	d.logf(LevelInfo, "Vacuumed database", "operation", "vacuum", "reclaimed", report.Reclaimed,
+		"tombstones", report.Tombstones, "duration", time.Since(start))
+	return report, nil
+}
+
+// vacuumTombstones removes the CRDT states and vector clocks of records deleted
+// longer than Options.TombstoneRetention ago
+func (d *Driver) vacuumTombstones(report *VacuumReport, now time.Time) error {
+	if d.tombstoneRetention <= 0 {
+		return nil
+	}
+	before := now.Add(-d.tombstoneRetention)
+
+	for _, kind := range []string{crdtDir, clockDir} {
+		root := filepath.Join(d.dir, kind)
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			resource, ok := d.recordName(fi.Name())
+			if fi.IsDir() || !ok {
+				return nil
+			}
+			rel, err := filepath.Rel(root, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			removed, err := d.dropTombstone(kind, filepath.ToSlash(rel), resource, before)
+			if removed {
+				report.Tombstones++
+				report.Reclaimed += fi.Size()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropTombstone removes the CRDT state (kind crdtDir) or vector clock (clockDir) of
+// a record if the record was deleted before then
+func (d *Driver) dropTombstone(kind, collection, resource string, before time.Time) (bool, error) {
+	mutex := d.lockFor(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if d.recordExists(collection, resource) {
+		return false, nil
+	}
+	path := d.clockPath(collection, resource)
+	if kind == crdtDir {
+		m, err := d.readCRDTMeta(collection, resource)
+		if err != nil {
+			return false, err
+		}
+		if m.Deleted == nil || !time.Unix(0, m.Deleted.TS).Before(before) {
+			return false, nil
+		}
+		path = d.crdtPath(collection, resource)
+	} else {
+		// the clock was last ticked by the delete
+		fi, err := os.Stat(path)
+		if err != nil || !fi.ModTime().Before(before) {
+			return false, nil
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// recordVersion is the version of a record as stored, a hash of its JSON. Writing
+// the same JSON again keeps it.
+func recordVersion(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:16])
+}
+
+// ReadVersion is Read also returning the version of the record, for DeleteIf. v may
+// be nil to only get the version.
+func (d *Driver) ReadVersion(collection, resource string, v interface{}, opts ...QueryOption) (string, error) {
+	out, err := d.timedDecode("read", collection, resource, v, func(v interface{}) (interface{}, error) {
+		return d.readVersion(collection, resource, v, opts...)
+	})
+	version, _ := out.(string)
+	return version, err
+}
+
+func (d *Driver) readVersion(collection, resource string, v interface{}, opts ...QueryOption) (_ string, err error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return "", err
+	}
+	op := d.begin(context.Background(), opRead, collection, resource)
+	defer op.end(&err)
+	defer func() { err = notFound("read", collection, resource, err) }()
+
+	if collection == "" {
+		return "", fmt.Errorf("%w - unable to read!", ErrEmptyCollection)
+	}
+	if resource == "" {
+		return "", fmt.Errorf("%w - unable to read record!", ErrEmptyResource)
+	}
+	if collection, err = d.partitionFor(collection, resource); err != nil {
+		return "", err
+	}
+	if !d.mayExist(collection, resource) {
+		return "", notExist(d.recordPath(collection, resource))
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	raw, err := d.storedRecord(buf, collection, resource)
+	if err != nil {
+		return "", err
+	}
+	version := recordVersion(raw)
+
+	if raw, err = d.redact(collection, raw, newQuery(opts)); err != nil {
+		return "", err
+	}
+	if err := d.auditRead("", opRead, collection, []string{resource}); err != nil {
+		return "", err
+	}
+	if v != nil {
+		if err := json.Unmarshal(raw, v); err != nil {
+			return "", err
+		}
+	}
+	return version, nil
+}
+
+// storedRecord returns the JSON of a record, from the read cache or read into buf
+func (d *Driver) storedRecord(buf *bytes.Buffer, collection, resource string) ([]byte, error) {
+	if d.cache != nil {
+		r, err := d.loadRecord(collection, resource)
+		if err != nil {
+			return nil, err
+		}
+		return r.raw, nil
+	}
+	if err := d.readRecordInto(buf, collection, resource); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeleteIf deletes a record only if it's still at the version ReadVersion gave,
+// failing with ErrVersionMismatch if it was written since, so a cleanup job doesn't
+// delete a record changed after it looked at it:
+//
+//	version, err := db.ReadVersion("sessions", id, &s)
+//	...
+//	if s.Expired() {
+//		err = db.DeleteIf("sessions", id, version)
+//	}
+//
+// The version is checked and the record deleted under the lock of the collection.
+// It isn't replicated, DeleteIf needs a Driver outside a cluster.
+func (d *Driver) DeleteIf(collection, resource, expectedVersion string) error {
+	_, err := d.timed("delete", collection, resource, func() (interface{}, error) {
+		return nil, d.removeIf(collection, resource, expectedVersion)
+	})
+	return err
+}
+
+func (d *Driver) removeIf(collection, resource, version string) (err error) {
+	collection, resource = d.fold(collection, resource)
+	if err := d.checkNames(collection, resource); err != nil {
+		return err
+	}
+	op := d.begin(context.Background(), opDelete, collection, resource)
+	defer op.end(&err)
+	defer func() { err = notFound("delete", collection, resource, err) }()
+
+	if collection == "" {
+		return fmt.Errorf("%w - unable to delete!", ErrEmptyCollection)
+	}
+	if resource == "" {
+		return fmt.Errorf("%w - unable to delete record!", ErrEmptyResource)
+	}
+	if collection, err = d.partitionFor(collection, resource); err != nil {
+		return err
+	}
+	if d.cluster() != nil {
+		return fmt.Errorf("the version check isn't replicated, DeleteIf needs a Driver outside a cluster")
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	mutex := d.lockFor(collection)
+	if err := op.lock(mutex); err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	raw, err := d.storedRecord(buf, collection, resource)
+	if err != nil {
+		return err
+	}
+	if current := recordVersion(raw); current != version {
+		return &RecordError{Op: "delete", Collection: collection, Resource: resource,
+			Err: fmt.Errorf("%w: at %v, not %v", ErrVersionMismatch, current, version)}
+	}
+	_, err = d.removeRecord(collection, resource)
+	return err
+}
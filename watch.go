@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// what a Change did
+const (
+	ChangeWrite  = "write"
+	ChangeDelete = "delete"
+	ChangeDrop   = "drop" // Delete of a whole collection
+)
+
+// how many changes a Watcher holds before it counts as lagging
+const watchBuffer = 256
+
+// how often the change feed handlers send something to idle clients, so proxies
+// keep the connection open and dead clients are noticed
+const watchKeepAlive = 30 * time.Second
+
+// Change is a write or delete a Watcher is told about
+type Change struct {
+	Op         string `json:"op"`
+	Collection string `json:"collection"`
+	Resource   string `json:"resource,omitempty"`
+	// the record as written. Left out for deletes and for WriteStream writes, which
+	// can be too large to pass around.
+	Record json.RawMessage `json:"record,omitempty"`
+	Time   time.Time       `json:"time"`
+	// of the record after the change, sent to followers with Options.VectorClocks
+	Clock VectorClock `json:"clock,omitempty"`
+}
+
+// Watcher gets the changes of a collection, or of all of them, on C. C is closed
+// when the Watcher or the Driver is closed, or when the Watcher falls watchBuffer
+// changes behind; Err tells which.
+type Watcher struct {
+	C <-chan Change
+
+	d          *Driver
+	c          chan Change
+	collection string
+	closed     bool  // guarded by d.wmu
+	err        error // guarded by d.wmu
+}
+
+// Watch starts watching the changes made through the Driver to a collection, or to
+// every collection for "". Writes in WriteBack mode show up when they're written,
+// not when they're flushed. The Watcher has to be closed when it's no longer read.
+func (d *Driver) Watch(collection string) *Watcher {
+	c := make(chan Change, watchBuffer)
+	w := &Watcher{C: c, d: d, c: c, collection: collection}
+
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	select {
+	case <-d.done:
+		w.stop(nil) // closed Driver, nothing will change
+		return w
+	default:
+	}
+	if d.watchers == nil {
+		d.watchers = map[*Watcher]struct{}{}
+	}
+	d.watchers[w] = struct{}{}
+	return w
+}
+
+// Close stops the Watcher and closes C
+func (w *Watcher) Close() {
+	w.d.wmu.Lock()
+	defer w.d.wmu.Unlock()
+	w.stop(nil)
+}
+
+// Err is ErrWatcherLagging when the Watcher fell behind and nil otherwise
+func (w *Watcher) Err() error {
+	w.d.wmu.Lock()
+	defer w.d.wmu.Unlock()
+	return w.err
+}
+
+// stop closes a Watcher once, with d.wmu held
+func (w *Watcher) stop(err error) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.err = err
+	delete(w.d.watchers, w)
+	close(w.c)
+}
+
+// notify hands a change to the replication log and the watchers of its collection.
+// It never blocks the write, a watcher that can't keep up is stopped instead.
+func (d *Driver) notify(op, collection, resource string, record []byte) {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if len(d.watchers) == 0 && d.repl == nil {
+		return
+	}
+
+	c := Change{Op: op, Collection: collection, Resource: resource, Time: time.Now()}
+	if record != nil {
+		c.Record = append(json.RawMessage(nil), record...) // the caller's buffer may go back to the pool
+	}
+	if d.repl != nil {
+		d.repl.append(c)
+	}
+	for w := range d.watchers {
+		if w.collection != "" && w.collection != collection && w.collection != d.partitionParent(collection) {
+			continue
+		}
+		select {
+		case w.c <- c:
+		default:
+			w.stop(ErrWatcherLagging)
+		}
+	}
+}
+
+// closeWatchers ends every Watcher, for Close
+func (d *Driver) closeWatchers() {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	for w := range d.watchers {
+		w.stop(nil)
+	}
+}
+
+// watchedCollection takes the collection out of a change feed request path: the
+// handlers are meant to be mounted on a prefix such as /watch/, where /watch/users
+// streams the changes to users and /watch/ those to every collection. The prefix
+// may also have been stripped already.
+func watchedCollection(r *http.Request, prefix string) string {
+	return strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+}
+
+// WatchHandler streams changes over WebSocket, one JSON encoded Change per text
+// message, for live dashboards that shouldn't poll:
+//
+//	http.Handle("/watch/", db.WatchHandler())
+//
+// Watching every collection streams the changes of those the caller may read.
+// Messages from the client are ignored. The connection is closed with status 1013
+// if the client falls behind and 1001 when the Driver is closed.
+func (d *Driver) WatchHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collection := watchedCollection(r, "/watch")
+		if collection != "" {
+			if err := d.authorize(r, collection, PermRead); err != nil {
+				WriteError(w, err)
+				return
+			}
+		}
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			writeError(w, CodeBadRequest, "%v", err)
+			return
+		}
+		defer conn.close()
+
+		watcher := d.Watch(collection)
+		defer watcher.Close()
+
+		// reads the client's frames to answer pings and notice it leaving
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			conn.discardMessages()
+		}()
+
+		keepAlive := time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case c, ok := <-watcher.C:
+				if !ok {
+					if err := watcher.Err(); err != nil {
+						conn.writeClose(wsStatusTryAgainLater, err.Error())
+					} else {
+						conn.writeClose(wsStatusGoingAway, "database closed")
+					}
+					return
+				}
+				if !d.allowed(r, c.Collection, PermRead) {
+					continue
+				}
+				if c.Record != nil {
+					record, err := d.redact(c.Collection, c.Record, nil)
+					if err != nil {
+						return
+					}
+					c.Record = record
+				}
+				b, err := json.Marshal(c)
+				if err != nil {
+					return
+				}
+				if err := conn.writeFrame(wsOpText, b); err != nil {
+					return
+				}
+
+			case <-keepAlive.C:
+				if err := conn.writeFrame(wsOpPing, nil); err != nil {
+					return
+				}
+
+			case <-gone:
+				return
+			}
+		}
+	})
+}
+
+// WatchEventsHandler streams changes as Server-Sent Events, for clients that can't
+// use WebSocket such as curl or browsers behind proxies that don't pass it:
+//
+//	http.Handle("/events/", db.WatchEventsHandler())
+//
+// /events/users streams the changes to users, /events/ those to every collection the
+// caller may read.
+// Each event is named after the Change's Op and carries the JSON encoded Change. An
+// error event ends the stream when the client falls behind.
+func (d *Driver) WatchEventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, CodeInternal, "streaming not supported")
+			return
+		}
+
+		collection := watchedCollection(r, "/events")
+		if collection != "" {
+			if err := d.authorize(r, collection, PermRead); err != nil {
+				WriteError(w, err)
+				return
+			}
+		}
+		watcher := d.Watch(collection)
+		defer watcher.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // nginx would hold the events back
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case c, ok := <-watcher.C:
+				if !ok {
+					if err := watcher.Err(); err != nil {
+						fmt.Fprintf(w, "event: error\ndata: %v\n\n", err)
+						flusher.Flush()
+					}
+					return
+				}
+				if !d.allowed(r, c.Collection, PermRead) {
+					continue
+				}
+				if c.Record != nil {
+					record, err := d.redact(c.Collection, c.Record, nil)
+					if err != nil {
+						return
+					}
+					c.Record = record
+				}
+				b, err := json.Marshal(c)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", c.Op, b); err != nil {
+					return
+				}
+				flusher.Flush()
+
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}